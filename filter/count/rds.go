@@ -27,6 +27,8 @@ type DSCounter struct {
 	RunInTransaction Entry
 	Run              Entry
 	Count            Entry
+	Aggregate        Entry
+	SampleKeys       Entry
 	DeleteMulti      Entry
 	GetMulti         Entry
 	PutMulti         Entry
@@ -58,6 +60,16 @@ func (r *dsCounter) Count(q *ds.FinalizedQuery) (int64, error) {
 	return count, r.c.Count.up(err)
 }
 
+func (r *dsCounter) Aggregate(q *ds.FinalizedQuery, aggs []*ds.Aggregation) (ds.PropertySlice, error) {
+	ret, err := r.ds.Aggregate(q, aggs)
+	return ret, r.c.Aggregate.up(err)
+}
+
+func (r *dsCounter) SampleKeys(q *ds.FinalizedQuery, n int32) ([]*ds.Key, error) {
+	ret, err := r.ds.SampleKeys(q, n)
+	return ret, r.c.SampleKeys.up(err)
+}
+
 func (r *dsCounter) RunInTransaction(f func(context.Context) error, opts *ds.TransactionOptions) error {
 	return r.c.RunInTransaction.up(r.ds.RunInTransaction(f, opts))
 }
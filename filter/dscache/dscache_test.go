@@ -58,6 +58,13 @@ func shardObjFn(k *ds.Key) (amt int, ok bool) {
 	return
 }
 
+type versionedObj struct {
+	ID      int64 `gae:"$id"`
+	Version int64 `gae:"$version"`
+
+	Value string
+}
+
 type noCacheObj struct {
 	ID string `gae:"$id"`
 
@@ -160,6 +167,26 @@ func TestDSCache(t *testing.T) {
 				})
 			})
 
+			Convey("never serves a version older than an observed one", func() {
+				o := &versionedObj{ID: 1, Value: "v1"}
+				So(ds.Put(c, o), ShouldBeNil)
+				So(ds.Get(c, &versionedObj{ID: 1}), ShouldBeNil)
+
+				// Update it bypassing the cache, so the cache keeps version 1.
+				o.Value = "v2"
+				So(ds.Put(underCtx, o), ShouldBeNil)
+				So(o.Version, ShouldEqual, 2)
+
+				// A Get which hasn't seen version 2 may be served from the cache...
+				old := &versionedObj{ID: 1}
+				So(ds.Get(c, old), ShouldBeNil)
+				So(old, ShouldResemble, &versionedObj{ID: 1, Version: 1, Value: "v1"})
+
+				// ...but one which has seen it isn't.
+				So(ds.Get(c, o), ShouldBeNil)
+				So(o, ShouldResemble, &versionedObj{ID: 1, Version: 2, Value: "v2"})
+			})
+
 			Convey("compression works", func() {
 				o := object{ID: 2, Value: `¯\_(ツ)_/¯`}
 				data := make([]byte, 4000)
@@ -169,6 +196,12 @@ func TestDSCache(t *testing.T) {
 				}
 				o.BigData = data
 
+				// BigData is indexed, and too big for that in production. Only the
+				// compression matters here, so lift the limit.
+				cons := ds.Raw(underCtx).Constraints()
+				cons.MaxIndexedPropertySize = 0
+				So(ds.GetTestable(underCtx).SetConstraints(&cons), ShouldBeNil)
+
 				So(ds.Put(c, &o), ShouldBeNil)
 				So(ds.Get(c, &o), ShouldBeNil)
 
@@ -126,6 +126,12 @@ func (d *dsCache) makeFetchPlan(f *facts) *plan {
 
 		case ItemHasData:
 			pmap, err := decodeItemValue(lockItm.Value(), d.KeyContext)
+			if (err == nil || err == ds.ErrNoSuchEntity) && ds.EntityVersion(pmap) < observedVersion(m) {
+				// The caller has already seen a newer version of this entity (see
+				// the `$version` meta field), so the cached one is stale.
+				p.add(i, getKey, m, nil)
+				continue
+			}
 			switch err {
 			case nil:
 				p.decoded[i] = pmap
@@ -144,3 +150,10 @@ func (d *dsCache) makeFetchPlan(f *facts) *plan {
 	}
 	return &p
 }
+
+// observedVersion returns the `$version` meta of the object which is being
+// loaded, or 0 if it has none.
+func observedVersion(m ds.MetaGetter) int64 {
+	v, _ := ds.GetMetaDefault(m, "version", int64(0)).(int64)
+	return v
+}
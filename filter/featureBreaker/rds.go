@@ -70,6 +70,24 @@ func (r *dsState) Count(q *ds.FinalizedQuery) (int64, error) {
 	return count, err
 }
 
+func (r *dsState) Aggregate(q *ds.FinalizedQuery, aggs []*ds.Aggregation) (ds.PropertySlice, error) {
+	var ret ds.PropertySlice
+	err := r.run(r.c, func() (err error) {
+		ret, err = r.rds.Aggregate(q, aggs)
+		return
+	})
+	return ret, err
+}
+
+func (r *dsState) SampleKeys(q *ds.FinalizedQuery, n int32) ([]*ds.Key, error) {
+	var ret []*ds.Key
+	err := r.run(r.c, func() (err error) {
+		ret, err = r.rds.SampleKeys(q, n)
+		return
+	})
+	return ret, err
+}
+
 func (r *dsState) RunInTransaction(f func(c context.Context) error, opts *ds.TransactionOptions) error {
 	// Note: we intentionally don't break RunInTransaction itself, but break
 	// BeginTransaction/CommitTransaction separately instead.
@@ -38,6 +38,24 @@ func FilterRDS(c context.Context) context.Context {
 	})
 }
 
+// SizeBudget returns the number of bytes which may still be written in the
+// buffered transaction in c before it exceeds its size budget, and so fails
+// with ErrTransactionTooLarge. ok is false if c isn't in a buffered
+// transaction.
+//
+// See also datastore.TransactionSizeBudget, which doesn't depend on this
+// package.
+func SizeBudget(c context.Context) (remaining int64, ok bool) {
+	state, _ := c.Value(&dsTxnBufParent).(*txnBufState)
+	if state == nil {
+		return 0, false
+	}
+	if haveLock, _ := c.Value(&dsTxnBufHaveLock).(bool); haveLock {
+		return state.sizeBudgetLocked(), true
+	}
+	return state.SizeBudget(), true
+}
+
 // impossible is a marker function to indicate that the given error is an
 // impossible state, due to conditions outside of the function.
 func impossible(err error) {
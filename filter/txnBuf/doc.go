@@ -61,11 +61,11 @@
 //     they were at the beginning of the transaction, and will not increment
 //     as you write inside of the transaction.
 //
-//   - Query cursors are not supported. Since the cursor format for the
-//     in-memory datastore implementation isn't compatible with the production
-//     cursors, it would be pretty tricky to make it so that cursors were
-//     viable outside the transaction as well as inside of it while also having
-//     it accurately reflect the 'merged' query results.
+//   - Query cursors produced inside of a transaction record the position of
+//     the 'merged' query results, and can only be used inside of that same
+//     transaction (e.g. to resume a query after a limit). Using them anywhere
+//     else returns ErrCursorOutsideTransaction. Conversely, cursors produced
+//     outside of the transaction can't be used inside of it.
 //
 //   - No parallel access* to datastore while in a transaction; all nested
 //     operations are serialized. This is done for simplicity and correctness.
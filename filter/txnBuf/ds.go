@@ -26,6 +26,13 @@ type dsBuf struct {
 
 var _ ds.RawInterface = (*dsBuf)(nil)
 
+func (d *dsBuf) DecodeCursor(s string) (ds.Cursor, error) {
+	if isTxnCursor(s) {
+		return nil, ErrCursorOutsideTransaction
+	}
+	return d.RawInterface.DecodeCursor(s)
+}
+
 func (d *dsBuf) RunInTransaction(f func(context.Context) error, opts *ds.TransactionOptions) error {
 	return doRunInTransaction(d.RawInterface, f, opts)
 }
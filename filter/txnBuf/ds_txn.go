@@ -22,8 +22,7 @@ import (
 
 // ErrTransactionTooLarge is returned when applying an inner transaction would
 // cause an outer transaction to become too large.
-var ErrTransactionTooLarge = errors.New(
-	"applying the transaction would make the parent transaction too large")
+var ErrTransactionTooLarge = ds.ErrTransactionTooLarge
 
 // ErrTooManyRoots is returned when executing an operation which would cause
 // the transaction to exceed it's allotted number of entity groups.
@@ -39,8 +38,38 @@ type dsTxnBuf struct {
 
 var _ ds.RawInterface = (*dsTxnBuf)(nil)
 
+// ErrCursorOutsideTransaction is returned when using a cursor of a query run
+// inside of a buffered transaction outside of that transaction.
+var ErrCursorOutsideTransaction = errors.New(
+	"txnBuf: query cursor can only be used inside the transaction which produced it")
+
 func (d *dsTxnBuf) DecodeCursor(s string) (ds.Cursor, error) {
-	return d.rds.DecodeCursor(s)
+	if !isTxnCursor(s) {
+		return d.rds.DecodeCursor(s)
+	}
+	c, err := decodeTxnCursor(s, d.state.parentDS.DecodeCursor)
+	if err != nil {
+		return nil, err
+	}
+	if c.txnID != d.state.id {
+		return nil, ErrCursorOutsideTransaction
+	}
+	return c, nil
+}
+
+// txnCursorOf returns c as a cursor of this transaction, or nil if c is nil.
+func (d *dsTxnBuf) txnCursorOf(c ds.Cursor) (*txnCursor, error) {
+	if c == nil {
+		return nil, nil
+	}
+	tc, ok := c.(*txnCursor)
+	if !ok {
+		return nil, errors.New("txnBuf: only cursors of queries run inside the transaction are supported")
+	}
+	if tc.txnID != d.state.id {
+		return nil, ErrCursorOutsideTransaction
+	}
+	return tc, nil
 }
 
 func (d *dsTxnBuf) AllocateIDs(keys []*ds.Key, cb ds.NewKeyCB) error {
@@ -76,9 +105,26 @@ func (d *dsTxnBuf) Count(fq *ds.FinalizedQuery) (count int64, err error) {
 	return
 }
 
+func (d *dsTxnBuf) Aggregate(fq *ds.FinalizedQuery, aggs []*ds.Aggregation) (ds.PropertySlice, error) {
+	// Like Count, this has to run the query so that the buffered writes are
+	// taken into account.
+	return ds.AggregateQuery(d, fq, aggs)
+}
+
+func (d *dsTxnBuf) SampleKeys(fq *ds.FinalizedQuery, n int32) ([]*ds.Key, error) {
+	// Samples are only approximate anyway, so the buffered writes are ignored.
+	return d.state.parentDS.SampleKeys(fq, n)
+}
+
 func (d *dsTxnBuf) Run(fq *ds.FinalizedQuery, cb ds.RawRunCB) error {
-	if start, end := fq.Bounds(); start != nil || end != nil {
-		return errors.New("txnBuf filter does not support query cursors")
+	startCursor, endCursor := fq.Bounds()
+	start, err := d.txnCursorOf(startCursor)
+	if err != nil {
+		return err
+	}
+	end, err := d.txnCursorOf(endCursor)
+	if err != nil {
+		return err
 	}
 
 	limit, limitSet := fq.Limit()
@@ -95,7 +141,7 @@ func (d *dsTxnBuf) Run(fq *ds.FinalizedQuery, cb ds.RawRunCB) error {
 		return d.state.bufDS, d.state.parentDS, d.state.entState.dup()
 	}()
 
-	return runMergedQueries(fq, sizes, bufDS, parentDS, func(key *ds.Key, data ds.PropertyMap) error {
+	return runMergedQueries(fq, sizes, bufDS, parentDS, d.state.id, start, end, func(key *ds.Key, data ds.PropertyMap, gc ds.CursorCB) error {
 		if offset > 0 {
 			offset--
 			return nil
@@ -115,7 +161,7 @@ func (d *dsTxnBuf) Run(fq *ds.FinalizedQuery, cb ds.RawRunCB) error {
 			}
 			data = newData
 		}
-		return cb(key, data, nil)
+		return cb(key, data, gc)
 	})
 }
 
@@ -16,28 +16,107 @@ package txnBuf
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
 	"sort"
+	"strings"
 
 	"github.com/conchoid/gae/impl/memory"
 	ds "github.com/conchoid/gae/service/datastore"
 	"github.com/conchoid/gae/service/datastore/serialize"
 	"go.chromium.org/luci/common/data/stringset"
+	"go.chromium.org/luci/common/errors"
 )
 
+// txnCursorPrefix marks the string form of a txnCursor. It never occurs at the
+// start of an implementation's (base64 encoded) cursor, nor of a multi-query
+// cursor.
+const txnCursorPrefix = "!"
+
+// txnCursor is the Cursor of a query run inside of a buffered transaction. It
+// records the position of the merge of the parent query and of the in-memory
+// buffer query.
+type txnCursor struct {
+	// txnID is the id of the txnBufState of the transaction which ran the query.
+	txnID uint64
+
+	// parent is the cursor of the parent query just after its last merged
+	// result, or nil if no parent result was merged yet.
+	parent ds.Cursor
+
+	// row is the comparable row (see toComparableString) of the last merged
+	// result. Results whose row is <= row come before the cursor.
+	row string
+}
+
+func (c *txnCursor) String() string {
+	buf := bytes.Buffer{}
+	tmp := make([]byte, binary.MaxVarintLen64)
+	buf.Write(tmp[:binary.PutUvarint(tmp, c.txnID)])
+	parent := ""
+	if c.parent != nil {
+		parent = c.parent.String()
+	}
+	buf.Write(tmp[:binary.PutUvarint(tmp, uint64(len(parent)))])
+	buf.WriteString(parent)
+	buf.WriteString(c.row)
+	return txnCursorPrefix + base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
+
+// isTxnCursor returns true iff s is the string form of a txnCursor.
+func isTxnCursor(s string) bool {
+	return strings.HasPrefix(s, txnCursorPrefix)
+}
+
+// decodeTxnCursor parses the string form of a txnCursor, using decode to parse
+// its parent query cursor.
+func decodeTxnCursor(s string, decode func(string) (ds.Cursor, error)) (*txnCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, txnCursorPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid transaction query cursor: %s", err)
+	}
+	ret := &txnCursor{}
+	id, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, errors.New("invalid transaction query cursor: truncated")
+	}
+	ret.txnID, data = id, data[n:]
+
+	l, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < l {
+		return nil, errors.New("invalid transaction query cursor: truncated")
+	}
+	if parent := string(data[n : n+int(l)]); parent != "" {
+		if ret.parent, err = decode(parent); err != nil {
+			return nil, err
+		}
+	}
+	ret.row = string(data[n+int(l):])
+	return ret, nil
+}
+
 // queryToIter takes a FinalizedQuery and returns an iterator function which
 // will produce either *items or errors.
 //
 //  - d is the raw datastore to run this query on
-//  - filter is a function which will return true if the given key should be
-//    excluded from the result set.
-func queryToIter(stopChan chan struct{}, fq *ds.FinalizedQuery, d ds.RawInterface) func() (*item, error) {
+//  - if withCursors is true, each item records the cursor of the query just
+//    after it.
+func queryToIter(stopChan chan struct{}, fq *ds.FinalizedQuery, d ds.RawInterface, withCursors bool) func() (*item, error) {
 	c := make(chan *item)
 
 	go func() {
 		defer close(c)
 
-		err := d.Run(fq, func(k *ds.Key, pm ds.PropertyMap, _ ds.CursorCB) error {
+		err := d.Run(fq, func(k *ds.Key, pm ds.PropertyMap, gc ds.CursorCB) error {
 			i := &item{key: k, data: pm}
+			if withCursors {
+				if gc == nil {
+					i.cursorErr = errors.New("cursors are not supported by the parent datastore")
+				} else {
+					i.cursor, i.cursorErr = gc()
+				}
+			}
 			select {
 			case c <- i:
 				return nil
@@ -71,6 +150,10 @@ func queryToIter(stopChan chan struct{}, fq *ds.FinalizedQuery, d ds.RawInterfac
 func adjustQuery(fq *ds.FinalizedQuery) (*ds.FinalizedQuery, error) {
 	q := fq.Original()
 
+	// Cursors are applied by runMergedQueries, since they're a position in the
+	// merged results.
+	q = q.Start(nil).End(nil)
+
 	// The limit and offset must be done in-memory because otherwise we may
 	// request too few entities from the underlying store if many matching
 	// entities have been deleted in the buffered transaction.
@@ -123,15 +206,31 @@ func adjustQuery(fq *ds.FinalizedQuery) (*ds.FinalizedQuery, error) {
 // an expanded projection query with more data than the user asked for. It's the
 // caller's responsibility to prune away the extra data.
 //
+// If start is not nil, the merged results resume just after it. If end is not
+// nil, they stop just after it. `cb` gets a CursorCB for the position just
+// after each result, whose cursors belong to the transaction txnID.
+//
 // See also `dsTxnBuf.Run()`.
 func runMergedQueries(fq *ds.FinalizedQuery, sizes *sizeTracker,
-	memDS, parentDS ds.RawInterface, cb func(k *ds.Key, data ds.PropertyMap) error) error {
+	memDS, parentDS ds.RawInterface, txnID uint64, start, end *txnCursor,
+	cb func(k *ds.Key, data ds.PropertyMap, gc ds.CursorCB) error) error {
 
 	toRun, err := adjustQuery(fq)
 	if err != nil {
 		return err
 	}
 
+	// The parent query resumes at its own position in the merge, and the rows
+	// which were already merged get skipped below.
+	parRun := toRun
+	parCursor, parCursorErr := ds.Cursor(nil), error(nil)
+	if start != nil && start.parent != nil {
+		parCursor = start.parent
+		if parRun, err = toRun.Original().Start(parCursor).Finalize(); err != nil {
+			return err
+		}
+	}
+
 	cmpLower, cmpUpper := memory.GetBinaryBounds(fq)
 	cmpOrder := fq.Orders()
 	cmpFn := func(i *item) string {
@@ -159,8 +258,8 @@ func runMergedQueries(fq *ds.FinalizedQuery, sizes *sizeTracker,
 
 	stopChan := make(chan struct{})
 
-	parIter := queryToIter(stopChan, toRun, parentDS)
-	memIter := queryToIter(stopChan, toRun, memDS)
+	parIter := queryToIter(stopChan, parRun, parentDS, true)
+	memIter := queryToIter(stopChan, toRun, memDS, false)
 
 	parItemGet := func() (*item, error) {
 		for {
@@ -224,12 +323,21 @@ func runMergedQueries(fq *ds.FinalizedQuery, sizes *sizeTracker,
 		// we check the error at the beginning of the loop.
 		if usePitm {
 			toUse = pitm
+			parCursor, parCursorErr = pitm.cursor, pitm.cursorErr
 			pitm, err = parItemGet()
 		} else {
 			toUse = mitm
 			mitm, err = memItemGet()
 		}
 
+		row := cmpFn(toUse)
+		if start != nil && row <= start.row {
+			continue
+		}
+		if end != nil && row > end.row {
+			break
+		}
+
 		if dedup != nil {
 			if !dedup.Add(toUse.getEncKey()) {
 				continue
@@ -244,7 +352,14 @@ func runMergedQueries(fq *ds.FinalizedQuery, sizes *sizeTracker,
 				continue
 			}
 		}
-		if err := cb(toUse.key, toUse.data); err != nil {
+		cursor, cursorErr := &txnCursor{txnID, parCursor, row}, parCursorErr
+		gc := func() (ds.Cursor, error) {
+			if cursorErr != nil {
+				return nil, cursorErr
+			}
+			return cursor, nil
+		}
+		if err := cb(toUse.key, toUse.data, gc); err != nil {
 			return err
 		}
 	}
@@ -17,6 +17,7 @@ package txnBuf
 import (
 	"bytes"
 	"sync"
+	"sync/atomic"
 
 	"github.com/conchoid/gae/impl/memory"
 	"github.com/conchoid/gae/service/datastore"
@@ -29,13 +30,7 @@ import (
 )
 
 // DefaultSizeBudget is the size budget for the root transaction.
-//
-// Because our estimation algorithm isn't entirely correct, we take 5% off
-// the limit for encoding and estimate inaccuracies.
-//
-// 10MB taken on 2015/09/24:
-// https://cloud.google.com/appengine/docs/go/datastore/#Go_Quotas_and_limits
-const DefaultSizeBudget = int64((10 * 1000 * 1000) * 0.95)
+const DefaultSizeBudget = datastore.DefaultTransactionSizeBudget
 
 // DefaultWriteCountBudget is the maximum number of entities that can be written
 // in a single call.
@@ -104,9 +99,16 @@ func (s *sizeTracker) dup() *sizeTracker {
 	return &sizeTracker{k2s, s.total}
 }
 
+// lastTxnID is the id of the most recent txnBufState.
+var lastTxnID uint64
+
 type txnBufState struct {
 	sync.Mutex
 
+	// id uniquely identifies this transaction within the process. It ties the
+	// cursors of queries run inside of the transaction to it.
+	id uint64
+
 	// encoded key -> size of entity. A size of 0 means that the entity is
 	// deleted.
 	entState *sizeTracker
@@ -128,6 +130,10 @@ type txnBufState struct {
 	// countBudget is the number of entity writes that this transaction has to
 	// operate in.
 	writeCountBudget int
+
+	// readOnly is true if this transaction (or one of its parents) is read-only,
+	// in which case it can't put or delete entities.
+	readOnly bool
 }
 
 func withTxnBuf(ctx context.Context, cb func(context.Context) error, opts *datastore.TransactionOptions) error {
@@ -138,6 +144,7 @@ func withTxnBuf(ctx context.Context, cb func(context.Context) error, opts *datas
 		rootLimit = XGTransactionGroupLimit
 	}
 	sizeBudget, writeCountBudget := DefaultSizeBudget, DefaultWriteCountBudget
+	readOnly := opts != nil && opts.ReadOnly
 	if parentState != nil {
 		// TODO(riannucci): this is a bit wonky since it means that a child
 		// transaction declaring XG=true will only get to modify 25 groups IF
@@ -149,9 +156,11 @@ func withTxnBuf(ctx context.Context, cb func(context.Context) error, opts *datas
 
 		sizeBudget = parentState.sizeBudget - parentState.entState.total
 		writeCountBudget = parentState.writeCountBudget - parentState.entState.numWrites()
+		readOnly = readOnly || parentState.readOnly
 	}
 
 	state := &txnBufState{
+		id:               atomic.AddUint64(&lastTxnID, 1),
 		entState:         &sizeTracker{},
 		bufDS:            memory.NewDatastore(ctx, info.Raw(ctx)),
 		roots:            roots,
@@ -160,6 +169,7 @@ func withTxnBuf(ctx context.Context, cb func(context.Context) error, opts *datas
 		parentDS:         datastore.Raw(context.WithValue(ctx, &dsTxnBufHaveLock, true)),
 		sizeBudget:       sizeBudget,
 		writeCountBudget: writeCountBudget,
+		readOnly:         readOnly,
 	}
 	if err := cb(context.WithValue(ctx, &dsTxnBufParent, state)); err != nil {
 		return err
@@ -195,6 +205,11 @@ type item struct {
 	// a query.
 	cmpRow string
 
+	// cursor is the cursor of the query just after this item, if requested
+	// from queryToIter. cursorErr is the error of retrieving it.
+	cursor    datastore.Cursor
+	cursorErr error
+
 	// err is a bit of a hack for passing back synchronized errors from
 	// queryToIter.
 	err error
@@ -218,6 +233,19 @@ func (i *item) getCmpRow(lower, upper []byte, order []datastore.IndexColumn) str
 	return i.cmpRow
 }
 
+// SizeBudget implements datastore.SizeBudgeter.
+func (t *txnBufState) SizeBudget() int64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.sizeBudgetLocked()
+}
+
+// sizeBudgetLocked returns the number of bytes which may still be written in
+// this transaction.
+func (t *txnBufState) sizeBudgetLocked() int64 {
+	return t.sizeBudget - t.entState.total
+}
+
 func (t *txnBufState) updateRootsLocked(roots stringset.Set) error {
 	curRootLen := t.roots.Len()
 	proposedRoots := stringset.New(1)
@@ -328,6 +356,9 @@ func (t *txnBufState) getMulti(keys []*datastore.Key, metas datastore.MultiMetaG
 }
 
 func (t *txnBufState) deleteMulti(keys []*datastore.Key, cb datastore.DeleteMultiCB, haveLock bool) error {
+	if t.readOnly {
+		return datastore.ErrReadOnlyTransaction
+	}
 	encKeys, roots := toEncoded(keys)
 
 	err := func() error {
@@ -409,6 +440,9 @@ func (t *txnBufState) fixKeys(keys []*datastore.Key) ([]*datastore.Key, error) {
 }
 
 func (t *txnBufState) putMulti(keys []*datastore.Key, vals []datastore.PropertyMap, cb datastore.NewKeyCB, haveLock bool) error {
+	if t.readOnly {
+		return datastore.ErrReadOnlyTransaction
+	}
 	keys, err := t.fixKeys(keys)
 	if err != nil {
 		for i, e := range err.(errors.MultiError) {
@@ -309,6 +309,20 @@ func TestTransactionBuffers(t *testing.T) {
 				So(over.PutMulti.Successes(), ShouldEqual, 1)
 			})
 
+			Convey("read-only transactions can't write", func() {
+				So(ds.RunInTransaction(c, func(c context.Context) error {
+					So(4, fooShouldHave(c), dataMultiRoot[3].Value)
+					So(ds.Put(c, &Foo{ID: 4, Value: []int64{1}}), ShouldEqual, ds.ErrReadOnlyTransaction)
+
+					// Neither can their inner transactions.
+					return ds.RunInTransaction(c, func(c context.Context) error {
+						return ds.Delete(c, ds.KeyForObj(c, &Foo{ID: 4}))
+					}, nil)
+				}, &ds.TransactionOptions{ReadOnly: true}), ShouldEqual, ds.ErrReadOnlyTransaction)
+				So(under.PutMulti.Total(), ShouldEqual, 0)
+				So(4, fooShouldHave(c), dataMultiRoot[3].Value)
+			})
+
 		})
 
 	})
@@ -356,6 +370,28 @@ func TestHuge(t *testing.T) {
 			So(18, fooShouldHave(c), hugeField)
 		})
 
+		Convey("SizeBudget tracks the remaining budget", func() {
+			_, ok := SizeBudget(c)
+			So(ok, ShouldBeFalse)
+			_, ok = ds.TransactionSizeBudget(c)
+			So(ok, ShouldBeFalse)
+
+			So(ds.RunInTransaction(c, func(c context.Context) error {
+				before, ok := SizeBudget(c)
+				So(ok, ShouldBeTrue)
+				So(before, ShouldEqual, DefaultSizeBudget)
+
+				So(18, fooSetTo(c), hugeField)
+				after, _ := SizeBudget(c)
+				So(after, ShouldBeLessThan, before-int64(len(hugeField)))
+
+				dsAfter, ok := ds.TransactionSizeBudget(c)
+				So(ok, ShouldBeTrue)
+				So(dsAfter, ShouldEqual, after)
+				return nil
+			}, nil), ShouldBeNil)
+		})
+
 		Convey("exceeding threshold in the parent, then retreating in the child is okay", func() {
 			So(ds.RunInTransaction(c, func(c context.Context) error {
 				So(ds.Put(c, hugeData), ShouldBeNil)
@@ -850,6 +886,90 @@ func TestQuerySupport(t *testing.T) {
 
 			})
 
+			Convey("iterator", func() {
+				_, _, c := mkds(projectData)
+				q = q.Eq("Value", 2, 3)
+
+				foo1 := &Foo{ID: 1, Parent: root, Value: []int64{2, 3}}
+
+				So(ds.RunInTransaction(c, func(c context.Context) error {
+					So(ds.Put(c, foo1), ShouldBeNil)
+
+					vals := []*Foo{}
+					it := ds.NewIteratorBatch(c, 1, q)
+					defer it.Close()
+					for {
+						f := &Foo{}
+						err := it.Next(f)
+						if err == ds.Done {
+							break
+						}
+						So(err, ShouldBeNil)
+						vals = append(vals, f)
+					}
+					So(vals, ShouldResemble, []*Foo{foo1, projectData[0], projectData[2]})
+
+					return nil
+				}, nil), ShouldBeNil)
+			})
+
+			Convey("cursors", func() {
+				_, _, c := mkds(projectData)
+				q = q.Eq("Value", 2, 3)
+
+				foo1 := &Foo{ID: 1, Parent: root, Value: []int64{2, 3}}
+
+				cursorStr := ""
+				So(ds.RunInTransaction(c, func(c context.Context) error {
+					So(ds.Put(c, foo1), ShouldBeNil)
+
+					vals := []*Foo{}
+					var cursor ds.Cursor
+					So(ds.Run(c, q.Limit(2), func(f *Foo, gc ds.CursorCB) error {
+						vals = append(vals, f)
+						var err error
+						cursor, err = gc()
+						return err
+					}), ShouldBeNil)
+					So(vals, ShouldResemble, []*Foo{foo1, projectData[0]})
+					cursorStr = cursor.String()
+
+					Convey("resume after the merged position", func() {
+						vals := []*Foo{}
+						So(ds.GetAll(c, q.Start(cursor), &vals), ShouldBeNil)
+						So(vals, ShouldResemble, []*Foo{projectData[2]})
+
+						decoded, err := ds.DecodeCursor(c, cursorStr)
+						So(err, ShouldBeNil)
+						vals = []*Foo{}
+						So(ds.GetAll(c, q.Start(decoded), &vals), ShouldBeNil)
+						So(vals, ShouldResemble, []*Foo{projectData[2]})
+					})
+
+					Convey("stop at the merged position", func() {
+						vals := []*Foo{}
+						So(ds.GetAll(c, q.End(cursor), &vals), ShouldBeNil)
+						So(vals, ShouldResemble, []*Foo{foo1, projectData[0]})
+					})
+
+					Convey("not in a nested transaction", func() {
+						So(ds.RunInTransaction(c, func(c context.Context) error {
+							_, err := ds.DecodeCursor(c, cursorStr)
+							So(err, ShouldEqual, ErrCursorOutsideTransaction)
+
+							vals := []*Foo{}
+							So(ds.GetAll(c, q.Start(cursor), &vals), ShouldEqual, ErrCursorOutsideTransaction)
+							return nil
+						}, nil), ShouldBeNil)
+					})
+
+					return nil
+				}, nil), ShouldBeNil)
+
+				_, err := ds.DecodeCursor(c, cursorStr)
+				So(err, ShouldEqual, ErrCursorOutsideTransaction)
+			})
+
 			Convey("start transaction from inside query", func() {
 				_, _, c := mkds(projectData)
 				So(ds.RunInTransaction(c, func(c context.Context) error {
@@ -26,6 +26,7 @@ import (
 	ds "github.com/conchoid/gae/service/datastore"
 
 	"cloud.google.com/go/datastore"
+	pb "cloud.google.com/go/datastore/apiv1/datastorepb"
 	"google.golang.org/api/iterator"
 
 	"golang.org/x/net/context"
@@ -37,10 +38,12 @@ type cloudDatastore struct {
 
 func (cds *cloudDatastore) use(c context.Context) context.Context {
 	return ds.SetRawFactory(c, func(ic context.Context) ds.RawInterface {
+		tx := datastoreTransaction(ic)
 		return &boundDatastore{
 			Context:        ic,
 			cloudDatastore: cds,
-			transaction:    datastoreTransaction(ic),
+			transaction:    tx.tx,
+			readOnly:       tx.readOnly,
 			kc:             ds.GetKeyContext(ic),
 		}
 	})
@@ -56,6 +59,7 @@ type boundDatastore struct {
 	*cloudDatastore
 
 	transaction *datastore.Transaction
+	readOnly    bool
 	kc          ds.KeyContext
 }
 
@@ -77,7 +81,10 @@ func (bds *boundDatastore) RunInTransaction(fn func(context.Context) error, opts
 		return errors.New("nested transactions are not supported")
 	}
 
-	// The cloud datastore SDK does not expose any transaction options.
+	// Retries are done by ds.RetryTransaction, so each attempt is a single
+	// attempt of the SDK.
+	txOpts := []datastore.TransactionOption{datastore.MaxAttempts(1)}
+	readOnly := false
 	if opts != nil {
 		switch {
 		case opts.XG:
@@ -85,21 +92,18 @@ func (bds *boundDatastore) RunInTransaction(fn func(context.Context) error, opts
 			// Refer: https://groups.google.com/forum/#!topic/gcd-discuss/YiQDESbe3ek
 			// return errors.New("cross-group transactions are not supported")
 		}
+		if opts.ReadOnly {
+			txOpts = append(txOpts, datastore.ReadOnly)
+			readOnly = true
+		}
 	}
 
-	attempts := 3
-	if opts != nil && opts.Attempts > 0 {
-		attempts = opts.Attempts
-	}
-	for i := 0; i < attempts; i++ {
+	return ds.RetryTransaction(bds, opts, func(int) error {
 		_, err := bds.client.RunInTransaction(bds, func(tx *datastore.Transaction) error {
-			return fn(withDatastoreTransaction(bds, tx))
-		})
-		if err = normalizeError(err); err != ds.ErrConcurrentTransaction {
-			return err
-		}
-	}
-	return ds.ErrConcurrentTransaction
+			return fn(withDatastoreTransaction(bds, tx, readOnly))
+		}, txOpts...)
+		return normalizeError(err)
+	})
 }
 
 func (bds *boundDatastore) DecodeCursor(s string) (ds.Cursor, error) {
@@ -147,6 +151,81 @@ func (bds *boundDatastore) Count(q *ds.FinalizedQuery) (int64, error) {
 	return int64(v), nil
 }
 
+func (bds *boundDatastore) Aggregate(q *ds.FinalizedQuery, aggs []*ds.Aggregation) (ds.PropertySlice, error) {
+	aq := bds.prepareNativeQuery(q).NewAggregationQuery()
+	for i, agg := range aggs {
+		alias := aggregationAlias(i)
+		switch agg.Op() {
+		case ds.AggregateCount:
+			aq = aq.WithCount(alias)
+		case ds.AggregateSum:
+			aq = aq.WithSum(agg.Field(), alias)
+		case ds.AggregateAvg:
+			aq = aq.WithAvg(agg.Field(), alias)
+		default:
+			return nil, fmt.Errorf("unsupported aggregation %q", agg.Op())
+		}
+	}
+
+	res, err := bds.client.RunAggregationQuery(bds, aq)
+	if err != nil {
+		return nil, normalizeError(err)
+	}
+	ret := make(ds.PropertySlice, len(aggs))
+	for i := range aggs {
+		v, ok := res[aggregationAlias(i)]
+		if !ok {
+			return nil, fmt.Errorf("missing result for aggregation %s", aggs[i])
+		}
+		if ret[i], err = nativeAggregationResultToGAE(v); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// SampleKeys uses the __scatter__ property, which the datastore sets on a
+// random sample of the entities.
+func (bds *boundDatastore) SampleKeys(q *ds.FinalizedQuery, n int32) ([]*ds.Key, error) {
+	nq := datastore.NewQuery(q.Kind()).Order("__scatter__").KeysOnly().Limit(int(n))
+	if bds.transaction != nil {
+		nq = nq.Transaction(bds.transaction)
+	}
+	if ns := bds.kc.Namespace; ns != "" {
+		nq = nq.Namespace(ns)
+	}
+	if ancestor := q.Ancestor(); ancestor != nil {
+		nq = nq.Ancestor(bds.gaeKeysToNative(ancestor)[0])
+	}
+
+	nativeKeys, err := bds.client.GetAll(bds, nq, nil)
+	if err != nil {
+		return nil, normalizeError(err)
+	}
+	return bds.nativeKeysToGAE(nativeKeys...), nil
+}
+
+func aggregationAlias(i int) string { return fmt.Sprintf("agg%d", i) }
+
+// nativeAggregationResultToGAE converts a value of a native AggregationResult,
+// which is a protobuf Value, into a Property.
+func nativeAggregationResultToGAE(v interface{}) (ds.Property, error) {
+	pv, ok := v.(*pb.Value)
+	if !ok {
+		return ds.Property{}, fmt.Errorf("unsupported aggregation result type %T", v)
+	}
+	switch t := pv.GetValueType().(type) {
+	case *pb.Value_IntegerValue:
+		return ds.MkProperty(t.IntegerValue), nil
+	case *pb.Value_DoubleValue:
+		return ds.MkProperty(t.DoubleValue), nil
+	case *pb.Value_NullValue:
+		return ds.MkProperty(nil), nil
+	default:
+		return ds.Property{}, fmt.Errorf("unsupported aggregation result value %T", t)
+	}
+}
+
 func fixMultiError(err error) error {
 	if err == nil {
 		return nil
@@ -201,6 +280,10 @@ func (bds *boundDatastore) GetMulti(keys []*ds.Key, _meta ds.MultiMetaGetter, cb
 }
 
 func (bds *boundDatastore) PutMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB) error {
+	if bds.readOnly {
+		return ds.ErrReadOnlyTransaction
+	}
+
 	nativeKeys := bds.gaeKeysToNative(keys...)
 	nativePLS := make([]*nativePropertyLoadSaver, len(vals))
 	for i := range nativePLS {
@@ -255,6 +338,10 @@ func (bds *boundDatastore) PutMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds
 }
 
 func (bds *boundDatastore) DeleteMulti(keys []*ds.Key, cb ds.DeleteMultiCB) error {
+	if bds.readOnly {
+		return ds.ErrReadOnlyTransaction
+	}
+
 	nativeKeys := bds.gaeKeysToNative(keys...)
 
 	var err error
@@ -272,7 +359,7 @@ func (bds *boundDatastore) DeleteMulti(keys []*ds.Key, cb ds.DeleteMultiCB) erro
 }
 
 func (bds *boundDatastore) WithoutTransaction() context.Context {
-	return withDatastoreTransaction(bds, nil)
+	return withDatastoreTransaction(bds, nil, false)
 }
 
 func (bds *boundDatastore) CurrentTransaction() ds.Transaction { return bds.transaction }
@@ -382,6 +469,9 @@ func (bds *boundDatastore) gaePropertyToNative(name string, pdata ds.PropertyDat
 		case ds.PTKey:
 			return bds.gaeKeysToNative(prop.Value().(*ds.Key))[0], nil
 
+		case ds.PTPropertyMap:
+			return bds.gaePropertyMapToNative(prop.Value().(ds.PropertyMap))
+
 		default:
 			return nil, fmt.Errorf("unsupported property type: %v", pt)
 		}
@@ -440,6 +530,13 @@ func (bds *boundDatastore) nativePropertyToGAE(nativeProp datastore.Property) (
 		case *datastore.Key:
 			nv = bds.nativeKeysToGAE(nvt)[0]
 
+		case *datastore.Entity:
+			pm, err := bds.nativeEntityToGAE(nvt)
+			if err != nil {
+				return err
+			}
+			nv = pm
+
 		default:
 			return fmt.Errorf("unsupported datastore.Value type for %q: %T", name, nvt)
 		}
@@ -478,6 +575,40 @@ func (bds *boundDatastore) nativePropertyToGAE(nativeProp datastore.Property) (
 	return
 }
 
+// gaePropertyMapToNative converts an embedded entity into its native form.
+// Meta properties are dropped.
+func (bds *boundDatastore) gaePropertyMapToNative(pm ds.PropertyMap) (*datastore.Entity, error) {
+	ent := &datastore.Entity{Properties: make([]datastore.Property, 0, len(pm))}
+	for name, pdata := range pm {
+		if strings.HasPrefix(name, "$") {
+			continue
+		}
+		nativeProp, err := bds.gaePropertyToNative(name, pdata)
+		if err != nil {
+			return nil, err
+		}
+		ent.Properties = append(ent.Properties, nativeProp)
+	}
+	return ent, nil
+}
+
+// nativeEntityToGAE converts a native embedded entity into a PropertyMap. The
+// key of the embedded entity, if any, is not preserved.
+func (bds *boundDatastore) nativeEntityToGAE(ent *datastore.Entity) (ds.PropertyMap, error) {
+	pm := make(ds.PropertyMap, len(ent.Properties))
+	for _, nativeProp := range ent.Properties {
+		name, pdata, err := bds.nativePropertyToGAE(nativeProp)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := pm[name]; ok {
+			return nil, fmt.Errorf("duplicate properties for %q", name)
+		}
+		pm[name] = pdata
+	}
+	return pm, nil
+}
+
 func (bds *boundDatastore) gaeKeysToNative(keys ...*ds.Key) []*datastore.Key {
 	nativeKeys := make([]*datastore.Key, len(keys))
 	for i, key := range keys {
@@ -578,15 +709,19 @@ func (npls *nativePropertyLoadSaver) Save() ([]datastore.Property, error) {
 
 var datastoreTransactionKey = "*datastore.Transaction"
 
-func withDatastoreTransaction(c context.Context, tx *datastore.Transaction) context.Context {
-	return context.WithValue(c, &datastoreTransactionKey, tx)
+// boundTransaction is the transaction installed in a Context.
+type boundTransaction struct {
+	tx       *datastore.Transaction
+	readOnly bool
 }
 
-func datastoreTransaction(c context.Context) *datastore.Transaction {
-	if tx, ok := c.Value(&datastoreTransactionKey).(*datastore.Transaction); ok {
-		return tx
-	}
-	return nil
+func withDatastoreTransaction(c context.Context, tx *datastore.Transaction, readOnly bool) context.Context {
+	return context.WithValue(c, &datastoreTransactionKey, boundTransaction{tx, readOnly})
+}
+
+func datastoreTransaction(c context.Context) boundTransaction {
+	tx, _ := c.Value(&datastoreTransactionKey).(boundTransaction)
+	return tx
 }
 
 func clonePropertyMap(pmap ds.PropertyMap) ds.PropertyMap {
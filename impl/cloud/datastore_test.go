@@ -26,6 +26,7 @@ import (
 	"github.com/conchoid/gae/service/info"
 
 	"cloud.google.com/go/datastore"
+	pb "cloud.google.com/go/datastore/apiv1/datastorepb"
 	"go.chromium.org/luci/common/errors"
 	"golang.org/x/net/context"
 
@@ -324,3 +325,26 @@ func TestDatastore(t *testing.T) {
 		})
 	})
 }
+
+func TestNativeAggregationResultToGAE(t *testing.T) {
+	t.Parallel()
+
+	Convey(`Converting native aggregation results`, t, func() {
+		conv := func(v interface{}) interface{} {
+			prop, err := nativeAggregationResultToGAE(v)
+			So(err, ShouldBeNil)
+			return prop.Value()
+		}
+
+		So(conv(&pb.Value{ValueType: &pb.Value_IntegerValue{IntegerValue: 42}}), ShouldEqual, int64(42))
+		So(conv(&pb.Value{ValueType: &pb.Value_DoubleValue{DoubleValue: 1.5}}), ShouldEqual, 1.5)
+		So(conv(&pb.Value{ValueType: &pb.Value_NullValue{}}), ShouldBeNil)
+
+		_, err := nativeAggregationResultToGAE(&pb.Value{ValueType: &pb.Value_StringValue{StringValue: "x"}})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "unsupported aggregation result value")
+		_, err = nativeAggregationResultToGAE(int64(42))
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "unsupported aggregation result type")
+	})
+}
@@ -95,6 +95,10 @@ func (ds) DeleteMulti([]*datastore.Key, datastore.DeleteMultiCB) error { panic(n
 func (ds) DecodeCursor(string) (datastore.Cursor, error)               { panic(ni()) }
 func (ds) Count(*datastore.FinalizedQuery) (int64, error)              { panic(ni()) }
 func (ds) Run(*datastore.FinalizedQuery, datastore.RawRunCB) error     { panic(ni()) }
+func (ds) Aggregate(*datastore.FinalizedQuery, []*datastore.Aggregation) (datastore.PropertySlice, error) {
+	panic(ni())
+}
+func (ds) SampleKeys(*datastore.FinalizedQuery, int32) ([]*datastore.Key, error) { panic(ni()) }
 func (ds) RunInTransaction(func(context.Context) error, *datastore.TransactionOptions) error {
 	panic(ni())
 }
@@ -229,6 +229,10 @@ func (d *dsImpl) RunInTransaction(f func(context.Context) error, o *ds.Transacti
 			return err
 		}
 
+		if o != nil && o.ReadOnly {
+			// There's nothing to commit, so nothing to contend on.
+			return nil
+		}
 		if !applyForReal {
 			return ds.ErrConcurrentTransaction
 		}
@@ -241,15 +245,7 @@ func (d *dsImpl) RunInTransaction(f func(context.Context) error, o *ds.Transacti
 		return nil
 	}
 
-	// From GAE docs for TransactionOptions: "If omitted, it defaults to 3."
-	attempts := 3
-	if o != nil && o.Attempts != 0 {
-		attempts = o.Attempts
-	}
-	for attempt := 0; attempt < attempts; attempt++ {
-		if err := loopBody(attempt >= d.data.txnFakeRetry); err != ds.ErrConcurrentTransaction {
-			return err
-		}
-	}
-	return ds.ErrConcurrentTransaction
+	return ds.RetryTransaction(d, o, func(failed int) error {
+		return loopBody(failed >= d.data.txnFakeRetry)
+	})
 }
@@ -15,8 +15,12 @@
 package memory
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"time"
+
+	"go.chromium.org/luci/common/clock"
 
 	"golang.org/x/net/context"
 
@@ -28,7 +32,17 @@ import (
 
 // useRDS adds a gae.Datastore implementation to context, accessible
 // by gae.GetDS(c)
+//
+// Unless the context already has them, it also installs an EncryptionProvider
+// and a page token secret with random keys, so that encrypted fields and
+// Paginate work out of the box.
 func useRDS(c context.Context) context.Context {
+	if ds.GetEncryptionProvider(c) == nil {
+		c = ds.SetEncryptionProvider(c, newEncryptionProvider())
+	}
+	if ds.GetPageTokenSecret(c) == nil {
+		c = ds.SetPageTokenSecret(c, randomKey())
+	}
 	return ds.SetRawFactory(c, func(ic context.Context) ds.RawInterface {
 		kc := ds.GetKeyContext(ic)
 		memCtx, isTxn := cur(ic)
@@ -40,6 +54,25 @@ func useRDS(c context.Context) context.Context {
 	})
 }
 
+// newEncryptionProvider returns an AES-GCM EncryptionProvider with a random
+// key.
+func newEncryptionProvider() ds.EncryptionProvider {
+	p, err := ds.NewAESGCMProvider(map[string][]byte{"memory": randomKey()}, "memory")
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// randomKey returns a random 256-bit key.
+func randomKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
 // NewDatastore creates a new standalone memory implementation of the datastore,
 // suitable for embedding for doing in-memory data organization.
 //
@@ -83,7 +116,35 @@ func (d *dsImpl) AllocateIDs(keys []*ds.Key, cb ds.NewKeyCB) error {
 }
 
 func (d *dsImpl) PutMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB) error {
-	d.data.putMulti(keys, vals, cb, false)
+	admitted := d.data.throttle.admitKeys(clock.Now(d), keys)
+	if admitted == nil {
+		d.data.putMulti(keys, vals, cb, false)
+		return nil
+	}
+
+	var idxs []int
+	var aKeys []*ds.Key
+	var aVals []ds.PropertyMap
+	for i, ok := range admitted {
+		switch {
+		case ok:
+			idxs = append(idxs, i)
+			aKeys = append(aKeys, keys[i])
+			aVals = append(aVals, vals[i])
+		case cb != nil:
+			if err := cb(i, nil, ds.ErrConcurrentTransaction); err != nil {
+				return err
+			}
+		}
+	}
+	if len(aKeys) > 0 {
+		d.data.putMulti(aKeys, aVals, func(i int, k *ds.Key, err error) error {
+			if cb == nil {
+				return nil
+			}
+			return cb(idxs[i], k, err)
+		}, false)
+	}
 	return nil
 }
 
@@ -92,7 +153,33 @@ func (d *dsImpl) GetMulti(keys []*ds.Key, _meta ds.MultiMetaGetter, cb ds.GetMul
 }
 
 func (d *dsImpl) DeleteMulti(keys []*ds.Key, cb ds.DeleteMultiCB) error {
-	d.data.delMulti(keys, cb, false)
+	admitted := d.data.throttle.admitKeys(clock.Now(d), keys)
+	if admitted == nil {
+		d.data.delMulti(keys, cb, false)
+		return nil
+	}
+
+	var idxs []int
+	var aKeys []*ds.Key
+	for i, ok := range admitted {
+		switch {
+		case ok:
+			idxs = append(idxs, i)
+			aKeys = append(aKeys, keys[i])
+		case cb != nil:
+			if err := cb(i, ds.ErrConcurrentTransaction); err != nil {
+				return err
+			}
+		}
+	}
+	if len(aKeys) > 0 {
+		d.data.delMulti(aKeys, func(i int, err error) error {
+			if cb == nil {
+				return nil
+			}
+			return cb(idxs[i], err)
+		}, false)
+	}
 	return nil
 }
 
@@ -102,24 +189,34 @@ func (d *dsImpl) DecodeCursor(s string) (ds.Cursor, error) {
 
 func (d *dsImpl) Run(fq *ds.FinalizedQuery, cb ds.RawRunCB) error {
 	idx, head := d.data.getQuerySnaps(!fq.EventuallyConsistent())
-	err := executeQuery(fq, d.kc, false, idx, head, cb)
+	err := executeQuery(fq, d.kc, false, idx, head, &d.data.usage, cb)
 	if d.data.maybeAutoIndex(err) {
 		idx, head = d.data.getQuerySnaps(!fq.EventuallyConsistent())
-		err = executeQuery(fq, d.kc, false, idx, head, cb)
+		err = executeQuery(fq, d.kc, false, idx, head, &d.data.usage, cb)
 	}
 	return err
 }
 
 func (d *dsImpl) Count(fq *ds.FinalizedQuery) (ret int64, err error) {
 	idx, head := d.data.getQuerySnaps(!fq.EventuallyConsistent())
-	ret, err = countQuery(fq, d.kc, false, idx, head)
+	ret, err = countQuery(fq, d.kc, false, idx, head, &d.data.usage)
 	if d.data.maybeAutoIndex(err) {
 		idx, head := d.data.getQuerySnaps(!fq.EventuallyConsistent())
-		ret, err = countQuery(fq, d.kc, false, idx, head)
+		ret, err = countQuery(fq, d.kc, false, idx, head, &d.data.usage)
 	}
 	return
 }
 
+// Aggregate computes aggregations from index scans: the values of fields are
+// read with projection queries.
+func (d *dsImpl) Aggregate(fq *ds.FinalizedQuery, aggs []*ds.Aggregation) (ds.PropertySlice, error) {
+	return ds.AggregateQuery(d, fq, aggs)
+}
+
+func (d *dsImpl) SampleKeys(fq *ds.FinalizedQuery, n int32) ([]*ds.Key, error) {
+	return sampleKeys(fq, d.kc, d.data.takeSnapshot(), n), nil
+}
+
 func (d *dsImpl) WithoutTransaction() context.Context {
 	// Already not in a Transaction.
 	return d
@@ -167,6 +264,22 @@ func (d *dsImpl) AutoIndex(enable bool) {
 	d.data.setAutoIndex(enable)
 }
 
+func (d *dsImpl) RecordMissingIndexes(set *ds.IndexSet) {
+	d.data.setMissingIndexes(set)
+}
+
+func (d *dsImpl) SetEntityGroupWriteRate(writes int, period time.Duration) {
+	d.data.throttle.set(writes, period)
+}
+
+func (d *dsImpl) IndexUsage() []ds.IndexUsage {
+	return d.data.indexUsage()
+}
+
+func (d *dsImpl) RefreshStats() {
+	d.data.refreshStats(clock.Now(d).UTC())
+}
+
 func (d *dsImpl) DisableSpecialEntities(enabled bool) {
 	d.data.setDisableSpecialEntities(enabled)
 }
@@ -198,6 +311,9 @@ func (d *txnDsImpl) AllocateIDs(keys []*ds.Key, cb ds.NewKeyCB) error {
 
 func (d *txnDsImpl) PutMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB) error {
 	return d.data.run(func() error {
+		if d.data.txn.readOnly {
+			return ds.ErrReadOnlyTransaction
+		}
 		d.data.putMulti(keys, vals, cb)
 		return nil
 	})
@@ -211,6 +327,9 @@ func (d *txnDsImpl) GetMulti(keys []*ds.Key, _meta ds.MultiMetaGetter, cb ds.Get
 
 func (d *txnDsImpl) DeleteMulti(keys []*ds.Key, cb ds.DeleteMultiCB) error {
 	return d.data.run(func() error {
+		if d.data.txn.readOnly {
+			return ds.ErrReadOnlyTransaction
+		}
 		return d.data.delMulti(keys, cb)
 	})
 }
@@ -226,12 +345,42 @@ func (d *txnDsImpl) Run(q *ds.FinalizedQuery, cb ds.RawRunCB) error {
 	//
 	// It's possible that if you have full-consistency and also auto index enabled
 	// that this would make sense... but at that point you should probably just
-	// add the index up front.
-	return executeQuery(q, d.kc, true, d.data.snap, d.data.snap, cb)
+	// add the index up front. The missing index is still recorded though.
+	return d.data.run(func() error {
+		if err := d.data.enlistQuery(q); err != nil {
+			return err
+		}
+		err := executeQuery(q, d.kc, true, d.data.snap, d.data.snap, &d.data.parent.usage, cb)
+		d.data.parent.recordMissingIndex(err)
+		return err
+	})
 }
 
 func (d *txnDsImpl) Count(fq *ds.FinalizedQuery) (ret int64, err error) {
-	return countQuery(fq, d.kc, true, d.data.snap, d.data.snap)
+	err = d.data.run(func() error {
+		if err := d.data.enlistQuery(fq); err != nil {
+			return err
+		}
+		ret, err = countQuery(fq, d.kc, true, d.data.snap, d.data.snap, &d.data.parent.usage)
+		d.data.parent.recordMissingIndex(err)
+		return err
+	})
+	return
+}
+
+func (d *txnDsImpl) Aggregate(fq *ds.FinalizedQuery, aggs []*ds.Aggregation) (ds.PropertySlice, error) {
+	return ds.AggregateQuery(d, fq, aggs)
+}
+
+func (d *txnDsImpl) SampleKeys(fq *ds.FinalizedQuery, n int32) (keys []*ds.Key, err error) {
+	err = d.data.run(func() error {
+		if err := d.data.enlistQuery(fq); err != nil {
+			return err
+		}
+		keys = sampleKeys(fq, d.kc, d.data.snap, n)
+		return nil
+	})
+	return
 }
 
 func (*txnDsImpl) RunInTransaction(func(c context.Context) error, *ds.TransactionOptions) error {
@@ -23,6 +23,7 @@ import (
 	prodConstraints "github.com/conchoid/gae/impl/prod/constraints"
 	ds "github.com/conchoid/gae/service/datastore"
 	"github.com/conchoid/gae/service/datastore/serialize"
+	"go.chromium.org/luci/common/clock"
 	"go.chromium.org/luci/common/errors"
 
 	"golang.org/x/net/context"
@@ -56,6 +57,12 @@ type dataStoreData struct {
 	// true means that queries with insufficent indexes will pause to add them
 	// and then continue instead of failing.
 	autoIndex bool
+	// if non-nil, every missing index is recorded here.
+	missingIndexes *ds.IndexSet
+	// accounts for the compound indexes used by queries.
+	usage indexUsage
+	// For testing, see SetEntityGroupWriteRate.
+	throttle writeThrottle
 	// true means that all of the __...__ keys which are normally automatically
 	// maintained will be omitted. This also means that Put with an incomplete
 	// key will become an error.
@@ -109,9 +116,41 @@ func (d *dataStoreData) setAutoIndex(enable bool) {
 	d.autoIndex = enable
 }
 
-func (d *dataStoreData) maybeAutoIndex(err error) bool {
+func (d *dataStoreData) indexUsage() []ds.IndexUsage {
+	d.rwlock.RLock()
+	head := d.head.Snapshot()
+	d.rwlock.RUnlock()
+	return d.usage.usage(head)
+}
+
+func (d *dataStoreData) setMissingIndexes(set *ds.IndexSet) {
+	d.rwlock.Lock()
+	defer d.rwlock.Unlock()
+	d.missingIndexes = set
+}
+
+// recordMissingIndex adds the index missing for err, if err is an
+// ErrMissingIndex, to the recorded missing indexes (see RecordMissingIndexes).
+// It returns err as an ErrMissingIndex, or nil.
+func (d *dataStoreData) recordMissingIndex(err error) *ErrMissingIndex {
 	mi, ok := err.(*ErrMissingIndex)
 	if !ok {
+		return nil
+	}
+
+	d.rwlock.RLock()
+	rec := d.missingIndexes
+	d.rwlock.RUnlock()
+
+	if rec != nil {
+		rec.Add(mi.Missing)
+	}
+	return mi
+}
+
+func (d *dataStoreData) maybeAutoIndex(err error) bool {
+	mi := d.recordMissingIndex(err)
+	if mi == nil {
 		return false
 	}
 
@@ -323,6 +362,26 @@ func (d *dataStoreData) fixKey(key *ds.Key) (*ds.Key, error) {
 	return key, nil
 }
 
+// checkEntityLocked returns an error if the entity (key, pmap) exceeds the size
+// or index constraints of d. d.rwlock must be held.
+func (d *dataStoreData) checkEntityLocked(key *ds.Key, pmap ds.PropertyMap) error {
+	c := &d.constraints
+	if c.MaxEntitySize > 0 && key.EstimateSize()+pmap.EstimateSize() > int64(c.MaxEntitySize) {
+		return errors.New("entity is too big")
+	}
+	if c.MaxIndexEntries > 0 && numIndexEntries(d.head, key, pmap) > c.MaxIndexEntries {
+		return fmt.Errorf("Too many indexed properties for entity %s", key)
+	}
+	return nil
+}
+
+// checkEntity is checkEntityLocked, for callers which don't hold d.rwlock.
+func (d *dataStoreData) checkEntity(key *ds.Key, pmap ds.PropertyMap) error {
+	d.rwlock.RLock()
+	defer d.rwlock.RUnlock()
+	return d.checkEntityLocked(key, pmap)
+}
+
 func (d *dataStoreData) putMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB, lockedAlready bool) error {
 	ns := keys[0].Namespace()
 
@@ -334,6 +393,12 @@ func (d *dataStoreData) putMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.Ne
 			if !lockedAlready {
 				d.rwlock.Lock()
 				defer d.rwlock.Unlock()
+
+				// Committed transactions were checked when their mutations were
+				// recorded.
+				if err = d.checkEntityLocked(k, pmap); err != nil {
+					return
+				}
 			}
 
 			ents := d.head.GetOrCreateCollection("ents:" + ns)
@@ -480,6 +545,18 @@ func (d *dataStoreData) beginCommit(c context.Context, obj memContextObj) txnCom
 		}
 	}
 
+	// Check for contention of the written entity groups.
+	var written []string
+	for rk, muts := range txn.muts {
+		if len(muts) > 0 {
+			written = append(written, rk)
+		}
+	}
+	if !d.throttle.admit(clock.Now(c), written...) {
+		unlock()
+		return nil
+	}
+
 	return &txnCommitCallback{
 		unlock: unlock,
 		apply: func() {
@@ -508,7 +585,8 @@ func (d *dataStoreData) mkTxn(o *ds.TransactionOptions) memContextObj {
 		// access to break features inside of transactions.
 		parent: d,
 		txn: &transactionImpl{
-			isXG: o != nil && o.XG,
+			isXG:     o != nil && o.XG,
+			readOnly: o != nil && o.ReadOnly,
 		},
 		snap: d.takeSnapshot(),
 		muts: map[string][]txnMutation{},
@@ -604,9 +682,22 @@ func (td *txnDataStoreData) writeMutation(getOnly bool, key *ds.Key, data ds.Pro
 	return nil
 }
 
+// enlistQuery ensures that this transaction can support the given query,
+// which includes the entity group of its ancestor.
+func (td *txnDataStoreData) enlistQuery(fq *ds.FinalizedQuery) error {
+	if anc := fq.Ancestor(); anc != nil {
+		return td.writeMutation(true, anc, nil)
+	}
+	return nil
+}
+
 func (td *txnDataStoreData) putMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB) {
 	for i, k := range keys {
-		k, err := td.parent.fixKey(k)
+		pmap, _ := vals[i].Save(false)
+		err := td.parent.checkEntity(k, pmap)
+		if err == nil {
+			k, err = td.parent.fixKey(k)
+		}
 		if err == nil {
 			err = td.writeMutation(false, k, vals[i])
 		}
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"fmt"
 	"sort"
+	"strings"
 
 	ds "github.com/conchoid/gae/service/datastore"
 	"github.com/conchoid/gae/service/datastore/serialize"
@@ -63,10 +64,50 @@ func indexEntriesWithBuiltins(k *ds.Key, pm ds.PropertyMap, complexIdxs []*ds.In
 	if pm == nil {
 		return newMemStore()
 	}
+	pm = flattenEmbedded(pm)
 	sip = serialize.PropertyMapPartially(k, pm)
 	return indexEntries(k, sip, append(defaultIndexes(k.Kind(), pm), complexIdxs...))
 }
 
+// flattenEmbedded returns pm with the indexed sub-properties of each indexed
+// embedded entity (PTPropertyMap value) added under their dotted names (e.g.
+// "Outer.Inner"). The embedded entities themselves are never indexed.
+//
+// If pm contains no embedded entities, it's returned as-is.
+func flattenEmbedded(pm ds.PropertyMap) ds.PropertyMap {
+	var ret ds.PropertyMap
+	for name, pdata := range pm {
+		for _, p := range pdata.Slice() {
+			if p.Type() != ds.PTPropertyMap || p.IndexSetting() == ds.NoIndex {
+				continue
+			}
+			if ret == nil {
+				ret = make(ds.PropertyMap, len(pm))
+				for k, v := range pm {
+					ret[k] = v
+				}
+			}
+			for subName, subData := range flattenEmbedded(p.Value().(ds.PropertyMap)) {
+				if strings.HasPrefix(subName, "$") {
+					continue
+				}
+				full := name + "." + subName
+				vals := append(ds.PropertySlice(nil), ret.Slice(full)...)
+				for _, sub := range subData.Slice() {
+					if sub.Type() != ds.PTPropertyMap {
+						vals = append(vals, sub)
+					}
+				}
+				ret[full] = vals
+			}
+		}
+	}
+	if ret == nil {
+		return pm
+	}
+	return ret
+}
+
 // indexRowGen contains enough information to generate all of the index rows which
 // correspond with a propertyList and a ds.IndexDefinition.
 type indexRowGen struct {
@@ -264,7 +305,7 @@ func addIndexes(store memStore, aid string, compIdx []*ds.IndexDefinition) {
 
 				k := prop.Value().(*ds.Key)
 
-				sip := serialize.PropertyMapPartially(k, pm)
+				sip := serialize.PropertyMapPartially(k, flattenEmbedded(pm))
 
 				mergeIndexes(ns, store,
 					newMemStore(),
@@ -281,14 +322,35 @@ func addIndexes(store memStore, aid string, compIdx []*ds.IndexDefinition) {
 // oldEnt is the previous entity value, and newEnt is the new entity value. If
 // newEnt is nil, that signifies deletion.
 func updateIndexes(store memStore, key *ds.Key, oldEnt, newEnt ds.PropertyMap) {
-	// load all current complex query index definitions.
+	compIdx := compoundIndexes(store)
+	mergeIndexes(key.Namespace(), store,
+		indexEntriesWithBuiltins(key, oldEnt, compIdx),
+		indexEntriesWithBuiltins(key, newEnt, compIdx))
+}
+
+// compoundIndexes loads all current complex query index definitions of store.
+func compoundIndexes(store memStore) []*ds.IndexDefinition {
 	var compIdx []*ds.IndexDefinition
 	walkCompIdxs(store.Snapshot(), nil, func(i *ds.IndexDefinition) bool {
 		compIdx = append(compIdx, i)
 		return true
 	})
+	return compIdx
+}
 
-	mergeIndexes(key.Namespace(), store,
-		indexEntriesWithBuiltins(key, oldEnt, compIdx),
-		indexEntriesWithBuiltins(key, newEnt, compIdx))
+// numIndexEntries returns the number of index rows, builtin and compound, that
+// the entity (key, pm) has in the indexes of store.
+func numIndexEntries(store memStore, key *ds.Key, pm ds.PropertyMap) int {
+	entries := indexEntriesWithBuiltins(key, pm, compoundIndexes(store))
+	ret := 0
+	for _, name := range entries.GetCollectionNames() {
+		if !strings.HasPrefix(name, "idx:") {
+			continue
+		}
+		entries.GetCollection(name).ForEachItem(func(_, _ []byte) bool {
+			ret++
+			return true
+		})
+	}
+	return ret
 }
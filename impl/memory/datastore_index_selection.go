@@ -80,6 +80,9 @@ type indexDefinitionSortable struct {
 	// (tag=1, tag=2) is a perfectly valid query).
 	eqFilts []ds.IndexColumn
 	coll    memCollection
+	// def is the definition of the index, or nil for the primary index of a
+	// kindless query.
+	def *ds.IndexDefinition
 }
 
 func (i *indexDefinitionSortable) hasAncestor() bool {
@@ -226,7 +229,7 @@ func (idxs *indexDefinitionSortableSlice) maybeAddDefinition(q *reducedQuery, s
 			}
 		}
 	}
-	toAdd := indexDefinitionSortable{coll: coll, eqFilts: eqFilts}
+	toAdd := indexDefinitionSortable{coll: coll, eqFilts: eqFilts, def: id}
 	if perfect {
 		*idxs = indexDefinitionSortableSlice{toAdd}
 	} else {
@@ -339,9 +342,13 @@ func generate(q *reducedQuery, idx *indexDefinitionSortable, c *constraints) *it
 		c:     idx.coll,
 		start: q.start,
 		end:   q.end,
+		idx:   idx.def,
 	}
 	toJoin := make([][]byte, len(idx.eqFilts))
 	for _, sb := range idx.eqFilts {
+		if _, ok := c.constraints[sb.Property]; !ok && sb.Property != "__ancestor__" {
+			def.residual = true
+		}
 		val := c.peel(sb.Property)
 		if sb.Descending {
 			val = serialize.Invert(val)
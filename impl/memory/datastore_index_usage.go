@@ -0,0 +1,120 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"sort"
+	"sync"
+
+	ds "github.com/conchoid/gae/service/datastore"
+)
+
+// indexUsage accounts for the compound indexes which service queries. It's
+// safe for concurrent use, and a nil *indexUsage accounts for nothing.
+type indexUsage struct {
+	lock sync.Mutex
+	// keyed by the String of the normalized IndexDefinition.
+	byIdx map[string]*ds.IndexUsage
+}
+
+// record accounts for the compound indexes iterated by defs to service fq.
+func (u *indexUsage) record(fq *ds.FinalizedQuery, defs []*iterDefinition) {
+	if u == nil {
+		return
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	gql := ""
+	seen := map[string]struct{}{}
+	for _, def := range defs {
+		if def.idx == nil || !def.idx.Compound() {
+			continue
+		}
+		k := def.idx.Normalize().String()
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+
+		iu := u.get(k, def.idx)
+		iu.Hits++
+		if len(defs) == 1 && def.residual {
+			iu.Oversized++
+		}
+		if gql == "" {
+			gql = fq.GQL()
+		}
+		found := false
+		for _, q := range iu.Queries {
+			if q == gql {
+				found = true
+				break
+			}
+		}
+		if !found {
+			iu.Queries = append(iu.Queries, gql)
+		}
+	}
+}
+
+// get returns the usage of the index id, whose normalized String is k. u.lock
+// must be held.
+func (u *indexUsage) get(k string, id *ds.IndexDefinition) *ds.IndexUsage {
+	if u.byIdx == nil {
+		u.byIdx = map[string]*ds.IndexUsage{}
+	}
+	iu := u.byIdx[k]
+	if iu == nil {
+		iu = &ds.IndexUsage{Index: yamlIndex(id)}
+		u.byIdx[k] = iu
+	}
+	return iu
+}
+
+// usage returns the usage of every compound index in store, sorted by index.
+func (u *indexUsage) usage(store memStore) []ds.IndexUsage {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	var ret []ds.IndexUsage
+	walkCompIdxs(store, nil, func(id *ds.IndexDefinition) bool {
+		iu := *u.get(id.Normalize().String(), id)
+		iu.Queries = append([]string(nil), iu.Queries...)
+		ret = append(ret, iu)
+		return true
+	})
+	sort.Sort(indexUsageSlice(ret))
+	return ret
+}
+
+// yamlIndex returns id without its implicit trailing ascending __key__ column,
+// as it would be written in an index YAML file.
+func yamlIndex(id *ds.IndexDefinition) *ds.IndexDefinition {
+	n := len(id.SortBy)
+	if n == 0 || id.SortBy[n-1] != (ds.IndexColumn{Property: "__key__"}) {
+		return id
+	}
+	ret := *id
+	ret.SortBy = id.SortBy[:n-1]
+	return &ret
+}
+
+type indexUsageSlice []ds.IndexUsage
+
+func (s indexUsageSlice) Len() int           { return len(s) }
+func (s indexUsageSlice) Less(i, j int) bool { return s[i].Index.Less(s[j].Index) }
+func (s indexUsageSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -286,3 +286,38 @@ func increment(bstr []byte) []byte {
 	}
 	return ret
 }
+
+// sampleKeys returns up to n keys of the entities in store which match the
+// kind and the ancestor of fq, evenly spaced over their key range.
+//
+// The production datastore samples keys with the __scatter__ property, which
+// is set on a random subset of the entities. Evenly spaced keys have the same
+// distribution, but are deterministic, which is nicer for tests.
+func sampleKeys(fq *ds.FinalizedQuery, kc ds.KeyContext, store memStore, n int32) []*ds.Key {
+	ents := store.GetCollection("ents:" + kc.Namespace)
+	if ents == nil {
+		return nil
+	}
+
+	anc := fq.Ancestor()
+	var keys []*ds.Key
+	ents.ForEachItem(func(ik, _ []byte) bool {
+		prop, err := serialize.ReadProperty(bytes.NewBuffer(ik), serialize.WithoutContext, kc)
+		memoryCorruption(err)
+
+		k := prop.Value().(*ds.Key)
+		if k.Kind() == fq.Kind() && (anc == nil || k.HasAncestor(anc)) {
+			keys = append(keys, k)
+		}
+		return true
+	})
+
+	if int32(len(keys)) <= n {
+		return keys
+	}
+	ret := make([]*ds.Key, n)
+	for i := range ret {
+		ret[i] = keys[i*len(keys)/int(n)]
+	}
+	return ret
+}
@@ -175,14 +175,14 @@ func parseSuffix(aid, ns string, suffixFormat []ds.IndexColumn, suffix []byte, c
 	return
 }
 
-func countQuery(fq *ds.FinalizedQuery, kc ds.KeyContext, isTxn bool, idx, head memStore) (ret int64, err error) {
+func countQuery(fq *ds.FinalizedQuery, kc ds.KeyContext, isTxn bool, idx, head memStore, usage *indexUsage) (ret int64, err error) {
 	if len(fq.Project()) == 0 && !fq.KeysOnly() {
 		fq, err = fq.Original().KeysOnly(true).Finalize()
 		if err != nil {
 			return
 		}
 	}
-	err = executeQuery(fq, kc, isTxn, idx, head, func(_ *ds.Key, _ ds.PropertyMap, _ ds.CursorCB) error {
+	err = executeQuery(fq, kc, isTxn, idx, head, usage, func(_ *ds.Key, _ ds.PropertyMap, _ ds.CursorCB) error {
 		ret++
 		return nil
 	})
@@ -235,7 +235,7 @@ func executeNamespaceQuery(fq *ds.FinalizedQuery, kc ds.KeyContext, head memStor
 	return nil
 }
 
-func executeQuery(fq *ds.FinalizedQuery, kc ds.KeyContext, isTxn bool, idx, head memStore, cb ds.RawRunCB) error {
+func executeQuery(fq *ds.FinalizedQuery, kc ds.KeyContext, isTxn bool, idx, head memStore, usage *indexUsage, cb ds.RawRunCB) error {
 	rq, err := reduce(fq, kc, isTxn)
 	if err == ds.ErrNullQuery {
 		return nil
@@ -244,8 +244,13 @@ func executeQuery(fq *ds.FinalizedQuery, kc ds.KeyContext, isTxn bool, idx, head
 		return err
 	}
 
-	if rq.kind == "__namespace__" {
+	switch rq.kind {
+	case "__namespace__":
 		return executeNamespaceQuery(fq, kc, head, cb)
+	case "__kind__":
+		return executeKindQuery(fq, kc, head, cb)
+	case "__property__":
+		return executePropertyQuery(fq, kc, head, cb)
 	}
 
 	idxs, err := getIndexes(rq, idx)
@@ -255,6 +260,7 @@ func executeQuery(fq *ds.FinalizedQuery, kc ds.KeyContext, isTxn bool, idx, head
 	if err != nil {
 		return err
 	}
+	usage.record(fq, idxs)
 
 	strategy := pickQueryStrategy(fq, rq, cb, head)
 	if strategy == nil {
@@ -129,6 +129,44 @@ var collapsedData = []ds.PropertyMap{
 	),
 }
 
+var fanOutData = []ds.PropertyMap{
+	pmap("$key", key("Item", 1), Next,
+		"Color", "red", Next,
+		"Size", 3,
+	),
+	pmap("$key", key("Item", 2), Next,
+		"Color", "blue", Next,
+		"Size", 1,
+	),
+	pmap("$key", key("Item", 3), Next,
+		"Color", "green", Next,
+		"Size", 2,
+	),
+	pmap("$key", key("Item", 4), Next,
+		"Color", "red", "blue", Next,
+		"Size", 5,
+	),
+	pmap("$key", key("Item", 5), Next,
+		"Color", "yellow", Next,
+		"Size", 4,
+	),
+}
+
+var multiValuedFanOutData = []ds.PropertyMap{
+	pmap("$key", key("Tagged", 1), Next,
+		"Color", "red", Next,
+		"Val", 1, 2, 3,
+	),
+	pmap("$key", key("Tagged", 2), Next,
+		"Color", "red", Next,
+		"Val", 4, 5,
+	),
+	pmap("$key", key("Tagged", 3), Next,
+		"Color", "blue", Next,
+		"Val", 6,
+	),
+}
+
 var queryExecutionTests = []qExTest{
 	{"basic", []qExStage{
 		{
@@ -544,6 +582,130 @@ var queryExecutionTests = []qExTest{
 			},
 		},
 	}},
+
+	{"IN, != and OR filters", []qExStage{
+		{
+			addIdxs: []*ds.IndexDefinition{
+				indx("Item", "Color", "Size"),
+				indx("Item", "Color", "-Size"),
+			},
+			putEnts: fanOutData,
+		},
+		{
+			expect: []qExpect{
+				{q: nq("Item").In("Color", "red", "blue"), get: []ds.PropertyMap{
+					fanOutData[0], fanOutData[1], fanOutData[3],
+				}},
+				{q: nq("Item").In("Color", "red", "blue").Order("Size"), get: []ds.PropertyMap{
+					fanOutData[1], fanOutData[0], fanOutData[3],
+				}},
+				{q: nq("Item").In("Color", "red", "blue").Order("-Size"), get: []ds.PropertyMap{
+					fanOutData[3], fanOutData[0], fanOutData[1],
+				}},
+				{q: nq("Item").In("Color", "red", "blue").Order("Size").Offset(1).Limit(1),
+					get: []ds.PropertyMap{fanOutData[0]}},
+				{q: nq("Item").In("Color", "red", "blue").Order("Color"), keys: []*ds.Key{
+					key("Item", 2), key("Item", 4), key("Item", 1),
+				}},
+				{q: nq("Item").In("Color", "red", "blue").Order("Size").KeysOnly(true), keys: []*ds.Key{
+					key("Item", 2), key("Item", 1), key("Item", 4),
+				}},
+				{q: nq("Item").In("Color", "purple", "green"), get: []ds.PropertyMap{
+					fanOutData[2],
+				}},
+				{q: nq("Item").Neq("Size", 3), get: []ds.PropertyMap{
+					fanOutData[1], fanOutData[2], fanOutData[4], fanOutData[3],
+				}},
+				{q: nq("Item").Neq("Size", 3).Lt("Size", 5).Project("Size"), get: []ds.PropertyMap{
+					pmap("$key", key("Item", 2), Next, "Size", 1),
+					pmap("$key", key("Item", 3), Next, "Size", 2),
+					pmap("$key", key("Item", 5), Next, "Size", 4),
+				}},
+				{q: nq("Item").Or(ds.EqFilter("Color", "green"), ds.GtFilter("Size", 3)),
+					get: []ds.PropertyMap{
+						fanOutData[2], fanOutData[4], fanOutData[3],
+					}},
+				{q: nq("Item").Or(ds.EqFilter("Color", "green"), ds.GtFilter("Size", 3)).Limit(2),
+					keys: []*ds.Key{key("Item", 3), key("Item", 5)}},
+				{q: nq("Item").Or(ds.EqFilter("Color", "red"), ds.EqFilter("Size", 5)), get: []ds.PropertyMap{
+					fanOutData[0], fanOutData[3],
+				}},
+			},
+
+			extraFns: []func(context.Context){
+				func(c context.Context) {
+					q := nq("Item").In("Color", "red", "blue").Order("Size")
+
+					curs := ds.Cursor(nil)
+					err := ds.Run(c, q, func(pm ds.PropertyMap, gc ds.CursorCB) error {
+						So(pm, ShouldResemble, fanOutData[1])
+
+						err := error(nil)
+						curs, err = gc()
+						So(err, ShouldBeNil)
+						return ds.Stop
+					})
+					So(err, shouldBeSuccessful)
+
+					curs, err = ds.DecodeCursor(c, curs.String())
+					So(err, ShouldBeNil)
+
+					rslt := []ds.PropertyMap(nil)
+					So(ds.GetAll(c, q.Start(curs), &rslt), shouldBeSuccessful)
+					So(rslt, ShouldResemble, []ds.PropertyMap{fanOutData[0], fanOutData[3]})
+
+					rslt = nil
+					So(ds.GetAll(c, q.End(curs), &rslt), shouldBeSuccessful)
+					So(rslt, ShouldResemble, []ds.PropertyMap{fanOutData[1]})
+				},
+			},
+		},
+	}},
+
+	{"IN on a multi-valued sort property", []qExStage{
+		{
+			addIdxs: []*ds.IndexDefinition{
+				indx("Tagged", "Color", "Val"),
+			},
+			putEnts: multiValuedFanOutData,
+		},
+		{
+			expect: []qExpect{
+				{q: nq("Tagged").In("Color", "red", "blue").Order("Val").KeysOnly(true).Limit(2),
+					keys: []*ds.Key{key("Tagged", 1), key("Tagged", 2)}},
+				{q: nq("Tagged").In("Color", "red", "blue").Order("Val").KeysOnly(true).Limit(3),
+					keys: []*ds.Key{key("Tagged", 1), key("Tagged", 2), key("Tagged", 3)}},
+				{q: nq("Tagged").In("Color", "red", "blue").Order("Val").KeysOnly(true).Offset(1).Limit(1),
+					keys: []*ds.Key{key("Tagged", 2)}},
+				{q: nq("Tagged").In("Val", 1, 3).Order("Val").KeysOnly(true),
+					keys: []*ds.Key{key("Tagged", 1)}},
+			},
+
+			extraFns: []func(context.Context){
+				func(c context.Context) {
+					// Tagged,1 matches both sub-queries, at Val 1 and Val 3. Cursors don't
+					// record that it was returned at Val 1, so a query started after it
+					// returns it again (see Query.In).
+					q := nq("Tagged").In("Val", 1, 3).Order("Val")
+
+					curs := ds.Cursor(nil)
+					err := ds.Run(c, q.Limit(1), func(k *ds.Key, gc ds.CursorCB) error {
+						So(k, ShouldResemble, key("Tagged", 1))
+
+						err := error(nil)
+						curs, err = gc()
+						So(err, ShouldBeNil)
+						return nil
+					})
+					So(err, shouldBeSuccessful)
+
+					keys := []*ds.Key(nil)
+					So(ds.GetAll(c, q.Start(curs), &keys), shouldBeSuccessful)
+					So(keys, ShouldResemble, []*ds.Key{key("Tagged", 1)})
+				},
+			},
+		},
+	}},
 }
 
 func TestQueryExecution(t *testing.T) {
@@ -682,6 +844,91 @@ func TestQueryExecution(t *testing.T) {
 		So(err, shouldBeSuccessful)
 		So(count, ShouldEqual, 2)
 	})
+
+	Convey("Test RecordMissingIndexes", t, func() {
+		c := Use(context.Background())
+		testing := ds.GetTestable(c)
+		testing.Consistent(true)
+
+		So(ds.Put(c, pmap("$key", key("Kind", 1), Next,
+			"Val", 1, 2, 3, Next,
+			"Extra", "hello",
+		)), shouldBeSuccessful)
+
+		set := &ds.IndexSet{}
+		testing.RecordMissingIndexes(set)
+
+		q := nq("Kind").Gt("Val", 2).Order("Val", "Extra")
+		_, err := ds.Count(c, q)
+		So(err, ShouldErrLike, "Insufficient indexes")
+
+		testing.AutoIndex(true)
+		So(ds.GetAll(c, q, &[]ds.PropertyMap{}), shouldBeSuccessful)
+		So(ds.GetAll(c, nq("Kind").Order("Extra", "-Val"), &[]ds.PropertyMap{}), shouldBeSuccessful)
+
+		So(set.Indexes(), ShouldResemble, []*ds.IndexDefinition{
+			indx("Kind", "Extra", "-Val"),
+			indx("Kind", "Val", "Extra"),
+		})
+
+		testing.RecordMissingIndexes(nil)
+		So(ds.GetAll(c, nq("Kind").Order("-Extra", "Val"), &[]ds.PropertyMap{}), shouldBeSuccessful)
+		So(set.Indexes(), ShouldHaveLength, 2)
+
+		Convey("inside transactions", func() {
+			testing.AutoIndex(false)
+			set := &ds.IndexSet{}
+			testing.RecordMissingIndexes(set)
+
+			q := nq("Kind").Ancestor(key("Kind", 1)).Order("-Val")
+			So(ds.RunInTransaction(c, func(c context.Context) error {
+				So(ds.GetAll(c, q, &[]ds.PropertyMap{}), ShouldErrLike, "Insufficient indexes")
+				_, err := ds.Count(c, q)
+				So(err, ShouldErrLike, "Insufficient indexes")
+				return nil
+			}, nil), shouldBeSuccessful)
+
+			So(set.Indexes(), ShouldResemble, []*ds.IndexDefinition{
+				indx("Kind!", "-Val"),
+			})
+		})
+	})
+
+	Convey("Test IndexUsage", t, func() {
+		c := Use(context.Background())
+		testing := ds.GetTestable(c)
+		testing.Consistent(true)
+		testing.AddIndexes(
+			indx("Kind", "Val", "Extra"),
+			indx("Kind", "Extra", "-Val"),
+			indx("Kind", "A", "A", "Val"),
+		)
+
+		So(ds.Put(c, pmap("$key", key("Kind", 1), Next,
+			"Val", 1, 2, 3, Next,
+			"Extra", "hello", Next,
+			"A", 1,
+		)), shouldBeSuccessful)
+
+		gql := func(q *ds.Query) string {
+			fq, err := q.Finalize()
+			So(err, ShouldBeNil)
+			return fq.GQL()
+		}
+
+		q := nq("Kind").Gt("Val", 2).Order("Val", "Extra")
+		So(ds.GetAll(c, q, &[]ds.PropertyMap{}), shouldBeSuccessful)
+		So(ds.GetAll(c, q, &[]ds.PropertyMap{}), shouldBeSuccessful)
+		aq := nq("Kind").Eq("A", 1).Order("Val")
+		So(ds.GetAll(c, aq, &[]ds.PropertyMap{}), shouldBeSuccessful)
+		So(ds.GetAll(c, nq("Kind").Eq("Val", 1), &[]ds.PropertyMap{}), shouldBeSuccessful)
+
+		So(testing.IndexUsage(), ShouldResemble, []ds.IndexUsage{
+			{Index: indx("Kind", "Extra", "-Val")},
+			{Index: indx("Kind", "Val", "Extra"), Hits: 2, Queries: []string{gql(q)}},
+			{Index: indx("Kind", "A", "A", "Val"), Hits: 1, Oversized: 1, Queries: []string{gql(aq)}},
+		})
+	})
 }
 
 func shouldBeSuccessful(actual interface{}, expected ...interface{}) string {
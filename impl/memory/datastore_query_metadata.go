@@ -0,0 +1,254 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	ds "github.com/conchoid/gae/service/datastore"
+	"github.com/conchoid/gae/service/datastore/serialize"
+	"go.chromium.org/luci/common/data/stringset"
+)
+
+// metaEntity is an entity returned by a "__kind__" or "__property__" query.
+type metaEntity struct {
+	key *ds.Key
+	pm  ds.PropertyMap
+}
+
+// executeKindQuery serves a "__kind__" query, which returns a `__kind__/Kind`
+// key for each kind of entity in the namespace of kc.
+func executeKindQuery(fq *ds.FinalizedQuery, kc ds.KeyContext, head memStore, cb ds.RawRunCB) error {
+	props := kindProperties(head, kc, "", false)
+
+	ents := make([]metaEntity, 0, len(props))
+	for _, kind := range sortedKinds(props) {
+		ents = append(ents, metaEntity{key: kc.MakeKey("__kind__", kind)})
+	}
+	return runMetaQuery(fq, ents, cb)
+}
+
+// executePropertyQuery serves a "__property__" query, which returns a
+// `__kind__/Kind/__property__/Name` entity for each indexed property of each
+// kind of entity in the namespace of kc. The "property_representation" of
+// these entities lists the representations of the values of the property.
+//
+// An ancestor filter on a `__kind__/Kind` key restricts the query to the
+// properties of Kind.
+func executePropertyQuery(fq *ds.FinalizedQuery, kc ds.KeyContext, head memStore, cb ds.RawRunCB) error {
+	kind := ""
+	if anc := fq.Ancestor(); anc != nil {
+		if anc.Kind() != "__kind__" || anc.Parent() != nil || anc.StringID() == "" {
+			return nil
+		}
+		kind = anc.StringID()
+	}
+	props := kindProperties(head, kc, kind, true)
+
+	var ents []metaEntity
+	for _, kind := range sortedKinds(props) {
+		kindKey := kc.MakeKey("__kind__", kind)
+
+		names := make([]string, 0, len(props[kind]))
+		for name := range props[kind] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			repNames := props[kind][name].ToSlice()
+			sort.Strings(repNames)
+			reps := make(ds.PropertySlice, len(repNames))
+			for i, rep := range repNames {
+				reps[i] = ds.MkProperty(rep)
+			}
+			ents = append(ents, metaEntity{
+				key: kc.NewKey("__property__", name, 0, kindKey),
+				pm:  ds.PropertyMap{"property_representation": reps},
+			})
+		}
+	}
+	return runMetaQuery(fq, ents, cb)
+}
+
+// runMetaQuery runs fq over ents, which are sorted by key.
+//
+// Metadata entities have no indexed properties, so filters and sort orders on
+// anything but __key__ cause an empty result.
+func runMetaQuery(fq *ds.FinalizedQuery, ents []metaEntity, cb ds.RawRunCB) error {
+	for prop := range fq.EqFilters() {
+		if prop != "__ancestor__" {
+			return nil
+		}
+	}
+	if len(fq.Project()) > 0 || len(fq.Orders()) > 1 {
+		return nil
+	}
+	if !(fq.IneqFilterProp() == "" || fq.IneqFilterProp() == "__key__") {
+		return nil
+	}
+	limit, hasLimit := fq.Limit()
+	offset, _ := fq.Offset()
+
+	cursErr := fmt.Errorf("cursors not supported for %s query", fq.Kind())
+	cursFn := func() (ds.Cursor, error) { return nil, cursErr }
+	if start, end := fq.Bounds(); !(start == nil && end == nil) {
+		return cursErr
+	}
+
+	_, lowOp, low := fq.IneqFilterLow()
+	_, highOp, high := fq.IneqFilterHigh()
+	inRange := func(k *ds.Key) bool {
+		switch lowOp {
+		case ">":
+			if !low.Value().(*ds.Key).Less(k) {
+				return false
+			}
+		case ">=":
+			if k.Less(low.Value().(*ds.Key)) {
+				return false
+			}
+		}
+		switch highOp {
+		case "<":
+			if !k.Less(high.Value().(*ds.Key)) {
+				return false
+			}
+		case "<=":
+			if high.Value().(*ds.Key).Less(k) {
+				return false
+			}
+		}
+		return true
+	}
+
+	descending := fq.Orders()[0].Descending
+	for i := range ents {
+		ent := ents[i]
+		if descending {
+			ent = ents[len(ents)-1-i]
+		}
+		if !inRange(ent.key) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if hasLimit {
+			if limit <= 0 {
+				return nil
+			}
+			limit--
+		}
+		pm := ent.pm
+		if fq.KeysOnly() {
+			pm = nil
+		}
+		if err := cb(ent.key, pm, cursFn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kindProperties returns the kinds of the entities in the namespace of kc,
+// mapped to their indexed properties, themselves mapped to the representations
+// of their values. Kinds are restricted to kind if it's not empty, and
+// properties are omitted if !withProps.
+//
+// Special kinds, like __entity_group__, are omitted.
+func kindProperties(head memStore, kc ds.KeyContext, kind string, withProps bool) map[string]map[string]stringset.Set {
+	ret := map[string]map[string]stringset.Set{}
+
+	ents := head.GetCollection("ents:" + kc.Namespace)
+	if ents == nil {
+		return ret
+	}
+	ents.ForEachItem(func(ik, iv []byte) bool {
+		prop, err := serialize.ReadProperty(bytes.NewBuffer(ik), serialize.WithoutContext, kc)
+		memoryCorruption(err)
+
+		k := prop.Value().(*ds.Key)
+		if k.LastTok().Special() || (kind != "" && k.Kind() != kind) {
+			return true
+		}
+		props := ret[k.Kind()]
+		if props == nil {
+			props = map[string]stringset.Set{}
+			ret[k.Kind()] = props
+		}
+		if !withProps {
+			return true
+		}
+
+		pm, err := rpm(iv)
+		memoryCorruption(err)
+		for name, pdata := range flattenEmbedded(pm) {
+			if name == "" || name[0] == '$' {
+				continue
+			}
+			for _, p := range pdata.Slice() {
+				if p.IndexSetting() == ds.NoIndex || p.Type() == ds.PTPropertyMap {
+					continue
+				}
+				reps := props[name]
+				if reps == nil {
+					reps = stringset.New(1)
+					props[name] = reps
+				}
+				reps.Add(propertyRepresentation(p))
+			}
+		}
+		return true
+	})
+	return ret
+}
+
+// propertyRepresentation returns the name of the representation of p in the
+// "property_representation" of "__property__" entities.
+func propertyRepresentation(p ds.Property) string {
+	switch t, _ := p.IndexTypeAndValue(); t {
+	case ds.PTNull:
+		return "NULL"
+	case ds.PTInt:
+		return "INT64"
+	case ds.PTBool:
+		return "BOOLEAN"
+	case ds.PTString:
+		return "STRING"
+	case ds.PTFloat:
+		return "DOUBLE"
+	case ds.PTGeoPoint:
+		return "POINT"
+	case ds.PTKey:
+		return "REFERENCE"
+	default:
+		impossible(fmt.Errorf("no representation for indexed type %s", t))
+		return ""
+	}
+}
+
+// sortedKinds returns the sorted kinds of props, as returned by kindProperties.
+func sortedKinds(props map[string]map[string]stringset.Set) []string {
+	ret := make([]string, 0, len(props))
+	for kind := range props {
+		ret = append(ret, kind)
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,251 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	ds "github.com/conchoid/gae/service/datastore"
+	"github.com/conchoid/gae/service/datastore/serialize"
+)
+
+// The kinds of the statistics entities maintained by refreshStats.
+const (
+	statTotalKind        = "__Stat_Total__"
+	statKindKind         = "__Stat_Kind__"
+	statPropertyTypeKind = "__Stat_PropertyType_Kind__"
+)
+
+// entityStats accumulates the statistics of a set of entities, or of a set of
+// property values.
+type entityStats struct {
+	count               int64
+	entityBytes         int64
+	builtinIndexCount   int64
+	builtinIndexBytes   int64
+	compositeIndexCount int64
+	compositeIndexBytes int64
+}
+
+func (s *entityStats) add(o *entityStats) {
+	s.count += o.count
+	s.entityBytes += o.entityBytes
+	s.builtinIndexCount += o.builtinIndexCount
+	s.builtinIndexBytes += o.builtinIndexBytes
+	s.compositeIndexCount += o.compositeIndexCount
+	s.compositeIndexBytes += o.compositeIndexBytes
+}
+
+// toPropertyMap returns the properties of the statistics entity for s,
+// computed at now. Property type statistics have no composite index
+// properties.
+func (s *entityStats) toPropertyMap(now time.Time, withComposite bool) ds.PropertyMap {
+	ret := ds.PropertyMap{
+		"bytes":               ds.MkProperty(s.entityBytes + s.builtinIndexBytes + s.compositeIndexBytes),
+		"count":               ds.MkProperty(s.count),
+		"timestamp":           ds.MkProperty(now),
+		"entity_bytes":        ds.MkProperty(s.entityBytes),
+		"builtin_index_bytes": ds.MkProperty(s.builtinIndexBytes),
+		"builtin_index_count": ds.MkProperty(s.builtinIndexCount),
+	}
+	if withComposite {
+		ret["composite_index_bytes"] = ds.MkProperty(s.compositeIndexBytes)
+		ret["composite_index_count"] = ds.MkProperty(s.compositeIndexCount)
+	}
+	return ret
+}
+
+// kindPropertyType identifies the statistics of the values of a property type
+// in the entities of a kind.
+type kindPropertyType struct {
+	kind         string
+	propertyType string
+}
+
+// refreshStats replaces the statistics entities of each namespace with the
+// statistics of its current entities, computed at now.
+func (d *dataStoreData) refreshStats(now time.Time) {
+	d.rwlock.Lock()
+	defer d.rwlock.Unlock()
+
+	snap := d.head.Snapshot()
+	compIdx := compoundIndexes(snap)
+	for _, ns := range namespaces(snap) {
+		ents := snap.GetCollection("ents:" + ns)
+		if ents == nil {
+			continue
+		}
+		kc := ds.MkKeyContext(d.aid, ns)
+
+		var old []*ds.Key
+		total := &entityStats{}
+		kinds := map[string]*entityStats{}
+		types := map[kindPropertyType]*entityStats{}
+		ents.ForEachItem(func(ik, iv []byte) bool {
+			prop, err := serialize.ReadProperty(bytes.NewBuffer(ik), serialize.WithoutContext, kc)
+			memoryCorruption(err)
+			k := prop.Value().(*ds.Key)
+
+			if kind := k.Kind(); kind == statTotalKind || kind == statKindKind || kind == statPropertyTypeKind {
+				old = append(old, k)
+				return true
+			}
+			if k.LastTok().Special() {
+				return true
+			}
+
+			pm, err := rpm(iv)
+			memoryCorruption(err)
+
+			es := entityStatsOf(k, pm, compIdx)
+			total.add(es)
+			if kinds[k.Kind()] == nil {
+				kinds[k.Kind()] = &entityStats{}
+			}
+			kinds[k.Kind()].add(es)
+
+			for kpt, ps := range propertyTypeStatsOf(k, pm) {
+				if types[kpt] == nil {
+					types[kpt] = &entityStats{}
+				}
+				types[kpt].add(ps)
+			}
+			return true
+		})
+
+		if len(old) > 0 {
+			impossible(d.delMulti(old, nil, true))
+		}
+		if total.count == 0 {
+			continue
+		}
+
+		keys := []*ds.Key{kc.MakeKey(statTotalKind, "total_entity_usage")}
+		vals := []ds.PropertyMap{total.toPropertyMap(now, true)}
+		for kind, ks := range kinds {
+			pm := ks.toPropertyMap(now, true)
+			pm["kind_name"] = ds.MkProperty(kind)
+			keys = append(keys, kc.MakeKey(statKindKind, kind))
+			vals = append(vals, pm)
+		}
+		for kpt, ts := range types {
+			pm := ts.toPropertyMap(now, false)
+			pm["kind_name"] = ds.MkProperty(kpt.kind)
+			pm["property_type"] = ds.MkProperty(kpt.propertyType)
+			keys = append(keys, kc.MakeKey(statPropertyTypeKind, kpt.propertyType+"_"+kpt.kind))
+			vals = append(vals, pm)
+		}
+		impossible(d.putMulti(keys, vals, nil, true))
+	}
+}
+
+// entityStatsOf returns the statistics of the entity (k, pm), whose composite
+// index rows are those of compIdx.
+func entityStatsOf(k *ds.Key, pm ds.PropertyMap, compIdx []*ds.IndexDefinition) *entityStats {
+	flat := flattenEmbedded(pm)
+	sip := serialize.PropertyMapPartially(k, flat)
+
+	ret := &entityStats{count: 1, entityBytes: k.EstimateSize() + pm.EstimateSize()}
+	ret.builtinIndexCount, ret.builtinIndexBytes = indexRows(indexEntries(k, sip, defaultIndexes(k.Kind(), flat)))
+	ret.compositeIndexCount, ret.compositeIndexBytes = indexRows(indexEntries(k, sip, compIdx))
+	return ret
+}
+
+// propertyTypeStatsOf returns the statistics of the property values of the
+// entity (k, pm), by property type.
+//
+// Each indexed value has an ascending and a descending builtin index row,
+// made of the value and of k.
+func propertyTypeStatsOf(k *ds.Key, pm ds.PropertyMap) map[kindPropertyType]*entityStats {
+	keySize := int64(len(keyBytes(k)))
+
+	ret := map[kindPropertyType]*entityStats{}
+	for name, pdata := range pm {
+		for _, p := range pdata.Slice() {
+			kpt := kindPropertyType{k.Kind(), statPropertyType(p)}
+			ps := ret[kpt]
+			if ps == nil {
+				ps = &entityStats{}
+				ret[kpt] = ps
+			}
+			ps.count++
+			ps.entityBytes += int64(len(name)) + p.EstimateSize()
+			if p.IndexSetting() == ds.ShouldIndex && p.Type() != ds.PTPropertyMap {
+				buf := &bytes.Buffer{}
+				memoryCorruption(serialize.WriteIndexProperty(buf, serialize.WithoutContext, p))
+				ps.builtinIndexCount += 2
+				ps.builtinIndexBytes += 2 * (int64(buf.Len()) + keySize)
+			}
+		}
+	}
+	return ret
+}
+
+// indexRows returns the number and the total size of the index rows in store,
+// as generated by indexEntries.
+func indexRows(store memStore) (count, size int64) {
+	for _, name := range store.GetCollectionNames() {
+		if !strings.HasPrefix(name, "idx:") {
+			continue
+		}
+		store.GetCollection(name).ForEachItem(func(k, _ []byte) bool {
+			count++
+			size += int64(len(k))
+			return true
+		})
+	}
+	return
+}
+
+// statPropertyType returns the "property_type" of the __Stat_PropertyType_Kind__
+// statistics of the values like p.
+func statPropertyType(p ds.Property) string {
+	switch p.Type() {
+	case ds.PTNull:
+		return "NULL"
+	case ds.PTInt:
+		return "Integer"
+	case ds.PTTime:
+		return "Date/Time"
+	case ds.PTBool:
+		return "Boolean"
+	case ds.PTString:
+		if p.IndexSetting() == ds.NoIndex {
+			return "Text"
+		}
+		return "String"
+	case ds.PTBytes:
+		if p.IndexSetting() == ds.NoIndex {
+			return "Blob"
+		}
+		return "ShortBlob"
+	case ds.PTFloat:
+		return "Float"
+	case ds.PTGeoPoint:
+		return "GeoPt"
+	case ds.PTKey:
+		return "Key"
+	case ds.PTBlobKey:
+		return "BlobKey"
+	case ds.PTPropertyMap:
+		return "Embedded Entity"
+	default:
+		impossible(fmt.Errorf("unknown property type %s", p.Type()))
+		return ""
+	}
+}
@@ -17,6 +17,7 @@ package memory
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -26,6 +27,9 @@ import (
 	"github.com/conchoid/gae/service/datastore/serialize"
 	infoS "github.com/conchoid/gae/service/info"
 
+	"go.chromium.org/luci/common/clock"
+	"go.chromium.org/luci/common/clock/testclock"
+
 	"golang.org/x/net/context"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -306,6 +310,20 @@ func TestDatastoreSingleReadWriter(t *testing.T) {
 					So(err, ShouldBeNil)
 				})
 
+				Convey("An ancestor query counts against your group count", func() {
+					err := ds.RunInTransaction(c, func(c context.Context) error {
+						So(ds.Get(c, &Foo{ID: 20}), ShouldEqual, ds.ErrNoSuchEntity)
+
+						var foos []*Foo
+						err := ds.GetAll(c, ds.NewQuery("Foo").Ancestor(k), &foos)
+						So(err, ShouldErrLike, "cross-group")
+						_, err = ds.Count(c, ds.NewQuery("Foo").Ancestor(k))
+						So(err, ShouldErrLike, "cross-group")
+						return nil
+					}, nil)
+					So(err, ShouldBeNil)
+				})
+
 				Convey("Get takes a snapshot", func() {
 					err := ds.RunInTransaction(c, func(c context.Context) error {
 						So(ds.Get(c, f), ShouldBeNil)
@@ -547,6 +565,59 @@ func TestDatastoreSingleReadWriter(t *testing.T) {
 						}, nil).Error(), ShouldEqual, "omg")
 						So(calls, ShouldEqual, 1)
 					})
+
+					Convey("RetryPolicy is consulted between attempts", func() {
+						tst.SetTransactionRetryCount(100)
+						calls := 0
+						var failures []int
+						policy := retryPolicyFunc(func(failed int) (time.Duration, bool) {
+							failures = append(failures, failed)
+							return 0, failed < 2
+						})
+						So(ds.RunInTransaction(c, func(c context.Context) error {
+							calls++
+							return nil
+						}, &ds.TransactionOptions{Attempts: 5, RetryPolicy: policy}), ShouldEqual, ds.ErrConcurrentTransaction)
+						So(calls, ShouldEqual, 2)
+						So(failures, ShouldResemble, []int{1, 2})
+					})
+				})
+
+				Convey("Read-only transactions", func() {
+					opts := &ds.TransactionOptions{ReadOnly: true}
+
+					Convey("can read", func() {
+						f := &Foo{ID: 1}
+						So(ds.RunInTransaction(c, func(c context.Context) error {
+							return ds.Get(c, f)
+						}, opts), ShouldBeNil)
+						So(f.Val, ShouldEqual, 10)
+					})
+
+					Convey("can't Put or Delete", func() {
+						So(ds.RunInTransaction(c, func(c context.Context) error {
+							So(ds.Put(c, &Foo{ID: 1, Val: 200}), ShouldEqual, ds.ErrReadOnlyTransaction)
+							So(ds.Delete(c, ds.KeyForObj(c, &Foo{ID: 1})), ShouldEqual, ds.ErrReadOnlyTransaction)
+							return nil
+						}, opts), ShouldBeNil)
+
+						f := &Foo{ID: 1}
+						So(ds.Get(c, f), ShouldBeNil)
+						So(f.Val, ShouldEqual, 10)
+					})
+
+					Convey("don't contend", func() {
+						tst := ds.GetTestable(c)
+						tst.SetTransactionRetryCount(100)
+						defer tst.SetTransactionRetryCount(0)
+
+						calls := 0
+						So(ds.RunInTransaction(c, func(c context.Context) error {
+							calls++
+							return ds.Get(c, &Foo{ID: 1})
+						}, opts), ShouldBeNil)
+						So(calls, ShouldEqual, 1)
+					})
 				})
 			})
 		})
@@ -606,6 +677,103 @@ func TestDatastoreSingleReadWriter(t *testing.T) {
 			So(count, ShouldEqual, 1) // normally this would include __entity_group__
 		})
 
+		Convey("Testable.SetEntityGroupWriteRate", func() {
+			c, tc := testclock.UseTime(c, testclock.TestRecentTimeUTC)
+			ds.GetTestable(c).SetEntityGroupWriteRate(2, time.Second)
+
+			So(ds.Put(c, &Foo{ID: 1}), ShouldBeNil)
+			So(ds.Delete(c, ds.KeyForObj(c, &Foo{ID: 1})), ShouldBeNil)
+
+			Convey("rejects writes above the rate", func() {
+				So(ds.Put(c, &Foo{ID: 1}), ShouldEqual, ds.ErrConcurrentTransaction)
+				So(ds.RunInTransaction(c, func(c context.Context) error {
+					return ds.Put(c, &Foo{ID: 1, Val: 2})
+				}, nil), ShouldEqual, ds.ErrConcurrentTransaction)
+
+				// Other entity groups are unaffected.
+				So(ds.Put(c, &Foo{ID: 2}), ShouldBeNil)
+				So(ds.Put(c, &Foo{}), ShouldBeNil)
+			})
+
+			Convey("accepts writes once the rate goes down", func() {
+				tc.Add(time.Second)
+				So(ds.Put(c, &Foo{ID: 1}), ShouldBeNil)
+			})
+
+			Convey("lets transactions succeed with a RetryPolicy", func() {
+				tc.SetTimerCallback(func(d time.Duration, t clock.Timer) { tc.Add(d) })
+				So(ds.RunInTransaction(c, func(c context.Context) error {
+					return ds.Put(c, &Foo{ID: 1, Val: 2})
+				}, &ds.TransactionOptions{RetryPolicy: &ds.ExponentialBackoff{Delay: time.Second}}), ShouldBeNil)
+				So(clock.Now(c).Sub(testclock.TestRecentTimeUTC), ShouldBeGreaterThanOrEqualTo, time.Second)
+			})
+
+			Convey("reads are unaffected", func() {
+				So(ds.RunInTransaction(c, func(c context.Context) error {
+					So(ds.Get(c, &Foo{ID: 1}), ShouldEqual, ds.ErrNoSuchEntity)
+					return nil
+				}, nil), ShouldBeNil)
+			})
+		})
+
+		Convey("Production constraints", func() {
+			put := func(c context.Context, pm ds.PropertyMap) error {
+				pm["$key"] = ds.MkPropertyNI(ds.MakeKey(c, "Big", 1))
+				return ds.Put(c, pm)
+			}
+			long := strings.Repeat("X", 1501)
+
+			Convey("reject indexed values which are too long", func() {
+				So(put(c, ds.PropertyMap{"Val": ds.MkProperty(long)}),
+					ShouldErrLike, `The value of property "Val" is longer than 1500 bytes.`)
+				So(put(c, ds.PropertyMap{"Val": ds.MkProperty([]byte(long))}),
+					ShouldErrLike, `The value of property "Val" is longer than 1500 bytes.`)
+				So(put(c, ds.PropertyMap{"Val": ds.MkPropertyNI(long)}), ShouldBeNil)
+			})
+
+			Convey("reject entities which are too big", func() {
+				pm := ds.PropertyMap{"Val": ds.MkPropertyNI(strings.Repeat("X", 1<<20))}
+				So(put(c, pm), ShouldErrLike, "entity is too big")
+				So(ds.RunInTransaction(c, func(c context.Context) error {
+					return put(c, pm)
+				}, nil), ShouldErrLike, "entity is too big")
+			})
+
+			Convey("reject entities with too many index entries", func() {
+				ds.GetTestable(c).AddIndexes(&ds.IndexDefinition{
+					Kind:   "Big",
+					SortBy: []ds.IndexColumn{{Property: "A"}, {Property: "B"}, {Property: "C"}},
+				})
+				// 28*28*28 = 21952 entries in the compound index.
+				vals := make(ds.PropertySlice, 28)
+				for i := range vals {
+					vals[i] = ds.MkProperty(i)
+				}
+				pm := ds.PropertyMap{"A": vals, "B": vals, "C": vals}
+				So(put(c, pm), ShouldErrLike, "Too many indexed properties for entity")
+
+				pm = ds.PropertyMap{"A": vals, "B": vals, "C": vals[:25]}
+				So(put(c, pm), ShouldBeNil)
+			})
+
+			Convey("reject keys which are too deep", func() {
+				toks := make([]interface{}, 0, 202)
+				for i := 1; i <= 101; i++ {
+					toks = append(toks, "Deep", i)
+				}
+				deep := ds.MakeKey(c, toks...)
+				So(ds.Put(c, ds.PropertyMap{"$key": ds.MkPropertyNI(deep)}),
+					ShouldErrLike, "has more than 100 path elements")
+				So(ds.Put(c, ds.PropertyMap{"$key": ds.MkPropertyNI(deep.Parent())}), ShouldBeNil)
+			})
+
+			Convey("can be changed with SetConstraints", func() {
+				So(ds.GetTestable(c).SetConstraints(&ds.Constraints{MaxIndexedPropertySize: 2000}), ShouldBeNil)
+				So(put(c, ds.PropertyMap{"Val": ds.MkProperty(long)}), ShouldBeNil)
+				So(put(c, ds.PropertyMap{"Val": ds.MkPropertyNI(strings.Repeat("X", 1<<20))}), ShouldBeNil)
+			})
+		})
+
 		Convey("Datastore namespace interaction", func() {
 			run := func(rc context.Context, txn bool) (putErr, getErr, queryErr, countErr error) {
 				var foo Foo
@@ -879,3 +1047,636 @@ func TestConcurrentTxn(t *testing.T) {
 		}
 	})
 }
+
+func TestAggregate(t *testing.T) {
+	t.Parallel()
+
+	Convey("Aggregate", t, func() {
+		type Model struct {
+			ID    int64 `gae:"$id"`
+			Color string
+			Size  int64
+			Score []float64
+		}
+
+		c := Use(context.Background())
+		testing := ds.GetTestable(c)
+		testing.Consistent(true)
+		testing.AutoIndex(true)
+
+		So(ds.Put(c, []*Model{
+			{1, "red", 1, []float64{0.5}},
+			{2, "red", 2, []float64{1.5, 2.5}},
+			{3, "blue", 3, nil},
+			{4, "green", 4, []float64{3.5}},
+		}), ShouldBeNil)
+
+		aggregate := func(q *ds.Query, aggs ...*ds.Aggregation) []interface{} {
+			vals, err := ds.Aggregate(c, q, aggs...)
+			So(err, ShouldBeNil)
+			ret := make([]interface{}, len(vals))
+			for i, v := range vals {
+				ret[i] = v.Value()
+			}
+			return ret
+		}
+
+		Convey("computes counts, sums and averages", func() {
+			So(aggregate(ds.NewQuery("Model"), ds.CountAll(), ds.Sum("Size"), ds.Avg("Size"), ds.Sum("Score"), ds.Avg("Score")),
+				ShouldResemble, []interface{}{int64(4), int64(10), 2.5, 8.0, 2.0})
+		})
+
+		Convey("respects filters and limits", func() {
+			So(aggregate(ds.NewQuery("Model").Gt("Size", 1), ds.CountAll(), ds.Sum("Size")),
+				ShouldResemble, []interface{}{int64(3), int64(9)})
+			So(aggregate(ds.NewQuery("Model").Eq("Color", "red"), ds.CountAll(), ds.Avg("Score")),
+				ShouldResemble, []interface{}{int64(2), 1.5})
+			So(aggregate(ds.NewQuery("Model").Limit(2), ds.CountAll(), ds.Sum("Size")),
+				ShouldResemble, []interface{}{int64(2), int64(3)})
+		})
+
+		Convey("works with fields that can't be projected", func() {
+			So(aggregate(ds.NewQuery("Model").Eq("Size", 2), ds.Sum("Size")),
+				ShouldResemble, []interface{}{int64(2)})
+			So(aggregate(ds.NewQuery("Model").In("Color", "red", "blue"), ds.CountAll(), ds.Sum("Size")),
+				ShouldResemble, []interface{}{int64(3), int64(6)})
+		})
+
+		Convey("ignores unindexed values, with or without a limit", func() {
+			So(ds.Put(c, []ds.PropertyMap{
+				{"$key": ds.MkPropertyNI(ds.MakeKey(c, "Mixed", 1)), "Size": ds.MkProperty(1)},
+				{"$key": ds.MkPropertyNI(ds.MakeKey(c, "Mixed", 2)), "Size": ds.MkPropertyNI(10)},
+				{"$key": ds.MkPropertyNI(ds.MakeKey(c, "Mixed", 3)), "Size": ds.PropertySlice{
+					ds.MkProperty(2), ds.MkPropertyNI(20)}},
+			}), ShouldBeNil)
+
+			So(aggregate(ds.NewQuery("Mixed"), ds.Sum("Size"), ds.Avg("Size")),
+				ShouldResemble, []interface{}{int64(3), 1.5})
+			So(aggregate(ds.NewQuery("Mixed").Limit(3), ds.Sum("Size"), ds.Avg("Size")),
+				ShouldResemble, []interface{}{int64(3), 1.5})
+		})
+
+		Convey("works in transactions", func() {
+			testing.AddIndexes(&ds.IndexDefinition{
+				Kind:     "Model",
+				Ancestor: true,
+				SortBy:   []ds.IndexColumn{{Property: "Score"}},
+			})
+			err := ds.RunInTransaction(c, func(c context.Context) error {
+				vals, err := ds.Aggregate(c, ds.NewQuery("Model").Ancestor(ds.MakeKey(c, "Model", 2)), ds.Sum("Score"))
+				So(err, ShouldBeNil)
+				So(vals[0].Value(), ShouldEqual, 4.0)
+				return nil
+			}, nil)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("handles empty results", func() {
+			So(aggregate(ds.NewQuery("Model").Eq("Color", "purple"), ds.CountAll(), ds.Sum("Size"), ds.Avg("Size")),
+				ShouldResemble, []interface{}{int64(0), int64(0), nil})
+			So(aggregate(ds.NewQuery("Model").Gt("Size", 5).Lt("Size", 2), ds.Avg("Size")),
+				ShouldResemble, []interface{}{nil})
+		})
+
+		Convey("rejects bad aggregations", func() {
+			_, err := ds.Aggregate(c, ds.NewQuery("Model"))
+			So(err, ShouldErrLike, "without aggregations")
+			_, err = ds.Aggregate(c, ds.NewQuery("Model"), ds.Sum(""))
+			So(err, ShouldErrLike, "without a field")
+			_, err = ds.Aggregate(c, ds.NewQuery("Model").Project("Size"), ds.CountAll())
+			So(err, ShouldErrLike, "projection query")
+		})
+	})
+}
+
+func TestEmbeddedEntities(t *testing.T) {
+	t.Parallel()
+
+	Convey("Embedded entities", t, func() {
+		type Address struct {
+			City string
+			Zip  string `gae:",noindex"`
+		}
+		type Person struct {
+			ID      int64     `gae:"$id"`
+			Home    Address   `gae:",entity"`
+			Old     []Address `gae:",entity"`
+			Private *Address  `gae:",entity,noindex"`
+		}
+
+		c := Use(context.Background())
+		testing := ds.GetTestable(c)
+		testing.Consistent(true)
+		testing.AutoIndex(true)
+
+		So(ds.Put(c, []*Person{
+			{ID: 1, Home: Address{"Paris", "75001"}, Old: []Address{{City: "Lyon"}, {City: "Nice"}}},
+			{ID: 2, Home: Address{"Lyon", "69001"}, Private: &Address{City: "Paris"}},
+		}), ShouldBeNil)
+
+		ids := func(q *ds.Query) []int64 {
+			var people []*Person
+			So(ds.GetAll(c, q, &people), ShouldBeNil)
+			ret := make([]int64, len(people))
+			for i, p := range people {
+				ret[i] = p.ID
+			}
+			return ret
+		}
+
+		Convey("round trip", func() {
+			p := &Person{ID: 2}
+			So(ds.Get(c, p), ShouldBeNil)
+			So(p, ShouldResemble, &Person{ID: 2, Home: Address{"Lyon", "69001"}, Private: &Address{City: "Paris"}})
+		})
+
+		Convey("indexed sub-properties can be queried", func() {
+			So(ids(ds.NewQuery("Person").Eq("Home.City", "Paris")), ShouldResemble, []int64{1})
+			So(ids(ds.NewQuery("Person").Eq("Old.City", "Lyon")), ShouldResemble, []int64{1})
+			So(ids(ds.NewQuery("Person").Gte("Home.City", "L").Order("Home.City")), ShouldResemble, []int64{2, 1})
+		})
+
+		Convey("unindexed sub-properties can't", func() {
+			So(ids(ds.NewQuery("Person").Eq("Home.Zip", "75001")), ShouldBeEmpty)
+			So(ids(ds.NewQuery("Person").Eq("Private.City", "Paris")), ShouldBeEmpty)
+		})
+
+		Convey("embedded entities can't be filtered on directly", func() {
+			So(ds.GetAll(c, ds.NewQuery("Person").Eq("Home", ds.PropertyMap{}), &[]*Person{}),
+				ShouldErrLike, "cannot filter on an embedded entity")
+		})
+	})
+}
+
+func TestEncryptedFields(t *testing.T) {
+	t.Parallel()
+
+	Convey("Encrypted fields", t, func() {
+		type Account struct {
+			ID    int64 `gae:"$id"`
+			Name  string
+			Token string `gae:",encrypted"`
+		}
+
+		keys := map[string][]byte{
+			"v1": []byte("0123456789abcdef"),
+			"v2": []byte("fedcba9876543210"),
+		}
+		v1, err := ds.NewAESGCMProvider(keys, "v1")
+		So(err, ShouldBeNil)
+		v2, err := ds.NewAESGCMProvider(keys, "v2")
+		So(err, ShouldBeNil)
+
+		c := Use(ds.SetEncryptionProvider(context.Background(), v1))
+		ds.GetTestable(c).Consistent(true)
+
+		So(ds.Put(c, []*Account{{1, "a", "secret-a"}, {2, "b", "secret-b"}, {3, "c", ""}}), ShouldBeNil)
+
+		Convey("are stored encrypted", func() {
+			pm := ds.PropertyMap{"$id": propNI(1), "$kind": propNI("Account")}
+			So(ds.Get(c, pm), ShouldBeNil)
+			So(pm.Slice("Token")[0].Value(), ShouldNotResemble, []byte("secret-a"))
+
+			a := &Account{ID: 1}
+			So(ds.Get(c, a), ShouldBeNil)
+			So(a.Token, ShouldEqual, "secret-a")
+		})
+
+		Convey("are rewritten onto a new key by ReEncrypt", func() {
+			c = ds.SetEncryptionProvider(c, v2)
+
+			n, err := ds.ReEncrypt(c, ds.NewQuery("Account"))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 3)
+
+			// The new key alone is enough to read them now.
+			v2only, err := ds.NewAESGCMProvider(map[string][]byte{"v2": keys["v2"]}, "v2")
+			So(err, ShouldBeNil)
+			c = ds.SetEncryptionProvider(c, v2only)
+
+			var accounts []*Account
+			So(ds.GetAll(c, ds.NewQuery("Account"), &accounts), ShouldBeNil)
+			So(accounts, ShouldResemble, []*Account{{1, "a", "secret-a"}, {2, "b", "secret-b"}, {3, "c", ""}})
+
+			n, err = ds.ReEncrypt(c, ds.NewQuery("Account"))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestVersionedEntities(t *testing.T) {
+	t.Parallel()
+
+	Convey("Entities with a $version field", t, func() {
+		type Counter struct {
+			ID      int64 `gae:"$id"`
+			Version int64 `gae:"$version"`
+			Count   int64
+		}
+
+		c := Use(context.Background())
+		ds.GetTestable(c).Consistent(true)
+
+		ctr := &Counter{ID: 1}
+		So(ds.Put(c, ctr), ShouldBeNil)
+		So(ctr.Version, ShouldEqual, 1)
+
+		Convey("load their stored version", func() {
+			loaded := &Counter{ID: 1}
+			So(ds.Get(c, loaded), ShouldBeNil)
+			So(loaded, ShouldResemble, ctr)
+
+			var all []*Counter
+			So(ds.GetAll(c, ds.NewQuery("Counter"), &all), ShouldBeNil)
+			So(all, ShouldResemble, []*Counter{ctr})
+
+			pm := ds.PropertyMap{"$id": propNI(1), "$kind": propNI("Counter")}
+			So(ds.Get(c, pm), ShouldBeNil)
+			So(pm.Slice("$version"), ShouldResemble, ds.PropertySlice{propNI(1)})
+			So(pm, ShouldNotContainKey, ds.VersionProperty)
+		})
+
+		Convey("fail to overwrite a newer version", func() {
+			stale := &Counter{ID: 1}
+			So(ds.Get(c, stale), ShouldBeNil)
+
+			ctr.Count++
+			So(ds.Put(c, ctr), ShouldBeNil)
+			So(ctr.Version, ShouldEqual, 2)
+
+			stale.Count += 10
+			err := ds.Put(c, stale)
+			So(err, ShouldResemble, &ds.ErrVersionConflict{
+				Key: ds.KeyForObj(c, stale), Expected: 1, Stored: 2})
+			So(stale.Version, ShouldEqual, 1)
+
+			So(ds.Get(c, stale), ShouldBeNil)
+			So(stale, ShouldResemble, ctr)
+		})
+
+		Convey("fail to create an entity which already exists", func() {
+			So(ds.Put(c, &Counter{ID: 1}), ShouldHaveSameTypeAs, &ds.ErrVersionConflict{})
+		})
+
+		Convey("are checked in the current transaction", func() {
+			So(ds.RunInTransaction(c, func(c context.Context) error {
+				return ds.Put(c, &Counter{ID: 1})
+			}, nil), ShouldHaveSameTypeAs, &ds.ErrVersionConflict{})
+		})
+
+		Convey("can be mixed with plain entities", func() {
+			foo := &Foo{ID: 1, Val: 2}
+			So(ds.Put(c, []interface{}{foo, &Counter{ID: 2}, ctr}), ShouldBeNil)
+			So(ctr.Version, ShouldEqual, 2)
+			So(ds.Get(c, &Foo{ID: 1}), ShouldBeNil)
+		})
+	})
+}
+
+func TestPaginate(t *testing.T) {
+	t.Parallel()
+
+	Convey("Paginate", t, func() {
+		type Item struct {
+			ID    int64 `gae:"$id"`
+			Group string
+		}
+
+		c := Use(context.Background())
+		ds.GetTestable(c).Consistent(true)
+		ds.GetTestable(c).AutoIndex(true)
+
+		var items []*Item
+		for i := 1; i <= 7; i++ {
+			items = append(items, &Item{ID: int64(i), Group: []string{"a", "b"}[i%2]})
+		}
+		So(ds.Put(c, items), ShouldBeNil)
+
+		page := func(q *ds.Query, token string) (ids []int64, p ds.Page) {
+			var got []*Item
+			p, err := ds.Paginate(c, q, 3, token, &got)
+			So(err, ShouldBeNil)
+			for _, it := range got {
+				ids = append(ids, it.ID)
+			}
+			return
+		}
+
+		Convey("pages forwards and backwards by key", func() {
+			q := ds.NewQuery("Item")
+
+			ids, p1 := page(q, "")
+			So(ids, ShouldResemble, []int64{1, 2, 3})
+			So(p1.Prev, ShouldEqual, "")
+
+			ids, p2 := page(q, p1.Next)
+			So(ids, ShouldResemble, []int64{4, 5, 6})
+
+			ids, p3 := page(q, p2.Next)
+			So(ids, ShouldResemble, []int64{7})
+			So(p3.Next, ShouldEqual, "")
+
+			ids, p := page(q, p3.Prev)
+			So(ids, ShouldResemble, []int64{4, 5, 6})
+			ids, p = page(q, p.Prev)
+			So(ids, ShouldResemble, []int64{1, 2, 3})
+			So(p.Prev, ShouldEqual, "")
+			ids, _ = page(q, p.Next)
+			So(ids, ShouldResemble, []int64{4, 5, 6})
+
+			Convey("in descending order", func() {
+				q := q.Order("-__key__")
+
+				ids, p1 := page(q, "")
+				So(ids, ShouldResemble, []int64{7, 6, 5})
+				ids, p2 := page(q, p1.Next)
+				So(ids, ShouldResemble, []int64{4, 3, 2})
+				ids, _ = page(q, p2.Prev)
+				So(ids, ShouldResemble, []int64{7, 6, 5})
+			})
+		})
+
+		Convey("pages forwards by cursor", func() {
+			q := ds.NewQuery("Item").Order("Group")
+
+			ids, p1 := page(q, "")
+			So(ids, ShouldResemble, []int64{2, 4, 6})
+			So(p1.Prev, ShouldEqual, "")
+
+			ids, p2 := page(q, p1.Next)
+			So(ids, ShouldResemble, []int64{1, 3, 5})
+			So(p2.Prev, ShouldEqual, "")
+
+			ids, p3 := page(q, p2.Next)
+			So(ids, ShouldResemble, []int64{7})
+			So(p3.Next, ShouldEqual, "")
+		})
+
+		Convey("applies the offset before the first page only", func() {
+			q := ds.NewQuery("Item").Offset(2)
+
+			ids, p1 := page(q, "")
+			So(ids, ShouldResemble, []int64{3, 4, 5})
+			So(p1.Prev, ShouldEqual, "")
+
+			ids, p2 := page(q, p1.Next)
+			So(ids, ShouldResemble, []int64{6, 7})
+			So(p2.Next, ShouldEqual, "")
+
+			ids, p := page(q, p2.Prev)
+			So(ids, ShouldResemble, []int64{3, 4, 5})
+			So(p.Prev, ShouldEqual, "")
+
+			Convey("by cursor", func() {
+				q := q.Order("Group")
+
+				ids, p1 := page(q, "")
+				So(ids, ShouldResemble, []int64{6, 1, 3})
+
+				ids, p2 := page(q, p1.Next)
+				So(ids, ShouldResemble, []int64{5, 7})
+				So(p2.Next, ShouldEqual, "")
+			})
+		})
+
+		Convey("pages keys", func() {
+			var keys []*ds.Key
+			p, err := ds.Paginate(c, ds.NewQuery("Item"), 3, "", &keys)
+			So(err, ShouldBeNil)
+			So(keys, ShouldHaveLength, 3)
+			So(keys[0], ShouldResemble, ds.KeyForObj(c, items[0]))
+			So(p.Next, ShouldNotEqual, "")
+		})
+
+		Convey("rejects tokens of other queries", func() {
+			_, p := page(ds.NewQuery("Item"), "")
+			_, err := ds.Paginate(c, ds.NewQuery("Item").Eq("Group", "a"), 3, p.Next, &[]*Item{})
+			So(err, ShouldEqual, ds.ErrInvalidPageToken)
+
+			_, err = ds.Paginate(infoS.MustNamespace(c, "other"), ds.NewQuery("Item"), 3, p.Next, &[]*Item{})
+			So(err, ShouldEqual, ds.ErrInvalidPageToken)
+		})
+
+		Convey("rejects tampered tokens", func() {
+			_, p := page(ds.NewQuery("Item"), "")
+			tampered := "x" + p.Next[1:]
+			if tampered == p.Next {
+				tampered = "y" + p.Next[1:]
+			}
+			_, err := ds.Paginate(c, ds.NewQuery("Item"), 3, tampered, &[]*Item{})
+			So(err, ShouldEqual, ds.ErrInvalidPageToken)
+
+			_, err = ds.Paginate(ds.SetPageTokenSecret(c, []byte("other")), ds.NewQuery("Item"), 3, p.Next, &[]*Item{})
+			So(err, ShouldEqual, ds.ErrInvalidPageToken)
+		})
+	})
+}
+
+func TestSplitQuery(t *testing.T) {
+	t.Parallel()
+
+	Convey("SplitQuery", t, func() {
+		type Item struct {
+			ID     int64   `gae:"$id"`
+			Parent *ds.Key `gae:"$parent"`
+		}
+
+		c := Use(context.Background())
+		ds.GetTestable(c).Consistent(true)
+
+		parent := ds.MakeKey(c, "Parent", 1)
+		var items []*Item
+		for i := 1; i <= 100; i++ {
+			it := &Item{ID: int64(i)}
+			if i > 60 {
+				it.Parent = parent
+			}
+			items = append(items, it)
+		}
+		So(ds.Put(c, items), ShouldBeNil)
+
+		run := func(c context.Context, q *ds.Query, shards int) (sizes []int, total int) {
+			qs, err := ds.SplitQuery(c, q, shards)
+			So(err, ShouldBeNil)
+			seen := map[string]bool{}
+			for _, q := range qs {
+				var keys []*ds.Key
+				So(ds.GetAll(c, q, &keys), ShouldBeNil)
+				for _, k := range keys {
+					So(seen[k.String()], ShouldBeFalse)
+					seen[k.String()] = true
+				}
+				sizes = append(sizes, len(keys))
+			}
+			return sizes, len(seen)
+		}
+
+		Convey("splits a kind into even key ranges", func() {
+			sizes, total := run(c, ds.NewQuery("Item"), 4)
+			So(total, ShouldEqual, 100)
+			So(sizes, ShouldResemble, []int{25, 25, 25, 25})
+		})
+
+		Convey("splits ancestor queries", func() {
+			sizes, total := run(c, ds.NewQuery("Item").Ancestor(parent), 4)
+			So(total, ShouldEqual, 40)
+			So(sizes, ShouldResemble, []int{10, 10, 10, 10})
+		})
+
+		Convey("keeps existing key bounds", func() {
+			q := ds.NewQuery("Item").Gte("__key__", ds.MakeKey(c, "Item", 51))
+			_, total := run(c, q, 4)
+			So(total, ShouldEqual, 50)
+		})
+
+		Convey("returns the split keys", func() {
+			splits, err := ds.SplitKeys(c, ds.NewQuery("Item"), 4)
+			So(err, ShouldBeNil)
+			So(splits, ShouldHaveLength, 3)
+
+			qs, err := ds.SplitQuery(c, ds.NewQuery("Item"), 4)
+			So(err, ShouldBeNil)
+			So(qs, ShouldHaveLength, 4)
+			for i, k := range splits {
+				var keys []*ds.Key
+				So(ds.GetAll(c, qs[i+1].Limit(1), &keys), ShouldBeNil)
+				So(keys, ShouldResemble, []*ds.Key{k})
+			}
+		})
+
+		Convey("returns fewer queries when there are few entities", func() {
+			qs, err := ds.SplitQuery(c, ds.NewQuery("Item").Ancestor(ds.MakeKey(c, "Parent", 2)), 4)
+			So(err, ShouldBeNil)
+			So(qs, ShouldHaveLength, 1)
+		})
+
+		Convey("works in namespaces", func() {
+			nc := infoS.MustNamespace(c, "ns")
+			So(ds.Put(nc, items[:8]), ShouldBeNil)
+			sizes, total := run(nc, ds.NewQuery("Item"), 2)
+			So(total, ShouldEqual, 8)
+			So(sizes, ShouldResemble, []int{4, 4})
+		})
+
+		Convey("rejects queries which aren't ordered by key", func() {
+			_, err := ds.SplitQuery(c, ds.NewQuery("Item").Order("Foo"), 4)
+			So(err, ShouldErrLike, "ordered by key")
+		})
+	})
+}
+
+func TestRefreshStats(t *testing.T) {
+	t.Parallel()
+
+	Convey("Testable.RefreshStats", t, func() {
+		c, _ := testclock.UseTime(Use(context.Background()), testclock.TestRecentTimeUTC)
+		testable := ds.GetTestable(c)
+		testable.AddIndexes(&ds.IndexDefinition{
+			Kind:   "Apple",
+			SortBy: []ds.IndexColumn{{Property: "Name"}, {Property: "Color"}},
+		})
+
+		ents := []ds.PropertyMap{
+			{
+				"$key":  ds.MkPropertyNI(ds.MakeKey(c, "Apple", 1)),
+				"Name":  ds.MkProperty("gala"),
+				"Color": ds.MkProperty("red"),
+				"Notes": ds.MkPropertyNI("sweet"),
+			},
+			{
+				"$key":  ds.MkPropertyNI(ds.MakeKey(c, "Apple", 2)),
+				"Name":  ds.MkProperty("granny smith"),
+				"Color": ds.MkProperty("green"),
+				"Notes": ds.MkPropertyNI("sour"),
+			},
+			{
+				"$key":   ds.MkPropertyNI(ds.MakeKey(c, "Pear", 1)),
+				"Weight": ds.MkProperty(180),
+			},
+		}
+		So(ds.Put(c, ents), ShouldBeNil)
+
+		entityBytes := int64(0)
+		for _, pm := range ents {
+			data, _ := pm.Save(false)
+			entityBytes += ds.KeyForObj(c, pm).EstimateSize() + data.EstimateSize()
+		}
+
+		refresh := func() {
+			testable.RefreshStats()
+			testable.CatchupIndexes()
+		}
+		get := func(kind, id string) ds.PropertyMap {
+			pm := ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(c, kind, id))}
+			So(ds.Get(c, pm), ShouldBeNil)
+			return pm
+		}
+		val := func(pm ds.PropertyMap, name string) interface{} {
+			return pm.Slice(name)[0].Value()
+		}
+
+		refresh()
+
+		Convey("computes __Stat_Total__", func() {
+			total := get("__Stat_Total__", "total_entity_usage")
+			So(val(total, "count"), ShouldEqual, 3)
+			So(val(total, "entity_bytes"), ShouldEqual, entityBytes)
+			// A kind row per entity, and 2 rows per indexed value.
+			So(val(total, "builtin_index_count"), ShouldEqual, 3+2*5)
+			So(val(total, "composite_index_count"), ShouldEqual, 2)
+			So(val(total, "timestamp"), ShouldResemble, ds.RoundTime(testclock.TestRecentTimeUTC))
+			So(val(total, "bytes"), ShouldEqual, entityBytes+
+				val(total, "builtin_index_bytes").(int64)+val(total, "composite_index_bytes").(int64))
+
+			Convey("which doesn't count the statistics entities", func() {
+				refresh()
+				So(val(get("__Stat_Total__", "total_entity_usage"), "count"), ShouldEqual, 3)
+			})
+		})
+
+		Convey("computes __Stat_Kind__", func() {
+			var kinds []string
+			var counts []int64
+			So(ds.Run(c, ds.NewQuery("__Stat_Kind__").Order("-count"), func(pm ds.PropertyMap) {
+				kinds = append(kinds, val(pm, "kind_name").(string))
+				counts = append(counts, val(pm, "count").(int64))
+			}), ShouldBeNil)
+			So(kinds, ShouldResemble, []string{"Apple", "Pear"})
+			So(counts, ShouldResemble, []int64{2, 1})
+
+			apple := get("__Stat_Kind__", "Apple")
+			So(val(apple, "builtin_index_count"), ShouldEqual, 2+2*4)
+			So(val(apple, "composite_index_count"), ShouldEqual, 2)
+
+			Convey("and removes the statistics of deleted kinds", func() {
+				So(ds.Delete(c, ds.MakeKey(c, "Pear", 1)), ShouldBeNil)
+				refresh()
+				So(ds.Get(c, ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(c, "__Stat_Kind__", "Pear"))}),
+					ShouldEqual, ds.ErrNoSuchEntity)
+			})
+		})
+
+		Convey("computes __Stat_PropertyType_Kind__", func() {
+			str := get("__Stat_PropertyType_Kind__", "String_Apple")
+			So(val(str, "kind_name"), ShouldEqual, "Apple")
+			So(val(str, "property_type"), ShouldEqual, "String")
+			So(val(str, "count"), ShouldEqual, 4)
+			So(val(str, "builtin_index_count"), ShouldEqual, 8)
+
+			text := get("__Stat_PropertyType_Kind__", "Text_Apple")
+			So(val(text, "count"), ShouldEqual, 2)
+			So(val(text, "builtin_index_count"), ShouldEqual, 0)
+			So(val(text, "entity_bytes"), ShouldEqual, 2*len("Notes")+(1+len("sweet"))+(1+len("sour")))
+
+			So(val(get("__Stat_PropertyType_Kind__", "Integer_Pear"), "count"), ShouldEqual, 1)
+		})
+	})
+}
+
+// retryPolicyFunc is a ds.RetryPolicy implemented by a function.
+type retryPolicyFunc func(failed int) (time.Duration, bool)
+
+func (f retryPolicyFunc) Next(c context.Context, failed int, elapsed time.Duration) (time.Duration, bool) {
+	return f(failed)
+}
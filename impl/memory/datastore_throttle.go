@@ -0,0 +1,114 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"sync"
+	"time"
+
+	ds "github.com/conchoid/gae/service/datastore"
+)
+
+// writeThrottle simulates the contention of entity groups which are written
+// too often: it rejects the writes to an entity group which was already
+// written to `writes` times during the last `period`. The zero value admits
+// all writes.
+type writeThrottle struct {
+	lock   sync.Mutex
+	writes int
+	period time.Duration
+
+	// The times of the recent writes to each entity group, oldest first, keyed
+	// by the encoded root key of the group.
+	recent map[string][]time.Time
+}
+
+func (t *writeThrottle) set(writes int, period time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.writes, t.period, t.recent = writes, period, nil
+}
+
+// admit records a write at now to the entity groups with the encoded root
+// keys roots, and returns true. If any of the groups was written to too often,
+// it records nothing and returns false instead.
+func (t *writeThrottle) admit(now time.Time, roots ...string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.writes <= 0 {
+		return true
+	}
+	for _, rk := range roots {
+		if len(t.pruneLocked(now, rk)) >= t.writes {
+			return false
+		}
+	}
+	if t.recent == nil {
+		t.recent = map[string][]time.Time{}
+	}
+	for _, rk := range roots {
+		t.recent[rk] = append(t.recent[rk], now)
+	}
+	return true
+}
+
+// pruneLocked forgets the writes to the entity group rk which happened more
+// than t.period before now, and returns the remaining ones.
+func (t *writeThrottle) pruneLocked(now time.Time, rk string) []time.Time {
+	recent := t.recent[rk]
+	cutoff := now.Add(-t.period)
+	i := 0
+	for i < len(recent) && !recent[i].After(cutoff) {
+		i++
+	}
+	if i == len(recent) {
+		delete(t.recent, rk)
+		return nil
+	}
+	t.recent[rk] = recent[i:]
+	return recent[i:]
+}
+
+// admitKeys checks the writes to the entity groups of keys at now, counting
+// one write per entity group. It returns nil if all the writes are admitted,
+// or which of keys are admitted otherwise.
+//
+// Incomplete root keys are always admitted, since they make new entity groups.
+func (t *writeThrottle) admitKeys(now time.Time, keys []*ds.Key) []bool {
+	var ret []bool
+	admitted := map[string]bool{}
+	for i, k := range keys {
+		ok := true
+		if root := k.Root(); !root.IsIncomplete() {
+			rk := string(keyBytes(root))
+			seen := false
+			if ok, seen = admitted[rk]; !seen {
+				ok = t.admit(now, rk)
+				admitted[rk] = ok
+			}
+		}
+		if !ok && ret == nil {
+			ret = make([]bool, len(keys))
+			for j := 0; j < i; j++ {
+				ret[j] = true
+			}
+		}
+		if ret != nil {
+			ret[i] = ok
+		}
+	}
+	return ret
+}
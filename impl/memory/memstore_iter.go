@@ -17,6 +17,7 @@ package memory
 import (
 	"bytes"
 
+	ds "github.com/conchoid/gae/service/datastore"
 	"github.com/conchoid/gae/service/datastore/serialize"
 )
 
@@ -43,6 +44,13 @@ type iterDefinition struct {
 	// included in the interation result). If this is nil, then there's no end
 	// except the natural end of the collection.
 	end []byte
+
+	// The index which c holds, if any. Only used to account for index usage.
+	idx *ds.IndexDefinition
+
+	// residual is true if the prefix was padded with residual values, because
+	// the index has more equality columns than the query has equality filters.
+	residual bool
 }
 
 func multiIterate(defs []*iterDefinition, cb func(suffix []byte) error) error {
@@ -21,6 +21,7 @@ import (
 
 	"golang.org/x/net/context"
 
+	ds "github.com/conchoid/gae/service/datastore"
 	"github.com/conchoid/gae/service/info"
 	tq "github.com/conchoid/gae/service/taskqueue"
 
@@ -205,6 +206,9 @@ func (t *taskqueueTxnImpl) AddMulti(tasks []*tq.Task, queueName string, cb tq.Ra
 	if err := assertTxnValid(t.ctx); err != nil {
 		return err
 	}
+	if t.readOnly {
+		return ds.ErrReadOnlyTransaction
+	}
 
 	// Reject the entire batch if at least one task is bad. That's how prod API
 	// behaves too.
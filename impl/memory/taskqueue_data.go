@@ -375,10 +375,11 @@ func (t *taskQueueData) beginCommit(c context.Context, txnCtxObj memContextObj)
 	}
 }
 
-func (t *taskQueueData) mkTxn(*ds.TransactionOptions) memContextObj {
+func (t *taskQueueData) mkTxn(o *ds.TransactionOptions) memContextObj {
 	return &txnTaskQueueData{
-		parent: t,
-		anony:  tq.AnonymousQueueData{},
+		parent:   t,
+		anony:    tq.AnonymousQueueData{},
+		readOnly: o != nil && o.ReadOnly,
 	}
 }
 
@@ -488,6 +489,10 @@ type txnTaskQueueData struct {
 	closed int32
 	anony  tq.AnonymousQueueData
 	parent *taskQueueData
+
+	// readOnly is true in a read-only transaction, which can't add tasks since
+	// it is never committed.
+	readOnly bool
 }
 
 var _ memContextObj = (*txnTaskQueueData)(nil)
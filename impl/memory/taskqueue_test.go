@@ -417,6 +417,16 @@ func TestTaskQueue(t *testing.T) {
 				So(tqt.GetTransactionTasks()["default"], ShouldBeNil)
 			})
 
+			Convey("can't add a task in a read-only transaction", func() {
+				So(ds.RunInTransaction(c, func(c context.Context) error {
+					return tq.Add(c, "", &tq.Task{Path: "/sandwitch/victory"})
+				}, &ds.TransactionOptions{ReadOnly: true}), ShouldErrLike, "read-only transaction")
+
+				So(tqt.GetScheduledTasks()["default"], ShouldHaveLength, 1)
+				So(tqt.GetScheduledTasks()["default"][t.Name], ShouldResemble, t)
+				So(tqt.GetTransactionTasks()["default"], ShouldBeNil)
+			})
+
 			Convey("likewise, a panic doesn't schedule anything", func() {
 				func() {
 					defer func() { _ = recover() }()
@@ -28,6 +28,8 @@ type transactionImpl struct {
 	// boolean 0 or 1, use atomic.*Int32 to access.
 	closed int32
 	isXG   bool
+	// true if the transaction can't Put or Delete.
+	readOnly bool
 }
 
 func (ti *transactionImpl) close() error {
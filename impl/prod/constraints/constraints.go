@@ -26,6 +26,11 @@ func DS() datastore.Constraints {
 		MaxGetSize:    1000,
 		MaxPutSize:    500,
 		MaxDeleteSize: 500,
+
+		MaxKeyDepth:            100,
+		MaxIndexedPropertySize: 1500,
+		MaxEntitySize:          1048572,
+		MaxIndexEntries:        20000,
 	}
 }
 
@@ -173,6 +173,9 @@ type prodState struct {
 
 	// inTxn if true if this is in a transaction, false otherwise.
 	inTxn bool
+
+	// readOnly is true if this is in a read-only transaction.
+	readOnly bool
 }
 
 func getProdState(c context.Context) prodState {
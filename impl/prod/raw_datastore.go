@@ -131,6 +131,9 @@ func (d *rdsImpl) AllocateIDs(keys []*ds.Key, cb ds.NewKeyCB) error {
 }
 
 func (d *rdsImpl) DeleteMulti(ks []*ds.Key, cb ds.DeleteMultiCB) error {
+	if d.ps.readOnly {
+		return ds.ErrReadOnlyTransaction
+	}
 	keys, err := dsMF2R(d.aeCtx, ks)
 	if err == nil {
 		err = datastore.DeleteMulti(d.aeCtx, keys)
@@ -158,6 +161,9 @@ func (d *rdsImpl) GetMulti(keys []*ds.Key, _meta ds.MultiMetaGetter, cb ds.GetMu
 }
 
 func (d *rdsImpl) PutMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB) error {
+	if d.ps.readOnly {
+		return ds.ErrReadOnlyTransaction
+	}
 	rkeys, err := dsMF2R(d.aeCtx, keys)
 	if err == nil {
 		rvals := make([]datastore.PropertyLoadSaver, len(vals))
@@ -294,17 +300,54 @@ func (d *rdsImpl) Count(fq *ds.FinalizedQuery) (int64, error) {
 	return int64(ret), err
 }
 
-func (d *rdsImpl) RunInTransaction(f func(c context.Context) error, opts *ds.TransactionOptions) error {
-	ropts := (*datastore.TransactionOptions)(opts)
-	return datastore.RunInTransaction(d.aeCtx, func(c context.Context) error {
-		// Derive a prodState with this transaction Context.
-		ps := d.ps
-		ps.ctx = c
-		ps.inTxn = true
+func (d *rdsImpl) Aggregate(fq *ds.FinalizedQuery, aggs []*ds.Aggregation) (ds.PropertySlice, error) {
+	// The classic App Engine datastore has no aggregation queries.
+	return ds.AggregateQuery(d, fq, aggs)
+}
+
+// SampleKeys uses the __scatter__ property, which the datastore sets on a
+// random sample of the entities.
+func (d *rdsImpl) SampleKeys(fq *ds.FinalizedQuery, n int32) ([]*ds.Key, error) {
+	q := datastore.NewQuery(fq.Kind()).Order("__scatter__").KeysOnly().Limit(int(n))
+	if anc := fq.Ancestor(); anc != nil {
+		ranc, err := dsF2R(d.aeCtx, anc)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Ancestor(ranc)
+	}
 
-		c = withProdState(d.userCtx, ps)
-		return f(c)
-	}, ropts)
+	rkeys, err := q.GetAll(d.aeCtx, nil)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*ds.Key, len(rkeys))
+	for i, k := range rkeys {
+		keys[i] = dsR2F(k)
+	}
+	return keys, nil
+}
+
+func (d *rdsImpl) RunInTransaction(f func(c context.Context) error, opts *ds.TransactionOptions) error {
+	// Retries are done by ds.RetryTransaction, so each attempt is a single
+	// attempt of the SDK.
+	ropts := &datastore.TransactionOptions{Attempts: 1}
+	if opts != nil {
+		ropts.XG = opts.XG
+		ropts.ReadOnly = opts.ReadOnly
+	}
+	return ds.RetryTransaction(d.userCtx, opts, func(int) error {
+		return datastore.RunInTransaction(d.aeCtx, func(c context.Context) error {
+			// Derive a prodState with this transaction Context.
+			ps := d.ps
+			ps.ctx = c
+			ps.inTxn = true
+			ps.readOnly = ropts.ReadOnly
+
+			c = withProdState(d.userCtx, ps)
+			return f(c)
+		}, ropts)
+	})
 }
 
 func (d *rdsImpl) WithoutTransaction() context.Context {
@@ -314,6 +357,7 @@ func (d *rdsImpl) WithoutTransaction() context.Context {
 		ps := d.ps
 		ps.ctx = ps.noTxnCtx
 		ps.inTxn = false
+		ps.readOnly = false
 		c = withProdState(c, ps)
 	}
 	return c
@@ -159,6 +159,8 @@ func dsF2RProp(ctx context.Context, in ds.Property) (datastore.Property, error)
 		ret.Value = appengine.BlobKey(in.Value().(bs.Key))
 	case ds.PTGeoPoint:
 		ret.Value = appengine.GeoPoint(in.Value().(ds.GeoPoint))
+	case ds.PTPropertyMap:
+		err = fmt.Errorf("embedded entities are not supported by the appengine datastore API")
 	default:
 		ret.Value = in.Value()
 	}
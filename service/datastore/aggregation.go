@@ -0,0 +1,259 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// AggregationOp is the operation of an Aggregation.
+type AggregationOp string
+
+// These are the supported AggregationOps.
+const (
+	AggregateCount AggregationOp = "COUNT"
+	AggregateSum   AggregationOp = "SUM"
+	AggregateAvg   AggregationOp = "AVG"
+)
+
+// Aggregation is a value computed over the results of a query by Aggregate.
+//
+// Sum and Avg aggregate the indexed numeric (PTInt and PTFloat) values of a
+// field. Unindexed values and values of other types are ignored, as are
+// entities without the field. Every value of a multi-valued field is
+// aggregated separately.
+type Aggregation struct {
+	op    AggregationOp
+	field string
+}
+
+// CountAll is an Aggregation which counts the results of the query. Its result
+// is an int64.
+func CountAll() *Aggregation {
+	return &Aggregation{op: AggregateCount}
+}
+
+// Sum is an Aggregation which adds up the values of field. Its result is an
+// int64 if all of the values are integers, and a float64 otherwise.
+func Sum(field string) *Aggregation {
+	return &Aggregation{op: AggregateSum, field: field}
+}
+
+// Avg is an Aggregation which averages the values of field. Its result is a
+// float64, or nil if there are no values.
+func Avg(field string) *Aggregation {
+	return &Aggregation{op: AggregateAvg, field: field}
+}
+
+// Op returns the operation of this Aggregation.
+func (a *Aggregation) Op() AggregationOp { return a.op }
+
+// Field returns the field which this Aggregation applies to. It's empty for
+// CountAll.
+func (a *Aggregation) Field() string { return a.field }
+
+func (a *Aggregation) String() string {
+	if a.op == AggregateCount {
+		return "COUNT(*)"
+	}
+	return fmt.Sprintf("%s(%s)", a.op, gqlQuoteName(a.field))
+}
+
+// validate returns an error if a is not a valid Aggregation.
+func (a *Aggregation) validate() error {
+	switch {
+	case a == nil:
+		return fmt.Errorf("datastore: nil aggregation")
+	case a.op == AggregateCount:
+		return nil
+	case a.op != AggregateSum && a.op != AggregateAvg:
+		return fmt.Errorf("datastore: unknown aggregation %q", a.op)
+	case a.field == "":
+		return fmt.Errorf("datastore: %s aggregation without a field", a.op)
+	case strings.HasPrefix(a.field, "__") && strings.HasSuffix(a.field, "__"):
+		return fmt.Errorf("datastore: cannot aggregate on reserved property: %q", a.field)
+	}
+	return nil
+}
+
+// validateAggregations returns an error if aggs is empty, or contains an
+// invalid Aggregation.
+func validateAggregations(aggs []*Aggregation) error {
+	if len(aggs) == 0 {
+		return fmt.Errorf("datastore: Aggregate without aggregations")
+	}
+	for _, a := range aggs {
+		if err := a.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Aggregate computes aggs over the results of q, and returns their results in
+// the same order.
+//
+// If q has a limit or an offset, only the results within them are aggregated.
+// If q can never match any entity, the results are those of an empty query.
+// Aggregations over projection queries are not supported.
+//
+// Implementations compute the aggregations in the backend where possible, so
+// this is much cheaper than running q and aggregating the results in the
+// application.
+func Aggregate(c context.Context, q *Query, aggs ...*Aggregation) (PropertySlice, error) {
+	fq, err := q.Finalize()
+	switch {
+	case err == ErrNullQuery:
+		if err := validateAggregations(aggs); err != nil {
+			return nil, err
+		}
+		ret := make(PropertySlice, len(aggs))
+		for i, a := range aggs {
+			ret[i] = (&aggregationState{}).result(a.op)
+		}
+		return ret, nil
+	case err != nil:
+		return nil, err
+	}
+	v, err := Raw(c).Aggregate(fq, aggs)
+	return v, filterStop(err)
+}
+
+// AggregateQuery computes aggs by running queries against raw. Counts use
+// raw.Count, and the values of each field are read with a projection query
+// where possible, which only scans indexes. Otherwise, e.g. if fq has a limit,
+// the matching entities are loaded. RawInterface implementations
+// which cannot compute aggregations in the backend may use it to implement
+// Aggregate.
+func AggregateQuery(raw RawInterface, fq *FinalizedQuery, aggs []*Aggregation) (PropertySlice, error) {
+	count := int64(-1)
+	fields := map[string]*aggregationState{}
+
+	ret := make(PropertySlice, len(aggs))
+	for i, a := range aggs {
+		if a.op == AggregateCount {
+			if count < 0 {
+				var err error
+				if count, err = raw.Count(fq); err != nil {
+					return nil, err
+				}
+			}
+			ret[i] = MkProperty(count)
+			continue
+		}
+
+		st := fields[a.field]
+		if st == nil {
+			var err error
+			if st, err = aggregateField(raw, fq, a.field); err != nil {
+				return nil, err
+			}
+			fields[a.field] = st
+		}
+		ret[i] = st.result(a.op)
+	}
+	return ret, nil
+}
+
+// aggregateField collects the values of field in the results of fq.
+func aggregateField(raw RawInterface, fq *FinalizedQuery, field string) (*aggregationState, error) {
+	st := &aggregationState{}
+	cb := func(_ *Key, pm PropertyMap, _ CursorCB) error {
+		st.add(pm.Slice(field))
+		return nil
+	}
+	// Loaded entities also have the unindexed values of field, which projection
+	// queries (and the backends) never see.
+	loadCB := func(_ *Key, pm PropertyMap, _ CursorCB) error {
+		vals := pm.Slice(field)
+		indexed := vals[:0]
+		for _, v := range vals {
+			if v.IndexSetting() == ShouldIndex {
+				indexed = append(indexed, v)
+			}
+		}
+		st.add(indexed)
+		return nil
+	}
+
+	base := fq.Original().KeysOnly(false)
+
+	// Projecting on field changes the order of the results, and so also which
+	// results are within the limits and cursors of the query.
+	_, hasLimit := fq.Limit()
+	_, hasOffset := fq.Offset()
+	start, end := fq.Bounds()
+	if !hasLimit && !hasOffset && start == nil && end == nil {
+		pfq, err := base.Project(field).Finalize()
+		switch err {
+		case nil:
+			return st, filterStop(raw.Run(pfq, cb))
+		case ErrNullQuery:
+			return st, nil
+		}
+	}
+
+	// field can't be projected (e.g. it has an equality filter), so fall back to
+	// loading the entities.
+	fq, err := base.Finalize()
+	if err != nil {
+		return nil, err
+	}
+	return st, filterStop(raw.Run(fq, loadCB))
+}
+
+// aggregationState accumulates the numeric values of a field.
+type aggregationState struct {
+	intSum   int64
+	floatSum float64
+	isFloat  bool
+	n        int64
+}
+
+func (st *aggregationState) add(vals PropertySlice) {
+	for _, v := range vals {
+		switch v.Type() {
+		case PTInt:
+			st.intSum += v.Value().(int64)
+		case PTFloat:
+			st.floatSum += v.Value().(float64)
+			st.isFloat = true
+		default:
+			continue
+		}
+		st.n++
+	}
+}
+
+func (st *aggregationState) result(op AggregationOp) Property {
+	switch op {
+	case AggregateCount:
+		return MkProperty(st.n)
+	case AggregateSum:
+		if st.isFloat {
+			return MkProperty(float64(st.intSum) + st.floatSum)
+		}
+		return MkProperty(st.intSum)
+	case AggregateAvg:
+		if st.n == 0 {
+			return MkProperty(nil)
+		}
+		return MkProperty((float64(st.intSum) + st.floatSum) / float64(st.n))
+	}
+	panic(fmt.Errorf("impossible aggregation %q", op))
+}
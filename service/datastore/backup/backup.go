@@ -0,0 +1,435 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backup exports the entities of whole namespaces to a portable file,
+// and restores them.
+//
+// A backup file starts with a magic string and a format version, followed by
+// a gzip stream of framed records. Each record is a record type byte, the
+// uvarint-encoded length of its payload, and the payload:
+//   - an index record holds a composite index definition, serialized with
+//     serialize.WriteIndexDefinition.
+//   - an entity record holds the key of an entity, serialized with
+//     serialize.WriteKey, followed by its properties, serialized with
+//     serialize.WritePropertyMap. Both include their key contexts.
+//   - an end record, with an empty payload, terminates the file, so that
+//     truncated files are detected.
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	ds "github.com/conchoid/gae/service/datastore"
+	"github.com/conchoid/gae/service/datastore/meta"
+	"github.com/conchoid/gae/service/datastore/serialize"
+	"github.com/conchoid/gae/service/info"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// magic starts every backup file.
+	magic = "gae-backup\n"
+
+	// Version is the version of the backup format written by this package.
+	Version = 1
+
+	// DefaultBatchSize is the default number of entities restored at a time.
+	DefaultBatchSize = 500
+
+	// maxRecordSize is the maximum size of a record payload. It's well above
+	// the size of the largest entity.
+	maxRecordSize = 64 << 20
+)
+
+// Record types.
+const (
+	recordIndex  byte = 'i'
+	recordEntity byte = 'e'
+	recordEnd    byte = 'z'
+)
+
+// Writer writes a backup file.
+type Writer struct {
+	w   io.Writer
+	gz  *gzip.Writer
+	buf bytes.Buffer
+}
+
+// NewWriter writes the header of a backup file to w, and returns a Writer
+// which writes its records. Close must be called to complete the file.
+func NewWriter(w io.Writer) (*Writer, error) {
+	if _, err := io.WriteString(w, magic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write([]byte{Version}); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, gz: gzip.NewWriter(w)}, nil
+}
+
+// WriteIndex writes a composite index definition.
+func (w *Writer) WriteIndex(idx *ds.IndexDefinition) error {
+	w.buf.Reset()
+	if err := serialize.WriteIndexDefinition(&w.buf, *idx); err != nil {
+		return err
+	}
+	return w.writeRecord(recordIndex)
+}
+
+// WriteEntity writes the entity pm, whose key is key.
+func (w *Writer) WriteEntity(key *ds.Key, pm ds.PropertyMap) error {
+	w.buf.Reset()
+	if err := serialize.WriteKey(&w.buf, serialize.WithContext, key); err != nil {
+		return err
+	}
+	if err := serialize.WritePropertyMap(&w.buf, serialize.WithContext, pm); err != nil {
+		return err
+	}
+	return w.writeRecord(recordEntity)
+}
+
+// Close writes the end of the file. It doesn't close the underlying writer.
+func (w *Writer) Close() error {
+	w.buf.Reset()
+	if err := w.writeRecord(recordEnd); err != nil {
+		return err
+	}
+	return w.gz.Close()
+}
+
+func (w *Writer) writeRecord(typ byte) error {
+	var hdr [1 + binary.MaxVarintLen64]byte
+	hdr[0] = typ
+	n := binary.PutUvarint(hdr[1:], uint64(w.buf.Len()))
+	if _, err := w.gz.Write(hdr[:1+n]); err != nil {
+		return err
+	}
+	_, err := w.gz.Write(w.buf.Bytes())
+	return err
+}
+
+// Reader reads a backup file.
+type Reader struct {
+	r   *bufio.Reader
+	buf []byte
+	end bool
+}
+
+// NewReader reads the header of a backup file from r, and returns a Reader
+// which reads its records.
+func NewReader(r io.Reader) (*Reader, error) {
+	hdr := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("backup: can't read header: %s", err)
+	}
+	if string(hdr[:len(magic)]) != magic {
+		return nil, fmt.Errorf("backup: not a backup file")
+	}
+	if v := hdr[len(magic)]; v != Version {
+		return nil, fmt.Errorf("backup: unsupported version %d", v)
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: bufio.NewReader(gz)}, nil
+}
+
+// Next reads the next record. It returns either an index definition, or the
+// key and the properties of an entity. Keys, including the keys in
+// properties, are in their original key contexts. err is io.EOF at the end of
+// the file.
+func (r *Reader) Next() (idx *ds.IndexDefinition, key *ds.Key, pm ds.PropertyMap, err error) {
+	if r.end {
+		return nil, nil, nil, io.EOF
+	}
+	typ, err := r.r.ReadByte()
+	if err != nil {
+		return nil, nil, nil, truncated(err)
+	}
+	size, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, nil, nil, truncated(err)
+	}
+	if size > maxRecordSize {
+		return nil, nil, nil, fmt.Errorf("backup: record is too large (%d bytes)", size)
+	}
+	if uint64(cap(r.buf)) < size {
+		r.buf = make([]byte, size)
+	}
+	payload := r.buf[:size]
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		return nil, nil, nil, truncated(err)
+	}
+
+	buf := bytes.NewReader(payload)
+	switch typ {
+	case recordIndex:
+		def, err := serialize.ReadIndexDefinition(buf)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return &def, nil, nil, nil
+
+	case recordEntity:
+		// The key contexts are read from the payload, so the one passed here is
+		// unused.
+		kc := ds.KeyContext{}
+		if key, err = serialize.ReadKey(buf, serialize.WithContext, kc); err != nil {
+			return nil, nil, nil, err
+		}
+		if pm, err = serialize.ReadPropertyMap(buf, serialize.WithContext, kc); err != nil {
+			return nil, nil, nil, err
+		}
+		return nil, key, pm, nil
+
+	case recordEnd:
+		r.end = true
+		return nil, nil, nil, io.EOF
+
+	default:
+		return nil, nil, nil, fmt.Errorf("backup: unknown record type %q", typ)
+	}
+}
+
+func truncated(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("backup: truncated file: %s", err)
+}
+
+// BackupOptions are the options of Backup.
+type BackupOptions struct {
+	// Namespaces are the namespaces to back up. If it's empty, all the
+	// namespaces are backed up.
+	Namespaces []string
+
+	// Indexes are the composite index definitions written to the backup, e.g.
+	// from FindAndParseIndexYAML.
+	Indexes []*ds.IndexDefinition
+
+	// WithSpecial, if true, includes entities whose kinds begin and end with
+	// "__". By default, they're skipped.
+	WithSpecial bool
+}
+
+// Backup writes the entities of every kind of the namespaces in opts, and the
+// index definitions in opts, to a backup file written to w. opts may be nil. It
+// returns the number of entities written.
+func Backup(c context.Context, w io.Writer, opts *BackupOptions) (n int, err error) {
+	if opts == nil {
+		opts = &BackupOptions{}
+	}
+	namespaces := opts.Namespaces
+	if len(namespaces) == 0 {
+		if err := meta.Namespaces(c, (*meta.NamespacesCollector)(&namespaces).Callback); err != nil {
+			return 0, err
+		}
+	}
+
+	bw, err := NewWriter(w)
+	if err != nil {
+		return 0, err
+	}
+	for _, idx := range opts.Indexes {
+		if err := bw.WriteIndex(idx); err != nil {
+			return n, err
+		}
+	}
+
+	for _, ns := range namespaces {
+		nc, err := info.Namespace(c, ns)
+		if err != nil {
+			return n, err
+		}
+		fq, err := ds.NewQuery("").Finalize()
+		if err != nil {
+			return n, err
+		}
+		err = ds.Raw(nc).Run(fq, func(k *ds.Key, pm ds.PropertyMap, _ ds.CursorCB) error {
+			if !opts.WithSpecial && isSpecial(k.Kind()) {
+				return nil
+			}
+			if err := bw.WriteEntity(k, pm); err != nil {
+				return err
+			}
+			n++
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, bw.Close()
+}
+
+func isSpecial(kind string) bool {
+	return strings.HasPrefix(kind, "__") && strings.HasSuffix(kind, "__")
+}
+
+// RestoreOptions are the options of Restore.
+type RestoreOptions struct {
+	// KeyContext maps the key context of the backed up entities to the key
+	// context they're restored in. It's also applied to the keys held by their
+	// properties. If it's nil, entities are restored in the app of the Context,
+	// in the namespace they were backed up from.
+	KeyContext func(ds.KeyContext) ds.KeyContext
+
+	// BatchSize is the number of entities written at a time. If it's 0,
+	// DefaultBatchSize is used.
+	BatchSize int
+}
+
+// Restore writes the entities of the backup file read from r to the
+// datastore of the Context, overwriting existing entities with the same keys.
+// opts may be nil.
+//
+// It returns the number of restored entities, and the index definitions of
+// the backup. If the datastore has a Testable (e.g. impl/memory), the indexes
+// are also added to it.
+func Restore(c context.Context, r io.Reader, opts *RestoreOptions) (n int, indexes []*ds.IndexDefinition, err error) {
+	if opts == nil {
+		opts = &RestoreOptions{}
+	}
+	remap := opts.KeyContext
+	if remap == nil {
+		appID := ds.GetKeyContext(c).AppID
+		remap = func(kc ds.KeyContext) ds.KeyContext {
+			return ds.MkKeyContext(appID, kc.Namespace)
+		}
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	br, err := NewReader(r)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Entities are written in batches of the same namespace, since the
+	// datastore of a Context is bound to a namespace.
+	var ns string
+	var keys []*ds.Key
+	var vals []ds.PropertyMap
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		nc, err := info.Namespace(c, ns)
+		if err != nil {
+			return err
+		}
+		var putErr error
+		err = ds.Raw(nc).PutMulti(keys, vals, func(_ int, _ *ds.Key, err error) error {
+			if putErr == nil {
+				putErr = err
+			}
+			return nil
+		})
+		if err == nil {
+			err = putErr
+		}
+		if err != nil {
+			return err
+		}
+		n += len(keys)
+		keys, vals = nil, nil
+		return nil
+	}
+
+	for {
+		idx, key, pm, err := br.Next()
+		switch {
+		case err == io.EOF:
+			if err := flush(); err != nil {
+				return n, indexes, err
+			}
+			if len(indexes) > 0 {
+				if t := ds.GetTestable(c); t != nil {
+					t.AddIndexes(indexes...)
+				}
+			}
+			return n, indexes, nil
+		case err != nil:
+			return n, indexes, err
+		case idx != nil:
+			indexes = append(indexes, idx)
+			continue
+		}
+
+		key = remapKey(key, remap)
+		if len(keys) == batchSize || (len(keys) > 0 && key.Namespace() != ns) {
+			if err := flush(); err != nil {
+				return n, indexes, err
+			}
+		}
+		ns = key.Namespace()
+		keys = append(keys, key)
+		vals = append(vals, remapProperties(pm, remap))
+	}
+}
+
+// remapKey returns k in the key context remap(k's context).
+func remapKey(k *ds.Key, remap func(ds.KeyContext) ds.KeyContext) *ds.Key {
+	appID, ns, toks := k.Split()
+	return remap(ds.MkKeyContext(appID, ns)).NewKeyToks(toks)
+}
+
+// remapProperties remaps the keys held by the properties of pm, including the
+// ones of embedded entities.
+func remapProperties(pm ds.PropertyMap, remap func(ds.KeyContext) ds.KeyContext) ds.PropertyMap {
+	ret := make(ds.PropertyMap, len(pm))
+	for name, pdata := range pm {
+		switch t := pdata.(type) {
+		case ds.Property:
+			ret[name] = remapProperty(t, remap)
+		case ds.PropertySlice:
+			slice := make(ds.PropertySlice, len(t))
+			for i, p := range t {
+				slice[i] = remapProperty(p, remap)
+			}
+			ret[name] = slice
+		default:
+			ret[name] = pdata
+		}
+	}
+	return ret
+}
+
+func remapProperty(p ds.Property, remap func(ds.KeyContext) ds.KeyContext) ds.Property {
+	var v interface{}
+	switch t := p.Value().(type) {
+	case *ds.Key:
+		v = remapKey(t, remap)
+	case ds.PropertyMap:
+		v = remapProperties(t, remap)
+	default:
+		return p
+	}
+	ret := ds.Property{}
+	if err := ret.SetValue(v, p.IndexSetting()); err != nil {
+		panic(err) // impossible, the value has the same type
+	}
+	return ret
+}
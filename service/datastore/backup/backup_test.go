@@ -0,0 +1,124 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/conchoid/gae/impl/memory"
+	ds "github.com/conchoid/gae/service/datastore"
+	"github.com/conchoid/gae/service/info"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+type Author struct {
+	ID   string `gae:"$id"`
+	Name string
+}
+
+type Book struct {
+	ID     int64   `gae:"$id"`
+	Author *ds.Key `gae:"$parent"`
+	Title  string
+	Editor *ds.Key
+	Tags   []string
+}
+
+func TestBackup(t *testing.T) {
+	t.Parallel()
+
+	Convey("Backup and Restore", t, func() {
+		c := memory.UseWithAppID(context.Background(), "dev~src")
+		ds.GetTestable(c).Consistent(true)
+		nc := info.MustNamespace(c, "ns")
+
+		author := &Author{ID: "ann", Name: "Ann"}
+		So(ds.Put(c, author), ShouldBeNil)
+		authorKey := ds.KeyForObj(c, author)
+		So(ds.Put(c, &Book{ID: 1, Author: authorKey, Title: "One", Editor: authorKey, Tags: []string{"a", "b"}}), ShouldBeNil)
+		So(ds.Put(c, &Book{ID: 2, Author: authorKey, Title: "Two"}), ShouldBeNil)
+		So(ds.Put(nc, &Author{ID: "bob", Name: "Bob"}), ShouldBeNil)
+
+		idx := &ds.IndexDefinition{Kind: "Book", SortBy: []ds.IndexColumn{{Property: "Tags"}, {Property: "Title"}}}
+
+		buf := &bytes.Buffer{}
+		n, err := Backup(c, buf, &BackupOptions{Indexes: []*ds.IndexDefinition{idx}})
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 4)
+
+		Convey("restores all the namespaces into another app", func() {
+			dst := memory.UseWithAppID(context.Background(), "dev~dst")
+			ds.GetTestable(dst).Consistent(true)
+
+			n, indexes, err := Restore(dst, bytes.NewReader(buf.Bytes()), &RestoreOptions{BatchSize: 2})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 4)
+			So(indexes, ShouldResemble, []*ds.IndexDefinition{idx})
+
+			dstAuthor := ds.MakeKey(dst, "Author", "ann")
+			So(dstAuthor.AppID(), ShouldEqual, "dev~dst")
+			book := &Book{ID: 1, Author: dstAuthor}
+			So(ds.Get(dst, book), ShouldBeNil)
+			So(book, ShouldResemble, &Book{ID: 1, Author: dstAuthor, Title: "One", Editor: dstAuthor, Tags: []string{"a", "b"}})
+
+			a := &Author{ID: "bob"}
+			So(ds.Get(info.MustNamespace(dst, "ns"), a), ShouldBeNil)
+			So(a.Name, ShouldEqual, "Bob")
+
+			// The composite index was added.
+			var books []*Book
+			So(ds.GetAll(dst, ds.NewQuery("Book").Eq("Tags", "a").Order("Title"), &books), ShouldBeNil)
+			So(books, ShouldHaveLength, 1)
+		})
+
+		Convey("backs up selected namespaces", func() {
+			buf.Reset()
+			n, err := Backup(c, buf, &BackupOptions{Namespaces: []string{"ns"}})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+		})
+
+		Convey("remaps key contexts", func() {
+			dst := memory.Use(context.Background())
+			ds.GetTestable(dst).Consistent(true)
+			kc := ds.GetKeyContext(dst)
+
+			_, _, err := Restore(dst, bytes.NewReader(buf.Bytes()), &RestoreOptions{
+				KeyContext: func(ds.KeyContext) ds.KeyContext {
+					return ds.MkKeyContext(kc.AppID, "restored")
+				},
+			})
+			So(err, ShouldBeNil)
+
+			rc := info.MustNamespace(dst, "restored")
+			var authors []*Author
+			So(ds.GetAll(rc, ds.NewQuery("Author"), &authors), ShouldResemble, nil)
+			So(authors, ShouldHaveLength, 2)
+		})
+
+		Convey("rejects truncated and foreign files", func() {
+			_, _, err := Restore(c, bytes.NewReader(buf.Bytes()[:buf.Len()-20]), nil)
+			So(err, ShouldNotBeNil)
+
+			_, _, err = Restore(c, bytes.NewReader([]byte("something else")), nil)
+			So(err, ShouldErrLike, "not a backup file")
+		})
+	})
+}
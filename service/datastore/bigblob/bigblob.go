@@ -0,0 +1,228 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bigblob stores values which are too large for a single datastore
+// entity.
+//
+// A blob is split into chunks of at most ChunkSize bytes, which are stored as
+// child entities of the entity which owns the blob, along with a header
+// entity which records the number of chunks. Since they're all in the owner's
+// entity group, a blob is always written, read and deleted in a single
+// transaction.
+//
+// All of the chunks are written in one transaction, so a blob can't be larger
+// than the transaction size limit. If the transaction tracks its size (see
+// datastore.TransactionSizeBudget), e.g. with a transaction buffer, its
+// remaining size budget is used instead, so writes which would make the
+// transaction too large fail before anything is written.
+package bigblob
+
+import (
+	"fmt"
+
+	ds "github.com/conchoid/gae/service/datastore"
+
+	"golang.org/x/net/context"
+)
+
+// ChunkSize is the maximum number of bytes of a blob stored in each chunk
+// entity. It leaves some room below the 1MB entity size limit for the key and
+// the property name.
+const ChunkSize = 1000 * 1000
+
+// These are the kinds of the entities which hold a blob.
+const (
+	HeaderKind = "BigBlob"
+	ChunkKind  = "BigBlobChunk"
+)
+
+// header records the number of chunks of a blob, and its total size.
+type header struct {
+	kind   string  `gae:"$kind,BigBlob"`
+	id     int64   `gae:"$id,1"`
+	Parent *ds.Key `gae:"$parent"`
+
+	Chunks int64 `gae:",noindex"`
+	Size   int64 `gae:",noindex"`
+}
+
+// chunk holds a part of a blob. Its ID is its 1-based index in the blob.
+type chunk struct {
+	kind   string  `gae:"$kind,BigBlobChunk"`
+	ID     int64   `gae:"$id"`
+	Parent *ds.Key `gae:"$parent"`
+
+	Data []byte `gae:",noindex"`
+}
+
+func headerFor(owner *ds.Key) *header {
+	return &header{Parent: owner}
+}
+
+// chunksFor returns the chunk entities with the IDs in [from, to], without
+// their data.
+func chunksFor(hdrKey *ds.Key, from, to int64) []*chunk {
+	if to < from {
+		return nil
+	}
+	ret := make([]*chunk, 0, to-from+1)
+	for id := from; id <= to; id++ {
+		ret = append(ret, &chunk{ID: id, Parent: hdrKey})
+	}
+	return ret
+}
+
+// inTransaction runs f in a transaction, or directly if c is already in one.
+func inTransaction(c context.Context, f func(c context.Context) error) error {
+	if ds.CurrentTransaction(c) != nil {
+		return f(c)
+	}
+	return ds.RunInTransaction(c, f, nil)
+}
+
+// Put stores data as the blob of the entity with the key owner, replacing its
+// previous blob if any. owner itself isn't written, so it may be written in
+// the same transaction, or not at all.
+//
+// If the writes would exceed the size budget of the transaction, Put returns
+// ds.ErrTransactionTooLarge without writing anything.
+func Put(c context.Context, owner *ds.Key, data []byte) error {
+	if owner.IsIncomplete() {
+		return fmt.Errorf("bigblob: owner key %s is incomplete", owner)
+	}
+	hdr := headerFor(owner)
+	hdrKey := ds.KeyForObj(c, hdr)
+
+	// Always write at least one chunk, so that an empty blob can be told apart
+	// from a missing one.
+	chunks := chunksFor(hdrKey, 1, int64((len(data)+ChunkSize-1)/ChunkSize))
+	if len(chunks) == 0 {
+		chunks = chunksFor(hdrKey, 1, 1)
+	}
+	for i, ch := range chunks {
+		end := (i + 1) * ChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		ch.Data = data[i*ChunkSize : end]
+	}
+	hdr.Chunks, hdr.Size = int64(len(chunks)), int64(len(data))
+
+	size, err := entitySize(c, hdr)
+	if err != nil {
+		return err
+	}
+	for _, ch := range chunks {
+		chSize, err := entitySize(c, ch)
+		if err != nil {
+			return err
+		}
+		size += chSize
+	}
+
+	return inTransaction(c, func(c context.Context) error {
+		var stale []*chunk
+		old := headerFor(owner)
+		switch err := ds.Get(c, old); err {
+		case nil:
+			stale = chunksFor(hdrKey, hdr.Chunks+1, old.Chunks)
+		case ds.ErrNoSuchEntity:
+		default:
+			return err
+		}
+
+		// Deletes count towards the budget for the size of their key.
+		size := size
+		for _, ch := range stale {
+			size += ds.KeyForObj(c, ch).EstimateSize()
+		}
+		budget, ok := ds.TransactionSizeBudget(c)
+		if !ok {
+			budget = ds.DefaultTransactionSizeBudget
+		}
+		if size > budget {
+			return ds.ErrTransactionTooLarge
+		}
+
+		if len(stale) > 0 {
+			if err := ds.Delete(c, stale); err != nil {
+				return err
+			}
+		}
+		return ds.Put(c, hdr, chunks)
+	})
+}
+
+// entitySize estimates the number of bytes written by putting obj, as counted
+// by transaction size budgets.
+func entitySize(c context.Context, obj interface{}) (int64, error) {
+	pm, err := ds.GetPLS(obj).Save(false)
+	if err != nil {
+		return 0, err
+	}
+	return ds.KeyForObj(c, obj).EstimateSize() + pm.EstimateSize(), nil
+}
+
+// Get returns the blob of the entity with the key owner. It returns
+// ds.ErrNoSuchEntity if there is none.
+func Get(c context.Context, owner *ds.Key) (data []byte, err error) {
+	err = inTransaction(c, func(c context.Context) error {
+		hdr := headerFor(owner)
+		if err := ds.Get(c, hdr); err != nil {
+			return err
+		}
+		chunks := chunksFor(ds.KeyForObj(c, hdr), 1, hdr.Chunks)
+		if err := ds.Get(c, chunks); err != nil {
+			return fmt.Errorf("bigblob: failed to get the chunks of %s: %s", owner, err)
+		}
+
+		data = make([]byte, 0, hdr.Size)
+		for _, ch := range chunks {
+			data = append(data, ch.Data...)
+		}
+		if int64(len(data)) != hdr.Size {
+			return fmt.Errorf("bigblob: the blob of %s has %d bytes, expected %d", owner, len(data), hdr.Size)
+		}
+		return nil
+	})
+	if err != nil {
+		data = nil
+	}
+	return
+}
+
+// Delete deletes the entities with the keys owners, along with their blobs.
+// Owners without a blob are simply deleted.
+func Delete(c context.Context, owners ...*ds.Key) error {
+	for _, owner := range owners {
+		err := inTransaction(c, func(c context.Context) error {
+			hdr := headerFor(owner)
+			switch err := ds.Get(c, hdr); err {
+			case nil:
+				chunks := chunksFor(ds.KeyForObj(c, hdr), 1, hdr.Chunks)
+				if err := ds.Delete(c, hdr, chunks); err != nil {
+					return err
+				}
+			case ds.ErrNoSuchEntity:
+			default:
+				return err
+			}
+			return ds.Delete(c, owner)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bigblob
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/conchoid/gae/filter/txnBuf"
+	"github.com/conchoid/gae/impl/memory"
+	ds "github.com/conchoid/gae/service/datastore"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBigBlob(t *testing.T) {
+	t.Parallel()
+
+	Convey("bigblob", t, func() {
+		c := memory.Use(context.Background())
+		ds.GetTestable(c).Consistent(true)
+		ds.GetTestable(c).AutoIndex(true)
+
+		owner := ds.MakeKey(c, "Report", 1)
+		big := bytes.Repeat([]byte("0123456789"), ChunkSize/4) // 2.5 chunks
+
+		countChunks := func() int64 {
+			n, err := ds.Count(c, ds.NewQuery(ChunkKind))
+			So(err, ShouldBeNil)
+			return n
+		}
+
+		Convey("round trips", func() {
+			for _, data := range [][]byte{[]byte("small"), {}, big} {
+				So(Put(c, owner, data), ShouldBeNil)
+				got, err := Get(c, owner)
+				So(err, ShouldBeNil)
+				So(got, ShouldResemble, data)
+			}
+		})
+
+		Convey("splits into chunks under the owner", func() {
+			So(Put(c, owner, big), ShouldBeNil)
+			So(countChunks(), ShouldEqual, 3)
+
+			var keys []*ds.Key
+			So(ds.GetAll(c, ds.NewQuery(ChunkKind), &keys), ShouldBeNil)
+			for _, k := range keys {
+				So(k.Root(), ShouldResemble, owner)
+			}
+
+			Convey("and removes stale chunks when replaced", func() {
+				So(Put(c, owner, []byte("small")), ShouldBeNil)
+				So(countChunks(), ShouldEqual, 1)
+			})
+		})
+
+		Convey("Get of a missing blob", func() {
+			_, err := Get(c, owner)
+			So(err, ShouldEqual, ds.ErrNoSuchEntity)
+		})
+
+		Convey("Delete removes the owner and its chunks", func() {
+			So(ds.Put(c, ds.PropertyMap{"$key": ds.MkPropertyNI(owner)}), ShouldBeNil)
+			So(Put(c, owner, big), ShouldBeNil)
+
+			So(Delete(c, owner, ds.MakeKey(c, "Report", 2)), ShouldBeNil)
+			So(countChunks(), ShouldEqual, 0)
+			ex, err := ds.Exists(c, owner)
+			So(err, ShouldBeNil)
+			So(ex.Any(), ShouldBeFalse)
+		})
+
+		Convey("rejects incomplete owners", func() {
+			So(Put(c, ds.NewIncompleteKeys(c, 1, "Report", nil)[0], big), ShouldNotBeNil)
+		})
+
+		Convey("fails early when the transaction would be too large", func() {
+			huge := make([]byte, ds.DefaultTransactionSizeBudget)
+			So(Put(c, owner, huge), ShouldEqual, ds.ErrTransactionTooLarge)
+			So(countChunks(), ShouldEqual, 0)
+
+			Convey("including the budget already used in a buffered transaction", func() {
+				c := txnBuf.FilterRDS(c)
+				So(ds.RunInTransaction(c, func(c context.Context) error {
+					So(Put(c, owner, huge[:ds.DefaultTransactionSizeBudget/2]), ShouldBeNil)
+					return Put(c, ds.NewKey(c, "Piece", "", 1, owner), huge[:ds.DefaultTransactionSizeBudget/2])
+				}, nil), ShouldEqual, ds.ErrTransactionTooLarge)
+				So(countChunks(), ShouldEqual, 0)
+			})
+		})
+	})
+}
@@ -42,9 +42,58 @@ func (tcf *checkFilter) Run(fq *FinalizedQuery, cb RawRunCB) error {
 	if cb == nil {
 		return fmt.Errorf("datastore: Run callback is nil")
 	}
+	if len(fq.subQueries) > 0 {
+		return runFanOut(tcf.RawInterface, fq, true, cb)
+	}
 	return tcf.RawInterface.Run(fq, cb)
 }
 
+func (tcf *checkFilter) Count(fq *FinalizedQuery) (int64, error) {
+	if fq == nil {
+		return 0, fmt.Errorf("datastore: Count query is nil")
+	}
+	if len(fq.subQueries) > 0 {
+		return countFanOut(tcf.RawInterface, fq)
+	}
+	return tcf.RawInterface.Count(fq)
+}
+
+func (tcf *checkFilter) Aggregate(fq *FinalizedQuery, aggs []*Aggregation) (PropertySlice, error) {
+	if fq == nil {
+		return nil, fmt.Errorf("datastore: Aggregate query is nil")
+	}
+	if err := validateAggregations(aggs); err != nil {
+		return nil, err
+	}
+	if len(fq.Project()) > 0 {
+		return nil, fmt.Errorf("datastore: cannot aggregate over a projection query")
+	}
+	if len(fq.subQueries) > 0 {
+		return AggregateQuery(tcf, fq, aggs)
+	}
+	return tcf.RawInterface.Aggregate(fq, aggs)
+}
+
+func (tcf *checkFilter) SampleKeys(fq *FinalizedQuery, n int32) ([]*Key, error) {
+	if fq == nil {
+		return nil, fmt.Errorf("datastore: SampleKeys query is nil")
+	}
+	if fq.Kind() == "" {
+		return nil, fmt.Errorf("datastore: SampleKeys query has no kind")
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	return tcf.RawInterface.SampleKeys(fq, n)
+}
+
+func (tcf *checkFilter) DecodeCursor(s string) (Cursor, error) {
+	if isMultiCursor(s) {
+		return decodeMultiCursor(s, tcf.RawInterface.DecodeCursor)
+	}
+	return tcf.RawInterface.DecodeCursor(s)
+}
+
 func (tcf *checkFilter) GetMulti(keys []*Key, meta MultiMetaGetter, cb GetMultiCB) error {
 	if len(keys) == 0 {
 		return nil
@@ -53,6 +102,7 @@ func (tcf *checkFilter) GetMulti(keys []*Key, meta MultiMetaGetter, cb GetMultiC
 		return fmt.Errorf("datastore: GetMulti callback is nil")
 	}
 	lme := errors.NewLazyMultiError(len(keys))
+	cons := tcf.RawInterface.Constraints()
 	for i, k := range keys {
 		var err error
 		switch {
@@ -60,6 +110,8 @@ func (tcf *checkFilter) GetMulti(keys []*Key, meta MultiMetaGetter, cb GetMultiC
 			err = MakeErrInvalidKey("key [%s] is incomplete", k).Err()
 		case !k.Valid(true, tcf.kc):
 			err = MakeErrInvalidKey("key [%s] is not valid in context %s", k, tcf.kc).Err()
+		default:
+			err = checkKeyDepth(&cons, k)
 		}
 		if err != nil {
 			lme.Assign(i, err)
@@ -85,15 +137,22 @@ func (tcf *checkFilter) PutMulti(keys []*Key, vals []PropertyMap, cb NewKeyCB) e
 		return fmt.Errorf("datastore: PutMulti callback is nil")
 	}
 	lme := errors.NewLazyMultiError(len(keys))
+	cons := tcf.RawInterface.Constraints()
 	for i, k := range keys {
 		if !k.PartialValid(tcf.kc) {
 			lme.Assign(i, MakeErrInvalidKey("key [%s] is not partially valid in context %s", k, tcf.kc).Err())
 			continue
 		}
+		if err := checkKeyDepth(&cons, k); err != nil {
+			lme.Assign(i, err)
+			continue
+		}
 		v := vals[i]
 		if v == nil {
 			lme.Assign(i, errors.New("datastore: PutMulti got nil vals entry"))
+			continue
 		}
+		lme.Assign(i, checkIndexedPropertySizes(&cons, "", v))
 	}
 	if me := lme.Get(); me != nil {
 		for idx, err := range me.(errors.MultiError) {
@@ -113,6 +172,7 @@ func (tcf *checkFilter) DeleteMulti(keys []*Key, cb DeleteMultiCB) error {
 		return fmt.Errorf("datastore: DeleteMulti callback is nil")
 	}
 	lme := errors.NewLazyMultiError(len(keys))
+	cons := tcf.RawInterface.Constraints()
 	for i, k := range keys {
 		var err error
 		switch {
@@ -120,6 +180,8 @@ func (tcf *checkFilter) DeleteMulti(keys []*Key, cb DeleteMultiCB) error {
 			err = MakeErrInvalidKey("key [%s] is incomplete", k).Err()
 		case !k.Valid(false, tcf.kc):
 			err = MakeErrInvalidKey("key [%s] is not valid in context %s", k, tcf.kc).Err()
+		default:
+			err = checkKeyDepth(&cons, k)
 		}
 		if err != nil {
 			lme.Assign(i, err)
@@ -134,6 +196,48 @@ func (tcf *checkFilter) DeleteMulti(keys []*Key, cb DeleteMultiCB) error {
 	return tcf.RawInterface.DeleteMulti(keys, cb)
 }
 
+// checkKeyDepth returns an error if k has more path elements than c allows.
+func checkKeyDepth(c *Constraints, k *Key) error {
+	if c.MaxKeyDepth > 0 && len(k.toks) > c.MaxKeyDepth {
+		return MakeErrInvalidKey("key [%s] has more than %d path elements", k, c.MaxKeyDepth).Err()
+	}
+	return nil
+}
+
+// checkIndexedPropertySizes returns an error if an indexed string or []byte
+// value of pm, or of the indexed entities embedded in pm, is larger than c
+// allows. prefix is prepended to the property names in the error.
+func checkIndexedPropertySizes(c *Constraints, prefix string, pm PropertyMap) error {
+	if c.MaxIndexedPropertySize <= 0 {
+		return nil
+	}
+	for name, pdata := range pm {
+		if isMetaKey(name) {
+			continue
+		}
+		for _, p := range pdata.Slice() {
+			if p.IndexSetting() == NoIndex {
+				continue
+			}
+			size := 0
+			switch p.Type() {
+			case PTString:
+				size = len(p.Value().(string))
+			case PTBytes:
+				size = len(p.Value().([]byte))
+			case PTPropertyMap:
+				if err := checkIndexedPropertySizes(c, prefix+name+".", p.Value().(PropertyMap)); err != nil {
+					return err
+				}
+			}
+			if size > c.MaxIndexedPropertySize {
+				return fmt.Errorf("The value of property %q is longer than %d bytes.", prefix+name, c.MaxIndexedPropertySize)
+			}
+		}
+	}
+	return nil
+}
+
 func applyCheckFilter(c context.Context, i RawInterface) RawInterface {
 	return &checkFilter{
 		RawInterface: i,
@@ -23,11 +23,33 @@ import (
 	"golang.org/x/net/context"
 
 	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
 )
 
-type fakeRDS struct{ RawInterface }
+type fakeRDS struct {
+	RawInterface
 
-func (fakeRDS) Constraints() Constraints { return Constraints{} }
+	constraints Constraints
+
+	// puts, if not nil, records the keys passed to PutMulti. Otherwise PutMulti
+	// reaches the nil RawInterface.
+	puts *[]*Key
+}
+
+func (f fakeRDS) Constraints() Constraints { return f.constraints }
+
+func (f fakeRDS) PutMulti(keys []*Key, vals []PropertyMap, cb NewKeyCB) error {
+	if f.puts == nil {
+		return f.RawInterface.PutMulti(keys, vals, cb)
+	}
+	*f.puts = append(*f.puts, keys...)
+	for i, k := range keys {
+		if err := cb(i, k, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
 func TestCheckFilter(t *testing.T) {
 	t.Parallel()
@@ -147,5 +169,47 @@ func TestCheckFilter(t *testing.T) {
 			So(hit, ShouldBeFalse)
 		})
 
+		Convey("Constraints", func() {
+			var puts []*Key
+			c := SetRaw(c, fakeRDS{
+				constraints: Constraints{MaxKeyDepth: 2, MaxIndexedPropertySize: 3},
+				puts:        &puts,
+			})
+			rds := Raw(c)
+
+			deep := mkKey("A", 1, "B", 2, "C", 3)
+			So(rds.GetMulti([]*Key{deep}, nil, func(_ int, _ PropertyMap, err error) error {
+				So(IsErrInvalidKey(err), ShouldBeTrue)
+				So(err, ShouldErrLike, "has more than 2 path elements")
+				return nil
+			}), ShouldBeNil)
+			So(rds.DeleteMulti([]*Key{deep}, func(_ int, err error) error {
+				So(IsErrInvalidKey(err), ShouldBeTrue)
+				return nil
+			}), ShouldBeNil)
+
+			put := func(k *Key, pm PropertyMap) (err error) {
+				So(rds.PutMulti([]*Key{k}, []PropertyMap{pm}, func(_ int, _ *Key, e error) error {
+					err = e
+					return nil
+				}), ShouldBeNil)
+				return
+			}
+			key := mkKey("A", 1)
+			So(put(deep, PropertyMap{}), ShouldErrLike, "has more than 2 path elements")
+			So(puts, ShouldBeEmpty)
+			So(put(key, PropertyMap{"Val": MkProperty("long")}),
+				ShouldErrLike, `The value of property "Val" is longer than 3 bytes.`)
+			So(put(key, PropertyMap{"Val": MkProperty([]byte("long"))}),
+				ShouldErrLike, `The value of property "Val" is longer than 3 bytes.`)
+			So(put(key, PropertyMap{"Outer": MkProperty(PropertyMap{"Val": MkProperty("long")})}),
+				ShouldErrLike, `The value of property "Outer.Val" is longer than 3 bytes.`)
+
+			So(puts, ShouldBeEmpty)
+
+			// Unindexed values aren't limited.
+			So(put(key, PropertyMap{"Val": MkPropertyNI("long")}), ShouldBeNil)
+			So(puts, ShouldResemble, []*Key{key})
+		})
 	})
 }
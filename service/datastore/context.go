@@ -26,6 +26,9 @@ const (
 	rawDatastoreKey key = iota
 	rawDatastoreFilterKey
 	rawDatastoreBatchKey
+	encryptionProviderKey
+	hideExpiredKey
+	pageTokenSecretKey
 )
 
 // RawFactory is the function signature for factory methods compatible with
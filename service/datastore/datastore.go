@@ -45,6 +45,31 @@ func ParseIndexYAML(content io.Reader) ([]*IndexDefinition, error) {
 	return m["indexes"], nil
 }
 
+// WriteIndexYAML writes the contents of an index YAML file, which can be read
+// back with ParseIndexYAML, with the compound indexes among idxs.
+//
+// The indexes are merged and normalized as by IndexSet: duplicates are only
+// written once, builtin indexes are skipped, and the output is sorted, so the
+// same indexes always produce the same file.
+func WriteIndexYAML(w io.Writer, idxs []*IndexDefinition) error {
+	set := IndexSet{}
+	set.Add(idxs...)
+
+	if _, err := io.WriteString(w, "indexes:\n"); err != nil {
+		return err
+	}
+	for _, id := range set.Indexes() {
+		yaml, err := id.YAMLString()
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "\n%s\n", yaml); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // getCallingTestFilePath looks up the call stack until the specified
 // maxStackDepth and returns the absolute path of the first source filename
 // ending with `_test.go`. If no test file is found, getCallingTestFilePath
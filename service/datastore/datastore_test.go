@@ -1428,6 +1428,120 @@ func TestRun(t *testing.T) {
 	})
 }
 
+type HookStruct struct {
+	_kind string `gae:"$kind,Index"`
+	ID    int64  `gae:"$id"`
+	Value int64
+
+	fail    bool
+	saved   bool
+	loaded  bool
+	deleted *Key
+}
+
+func (h *HookStruct) BeforeSave(c context.Context) error {
+	if h.fail {
+		return errors.New("BeforeSave failed")
+	}
+	h.saved = true
+	h.Value = h.ID
+	return nil
+}
+
+func (h *HookStruct) AfterLoad(c context.Context) error {
+	if h.Value == noSuchEntityID-1 {
+		return errors.New("AfterLoad failed")
+	}
+	h.loaded = true
+	return nil
+}
+
+func (h *HookStruct) BeforeDelete(c context.Context, key *Key) error {
+	if h.fail {
+		return errors.New("BeforeDelete failed")
+	}
+	h.deleted = key
+	return nil
+}
+
+func TestHooks(t *testing.T) {
+	t.Parallel()
+
+	Convey("A testing environment", t, func() {
+		c := info.Set(context.Background(), fakeInfo{})
+		fds := fakeDatastore{}
+		c = SetRawFactory(c, fds.factory())
+
+		Convey("BeforeSave", func() {
+			Convey("is called for single objects and slices", func() {
+				hs := &HookStruct{ID: 1}
+				hss := []HookStruct{{ID: 2}, {ID: 3}}
+				So(Put(c, hs, hss), ShouldBeNil)
+				So(hs.saved, ShouldBeTrue)
+				So(hs.Value, ShouldEqual, 1)
+				for _, h := range hss {
+					So(h.saved, ShouldBeTrue)
+					So(h.Value, ShouldEqual, h.ID)
+				}
+			})
+
+			Convey("aborts the Put if it fails", func() {
+				hss := []*HookStruct{{ID: 1}, {ID: 2, fail: true}}
+				err := Put(c, hss)
+				So(err, ShouldResemble, errors.MultiError{nil, errors.New("BeforeSave failed")})
+			})
+		})
+
+		Convey("AfterLoad", func() {
+			Convey("is called by Get", func() {
+				hss := []*HookStruct{{ID: 1}, {ID: noSuchEntityID - 1}, {ID: noSuchEntityID}}
+				err := Get(c, hss)
+				So(err, ShouldResemble, errors.MultiError{nil, errors.New("AfterLoad failed"), ErrNoSuchEntity})
+				So(hss[0].loaded, ShouldBeTrue)
+				So(hss[2].loaded, ShouldBeFalse)
+			})
+
+			Convey("is called by queries", func() {
+				fds.entities = 2
+				c = SetRawFactory(c, fds.factory())
+				q := NewQuery("Index")
+
+				var hss []HookStruct
+				So(GetAll(c, q, &hss), ShouldBeNil)
+				So(hss, ShouldHaveLength, 2)
+				So(hss[1].loaded, ShouldBeTrue)
+
+				So(Run(c, q, func(h *HookStruct) {
+					So(h.loaded, ShouldBeTrue)
+				}), ShouldBeNil)
+
+				it := NewIterator(c, q)
+				defer it.Close()
+				var h HookStruct
+				So(it.Next(&h), ShouldBeNil)
+				So(h.loaded, ShouldBeTrue)
+			})
+		})
+
+		Convey("BeforeDelete", func() {
+			Convey("is called with the key", func() {
+				hs := &HookStruct{ID: 1}
+				So(Delete(c, hs), ShouldBeNil)
+				So(hs.deleted, ShouldResemble, MakeKey(c, "Index", 1))
+			})
+
+			Convey("aborts the Delete if it fails", func() {
+				deleted := false
+				fds.onDelete = func(*Key) { deleted = true }
+				c = SetRawFactory(c, fds.factory())
+
+				So(Delete(c, &HookStruct{ID: 1, fail: true}), ShouldErrLike, "BeforeDelete failed")
+				So(deleted, ShouldBeFalse)
+			})
+		})
+	})
+}
+
 type fixedDataDatastore struct {
 	RawInterface
 
@@ -1833,6 +1947,49 @@ indexes:
 	})
 }
 
+func TestWriteIndexYAML(t *testing.T) {
+	t.Parallel()
+
+	Convey("writes merged, normalized index YAML", t, func() {
+		idxs := []*IndexDefinition{
+			{Kind: "Store", Ancestor: true, SortBy: []IndexColumn{{Property: "owner"}}},
+			{Kind: "Cat", SortBy: []IndexColumn{{Property: "name"}, {Property: "age", Descending: true}}},
+			{Kind: "Cat", SortBy: []IndexColumn{{Property: "name"}}},
+			{Kind: "Cat", SortBy: []IndexColumn{
+				{Property: "name"}, {Property: "age", Descending: true}, {Property: "__key__"}}},
+		}
+
+		buf := &bytes.Buffer{}
+		So(WriteIndexYAML(buf, idxs), ShouldBeNil)
+		So(buf.String(), ShouldEqual, `indexes:
+
+- kind: Cat
+  properties:
+  - name: name
+  - name: age
+    direction: desc
+
+- kind: Store
+  ancestor: yes
+  properties:
+  - name: owner
+`)
+
+		ids, err := ParseIndexYAML(buf)
+		So(err, ShouldBeNil)
+		So(ids, ShouldResemble, []*IndexDefinition{idxs[1], idxs[0]})
+	})
+
+	Convey("writes an empty index YAML", t, func() {
+		buf := &bytes.Buffer{}
+		So(WriteIndexYAML(buf, nil), ShouldBeNil)
+
+		ids, err := ParseIndexYAML(buf)
+		So(err, ShouldBeNil)
+		So(ids, ShouldBeEmpty)
+	})
+}
+
 func TestFindAndParseIndexYAML(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,263 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+// EncryptionProvider encrypts and decrypts the values of struct fields tagged
+// with `gae:",encrypted"`. Install one with SetEncryptionProvider.
+//
+// Every encrypted value records the ID of the key which encrypted it, so a
+// provider may rotate to a new key while still decrypting values encrypted
+// with older ones. See ReEncrypt.
+type EncryptionProvider interface {
+	// KeyID returns the ID of the key which Encrypt currently uses.
+	KeyID() string
+
+	// Encrypt encrypts plaintext with the current key, and returns the ID of
+	// that key along with the ciphertext.
+	Encrypt(plaintext []byte) (keyID string, ciphertext []byte, err error)
+
+	// Decrypt decrypts ciphertext, which was encrypted with the key keyID.
+	Decrypt(keyID string, ciphertext []byte) ([]byte, error)
+}
+
+// ErrNoEncryptionProvider is returned when saving or loading an encrypted field
+// without an EncryptionProvider installed in the Context.
+var ErrNoEncryptionProvider = errors.New("datastore: no EncryptionProvider installed in the context")
+
+// SetEncryptionProvider installs p in the Context. It's used by Put, Get and
+// queries to encrypt and decrypt the struct fields tagged as encrypted.
+func SetEncryptionProvider(c context.Context, p EncryptionProvider) context.Context {
+	return context.WithValue(c, encryptionProviderKey, p)
+}
+
+// GetEncryptionProvider returns the EncryptionProvider installed in the
+// Context, or nil if there is none.
+func GetEncryptionProvider(c context.Context) EncryptionProvider {
+	p, _ := c.Value(encryptionProviderKey).(EncryptionProvider)
+	return p
+}
+
+// encryptedMagic prefixes every encrypted value. It's followed by the
+// uvarint-encoded length of the key ID, the key ID and the ciphertext.
+const encryptedMagic = "\x00gae:encrypted:v1\x00"
+
+// encryptValue encrypts data with enc, recording the ID of the key used.
+func encryptValue(enc EncryptionProvider, data []byte) ([]byte, error) {
+	if enc == nil {
+		return nil, ErrNoEncryptionProvider
+	}
+	keyID, ciphertext, err := enc.Encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBufferString(encryptedMagic)
+	var n [binary.MaxVarintLen64]byte
+	buf.Write(n[:binary.PutUvarint(n[:], uint64(len(keyID)))])
+	buf.WriteString(keyID)
+	buf.Write(ciphertext)
+	return buf.Bytes(), nil
+}
+
+// splitEncryptedValue returns the key ID and the ciphertext of an encrypted
+// value. ok is false if data isn't an encrypted value.
+func splitEncryptedValue(data []byte) (keyID string, ciphertext []byte, ok bool) {
+	if !bytes.HasPrefix(data, []byte(encryptedMagic)) {
+		return
+	}
+	data = data[len(encryptedMagic):]
+	l, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < l {
+		return
+	}
+	data = data[n:]
+	return string(data[:l]), data[l:], true
+}
+
+// decryptValue is the inverse of encryptValue.
+func decryptValue(enc EncryptionProvider, data []byte) ([]byte, error) {
+	keyID, ciphertext, ok := splitEncryptedValue(data)
+	if !ok {
+		return nil, errors.New("not an encrypted value")
+	}
+	if enc == nil {
+		return nil, ErrNoEncryptionProvider
+	}
+	return enc.Decrypt(keyID, ciphertext)
+}
+
+// AESGCMProvider is an EncryptionProvider which encrypts values locally with
+// AES-GCM. It's suitable for tests, or for applications which manage their own
+// keys.
+type AESGCMProvider struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+var _ EncryptionProvider = (*AESGCMProvider)(nil)
+
+// NewAESGCMProvider returns an AESGCMProvider which encrypts with the key
+// current, and decrypts with any of keys. Each key must be 16, 24 or 32 bytes
+// long, to select AES-128, AES-192 or AES-256.
+func NewAESGCMProvider(keys map[string][]byte, current string) (*AESGCMProvider, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("datastore: no key with the current ID %q", current)
+	}
+	p := &AESGCMProvider{current: current, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("datastore: bad key %q: %s", id, err)
+		}
+		if p.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("datastore: bad key %q: %s", id, err)
+		}
+	}
+	return p, nil
+}
+
+// KeyID implements EncryptionProvider.
+func (p *AESGCMProvider) KeyID() string { return p.current }
+
+// Encrypt implements EncryptionProvider. The random nonce is prepended to the
+// ciphertext.
+func (p *AESGCMProvider) Encrypt(plaintext []byte) (string, []byte, error) {
+	aead := p.aeads[p.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, err
+	}
+	return p.current, aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt implements EncryptionProvider.
+func (p *AESGCMProvider) Decrypt(keyID string, ciphertext []byte) ([]byte, error) {
+	aead := p.aeads[keyID]
+	if aead == nil {
+		return nil, fmt.Errorf("datastore: unknown encryption key %q", keyID)
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("datastore: ciphertext is too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// ReEncrypt rewrites every entity returned by q whose encrypted values weren't
+// encrypted with the current key of the installed EncryptionProvider, so that
+// they are. It returns the number of rewritten entities.
+//
+// Encrypted values are found by their encoding, so ReEncrypt works on any
+// kind without knowing its struct type. Entities are rewritten in batches,
+// outside of transactions, so concurrent writers may need to be stopped.
+func ReEncrypt(c context.Context, q *Query) (int, error) {
+	enc := GetEncryptionProvider(c)
+	if enc == nil {
+		return 0, ErrNoEncryptionProvider
+	}
+	current := enc.KeyID()
+
+	// reEncrypt re-encrypts the outdated values in pm in place, including those
+	// within embedded entities, and returns true if there were any.
+	var reEncrypt func(pm PropertyMap) (bool, error)
+	reEncryptProp := func(p *Property) (bool, error) {
+		switch p.Type() {
+		case PTPropertyMap:
+			return reEncrypt(p.Value().(PropertyMap))
+		case PTBytes:
+		default:
+			return false, nil
+		}
+		keyID, _, ok := splitEncryptedValue(p.Value().([]byte))
+		if !ok || keyID == current {
+			return false, nil
+		}
+		data, err := decryptValue(enc, p.Value().([]byte))
+		if err == nil {
+			data, err = encryptValue(enc, data)
+		}
+		if err != nil {
+			return false, err
+		}
+		*p = MkPropertyNI(data)
+		return true, nil
+	}
+	reEncrypt = func(pm PropertyMap) (changed bool, err error) {
+		for name, pdata := range pm {
+			var props PropertySlice
+			switch t := pdata.(type) {
+			case Property:
+				props = PropertySlice{t}
+			case PropertySlice:
+				props = t
+			}
+			for i := range props {
+				ok, err := reEncryptProp(&props[i])
+				if err != nil {
+					return false, fmt.Errorf("datastore: failed to re-encrypt %q: %s", name, err)
+				}
+				changed = changed || ok
+			}
+			if _, ok := pdata.(Property); ok {
+				pm[name] = props[0]
+			}
+		}
+		return
+	}
+
+	const batchSize = 100
+	count := 0
+	var batch []PropertyMap
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := Put(c, batch); err != nil {
+			return err
+		}
+		count += len(batch)
+		batch = nil
+		return nil
+	}
+
+	err := Run(c, q, func(pm PropertyMap) error {
+		changed, err := reEncrypt(pm)
+		if err != nil || !changed {
+			return err
+		}
+		if batch = append(batch, pm); len(batch) >= batchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	return count, err
+}
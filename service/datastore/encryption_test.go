@@ -0,0 +1,115 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+type Secretive struct {
+	Name   string
+	Token  string            `gae:",encrypted"`
+	Blob   []byte            `gae:",encrypted,gzip"`
+	Config map[string]string `gae:",json,encrypted"`
+	Tokens []string          `gae:",encrypted"`
+}
+
+func TestEncryption(t *testing.T) {
+	t.Parallel()
+
+	Convey("Encryption", t, func() {
+		keys := map[string][]byte{
+			"v1": bytes.Repeat([]byte{1}, 32),
+			"v2": bytes.Repeat([]byte{2}, 16),
+		}
+		v1, err := NewAESGCMProvider(keys, "v1")
+		So(err, ShouldBeNil)
+		v2, err := NewAESGCMProvider(keys, "v2")
+		So(err, ShouldBeNil)
+
+		Convey("NewAESGCMProvider validates its keys", func() {
+			_, err := NewAESGCMProvider(keys, "v3")
+			So(err, ShouldErrLike, `no key with the current ID "v3"`)
+			_, err = NewAESGCMProvider(map[string][]byte{"bad": []byte("short")}, "bad")
+			So(err, ShouldErrLike, `bad key "bad"`)
+		})
+
+		Convey("values record their key ID", func() {
+			data, err := encryptValue(v1, []byte("hello"))
+			So(err, ShouldBeNil)
+			So(bytes.Contains(data, []byte("hello")), ShouldBeFalse)
+
+			keyID, _, ok := splitEncryptedValue(data)
+			So(ok, ShouldBeTrue)
+			So(keyID, ShouldEqual, "v1")
+
+			// v2 still knows the v1 key, so it can decrypt the value.
+			dec, err := decryptValue(v2, data)
+			So(err, ShouldBeNil)
+			So(dec, ShouldResemble, []byte("hello"))
+
+			_, _, ok = splitEncryptedValue([]byte("hello"))
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("struct fields", func() {
+			src := &Secretive{
+				Name:   "n",
+				Token:  "t0k3n",
+				Blob:   []byte("blob"),
+				Config: map[string]string{"a": "b"},
+				Tokens: []string{"x", "y"},
+			}
+			pls := GetPLS(src).(*structPLS)
+
+			Convey("fail without an EncryptionProvider", func() {
+				_, err := pls.Save(false)
+				So(err, ShouldErrLike, "no EncryptionProvider installed")
+			})
+
+			Convey("round trip", func() {
+				pls.enc = v1
+				pm, err := pls.Save(false)
+				So(err, ShouldBeNil)
+				So(pm["Name"], ShouldResemble, mp("n"))
+				for _, name := range []string{"Token", "Blob", "Config"} {
+					p := pm[name].(Property)
+					So(p.IndexSetting(), ShouldEqual, NoIndex)
+					keyID, _, ok := splitEncryptedValue(p.Value().([]byte))
+					So(ok, ShouldBeTrue)
+					So(keyID, ShouldEqual, "v1")
+				}
+				So(pm.Slice("Tokens"), ShouldHaveLength, 2)
+
+				dst := &Secretive{}
+				dpls := GetPLS(dst).(*structPLS)
+				dpls.enc = v2
+				So(dpls.Load(pm), ShouldBeNil)
+				So(dst, ShouldResemble, src)
+
+				Convey("and fail to load with an unknown key", func() {
+					other, err := NewAESGCMProvider(map[string][]byte{"v3": keys["v1"]}, "v3")
+					So(err, ShouldBeNil)
+					dpls.enc = other
+					So(dpls.Load(pm), ShouldErrLike, `unknown encryption key "v1"`)
+				})
+			})
+		})
+	})
+}
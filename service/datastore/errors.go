@@ -32,6 +32,18 @@ var (
 
 	// Stop is an alias for "github.com/conchoid/gae".Stop
 	Stop = gae.Stop
+
+	// Done is returned by Iterator.Next when the query has no more results.
+	Done = errors.New("datastore: no more results")
+
+	// ErrReadOnlyTransaction is returned by Put, Delete and transactional task
+	// adds in a read-only transaction.
+	ErrReadOnlyTransaction = errors.New("datastore: mutation in a read-only transaction")
+
+	// ErrTransactionTooLarge is returned when applying a transaction would
+	// exceed its size budget (see TransactionSizeBudget).
+	ErrTransactionTooLarge = errors.New(
+		"applying the transaction would make the parent transaction too large")
 )
 
 // MakeErrInvalidKey returns an errors.Annotator instance that wraps an invalid
@@ -43,6 +43,7 @@ type FinalizedQuery struct {
 	orders  []IndexColumn
 
 	eqFilts map[string]PropertySlice
+	inFilts map[string]PropertySlice
 
 	ineqFiltProp     string
 	ineqFiltLow      Property
@@ -51,6 +52,16 @@ type FinalizedQuery struct {
 	ineqFiltHigh     Property
 	ineqFiltHighIncl bool
 	ineqFiltHighSet  bool
+	neqFilts         PropertySlice
+
+	// filterGroups are the Or and And groups of the query. Queries with filter
+	// groups always fan out.
+	filterGroups []Filter
+
+	// subQueries is the fan-out of this query, if it has In or Neq filters. It
+	// has one entry per candidate sub-query; entries for sub-queries which can
+	// never have results are nil.
+	subQueries []*FinalizedQuery
 }
 
 // Original returns the original Query object from which this FinalizedQuery was
@@ -154,6 +165,37 @@ func (q *FinalizedQuery) EqFilters() map[string]PropertySlice {
 	return ret
 }
 
+// Filters returns the filter groups of this query (see Query.Or and
+// Query.And), all of which must match in addition to the other filters.
+func (q *FinalizedQuery) Filters() []Filter {
+	return append([]Filter(nil), q.filterGroups...)
+}
+
+// SubQueries returns the queries which this query fans out into, or nil if
+// this query can be run directly.
+//
+// A query fans out if it uses In or Neq filters, or more than one alternative
+// of filter groups. The result set of such a query
+// is the union of the results of its sub-queries, merged according to Orders
+// and deduplicated. The limit, offset and cursors of the original query apply
+// to the merged result set.
+//
+// Implementations of RawInterface never need to handle these queries
+// themselves: Run and Count calls for them are broken up into calls for the
+// individual sub-queries before they reach any filter or implementation.
+func (q *FinalizedQuery) SubQueries() []*FinalizedQuery {
+	if len(q.subQueries) == 0 {
+		return nil
+	}
+	ret := make([]*FinalizedQuery, 0, len(q.subQueries))
+	for _, sq := range q.subQueries {
+		if sq != nil {
+			ret = append(ret, sq)
+		}
+	}
+	return ret
+}
+
 // IneqFilterProp returns the inequality filter property name, if one is used
 // for this filter. An empty return value means that this query does not
 // contain any inequality filters.
@@ -284,7 +326,24 @@ func (q *FinalizedQuery) GQL() string {
 			}
 		}
 	}
+	if len(q.inFilts) > 0 {
+		inProps := make([]string, 0, len(q.inFilts))
+		for k := range q.inFilts {
+			inProps = append(inProps, k)
+		}
+		sort.Strings(inProps)
+		for _, k := range inProps {
+			vals := make([]string, len(q.inFilts[k]))
+			for i, v := range q.inFilts[k] {
+				vals[i] = v.GQL()
+			}
+			filts = append(filts, fmt.Sprintf("%s IN ARRAY(%s)", gqlQuoteName(k), strings.Join(vals, ", ")))
+		}
+	}
 	if q.ineqFiltProp != "" {
+		for _, v := range q.neqFilts {
+			filts = append(filts, fmt.Sprintf("%s != %s", gqlQuoteName(q.ineqFiltProp), v.GQL()))
+		}
 		for _, f := range [](func() (p, op string, v Property)){q.IneqFilterLow, q.IneqFilterHigh} {
 			prop, op, v := f()
 			if prop != "" {
@@ -292,6 +351,9 @@ func (q *FinalizedQuery) GQL() string {
 			}
 		}
 	}
+	for _, g := range q.filterGroups {
+		filts = append(filts, g.GQL())
+	}
 	if anc.propType != PTNull {
 		filts = append(filts, fmt.Sprintf("__key__ HAS ANCESTOR %s", anc.GQL()))
 	}
@@ -332,10 +394,13 @@ func (q *FinalizedQuery) String() string {
 // values of type PTKey, nor does it validate inequality filters that happen to
 // have values of type PTKey (but don't filter on the magic '__key__' field).
 func (q *FinalizedQuery) Valid(kc KeyContext) error {
+	// Queries for metadata kinds, like __property__, filter on metadata keys.
+	allowSpecial := KeyTok{Kind: q.kind}.Special()
+
 	anc := q.Ancestor()
 	if anc != nil {
 		switch {
-		case !anc.Valid(false, kc):
+		case !anc.Valid(allowSpecial, kc):
 			return MakeErrInvalidKey("ancestor [%s] is not valid in context %s", anc, kc).Err()
 		case anc.IsIncomplete():
 			return MakeErrInvalidKey("ancestor [%s] is incomplete", anc).Err()
@@ -344,17 +409,25 @@ func (q *FinalizedQuery) Valid(kc KeyContext) error {
 
 	if q.ineqFiltProp == "__key__" {
 		if q.ineqFiltLowSet {
-			if k := q.ineqFiltLow.Value().(*Key); !k.Valid(false, kc) {
+			if k := q.ineqFiltLow.Value().(*Key); !k.Valid(allowSpecial, kc) {
 				return MakeErrInvalidKey(
 					"low inequality filter key [%s] is not valid in context %s", k, kc).Err()
 			}
 		}
 		if q.ineqFiltHighSet {
-			if k := q.ineqFiltHigh.Value().(*Key); !k.Valid(false, kc) {
+			if k := q.ineqFiltHigh.Value().(*Key); !k.Valid(allowSpecial, kc) {
 				return MakeErrInvalidKey(
 					"high inequality filter key [%s] is not valid in context %s", k, kc).Err()
 			}
 		}
 	}
+
+	for _, sq := range q.subQueries {
+		if sq != nil {
+			if err := sq.Valid(kc); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
@@ -0,0 +1,989 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/conchoid/gae/service/blobstore"
+)
+
+// ParseGQL parses a Cloud Datastore GQL query into a Query.
+//
+// The supported syntax is the one emitted by FinalizedQuery.GQL, which is a
+// subset of the syntax described at
+// https://cloud.google.com/datastore/docs/apis/gql/gql_reference.
+//
+// This includes projections (with DISTINCT), comparisons, IN, IS NULL, OR and
+// AND groups, HAS ANCESTOR, the KEY, DATETIME, BLOB, BLOBKEY and GEOPOINT
+// literals, ORDER BY, and LIMIT and OFFSET (with FIRST and cursors). KEY
+// literals without DATASET and NAMESPACE are made in kc.
+//
+// Values may also be supplied as bindings: "@1" refers to the first binding,
+// "@2" to the second, and so on. A binding of type map[string]interface{}
+// supplies named bindings instead, which are referred to as "@name". Bindings
+// of IN filters may be slices, and bindings of LIMIT and OFFSET may be Cursors,
+// which set the end and start cursor of the Query respectively.
+func ParseGQL(kc KeyContext, gql string, bindings ...interface{}) (*Query, error) {
+	p := &gqlParser{
+		kc:  kc,
+		lex: gqlLexer{src: gql},
+	}
+	for _, b := range bindings {
+		if named, ok := b.(map[string]interface{}); ok {
+			if p.named == nil {
+				p.named = make(map[string]interface{}, len(named))
+			}
+			for k, v := range named {
+				p.named[k] = v
+			}
+		} else {
+			p.positional = append(p.positional, b)
+		}
+	}
+
+	q, err := p.parseQuery()
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+type gqlTokenType int
+
+const (
+	gqlEOF gqlTokenType = iota
+	gqlWord
+	gqlName
+	gqlString
+	gqlNumber
+	gqlBinding
+	gqlOp
+	gqlPunct
+)
+
+type gqlToken struct {
+	typ gqlTokenType
+	val string
+	pos int
+}
+
+func (t gqlToken) String() string {
+	if t.typ == gqlEOF {
+		return "end of query"
+	}
+	return fmt.Sprintf("%q", t.val)
+}
+
+// is returns true iff t is the punctuation, operator or (case-insensitive)
+// keyword s.
+func (t gqlToken) is(s string) bool {
+	switch t.typ {
+	case gqlWord:
+		return strings.EqualFold(t.val, s)
+	case gqlOp, gqlPunct:
+		return t.val == s
+	}
+	return false
+}
+
+// gqlLexer splits a GQL string into tokens.
+type gqlLexer struct {
+	src string
+	pos int
+
+	peeked *gqlToken
+}
+
+var gqlUnescaper = map[byte]string{
+	'0':  "\x00",
+	'b':  "\b",
+	'n':  "\n",
+	'r':  "\r",
+	't':  "\t",
+	'Z':  "\x1A",
+	'\\': "\\",
+	'\'': "'",
+	'"':  "\"",
+	'`':  "`",
+	'%':  `\%`,
+	'_':  `\_`,
+}
+
+func (l *gqlLexer) errorf(pos int, format string, args ...interface{}) error {
+	return fmt.Errorf("gql: %s (at offset %d)", fmt.Sprintf(format, args...), pos)
+}
+
+func (l *gqlLexer) skipSpace() {
+	for l.pos < len(l.src) {
+		r, size := utf8.DecodeRuneInString(l.src[l.pos:])
+		if !unicode.IsSpace(r) {
+			return
+		}
+		l.pos += size
+	}
+}
+
+// peek returns the next token without consuming it.
+func (l *gqlLexer) peek() (gqlToken, error) {
+	if l.peeked == nil {
+		tok, err := l.lex()
+		if err != nil {
+			return tok, err
+		}
+		l.peeked = &tok
+	}
+	return *l.peeked, nil
+}
+
+// next consumes and returns the next token.
+func (l *gqlLexer) next() (gqlToken, error) {
+	tok, err := l.peek()
+	l.peeked = nil
+	return tok, err
+}
+
+// raw consumes the text up to (but excluding) the next occurrence of end. It
+// must not be called while a token is peeked.
+func (l *gqlLexer) raw(end byte) string {
+	l.skipSpace()
+	start := l.pos
+	for l.pos < len(l.src) && l.src[l.pos] != end {
+		l.pos++
+	}
+	return strings.TrimSpace(l.src[start:l.pos])
+}
+
+func isGQLWordChar(r rune, first bool) bool {
+	switch {
+	case r == '_' || r == '$' || unicode.IsLetter(r):
+		return true
+	case !first && (r == '.' || unicode.IsDigit(r)):
+		return true
+	}
+	return false
+}
+
+func (l *gqlLexer) lex() (gqlToken, error) {
+	l.skipSpace()
+	tok := gqlToken{pos: l.pos}
+	if l.pos >= len(l.src) {
+		return tok, nil
+	}
+
+	c := l.src[l.pos]
+	switch {
+	case c == '`' || c == '"' || c == '\'':
+		tok.typ = gqlString
+		if c == '`' {
+			tok.typ = gqlName
+		}
+		val, err := l.lexQuoted(c)
+		tok.val = val
+		return tok, err
+
+	case c == '@':
+		l.pos++
+		start := l.pos
+		for l.pos < len(l.src) {
+			r, size := utf8.DecodeRuneInString(l.src[l.pos:])
+			if !isGQLWordChar(r, false) {
+				break
+			}
+			l.pos += size
+		}
+		if start == l.pos {
+			return tok, l.errorf(tok.pos, "empty binding name")
+		}
+		tok.typ, tok.val = gqlBinding, l.src[start:l.pos]
+		return tok, nil
+
+	case (c >= '0' && c <= '9') ||
+		((c == '-' || c == '.') && l.pos+1 < len(l.src) &&
+			l.src[l.pos+1] >= '0' && l.src[l.pos+1] <= '9'):
+		start := l.pos
+		l.pos++
+		for l.pos < len(l.src) {
+			c := l.src[l.pos]
+			if (c >= '0' && c <= '9') || c == '.' || c == 'e' || c == 'E' ||
+				((c == '-' || c == '+') && (l.src[l.pos-1] == 'e' || l.src[l.pos-1] == 'E')) {
+				l.pos++
+				continue
+			}
+			break
+		}
+		tok.typ, tok.val = gqlNumber, l.src[start:l.pos]
+		return tok, nil
+
+	case c == '<' || c == '>' || c == '!' || c == '=':
+		tok.typ = gqlOp
+		if l.pos+1 < len(l.src) && l.src[l.pos+1] == '=' && c != '=' {
+			tok.val = l.src[l.pos : l.pos+2]
+		} else if c == '!' {
+			return tok, l.errorf(tok.pos, "unexpected %q", c)
+		} else {
+			tok.val = l.src[l.pos : l.pos+1]
+		}
+		l.pos += len(tok.val)
+		return tok, nil
+
+	case strings.IndexByte("(),*+", c) >= 0:
+		l.pos++
+		tok.typ, tok.val = gqlPunct, string(c)
+		return tok, nil
+	}
+
+	r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+	if !isGQLWordChar(r, true) {
+		return tok, l.errorf(tok.pos, "unexpected %q", r)
+	}
+	start := l.pos
+	for l.pos < len(l.src) {
+		r, size := utf8.DecodeRuneInString(l.src[l.pos:])
+		if !isGQLWordChar(r, false) {
+			break
+		}
+		l.pos += size
+	}
+	tok.typ, tok.val = gqlWord, l.src[start:l.pos]
+	return tok, nil
+}
+
+// lexQuoted lexes a string or name quoted with quote, and returns its unescaped
+// contents.
+func (l *gqlLexer) lexQuoted(quote byte) (string, error) {
+	start := l.pos
+	l.pos++
+	buf := bytes.Buffer{}
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == quote:
+			l.pos++
+			// A doubled quote stands for the quote itself.
+			if l.pos < len(l.src) && l.src[l.pos] == quote {
+				buf.WriteByte(quote)
+				l.pos++
+				continue
+			}
+			return buf.String(), nil
+
+		case c == '\\' && l.pos+1 < len(l.src):
+			if s, ok := gqlUnescaper[l.src[l.pos+1]]; ok {
+				buf.WriteString(s)
+			} else {
+				buf.WriteByte(l.src[l.pos+1])
+			}
+			l.pos += 2
+
+		default:
+			buf.WriteByte(c)
+			l.pos++
+		}
+	}
+	return "", l.errorf(start, "unterminated %c", quote)
+}
+
+// gqlParser is a recursive descent parser for GQL.
+type gqlParser struct {
+	kc  KeyContext
+	lex gqlLexer
+
+	positional []interface{}
+	named      map[string]interface{}
+}
+
+func (p *gqlParser) errorf(tok gqlToken, format string, args ...interface{}) error {
+	return p.lex.errorf(tok.pos, format, args...)
+}
+
+// accept consumes the next token if it is s, and returns true iff it did.
+func (p *gqlParser) accept(s string) (bool, error) {
+	tok, err := p.lex.peek()
+	if err != nil || !tok.is(s) {
+		return false, err
+	}
+	p.lex.next()
+	return true, nil
+}
+
+// expect consumes the next token, which must be s.
+func (p *gqlParser) expect(s string) error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	if !tok.is(s) {
+		return p.errorf(tok, "expected %q, got %s", s, tok)
+	}
+	return nil
+}
+
+// parseName parses a property or kind name.
+func (p *gqlParser) parseName() (string, error) {
+	tok, err := p.lex.next()
+	if err != nil {
+		return "", err
+	}
+	if tok.typ != gqlName && tok.typ != gqlWord {
+		return "", p.errorf(tok, "expected a name, got %s", tok)
+	}
+	return tok.val, nil
+}
+
+// binding returns the value of the binding token tok.
+func (p *gqlParser) binding(tok gqlToken) (interface{}, error) {
+	if idx, err := strconv.Atoi(tok.val); err == nil {
+		if idx < 1 || idx > len(p.positional) {
+			return nil, p.errorf(tok, "no value for binding @%d", idx)
+		}
+		return p.positional[idx-1], nil
+	}
+	v, ok := p.named[tok.val]
+	if !ok {
+		return nil, p.errorf(tok, "no value for binding @%s", tok.val)
+	}
+	return v, nil
+}
+
+func (p *gqlParser) parseQuery() (*Query, error) {
+	if err := p.expect("SELECT"); err != nil {
+		return nil, err
+	}
+	q := NewQuery("")
+
+	// Projection
+	distinct, err := p.accept("DISTINCT")
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := p.accept("*"); err != nil {
+		return nil, err
+	} else if !ok {
+		project := []string(nil)
+		for {
+			name, err := p.parseName()
+			if err != nil {
+				return nil, err
+			}
+			project = append(project, name)
+			if ok, err := p.accept(","); err != nil {
+				return nil, err
+			} else if !ok {
+				break
+			}
+		}
+		if len(project) == 1 && project[0] == "__key__" && !distinct {
+			q = q.KeysOnly(true)
+		} else {
+			q = q.Project(project...).Distinct(distinct)
+		}
+	} else if distinct {
+		return nil, fmt.Errorf("gql: DISTINCT requires a projection")
+	}
+
+	if ok, err := p.accept("FROM"); err != nil {
+		return nil, err
+	} else if ok {
+		kind, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		q = q.Kind(kind)
+	}
+
+	if ok, err := p.accept("WHERE"); err != nil {
+		return nil, err
+	} else if ok {
+		if q, err = p.parseWhere(q); err != nil {
+			return nil, err
+		}
+	}
+
+	if ok, err := p.accept("ORDER"); err != nil {
+		return nil, err
+	} else if ok {
+		if err := p.expect("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			name, err := p.parseName()
+			if err != nil {
+				return nil, err
+			}
+			if ok, err := p.accept("DESC"); err != nil {
+				return nil, err
+			} else if ok {
+				name = "-" + name
+			} else if _, err := p.accept("ASC"); err != nil {
+				return nil, err
+			}
+			q = q.Order(name)
+			if ok, err := p.accept(","); err != nil {
+				return nil, err
+			} else if !ok {
+				break
+			}
+		}
+	}
+
+	if ok, err := p.accept("LIMIT"); err != nil {
+		return nil, err
+	} else if ok {
+		if q, err = p.parseLimit(q); err != nil {
+			return nil, err
+		}
+	}
+
+	if ok, err := p.accept("OFFSET"); err != nil {
+		return nil, err
+	} else if ok {
+		if q, err = p.parseOffset(q); err != nil {
+			return nil, err
+		}
+	}
+
+	tok, err := p.lex.next()
+	if err != nil {
+		return nil, err
+	}
+	if tok.typ != gqlEOF {
+		return nil, p.errorf(tok, "unexpected %s", tok)
+	}
+	return q, nil
+}
+
+// gqlCondition is a parsed WHERE condition: a Filter, and the ancestor
+// restriction of a conjunction containing HAS ANCESTOR. A condition which is
+// only an ancestor restriction has a zero Filter.
+type gqlCondition struct {
+	filter   Filter
+	ancestor *Key
+}
+
+func (p *gqlParser) parseWhere(q *Query) (*Query, error) {
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if cond.ancestor != nil {
+		q = q.Ancestor(cond.ancestor)
+	}
+
+	// Conjunctions at the top level apply directly to the query.
+	filters := []Filter{cond.filter}
+	switch cond.filter.op {
+	case "":
+		filters = nil
+	case "AND":
+		filters = cond.filter.children
+	}
+	for _, f := range filters {
+		switch {
+		case f.op == "OR":
+			q = q.Or(f.children...)
+		case f.op == "AND":
+			q = q.And(f.children...)
+		case f.err != nil:
+			return nil, f.err
+		default:
+			q = f.apply(q)
+		}
+	}
+	return q, nil
+}
+
+func (p *gqlParser) parseOr() (gqlCondition, error) {
+	return p.parseGroup("OR", p.parseAnd)
+}
+
+func (p *gqlParser) parseAnd() (gqlCondition, error) {
+	return p.parseGroup("AND", p.parseCondition)
+}
+
+// parseGroup parses a list of operands, separated by op.
+func (p *gqlParser) parseGroup(op string, operand func() (gqlCondition, error)) (gqlCondition, error) {
+	conds := []gqlCondition(nil)
+	for {
+		c, err := operand()
+		if err != nil {
+			return c, err
+		}
+		conds = append(conds, c)
+		if ok, err := p.accept(op); err != nil {
+			return c, err
+		} else if !ok {
+			break
+		}
+	}
+	if len(conds) == 1 {
+		return conds[0], nil
+	}
+
+	ret := gqlCondition{}
+	filters := make([]Filter, 0, len(conds))
+	for _, c := range conds {
+		if c.ancestor != nil {
+			switch {
+			case op == "OR":
+				return gqlCondition{}, fmt.Errorf("gql: HAS ANCESTOR may not be used within OR")
+			case ret.ancestor != nil:
+				return gqlCondition{}, fmt.Errorf("gql: HAS ANCESTOR may only be used once")
+			}
+			ret.ancestor = c.ancestor
+		}
+		switch c.filter.op {
+		case "":
+		case op:
+			// Flatten nested groups of the same kind.
+			filters = append(filters, c.filter.children...)
+		default:
+			filters = append(filters, c.filter)
+		}
+	}
+	if op == "OR" {
+		ret.filter = OrFilter(filters...)
+	} else {
+		ret.filter = AndFilter(filters...)
+	}
+	return ret, nil
+}
+
+func (p *gqlParser) parseCondition() (gqlCondition, error) {
+	if ok, err := p.accept("("); err != nil {
+		return gqlCondition{}, err
+	} else if ok {
+		c, err := p.parseOr()
+		if err != nil {
+			return c, err
+		}
+		return c, p.expect(")")
+	}
+
+	tok, err := p.lex.peek()
+	if err != nil {
+		return gqlCondition{}, err
+	}
+	switch {
+	case tok.is("TRUE"):
+		p.lex.next()
+		return gqlCondition{filter: AndFilter()}, nil
+	case tok.is("FALSE"):
+		p.lex.next()
+		return gqlCondition{filter: OrFilter()}, nil
+	}
+
+	name, err := p.parseName()
+	if err != nil {
+		return gqlCondition{}, err
+	}
+
+	tok, err = p.lex.next()
+	if err != nil {
+		return gqlCondition{}, err
+	}
+	switch {
+	case tok.typ == gqlOp:
+		v, err := p.parseValue()
+		if err != nil {
+			return gqlCondition{}, err
+		}
+		return gqlCondition{filter: mkLeafFilter(tok.val, name, v)}, nil
+
+	case tok.is("IS"):
+		if err := p.expect("NULL"); err != nil {
+			return gqlCondition{}, err
+		}
+		return gqlCondition{filter: EqFilter(name, nil)}, nil
+
+	case tok.is("IN"):
+		vals, err := p.parseInValues()
+		if err != nil {
+			return gqlCondition{}, err
+		}
+		return gqlCondition{filter: InFilter(name, vals...)}, nil
+
+	case tok.is("HAS"):
+		if err := p.expect("ANCESTOR"); err != nil {
+			return gqlCondition{}, err
+		}
+		if name != "__key__" {
+			return gqlCondition{}, p.errorf(tok, "HAS ANCESTOR only applies to __key__")
+		}
+		v, err := p.parseValue()
+		if err != nil {
+			return gqlCondition{}, err
+		}
+		k, ok := v.(*Key)
+		if !ok {
+			return gqlCondition{}, p.errorf(tok, "HAS ANCESTOR requires a key, got %T", v)
+		}
+		return gqlCondition{ancestor: k}, nil
+	}
+	return gqlCondition{}, p.errorf(tok, "expected a comparison, got %s", tok)
+}
+
+// parseInValues parses the right hand side of an IN condition.
+func (p *gqlParser) parseInValues() ([]interface{}, error) {
+	tok, err := p.lex.peek()
+	if err != nil {
+		return nil, err
+	}
+	if tok.typ == gqlBinding {
+		p.lex.next()
+		v, err := p.binding(tok)
+		if err != nil {
+			return nil, err
+		}
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Slice || rv.Type().Elem().Kind() == reflect.Uint8 {
+			return []interface{}{v}, nil
+		}
+		ret := make([]interface{}, rv.Len())
+		for i := range ret {
+			ret[i] = rv.Index(i).Interface()
+		}
+		return ret, nil
+	}
+
+	if err := p.expect("ARRAY"); err != nil {
+		return nil, err
+	}
+	return p.parseArgs()
+}
+
+// parseArgs parses a parenthesized, comma-separated list of values.
+func (p *gqlParser) parseArgs() ([]interface{}, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	ret := []interface{}(nil)
+	if ok, err := p.accept(")"); err != nil || ok {
+		return ret, err
+	}
+	for {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, v)
+
+		tok, err := p.lex.next()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case tok.is(")"):
+			return ret, nil
+		case !tok.is(","):
+			return nil, p.errorf(tok, "expected \",\" or \")\", got %s", tok)
+		}
+	}
+}
+
+func (p *gqlParser) parseValue() (interface{}, error) {
+	tok, err := p.lex.next()
+	if err != nil {
+		return nil, err
+	}
+	switch tok.typ {
+	case gqlString:
+		return tok.val, nil
+
+	case gqlBinding:
+		return p.binding(tok)
+
+	case gqlNumber:
+		// A number is an int unless it has a fraction or an exponent.
+		if !strings.ContainsAny(tok.val, ".eE") {
+			if i, err := strconv.ParseInt(tok.val, 10, 64); err == nil {
+				return i, nil
+			}
+		}
+		f, err := strconv.ParseFloat(tok.val, 64)
+		if err != nil {
+			return nil, p.errorf(tok, "bad number %s", tok)
+		}
+		return f, nil
+
+	case gqlWord:
+		switch strings.ToUpper(tok.val) {
+		case "NULL":
+			return nil, nil
+		case "TRUE":
+			return true, nil
+		case "FALSE":
+			return false, nil
+		case "NAN":
+			return math.NaN(), nil
+		case "KEY":
+			return p.parseKey(tok)
+		case "DATETIME":
+			return p.parseDatetime(tok)
+		case "BLOB":
+			s, err := p.parseStringArg(tok)
+			if err != nil {
+				return nil, err
+			}
+			for _, enc := range []*base64.Encoding{base64.URLEncoding, base64.StdEncoding} {
+				if b, err := enc.DecodeString(s); err == nil {
+					return b, nil
+				}
+			}
+			return nil, p.errorf(tok, "bad BLOB value %q", s)
+		case "BLOBKEY":
+			s, err := p.parseStringArg(tok)
+			return blobstore.Key(s), err
+		case "GEOPOINT":
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			pt := GeoPoint{}
+			ok := len(args) == 2
+			if ok {
+				pt.Lat, ok = gqlFloat(args[0])
+			}
+			if ok {
+				pt.Lng, ok = gqlFloat(args[1])
+			}
+			if !ok || !pt.Valid() {
+				return nil, p.errorf(tok, "bad GEOPOINT value")
+			}
+			return pt, nil
+		}
+	}
+	return nil, p.errorf(tok, "expected a value, got %s", tok)
+}
+
+func gqlFloat(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case int64:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	return 0, false
+}
+
+// parseStringArg parses a single, parenthesized string argument of the
+// function tok.
+func (p *gqlParser) parseStringArg(tok gqlToken) (string, error) {
+	args, err := p.parseArgs()
+	if err != nil {
+		return "", err
+	}
+	if len(args) != 1 {
+		return "", p.errorf(tok, "%s takes a single argument", tok.val)
+	}
+	s, ok := args[0].(string)
+	if !ok {
+		return "", p.errorf(tok, "%s requires a string, got %T", tok.val, args[0])
+	}
+	return s, nil
+}
+
+func (p *gqlParser) parseDatetime(tok gqlToken) (interface{}, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	// FinalizedQuery.GQL emits the timestamp without quotes.
+	s := ""
+	if p.lex.skipSpace(); p.lex.pos < len(p.lex.src) && strings.IndexByte(`"'`, p.lex.src[p.lex.pos]) >= 0 {
+		str, err := p.lex.next()
+		if err != nil {
+			return nil, err
+		}
+		s = str.val
+	} else {
+		s = p.lex.raw(')')
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil, p.errorf(tok, "bad DATETIME value %q: %s", s, err)
+	}
+	return t.UTC(), nil
+}
+
+func (p *gqlParser) parseKey(tok gqlToken) (interface{}, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	kc := p.kc
+	for _, fn := range []string{"DATASET", "NAMESPACE"} {
+		next, err := p.lex.peek()
+		if err != nil {
+			return nil, err
+		}
+		if !next.is(fn) {
+			continue
+		}
+		p.lex.next()
+		s, err := p.parseStringArg(next)
+		if err != nil {
+			return nil, err
+		}
+		if fn == "DATASET" {
+			kc = MkKeyContext(s, "")
+		} else {
+			kc.Namespace = s
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+
+	toks := []KeyTok(nil)
+	for {
+		kind, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		id, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+
+		kt := KeyTok{}
+		ok := false
+		if kt.Kind, ok = kind.(string); !ok {
+			return nil, p.errorf(tok, "key kinds must be strings, got %T", kind)
+		}
+		switch x := id.(type) {
+		case int64:
+			kt.IntID = x
+		case string:
+			kt.StringID = x
+		default:
+			return nil, p.errorf(tok, "key IDs must be integers or strings, got %T", id)
+		}
+		toks = append(toks, kt)
+
+		next, err := p.lex.next()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case next.is(")"):
+			return kc.NewKeyToks(toks), nil
+		case !next.is(","):
+			return nil, p.errorf(next, "expected \",\" or \")\", got %s", next)
+		}
+	}
+}
+
+// parseCursorOrInt parses a literal integer, or a binding of an integer or a
+// Cursor.
+func (p *gqlParser) parseCursorOrInt() (Cursor, int32, error) {
+	tok, err := p.lex.peek()
+	if err != nil {
+		return nil, 0, err
+	}
+	v, err := p.parseValue()
+	if err != nil {
+		return nil, 0, err
+	}
+	switch x := v.(type) {
+	case Cursor:
+		return x, 0, nil
+	case int, int32, int64:
+		i := reflect.ValueOf(x).Int()
+		if i < 0 || i > math.MaxInt32 {
+			return nil, 0, p.errorf(tok, "%d is out of range", i)
+		}
+		return nil, int32(i), nil
+	}
+	return nil, 0, p.errorf(tok, "expected an integer or a cursor, got %T", v)
+}
+
+func (p *gqlParser) parseLimit(q *Query) (*Query, error) {
+	first, err := p.accept("FIRST")
+	if err != nil {
+		return nil, err
+	}
+	if first {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+	}
+
+	c, n, err := p.parseCursorOrInt()
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		q = q.End(c)
+	} else {
+		q = q.Limit(n)
+	}
+
+	if first {
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		c, n, err := p.parseCursorOrInt()
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			return nil, fmt.Errorf("gql: the second argument of FIRST must be an integer")
+		}
+		q = q.Limit(n)
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+func (p *gqlParser) parseOffset(q *Query) (*Query, error) {
+	c, n, err := p.parseCursorOrInt()
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return q.Offset(n), nil
+	}
+
+	q = q.Start(c)
+	if ok, err := p.accept("+"); err != nil {
+		return nil, err
+	} else if ok {
+		c, n, err := p.parseCursorOrInt()
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			return nil, fmt.Errorf("gql: only an integer may be added to a cursor")
+		}
+		q = q.Offset(n)
+	}
+	return q, nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/conchoid/gae/service/blobstore"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+func TestParseGQL(t *testing.T) {
+	t.Parallel()
+
+	kc := MkKeyContext("s~aid", "ns")
+
+	parse := func(gql string, bindings ...interface{}) *FinalizedQuery {
+		q, err := ParseGQL(kc, gql, bindings...)
+		So(err, ShouldBeNil)
+		fq, err := q.Finalize()
+		So(err, ShouldBeNil)
+		return fq
+	}
+
+	Convey("ParseGQL", t, func() {
+		Convey("round-trips the output of GQL", func() {
+			for _, tc := range queryTests {
+				if tc.gql == "" {
+					continue
+				}
+				So(parse(tc.gql).GQL(), ShouldEqual, tc.gql)
+			}
+		})
+
+		Convey("round-trips literals", func() {
+			gqls := []string{
+				"SELECT * FROM `Foo` WHERE `a` = \"it\\'s \\\"quoted\\\"\\n\" ORDER BY `__key__`",
+				"SELECT * FROM `Foo` WHERE `a` = 1.5 AND `b` = true AND `c` IS NULL ORDER BY `__key__`",
+				"SELECT * FROM `Foo` WHERE `a` = BLOB(\"aGVsbG8=\") AND `b` = BLOBKEY(\"bk\") ORDER BY `__key__`",
+				"SELECT * FROM `Foo` WHERE `a` = GEOPOINT(1.5, -2.25) ORDER BY `__key__`",
+				"SELECT * FROM `Foo` WHERE `a` = DATETIME(2016-01-02T03:04:05.000000006Z) ORDER BY `__key__`",
+				"SELECT * FROM `Foo` WHERE `a` = KEY(DATASET(\"other\"), \"Kind\", \"id\") ORDER BY `__key__`",
+				"SELECT * FROM `Foo` WHERE `we \\`ird` > -3 ORDER BY `we \\`ird`, `__key__` LIMIT 10 OFFSET 20",
+			}
+			for _, gql := range gqls {
+				So(parse(gql).GQL(), ShouldEqual, gql)
+			}
+		})
+
+		Convey("round-trips value types", func() {
+			vals := []interface{}{
+				int64(2), int64(-3), 2.0, -3.0, 1.5, 1e21, 1e-7, true, "2",
+			}
+			for _, v := range vals {
+				fq, err := NewQuery("Foo").Eq("a", v).Finalize()
+				So(err, ShouldBeNil)
+				eq := parse(fq.GQL()).EqFilters()["a"]
+				So(eq, ShouldHaveLength, 1)
+				So(eq[0].Type(), ShouldEqual, fq.EqFilters()["a"][0].Type())
+				So(eq[0].Value(), ShouldResemble, fq.EqFilters()["a"][0].Value())
+			}
+		})
+
+		Convey("accepts the wider GQL syntax", func() {
+			fq := parse(`select distinct a, b from Foo
+				where a > 1 and (b = 'x' or b = 'y') and __key__ has ancestor key('Parent', 1)
+				order by a desc, b asc limit 5`)
+			So(fq.GQL(), ShouldEqual, "SELECT DISTINCT `a`, `b` FROM `Foo` "+
+				"WHERE `a` > 1 AND (`b` = \"x\" OR `b` = \"y\") "+
+				"AND __key__ HAS ANCESTOR KEY(DATASET(\"s~aid\"), NAMESPACE(\"ns\"), \"Parent\", 1) "+
+				"ORDER BY `a` DESC, `b`, `__key__` LIMIT 5")
+
+			fq = parse("SELECT __key__ FROM Foo WHERE a = DATETIME('2016-01-02T03:04:05Z')")
+			So(fq.KeysOnly(), ShouldBeTrue)
+			So(fq.EqFilters()["a"][0].Value(), ShouldResemble, time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC))
+		})
+
+		Convey("resolves bindings", func() {
+			fq := parse("SELECT * FROM Foo WHERE a = @1 AND b IN @2 AND c = @name AND d = @1",
+				"one", []int64{1, 2}, map[string]interface{}{"name": blobstore.Key("bk")})
+			So(fq.GQL(), ShouldEqual, "SELECT * FROM `Foo` "+
+				"WHERE `a` = \"one\" AND `c` = BLOBKEY(\"bk\") AND `d` = \"one\" AND `b` IN ARRAY(1, 2) "+
+				"ORDER BY `__key__`")
+
+			Convey("including cursors", func() {
+				fq := parse("SELECT * FROM Foo LIMIT FIRST(@end, 5) OFFSET @start + 3",
+					map[string]interface{}{"start": fakeCursor(10), "end": fakeCursor(20)})
+				start, end := fq.Bounds()
+				So(start, ShouldEqual, fakeCursor(10))
+				So(end, ShouldEqual, fakeCursor(20))
+				limit, _ := fq.Limit()
+				offset, _ := fq.Offset()
+				So(limit, ShouldEqual, 5)
+				So(offset, ShouldEqual, 3)
+			})
+		})
+
+		Convey("rejects bad queries", func() {
+			bad := []struct {
+				gql string
+				err string
+			}{
+				{"DELETE FROM Foo", `expected "SELECT"`},
+				{"SELECT * FROM Foo WHERE", "expected a name"},
+				{"SELECT * FROM Foo WHERE a = 'open", "unterminated '"},
+				{"SELECT * FROM Foo WHERE a = @1", "no value for binding @1"},
+				{"SELECT * FROM Foo WHERE a = @nope", "no value for binding @nope"},
+				{"SELECT * FROM Foo WHERE a HAS ANCESTOR KEY('A', 1)", "only applies to __key__"},
+				{"SELECT * FROM Foo WHERE a = 1 OR __key__ HAS ANCESTOR KEY('A', 1)", "may not be used within OR"},
+				{"SELECT * FROM Foo WHERE a = DATETIME(yesterday)", "bad DATETIME value"},
+				{"SELECT * FROM Foo WHERE a = KEY('A', 1.5)", "key IDs must be integers or strings"},
+				{"SELECT * FROM Foo LIMIT 'ten'", "expected an integer or a cursor"},
+				{"SELECT * FROM Foo ORDER BY a LIMIT 1 junk", `unexpected "junk"`},
+			}
+			for _, b := range bad {
+				_, err := ParseGQL(kc, b.gql)
+				So(err, ShouldErrLike, b.err)
+			}
+		})
+	})
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"reflect"
+
+	"golang.org/x/net/context"
+)
+
+// BeforeSaver may be implemented by entities to update themselves before they
+// are saved, for example to set a modification timestamp. Unlike implementing
+// PropertyLoadSaver, this keeps the default struct encoding.
+//
+// Put calls BeforeSave on each entity before any of them are saved. If it
+// returns an error, that error is reported for the entity, and nothing is
+// written.
+type BeforeSaver interface {
+	BeforeSave(c context.Context) error
+}
+
+// AfterLoader may be implemented by entities to update themselves after they
+// are loaded, for example to normalize fields.
+//
+// Get, GetAll, Run and Iterator.Next call AfterLoad on each entity which was
+// loaded successfully. If it returns an error, that error is reported for the
+// entity as if it had failed to load.
+type AfterLoader interface {
+	AfterLoad(c context.Context) error
+}
+
+// BeforeDeleter may be implemented by entities to check or clean up before
+// they are deleted. key is the key of the entity being deleted.
+//
+// Delete calls BeforeDelete on each entity before any of them are deleted. If
+// it returns an error, that error is reported for the entity, and nothing is
+// deleted. It's not called when deleting by *Key.
+type BeforeDeleter interface {
+	BeforeDelete(c context.Context, key *Key) error
+}
+
+// hookObj returns the object in slot which may implement the hook interfaces.
+// If slot holds a struct, this is a pointer to it, so hooks may be implemented
+// with pointer receivers.
+func hookObj(slot reflect.Value) interface{} {
+	if slot.Kind() == reflect.Interface {
+		slot = slot.Elem()
+	}
+	if slot.Kind() != reflect.Ptr && slot.CanAddr() {
+		slot = slot.Addr()
+	}
+	return slot.Interface()
+}
+
+func (mat *multiArgType) beforeSave(c context.Context, slot reflect.Value) error {
+	if h, ok := hookObj(slot).(BeforeSaver); ok {
+		return h.BeforeSave(c)
+	}
+	return nil
+}
+
+func (mat *multiArgType) afterLoad(c context.Context, slot reflect.Value) error {
+	if h, ok := hookObj(slot).(AfterLoader); ok {
+		return h.AfterLoad(c)
+	}
+	return nil
+}
+
+func (mat *multiArgType) beforeDelete(c context.Context, slot reflect.Value, key *Key) error {
+	if h, ok := hookObj(slot).(BeforeDeleter); ok {
+		return h.BeforeDelete(c, key)
+	}
+	return nil
+}
+
+// setPMWithHooks loads pm into slot, and then calls its AfterLoad hook. If
+// expired entities are hidden (see WithHideExpired) and the loaded entity is
+// expired, it returns ErrNoSuchEntity instead.
+func (mat *multiArgType) setPMWithHooks(c context.Context, slot reflect.Value, pm PropertyMap) error {
+	if err := mat.setPM(slot, pm, GetEncryptionProvider(c)); err != nil {
+		return err
+	}
+	if hideExpired(c) && mat.isExpired(c, slot) {
+		return ErrNoSuchEntity
+	}
+	return mat.afterLoad(c, slot)
+}
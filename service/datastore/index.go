@@ -17,7 +17,9 @@ package datastore
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 
 	"gopkg.in/yaml.v2"
 )
@@ -358,3 +360,56 @@ func (id *IndexDefinition) String() string {
 	}
 	return ret.String()
 }
+
+// IndexSet is a set of compound IndexDefinitions. It is safe for concurrent
+// use, and its zero value is an empty set.
+//
+// IndexDefinitions are added to the set in the form they'd have in an index
+// YAML file (i.e. without the implicit trailing ascending __key__ column), so
+// two definitions of the same index are only added once.
+type IndexSet struct {
+	mu   sync.Mutex
+	idxs []*IndexDefinition
+}
+
+// Add adds the compound IndexDefinitions to the set. Builtin and non-compound
+// IndexDefinitions are ignored.
+func (s *IndexSet) Add(idxs ...*IndexDefinition) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+outer:
+	for _, id := range idxs {
+		if n := len(id.SortBy); n > 0 && id.SortBy[n-1] == (IndexColumn{Property: "__key__"}) {
+			cpy := *id
+			cpy.SortBy = id.SortBy[:n-1]
+			id = &cpy
+		}
+		if !id.Compound() {
+			continue
+		}
+		for _, o := range s.idxs {
+			if o.Equal(id) {
+				continue outer
+			}
+		}
+		s.idxs = append(s.idxs, id)
+	}
+}
+
+// Indexes returns the IndexDefinitions of the set, in sorted order.
+func (s *IndexSet) Indexes() []*IndexDefinition {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := make([]*IndexDefinition, len(s.idxs))
+	copy(ret, s.idxs)
+	sort.Sort(indexDefinitionSlice(ret))
+	return ret
+}
+
+type indexDefinitionSlice []*IndexDefinition
+
+func (s indexDefinitionSlice) Len() int           { return len(s) }
+func (s indexDefinitionSlice) Less(i, j int) bool { return s[i].Less(s[j]) }
+func (s indexDefinitionSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
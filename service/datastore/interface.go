@@ -154,7 +154,7 @@ func AllocateIDs(c context.Context, ent ...interface{}) error {
 		panic(err)
 	}
 
-	keys, _, err := mma.getKeysPMs(GetKeyContext(c), false)
+	keys, _, err := mma.getKeysPMs(GetKeyContext(c), GetEncryptionProvider(c), false)
 	if err != nil {
 		return maybeSingleError(err, ent)
 	}
@@ -369,10 +369,14 @@ func Run(c context.Context, q *Query, cb interface{}) error {
 	} else {
 		err = raw.Run(fq, func(k *Key, pm PropertyMap, gc CursorCB) error {
 			itm := mat.newElem()
-			if err := mat.setPM(itm, pm); err != nil {
+			mat.setKey(itm, k)
+			switch err := mat.setPMWithHooks(c, itm, pm); err {
+			case nil:
+			case ErrNoSuchEntity:
+				return nil // expired
+			default:
 				return err
 			}
-			mat.setKey(itm, k)
 			return rcb(itm, gc)
 		})
 	}
@@ -413,10 +417,7 @@ func DecodeCursor(c context.Context, s string) (Cursor, error) {
 //     PropertyLoadSaver
 //   - *[]*Key implies a keys-only query.
 func GetAll(c context.Context, q *Query, dst interface{}) error {
-	return getAllRaw(Raw(c), q, dst)
-}
-
-func getAllRaw(raw RawInterface, q *Query, dst interface{}) error {
+	raw := Raw(c)
 	v := reflect.ValueOf(dst)
 	if v.Kind() != reflect.Ptr {
 		panic(fmt.Errorf("invalid GetAll dst: must have a ptr-to-slice: %T", dst))
@@ -453,8 +454,13 @@ func getAllRaw(raw RawInterface, q *Query, dst interface{}) error {
 		slice.Set(reflect.Append(slice, mat.newElem()))
 		itm := slice.Index(i)
 		mat.setKey(itm, k)
-		err := mat.setPM(itm, pm)
-		if err != nil {
+		switch err := mat.setPMWithHooks(c, itm, pm); err {
+		case nil:
+		case ErrNoSuchEntity:
+			// expired
+			slice.Set(slice.Slice(0, i))
+			return nil
+		default:
 			errs[i] = err
 		}
 		i++
@@ -503,7 +509,7 @@ func Exists(c context.Context, ent ...interface{}) (*ExistsResult, error) {
 		panic(err)
 	}
 
-	keys, _, err := mma.getKeysPMs(GetKeyContext(c), false)
+	keys, _, err := mma.getKeysPMs(GetKeyContext(c), GetEncryptionProvider(c), false)
 	if err != nil {
 		return nil, maybeSingleError(err, ent)
 	}
@@ -532,6 +538,9 @@ func Exists(c context.Context, ent ...interface{}) (*ExistsResult, error) {
 //	- []I, where I is some interface type. Each element of the slice must
 //	  be non-nil, and its underlying type must be either *S or *P.
 //
+// Entities which implement AfterLoader have their AfterLoad hook called once
+// they are loaded.
+//
 // If an error is encountered, the returned error value will depend on the
 // input arguments. If one argument is supplied, the result will be the
 // encountered error type. If multiple arguments are supplied, the result will
@@ -551,7 +560,7 @@ func Get(c context.Context, dst ...interface{}) error {
 		panic(err)
 	}
 
-	keys, pms, err := mma.getKeysPMs(GetKeyContext(c), true)
+	keys, pms, err := mma.getKeysPMs(GetKeyContext(c), nil, true)
 	if err != nil {
 		return maybeSingleError(err, dst)
 	}
@@ -570,7 +579,7 @@ func Get(c context.Context, dst ...interface{}) error {
 		}
 
 		mat, v := mma.get(index)
-		if err := mat.setPM(v, pm); err != nil {
+		if err := mat.setPMWithHooks(c, v, pm); err != nil {
 			et.trackError(index, err)
 			return nil
 		}
@@ -603,6 +612,17 @@ func Get(c context.Context, dst ...interface{}) error {
 // A model with a string-typed `$id` field will not accept an integer id'd *Key
 // and will cause the Put to fail.
 //
+// Entities which implement BeforeSaver have their BeforeSave hook called
+// before anything is written. Struct fields are then checked against their
+// validation rules (see Validate), and nothing is written if any of them
+// fail.
+//
+// Objects with a `$version` meta field (an integer) are written with
+// optimistic concurrency: each one is checked and written in a transaction
+// (the current one, if any), and fails with an *ErrVersionConflict if the
+// stored entity's version isn't the object's. On success, the object's version
+// is incremented. Loading an entity sets the field to the stored version.
+//
 // If an error is encountered, the returned error value will depend on the
 // input arguments. If one argument is supplied, the result will be the
 // encountered error type. If multiple arguments are supplied, the result will
@@ -613,10 +633,6 @@ func Get(c context.Context, dst ...interface{}) error {
 // that in the scenario where multiple slices are provided, this will return a
 // MultiError containing a nested MultiError for each slice argument.
 func Put(c context.Context, src ...interface{}) error {
-	return putRaw(Raw(c), GetKeyContext(c), src)
-}
-
-func putRaw(raw RawInterface, kctx KeyContext, src []interface{}) error {
 	if len(src) == 0 {
 		return nil
 	}
@@ -626,7 +642,17 @@ func putRaw(raw RawInterface, kctx KeyContext, src []interface{}) error {
 		panic(err)
 	}
 
-	keys, vals, err := mma.getKeysPMs(kctx, false)
+	err = mma.runHooks(func(_ int, mat *multiArgType, slot reflect.Value) error {
+		if err := mat.beforeSave(c, slot); err != nil {
+			return err
+		}
+		return mat.validate(slot)
+	})
+	if err != nil {
+		return maybeSingleError(err, src)
+	}
+
+	keys, vals, err := mma.getKeysPMs(GetKeyContext(c), GetEncryptionProvider(c), false)
 	if err != nil {
 		return maybeSingleError(err, src)
 	}
@@ -634,8 +660,24 @@ func putRaw(raw RawInterface, kctx KeyContext, src []interface{}) error {
 		return nil
 	}
 
+	// Objects with a $version meta field are written one at a time, by
+	// putVersioned.
+	var versions map[int]int64
+	for i, pm := range vals {
+		version, ok, err := versionMeta(pm)
+		if err != nil {
+			return maybeSingleError(err, src)
+		}
+		if ok {
+			if versions == nil {
+				versions = make(map[int]int64)
+			}
+			versions[i] = version
+		}
+	}
+
 	et := newErrorTracker(mma)
-	err = filterStop(raw.PutMulti(keys, vals, func(idx int, key *Key, err error) error {
+	cb := func(idx int, key *Key, err error) error {
 		index := mma.index(idx)
 
 		if err != nil {
@@ -643,13 +685,39 @@ func putRaw(raw RawInterface, kctx KeyContext, src []interface{}) error {
 			return nil
 		}
 
+		mat, v := mma.get(index)
 		if !key.Equal(keys[idx]) {
-			mat, v := mma.get(index)
 			mat.setKey(v, key)
 		}
+		if version, ok := versions[idx]; ok {
+			mat.getMGS(v).SetMeta("version", version+1)
+		}
 
 		return nil
-	}))
+	}
+
+	if len(versions) == 0 {
+		err = filterStop(Raw(c).PutMulti(keys, vals, cb))
+	} else {
+		var plainKeys []*Key
+		var plainVals []PropertyMap
+		var plainIdx []int
+		for i := range keys {
+			if version, ok := versions[i]; ok {
+				key, err := putVersioned(c, keys[i], vals[i], version)
+				cb(i, key, err)
+			} else {
+				plainKeys = append(plainKeys, keys[i])
+				plainVals = append(plainVals, vals[i])
+				plainIdx = append(plainIdx, i)
+			}
+		}
+		if len(plainKeys) > 0 {
+			err = filterStop(Raw(c).PutMulti(plainKeys, plainVals, func(j int, key *Key, err error) error {
+				return cb(plainIdx[j], key, err)
+			}))
+		}
+	}
 
 	if err == nil {
 		err = et.error()
@@ -669,6 +737,9 @@ func putRaw(raw RawInterface, kctx KeyContext, src []interface{}) error {
 //	- *Key, to remove a specific key from the datastore.
 //	- []*Key, to remove a slice of keys from the datastore.
 //
+// Entities which implement BeforeDeleter have their BeforeDelete hook called
+// before anything is deleted.
+//
 // If an error is encountered, the returned error value will depend on the
 // input arguments. If one argument is supplied, the result will be the
 // encountered error type. If multiple arguments are supplied, the result will
@@ -688,7 +759,7 @@ func Delete(c context.Context, ent ...interface{}) error {
 		panic(err)
 	}
 
-	keys, _, err := mma.getKeysPMs(GetKeyContext(c), false)
+	keys, _, err := mma.getKeysPMs(GetKeyContext(c), GetEncryptionProvider(c), false)
 	if err != nil {
 		return maybeSingleError(err, ent)
 	}
@@ -696,6 +767,13 @@ func Delete(c context.Context, ent ...interface{}) error {
 		return nil
 	}
 
+	err = mma.runHooks(func(i int, mat *multiArgType, slot reflect.Value) error {
+		return mat.beforeDelete(c, slot, keys[i])
+	})
+	if err != nil {
+		return maybeSingleError(err, ent)
+	}
+
 	et := newErrorTracker(mma)
 	err = filterStop(Raw(c).DeleteMulti(keys, func(idx int, err error) error {
 		if err != nil {
@@ -0,0 +1,249 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultIteratorBatchSize is the number of results which an Iterator created
+// by NewIterator fetches at a time.
+const DefaultIteratorBatchSize = 100
+
+// errIteratorClosed is returned by Iterator.Next after Close.
+var errIteratorClosed = errors.New("datastore: iterator is closed")
+
+// iteratorResult is a single buffered result of an Iterator.
+type iteratorResult struct {
+	key       *Key
+	data      PropertyMap
+	cursor    Cursor
+	cursorErr error
+}
+
+// Iterator is the result of running a query with NewIterator. Unlike Run, it
+// lets the caller pull results one at a time.
+//
+// An Iterator is not safe for concurrent use.
+type Iterator struct {
+	c         context.Context
+	raw       RawInterface
+	q         *Query
+	batchSize int32
+
+	// limit is the number of results which the Iterator may still return, or -1
+	// for no limit.
+	limit int32
+
+	buf []iteratorResult
+
+	// fetched is the number of results which were fetched so far.
+	fetched int32
+	// next is the cursor to continue fetching from.
+	next Cursor
+	// noCursors is true if the underlying RawInterface does not produce
+	// cursors. Such Iterators continue fetching with offsets instead.
+	noCursors bool
+	exhausted bool
+
+	cursor    Cursor
+	cursorErr error
+
+	err    error
+	closed bool
+}
+
+// NewIterator runs a query and returns an Iterator over its results.
+//
+// The Iterator fetches DefaultIteratorBatchSize results at a time, continuing
+// the query from a cursor for each batch. It works with any RawInterface; if
+// the RawInterface can't provide cursors (e.g. within a transaction), batches
+// are continued with offsets instead.
+//
+// Errors in the query are returned by the first call to Next.
+func NewIterator(c context.Context, q *Query) *Iterator {
+	return NewIteratorBatch(c, DefaultIteratorBatchSize, q)
+}
+
+// NewIteratorBatch is a version of NewIterator with a custom batch size. If
+// batchSize is <= 0, all results are fetched in a single batch.
+func NewIteratorBatch(c context.Context, batchSize int32, q *Query) *Iterator {
+	it := &Iterator{
+		c:         c,
+		raw:       Raw(c),
+		q:         q,
+		batchSize: batchSize,
+		limit:     -1,
+	}
+
+	fq, err := q.Finalize()
+	if err != nil {
+		if err == ErrNullQuery {
+			it.exhausted = true
+		} else {
+			it.err = err
+		}
+		return it
+	}
+	if limit, ok := fq.Limit(); ok {
+		it.limit = limit
+	}
+	it.cursor, _ = fq.Bounds()
+	return it
+}
+
+// Next loads the next result of the query into dst, and returns Done when
+// there are no more results.
+//
+// dst must be one of:
+//   - *S, where S is a struct
+//   - *P, where *P is a concrete type implementing PropertyLoadSaver
+//   - **Key, to retrieve only the key of the result
+//
+// If the Context of the Iterator is cancelled or reaches its deadline, Next
+// returns the Context's error. Other errors from the datastore are sticky:
+// once Next returns one, it keeps returning it. Errors loading the result into
+// dst are not sticky; the Iterator moves on to the next result regardless.
+func (it *Iterator) Next(dst interface{}) error {
+	switch {
+	case it.closed:
+		return errIteratorClosed
+	case it.err != nil:
+		return it.err
+	}
+	if err := it.c.Err(); err != nil {
+		return err
+	}
+
+	if len(it.buf) == 0 {
+		if it.exhausted || it.limit == 0 {
+			return Done
+		}
+		if err := it.fetch(); err != nil {
+			it.err = err
+			return err
+		}
+		if len(it.buf) == 0 {
+			return Done
+		}
+	}
+
+	r := it.buf[0]
+	it.buf = it.buf[1:]
+	it.cursor, it.cursorErr = r.cursor, r.cursorErr
+	if it.limit > 0 {
+		it.limit--
+	}
+
+	if kp, ok := dst.(**Key); ok {
+		*kp = r.key
+		return nil
+	}
+	t := reflect.TypeOf(dst)
+	if err := isOKSingleType(t, false); err != nil {
+		panic(fmt.Errorf("invalid Next dst: %T: %s", dst, err))
+	}
+	mat := parseArg(t, false)
+	if mat == nil {
+		panic(fmt.Errorf("invalid Next dst: %T", dst))
+	}
+	v := reflect.ValueOf(dst)
+	mat.setKey(v, r.key)
+	if r.data == nil {
+		return nil
+	}
+	if err := mat.setPMWithHooks(it.c, v, r.data); err != ErrNoSuchEntity {
+		return err
+	}
+	// The entity is expired, so skip it.
+	if v.Kind() == reflect.Ptr {
+		v.Elem().Set(reflect.Zero(v.Elem().Type()))
+	}
+	return it.Next(dst)
+}
+
+// Cursor returns a cursor for the position just after the last result returned
+// by Next. Before the first call to Next, it returns the starting cursor of the
+// query, which may be nil.
+func (it *Iterator) Cursor() (Cursor, error) {
+	return it.cursor, it.cursorErr
+}
+
+// Close releases the results buffered by the Iterator. Next returns an error
+// after Close.
+func (it *Iterator) Close() {
+	it.closed = true
+	it.buf = nil
+}
+
+// fetch fetches the next batch of results into buf.
+func (it *Iterator) fetch() error {
+	q := it.q
+	switch {
+	case it.noCursors:
+		offset := it.fetched
+		if fq, err := q.Finalize(); err == nil {
+			if o, ok := fq.Offset(); ok {
+				offset += o
+			}
+		}
+		q = q.Offset(offset)
+	case it.next != nil:
+		q = q.Start(it.next)
+	}
+
+	batch := it.batchSize
+	if it.limit >= 0 && (batch <= 0 || it.limit < batch) {
+		batch = it.limit
+	}
+	if batch > 0 {
+		q = q.Limit(batch)
+	}
+	fq, err := q.Finalize()
+	if err != nil {
+		return err
+	}
+
+	count := int32(0)
+	err = it.raw.Run(fq, func(k *Key, pm PropertyMap, gc CursorCB) error {
+		r := iteratorResult{key: k, data: pm}
+		if gc == nil {
+			r.cursorErr = errors.New("datastore: cursors are not available for this query")
+		} else {
+			r.cursor, r.cursorErr = gc()
+		}
+		it.buf = append(it.buf, r)
+		count++
+		return it.c.Err()
+	})
+	if err = filterStop(err); err != nil {
+		return err
+	}
+
+	it.fetched += count
+	if batch <= 0 || count < batch {
+		it.exhausted = true
+	} else if last := it.buf[len(it.buf)-1]; last.cursorErr != nil {
+		it.noCursors = true
+	} else {
+		it.next = last.cursor
+	}
+	return nil
+}
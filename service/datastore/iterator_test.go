@@ -0,0 +1,152 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"testing"
+
+	"github.com/conchoid/gae/service/info"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+// noCursorFilter hides the cursors of query results, like filters which can't
+// provide them do. It implements offsets with the fakeDatastore's cursors.
+type noCursorFilter struct {
+	RawInterface
+}
+
+func (f *noCursorFilter) Run(fq *FinalizedQuery, cb RawRunCB) error {
+	if offset, ok := fq.Offset(); ok {
+		var err error
+		if fq, err = fq.Original().Offset(-1).Start(fakeCursor(offset)).Finalize(); err != nil {
+			return err
+		}
+	}
+	return f.RawInterface.Run(fq, func(k *Key, pm PropertyMap, _ CursorCB) error {
+		return cb(k, pm, nil)
+	})
+}
+
+func TestIterator(t *testing.T) {
+	t.Parallel()
+
+	Convey("A testing datastore with a data set installed", t, func() {
+		c := info.Set(context.Background(), fakeInfo{})
+
+		fds := fakeDatastore{
+			entities: 250,
+		}
+		c = SetRawFactory(c, fds.factory())
+
+		cf := counterFilter{}
+		c = AddRawFilters(c, cf.filter())
+
+		drain := func(it *Iterator) []int64 {
+			ret := []int64(nil)
+			for {
+				var cs CommonStruct
+				switch err := it.Next(&cs); err {
+				case nil:
+					ret = append(ret, cs.Value)
+				case Done:
+					return ret
+				default:
+					panic(err)
+				}
+			}
+		}
+
+		Convey("Can iterate over all results in batches", func() {
+			it := NewIterator(c, NewQuery("CommonStruct"))
+			defer it.Close()
+
+			vals := drain(it)
+			So(vals, ShouldHaveLength, 250)
+			for i, v := range vals {
+				So(v, ShouldEqual, i)
+			}
+			So(cf.run, ShouldEqual, 3)
+
+			So(it.Next(&CommonStruct{}), ShouldEqual, Done)
+		})
+
+		Convey("Respects the limit of the query", func() {
+			it := NewIteratorBatch(c, 10, NewQuery("CommonStruct").Limit(25))
+			So(drain(it), ShouldHaveLength, 25)
+			So(cf.run, ShouldEqual, 3)
+		})
+
+		Convey("Can load keys", func() {
+			it := NewIterator(c, NewQuery("CommonStruct").KeysOnly(true))
+
+			var k *Key
+			So(it.Next(&k), ShouldBeNil)
+			So(k, ShouldResemble, MkKeyContext("s~aid", "ns").MakeKey("Kind", 1))
+		})
+
+		Convey("Can resume from a cursor", func() {
+			q := NewQuery("CommonStruct")
+			it := NewIteratorBatch(c, 7, q)
+			for i := 0; i < 10; i++ {
+				So(it.Next(&CommonStruct{}), ShouldBeNil)
+			}
+			curs, err := it.Cursor()
+			So(err, ShouldBeNil)
+			it.Close()
+
+			vals := drain(NewIteratorBatch(c, 7, q.Start(curs)))
+			So(vals, ShouldHaveLength, 240)
+			So(vals[0], ShouldEqual, 10)
+		})
+
+		Convey("Stops when the context is cancelled", func() {
+			c, cancel := context.WithCancel(c)
+			it := NewIteratorBatch(c, 10, NewQuery("CommonStruct"))
+			So(it.Next(&CommonStruct{}), ShouldBeNil)
+
+			cancel()
+			So(it.Next(&CommonStruct{}), ShouldEqual, context.Canceled)
+		})
+
+		Convey("Returns query errors from Next", func() {
+			it := NewIterator(c, NewQuery("CommonStruct").Order(""))
+			So(it.Next(&CommonStruct{}), ShouldErrLike, "empty order")
+		})
+
+		Convey("Fails after Close", func() {
+			it := NewIterator(c, NewQuery("CommonStruct"))
+			it.Close()
+			So(it.Next(&CommonStruct{}), ShouldErrLike, "iterator is closed")
+		})
+
+		Convey("Works without cursors", func() {
+			c = AddRawFilters(c, func(_ context.Context, raw RawInterface) RawInterface {
+				return &noCursorFilter{raw}
+			})
+
+			it := NewIteratorBatch(c, 100, NewQuery("CommonStruct"))
+			vals := drain(it)
+			So(vals, ShouldHaveLength, 250)
+			So(vals[249], ShouldEqual, 249)
+
+			_, err := it.Cursor()
+			So(err, ShouldErrLike, "cursors are not available")
+		})
+	})
+}
@@ -0,0 +1,697 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mapper runs a function over all the entities of a query, using push
+// tasks.
+//
+// A job splits its query into shards (see datastore.SplitQuery), each of which
+// runs as a chain of push tasks, which are added by the first task of the job. A task maps batches of entities until it
+// runs out of time, checkpointing the cursor and the progress of its shard in
+// the datastore after each batch, and then adds the task which continues the
+// shard. Once all the shards are done, the job is done.
+//
+// Batches are mapped at least once: a batch may be mapped again if its task
+// fails or is retried before its checkpoint, so map functions must be
+// idempotent. Likewise, the done callback of a job is retried until it
+// succeeds, so it may be called more than once.
+package mapper
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/conchoid/gae/service/datastore"
+	"github.com/conchoid/gae/service/datastore/serialize"
+	"github.com/conchoid/gae/service/info"
+	tq "github.com/conchoid/gae/service/taskqueue"
+
+	"go.chromium.org/luci/common/clock"
+	"go.chromium.org/luci/common/data/cmpbin"
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultBatchSize is the default number of entities mapped at a time.
+	DefaultBatchSize = 100
+
+	// DefaultTaskDuration is the default time after which a task stops mapping
+	// batches, and adds the task which continues its shard.
+	DefaultTaskDuration = 5 * time.Minute
+
+	// deadlineMargin is the time left before the deadline of the Context of a
+	// task, when it stops mapping batches.
+	deadlineMargin = 30 * time.Second
+)
+
+// ErrNoSuchJob is returned for a job which doesn't exist.
+var ErrNoSuchJob = errors.New("mapper: no such job")
+
+// errStaleTask is returned by checkpoint when the shard was continued by
+// another task.
+var errStaleTask = errors.New("mapper: stale task")
+
+// ID identifies a mapper registered with a Controller.
+type ID string
+
+// Func maps a batch of entities, given their keys. It loads the entities
+// itself if it needs them; e.g. in a transaction, to update them.
+type Func func(c context.Context, keys []*ds.Key) error
+
+// DoneFunc is called once a job is done, with the final state of the job.
+type DoneFunc func(c context.Context, job *Job) error
+
+// State is the state of a job.
+type State string
+
+const (
+	// StateRunning is the state of a job whose shards are running.
+	StateRunning State = "running"
+	// StatePaused is the state of a job which was paused by Pause. Its shards
+	// stop after their current batch, until Resume.
+	StatePaused State = "paused"
+	// StateAborted is the state of a job which was aborted by Abort. Its
+	// shards stop after their current batch.
+	StateAborted State = "aborted"
+	// StateDone is the state of a job whose shards are all done.
+	StateDone State = "done"
+)
+
+// Job is the datastore entity of a job.
+type Job struct {
+	_kind string `gae:"$kind,mapper.Job"`
+	ID    int64  `gae:"$id"`
+
+	// Mapper is the mapper which maps the entities.
+	Mapper ID
+	// Query is the GQL of the query whose entities are mapped. It's only
+	// informational: the job runs the query encoded in QueryData.
+	Query string `gae:",noindex"`
+	// QueryData is the query whose entities are mapped, as encoded by
+	// encodeQuery.
+	QueryData []byte `gae:",noindex"`
+	// State is the state of the job.
+	State State
+	// Shards is the number of shards of the job.
+	Shards int `gae:",noindex"`
+	// ShardsDone is the number of shards which are done.
+	ShardsDone int `gae:",noindex"`
+	// DoneCalled is true once the done callback of the mapper succeeded for the
+	// job.
+	DoneCalled bool `gae:",noindex"`
+
+	Created time.Time
+	Updated time.Time `gae:",noindex"`
+}
+
+// Shard is the datastore entity of a shard of a job.
+type Shard struct {
+	_kind string `gae:"$kind,mapper.Shard"`
+	// ID is "<job ID>-<index>".
+	ID string `gae:"$id"`
+
+	// Start is the encoded key at which the shard starts (inclusive), or empty
+	// if it starts with the query of its job.
+	Start string `gae:",noindex"`
+	// End is the encoded key at which the shard ends (exclusive), or empty if
+	// it ends with the query of its job.
+	End string `gae:",noindex"`
+	// Cursor is the cursor of the next batch, or empty if the shard hasn't
+	// started.
+	Cursor string `gae:",noindex"`
+	// Processed is the number of entities mapped by the shard.
+	Processed int64 `gae:",noindex"`
+	// Done is true once all the entities of the shard were mapped.
+	Done bool `gae:",noindex"`
+}
+
+func shardID(job int64, index int) string { return fmt.Sprintf("%d-%d", job, index) }
+
+// mapper is a registered mapper.
+type mapper struct {
+	fn   Func
+	done DoneFunc
+}
+
+// Controller registers mappers, and launches and runs their jobs.
+type Controller struct {
+	// Queue is the name of the push queue which runs the tasks of the jobs. If
+	// it's empty, the default queue is used.
+	Queue string
+	// Path is the URL of the handler of the tasks of the jobs, which must call
+	// HandleTask.
+	Path string
+
+	// BatchSize is the number of entities mapped at a time. If it's 0,
+	// DefaultBatchSize is used.
+	BatchSize int32
+	// TaskDuration is the time after which a task stops mapping batches, and
+	// adds the task which continues its shard. If it's 0, DefaultTaskDuration
+	// is used. Tasks also stop shortly before the deadline of their Context.
+	TaskDuration time.Duration
+
+	mu      sync.RWMutex
+	mappers map[ID]*mapper
+}
+
+// Register registers the mapper id. fn maps the entities of its jobs, and
+// done, if it's not nil, is called once a job is done. If done fails, it's
+// called again when the task of the last shard of the job is retried.
+//
+// Register panics if id is already registered.
+func (ctl *Controller) Register(id ID, fn Func, done DoneFunc) {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+	if _, ok := ctl.mappers[id]; ok {
+		panic(fmt.Errorf("mapper %q is already registered", id))
+	}
+	if ctl.mappers == nil {
+		ctl.mappers = map[ID]*mapper{}
+	}
+	ctl.mappers[id] = &mapper{fn, done}
+}
+
+func (ctl *Controller) getMapper(id ID) (*mapper, error) {
+	ctl.mu.RLock()
+	defer ctl.mu.RUnlock()
+	m, ok := ctl.mappers[id]
+	if !ok {
+		return nil, fmt.Errorf("mapper: %q isn't registered", id)
+	}
+	return m, nil
+}
+
+// Launch starts a job which maps the entities of q with the mapper id, in at
+// most shards shards. q must be splittable by datastore.SplitQuery.
+//
+// The entities of the job are stored in the namespace of the Context, and the
+// job maps the entities of that namespace. The job is stored together with its
+// first task, which adds the tasks of its shards.
+func (ctl *Controller) Launch(c context.Context, id ID, q *ds.Query, shards int) (*Job, error) {
+	if _, err := ctl.getMapper(id); err != nil {
+		return nil, err
+	}
+	fq, err := q.Finalize()
+	if err != nil {
+		return nil, err
+	}
+	data, err := encodeQuery(fq)
+	if err != nil {
+		return nil, err
+	}
+	splits, err := ds.SplitKeys(c, q, shards)
+	if err != nil {
+		return nil, err
+	}
+
+	now := clock.Now(c).UTC()
+	job := &Job{
+		Mapper:    id,
+		Query:     fq.GQL(),
+		QueryData: data,
+		State:     StateRunning,
+		Shards:    len(splits) + 1,
+		Created:   now,
+		Updated:   now,
+	}
+	if err := ds.AllocateIDs(c, job); err != nil {
+		return nil, err
+	}
+
+	// The shards aren't used until the job is stored, so they don't need to be
+	// in its transaction, which couldn't hold as many entity groups anyway.
+	shardEnts := make([]*Shard, job.Shards)
+	for i := range shardEnts {
+		shardEnts[i] = &Shard{ID: shardID(job.ID, i)}
+		if i > 0 {
+			shardEnts[i].Start = splits[i-1].Encode()
+		}
+		if i < len(splits) {
+			shardEnts[i].End = splits[i].Encode()
+		}
+	}
+	if err := ds.Put(c, shardEnts); err != nil {
+		return nil, err
+	}
+	err = ds.RunInTransaction(c, func(c context.Context) error {
+		if err := ds.Put(c, job); err != nil {
+			return err
+		}
+		return tq.Add(c, ctl.Queue, ctl.task(c, job.ID, -1))
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// GetJob returns the job jobID and its shards.
+func (ctl *Controller) GetJob(c context.Context, jobID int64) (*Job, []*Shard, error) {
+	job := &Job{ID: jobID}
+	switch err := ds.Get(c, job); {
+	case err == ds.ErrNoSuchEntity:
+		return nil, nil, ErrNoSuchJob
+	case err != nil:
+		return nil, nil, err
+	}
+
+	shards := make([]*Shard, job.Shards)
+	for i := range shards {
+		shards[i] = &Shard{ID: shardID(jobID, i)}
+	}
+	if err := ds.Get(c, shards); err != nil {
+		return nil, nil, err
+	}
+	return job, shards, nil
+}
+
+// Pause pauses the job jobID, if it's running. Its shards stop after their
+// current batch.
+func (ctl *Controller) Pause(c context.Context, jobID int64) error {
+	_, err := ctl.setState(c, jobID, StatePaused, StateRunning)
+	return err
+}
+
+// Resume resumes the job jobID, if it's paused.
+func (ctl *Controller) Resume(c context.Context, jobID int64) error {
+	job, err := ctl.setState(c, jobID, StateRunning, StatePaused)
+	if err != nil || job == nil {
+		return err
+	}
+
+	return ctl.addShardTasks(c, jobID)
+}
+
+// addShardTasks adds the tasks of the shards of the job jobID which aren't
+// done.
+func (ctl *Controller) addShardTasks(c context.Context, jobID int64) error {
+	_, shards, err := ctl.GetJob(c, jobID)
+	if err != nil {
+		return err
+	}
+	var tasks []*tq.Task
+	for i, s := range shards {
+		if !s.Done {
+			tasks = append(tasks, ctl.task(c, jobID, i))
+		}
+	}
+	if len(tasks) == 0 {
+		return nil
+	}
+	return tq.Add(c, ctl.Queue, tasks...)
+}
+
+// Abort aborts the job jobID, unless it's done. Its shards stop after their
+// current batch.
+func (ctl *Controller) Abort(c context.Context, jobID int64) error {
+	_, err := ctl.setState(c, jobID, StateAborted, StateRunning, StatePaused)
+	return err
+}
+
+// setState sets the state of the job jobID to to, if it's in one of the states
+// from. It returns the updated job, or nil if the job wasn't in any of them.
+func (ctl *Controller) setState(c context.Context, jobID int64, to State, from ...State) (*Job, error) {
+	var ret *Job
+	err := ds.RunInTransaction(c, func(c context.Context) error {
+		ret = nil
+		job := &Job{ID: jobID}
+		switch err := ds.Get(c, job); {
+		case err == ds.ErrNoSuchEntity:
+			return ErrNoSuchJob
+		case err != nil:
+			return err
+		}
+		ok := false
+		for _, st := range from {
+			ok = ok || job.State == st
+		}
+		if !ok {
+			return nil
+		}
+		job.State, job.Updated = to, clock.Now(c).UTC()
+		if err := ds.Put(c, job); err != nil {
+			return err
+		}
+		ret = job
+		return nil
+	}, nil)
+	return ret, err
+}
+
+// task returns the push task which runs the shard index of the job jobID, or
+// the first task of the job, which adds the tasks of its shards, if index is
+// negative.
+func (ctl *Controller) task(c context.Context, jobID int64, index int) *tq.Task {
+	payload := url.Values{
+		"ns":  {info.GetNamespace(c)},
+		"job": {strconv.FormatInt(jobID, 10)},
+	}
+	if index >= 0 {
+		payload.Set("shard", strconv.Itoa(index))
+	}
+	return &tq.Task{
+		Path:    ctl.Path,
+		Method:  "POST",
+		Payload: []byte(payload.Encode()),
+		Header:  http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+	}
+}
+
+// HandleTask runs a task of a job, whose payload is body. It maps batches of
+// the entities of a shard until it runs out of time, and then adds the task
+// which continues the shard.
+//
+// An error is returned if the current batch couldn't be mapped, so that the
+// task is retried.
+func (ctl *Controller) HandleTask(c context.Context, body []byte) error {
+	vals, err := url.ParseQuery(string(body))
+	if err != nil {
+		return err
+	}
+	jobID, err := strconv.ParseInt(vals.Get("job"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("mapper: bad job ID: %s", err)
+	}
+	if c, err = info.Namespace(c, vals.Get("ns")); err != nil {
+		return err
+	}
+	if vals.Get("shard") == "" {
+		return ctl.startJob(c, jobID)
+	}
+	index, err := strconv.Atoi(vals.Get("shard"))
+	if err != nil {
+		return fmt.Errorf("mapper: bad shard index: %s", err)
+	}
+	return ctl.runShard(c, jobID, index)
+}
+
+// startJob runs the first task of the job jobID, which adds the tasks of its
+// shards. If it's retried, some shards may run twice in parallel, which
+// checkpoint detects.
+func (ctl *Controller) startJob(c context.Context, jobID int64) error {
+	job := &Job{ID: jobID}
+	switch err := ds.Get(c, job); {
+	case err == ds.ErrNoSuchEntity:
+		return nil // the job was deleted
+	case err != nil:
+		return err
+	case job.State != StateRunning:
+		return nil
+	}
+	return ctl.addShardTasks(c, jobID)
+}
+
+func (ctl *Controller) runShard(c context.Context, jobID int64, index int) error {
+	job, shard := &Job{ID: jobID}, &Shard{ID: shardID(jobID, index)}
+	if err := ds.Get(c, job, shard); err != nil {
+		if errors.Filter(err, ds.ErrNoSuchEntity) == nil {
+			return nil // the job was deleted
+		}
+		return err
+	}
+	if job.State == StateDone {
+		// The done callback of the job failed, and this is the retry of the task
+		// of its last shard.
+		return ctl.callDone(c, job)
+	}
+	if job.State != StateRunning || shard.Done {
+		return nil
+	}
+	m, err := ctl.getMapper(job.Mapper)
+	if err != nil {
+		return err
+	}
+
+	batchSize := ctl.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	q, err := shardQuery(c, job, shard)
+	if err != nil {
+		return err
+	}
+	q = q.KeysOnly(true).Limit(batchSize)
+
+	taskDuration := ctl.TaskDuration
+	if taskDuration <= 0 {
+		taskDuration = DefaultTaskDuration
+	}
+	deadline := clock.Now(c).Add(taskDuration)
+	if d, ok := c.Deadline(); ok && d.Add(-deadlineMargin).Before(deadline) {
+		deadline = d.Add(-deadlineMargin)
+	}
+
+	for {
+		bq := q
+		if shard.Cursor != "" {
+			cur, err := ds.DecodeCursor(c, shard.Cursor)
+			if err != nil {
+				return err
+			}
+			bq = q.Start(cur)
+		}
+		var keys []*ds.Key
+		var end ds.CursorCB
+		err := ds.Run(c, bq, func(k *ds.Key, cb ds.CursorCB) {
+			keys = append(keys, k)
+			end = cb
+		})
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := m.fn(c, keys); err != nil {
+				return err
+			}
+		}
+
+		next := ""
+		if int32(len(keys)) == batchSize {
+			cur, err := end()
+			if err != nil {
+				return err
+			}
+			next = cur.String()
+		}
+		job, shard, err = ctl.checkpoint(c, jobID, index, shard.Cursor, next, len(keys))
+		switch {
+		case err == errStaleTask:
+			return nil
+		case err != nil:
+			return err
+		}
+
+		// The job is done once its last shard is done, which is this one.
+		switch {
+		case job.State == StateDone:
+			return ctl.callDone(c, job)
+		case job.State != StateRunning || shard.Done:
+			return nil
+		case !clock.Now(c).Before(deadline):
+			return tq.Add(c, ctl.Queue, ctl.task(c, jobID, index))
+		}
+	}
+}
+
+// callDone calls the done callback of the mapper of job, which is done, unless
+// it already succeeded. An error is returned if it fails, so that the task is
+// retried.
+func (ctl *Controller) callDone(c context.Context, job *Job) error {
+	if job.DoneCalled {
+		return nil
+	}
+	m, err := ctl.getMapper(job.Mapper)
+	if err != nil {
+		return err
+	}
+	if m.done != nil {
+		if err := m.done(c, job); err != nil {
+			return errors.Annotate(err, "mapper: done callback of job %d failed", job.ID).Err()
+		}
+	}
+	return ds.RunInTransaction(c, func(c context.Context) error {
+		job := &Job{ID: job.ID}
+		if err := ds.Get(c, job); err != nil {
+			return err
+		}
+		job.DoneCalled = true
+		return ds.Put(c, job)
+	}, nil)
+}
+
+// shardQuery returns the query of shard, a shard of job.
+func shardQuery(c context.Context, job *Job, shard *Shard) (*ds.Query, error) {
+	q, err := decodeQuery(ds.GetKeyContext(c), job.QueryData)
+	if err != nil {
+		return nil, err
+	}
+	if shard.Start != "" {
+		k, err := ds.NewKeyEncoded(shard.Start)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Gte("__key__", k)
+	}
+	if shard.End != "" {
+		k, err := ds.NewKeyEncoded(shard.End)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Lt("__key__", k)
+	}
+	return q, nil
+}
+
+// encodeQuery encodes the kind and the filters of fq, which SplitQuery accepts,
+// so that decodeQuery rebuilds a query with the same results. Unlike GQL, the
+// encoding preserves the types of all the values.
+//
+// The filters are encoded as a PropertyMap per sub-query of fq (or for fq
+// itself, if it doesn't fan out), from "<field> <op>" to the values of the
+// filters.
+func encodeQuery(fq *ds.FinalizedQuery) ([]byte, error) {
+	conjs := fq.SubQueries()
+	if conjs == nil {
+		conjs = []*ds.FinalizedQuery{fq}
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := cmpbin.WriteString(buf, fq.Kind()); err != nil {
+		return nil, err
+	}
+	if _, err := cmpbin.WriteUint(buf, uint64(len(conjs))); err != nil {
+		return nil, err
+	}
+	for _, sq := range conjs {
+		pm := ds.PropertyMap{}
+		for field, vals := range sq.EqFilters() {
+			pm[field+" ="] = vals
+		}
+		if field, op, val := sq.IneqFilterLow(); field != "" {
+			pm[field+" "+op] = val
+		}
+		if field, op, val := sq.IneqFilterHigh(); field != "" {
+			pm[field+" "+op] = val
+		}
+		if err := serialize.WritePropertyMap(buf, serialize.WithContext, pm); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeQuery decodes a query encoded by encodeQuery.
+func decodeQuery(kc ds.KeyContext, data []byte) (*ds.Query, error) {
+	buf := bytes.NewReader(data)
+	kind, _, err := cmpbin.ReadString(buf)
+	if err != nil {
+		return nil, err
+	}
+	n, _, err := cmpbin.ReadUint(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	q := ds.NewQuery(kind)
+	groups := []ds.Filter(nil)
+	for i := uint64(0); i < n; i++ {
+		pm, err := serialize.ReadPropertyMap(buf, serialize.WithContext, kc)
+		if err != nil {
+			return nil, err
+		}
+		filts := []ds.Filter(nil)
+		for name, pdata := range pm {
+			sep := strings.LastIndex(name, " ")
+			if sep < 0 {
+				return nil, fmt.Errorf("mapper: bad filter %q", name)
+			}
+			field, op := name[:sep], name[sep+1:]
+			for _, p := range pdata.Slice() {
+				if field == "__ancestor__" {
+					q = q.Ancestor(p.Value().(*ds.Key))
+					continue
+				}
+				f, err := mkFilter(field, op, p.Value())
+				if err != nil {
+					return nil, err
+				}
+				filts = append(filts, f)
+			}
+		}
+		groups = append(groups, ds.AndFilter(filts...))
+	}
+
+	switch {
+	case len(groups) > 1:
+		q = q.Or(groups...)
+	case len(groups) == 1 && len(groups[0].Children()) > 0:
+		q = q.And(groups...)
+	}
+	return q, nil
+}
+
+// mkFilter returns the filter on field with the operator op and value v.
+func mkFilter(field, op string, v interface{}) (ds.Filter, error) {
+	switch op {
+	case "=":
+		return ds.EqFilter(field, v), nil
+	case "<":
+		return ds.LtFilter(field, v), nil
+	case "<=":
+		return ds.LteFilter(field, v), nil
+	case ">":
+		return ds.GtFilter(field, v), nil
+	case ">=":
+		return ds.GteFilter(field, v), nil
+	}
+	return ds.Filter{}, fmt.Errorf("mapper: bad filter operator %q", op)
+}
+
+// checkpoint records that the batch of n entities at the cursor prev of a
+// shard was mapped, and that the shard continues at next. The shard is done if
+// next is empty. It returns the updated job and shard, or errStaleTask if the
+// shard isn't at prev anymore.
+func (ctl *Controller) checkpoint(c context.Context, jobID int64, index int, prev, next string, n int) (
+	job *Job, shard *Shard, err error) {
+
+	err = ds.RunInTransaction(c, func(c context.Context) error {
+		job, shard = &Job{ID: jobID}, &Shard{ID: shardID(jobID, index)}
+		if err := ds.Get(c, job, shard); err != nil {
+			return err
+		}
+		if shard.Done || shard.Cursor != prev {
+			return errStaleTask
+		}
+
+		shard.Cursor, shard.Processed = next, shard.Processed+int64(n)
+		if next != "" {
+			return ds.Put(c, shard)
+		}
+		shard.Done = true
+		job.ShardsDone++
+		if job.ShardsDone == job.Shards && job.State != StateAborted {
+			job.State = StateDone
+		}
+		job.Updated = clock.Now(c).UTC()
+		return ds.Put(c, job, shard)
+	}, &ds.TransactionOptions{XG: true})
+	return
+}
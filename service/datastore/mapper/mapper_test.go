@@ -0,0 +1,261 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/conchoid/gae/impl/memory"
+	ds "github.com/conchoid/gae/service/datastore"
+	"github.com/conchoid/gae/service/info"
+	tq "github.com/conchoid/gae/service/taskqueue"
+
+	"go.chromium.org/luci/common/clock/testclock"
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+type Record struct {
+	ID      int64 `gae:"$id"`
+	Schema  int
+	Weight  float64
+	Touched int `gae:",noindex"`
+}
+
+func TestMapper(t *testing.T) {
+	t.Parallel()
+
+	Convey("Mapper", t, func() {
+		c, tc := testclock.UseTime(context.Background(), testclock.TestRecentTimeUTC)
+		c = memory.Use(c)
+		ds.GetTestable(c).Consistent(true)
+		tqt := tq.GetTestable(c)
+
+		var records []*Record
+		for i := 1; i <= 50; i++ {
+			records = append(records, &Record{ID: int64(i), Schema: 1, Weight: float64(i%2) + 1})
+		}
+		So(ds.Put(c, records), ShouldBeNil)
+
+		ctl := &Controller{Path: "/mapper", BatchSize: 4, TaskDuration: time.Minute}
+
+		// migrate bumps the schema of the records, and takes 25 seconds per batch,
+		// so a task maps 3 batches.
+		var done []*Job
+		ctl.Register("migrate", func(c context.Context, keys []*ds.Key) error {
+			tc.Add(25 * time.Second)
+			return ds.RunInTransaction(c, func(c context.Context) error {
+				recs := make([]*Record, len(keys))
+				for i, k := range keys {
+					recs[i] = &Record{ID: k.IntID()}
+				}
+				if err := ds.Get(c, recs); err != nil {
+					return err
+				}
+				for _, r := range recs {
+					r.Schema = 2
+					r.Touched++
+				}
+				return ds.Put(c, recs)
+			}, &ds.TransactionOptions{XG: true})
+		}, func(c context.Context, job *Job) error {
+			done = append(done, job)
+			return nil
+		})
+
+		// runTasks runs the scheduled tasks, until there are none left or
+		// rounds rounds ran. It returns the number of tasks which ran.
+		runTasks := func(rounds int) (n int) {
+			for i := 0; i < rounds; i++ {
+				tasks := tqt.GetScheduledTasks()["default"]
+				if len(tasks) == 0 {
+					break
+				}
+				tqt.ResetTasks()
+				for _, t := range tasks {
+					So(t.Path, ShouldEqual, "/mapper")
+					So(ctl.HandleTask(c, t.Payload), ShouldBeNil)
+					n++
+				}
+			}
+			return
+		}
+
+		// launch launches a job, and runs its first task, which adds the tasks of
+		// its shards.
+		launch := func(c context.Context, id ID, q *ds.Query, shards int) *Job {
+			job, err := ctl.Launch(c, id, q, shards)
+			So(err, ShouldBeNil)
+			So(runTasks(1), ShouldEqual, 1)
+			So(tqt.GetScheduledTasks()["default"], ShouldHaveLength, job.Shards)
+			return job
+		}
+
+		schemas := func() map[int]int {
+			var all []*Record
+			So(ds.GetAll(c, ds.NewQuery("Record"), &all), ShouldBeNil)
+			ret := map[int]int{}
+			for _, r := range all {
+				So(r.Touched, ShouldBeLessThanOrEqualTo, 1)
+				ret[r.Schema]++
+			}
+			return ret
+		}
+
+		Convey("maps all the entities of a query", func() {
+			job := launch(c, "migrate", ds.NewQuery("Record"), 2)
+			So(job.Shards, ShouldEqual, 2)
+
+			// Each shard has 25 records, or 7 batches, which take 3 tasks.
+			So(runTasks(100), ShouldEqual, 6)
+			So(schemas(), ShouldResemble, map[int]int{2: 50})
+
+			job, shards, err := ctl.GetJob(c, job.ID)
+			So(err, ShouldBeNil)
+			So(job.State, ShouldEqual, StateDone)
+			So(job.ShardsDone, ShouldEqual, 2)
+			for _, s := range shards {
+				So(s.Done, ShouldBeTrue)
+				So(s.Processed, ShouldEqual, 25)
+			}
+			So(done, ShouldHaveLength, 1)
+			So(done[0].ID, ShouldEqual, job.ID)
+		})
+
+		Convey("maps the entities of a namespace", func() {
+			nc := info.MustNamespace(c, "ns")
+			So(ds.Put(nc, &Record{ID: 1, Schema: 1}), ShouldBeNil)
+
+			launch(nc, "migrate", ds.NewQuery("Record"), 2)
+			runTasks(100)
+
+			r := &Record{ID: 1}
+			So(ds.Get(nc, r), ShouldBeNil)
+			So(r.Schema, ShouldEqual, 2)
+			So(schemas(), ShouldResemble, map[int]int{1: 50})
+		})
+
+		Convey("maps the entities of a query with filters", func() {
+			// The float filter value must not turn into an int.
+			q := ds.NewQuery("Record").Eq("Weight", 2.0)
+			job := launch(c, "migrate", q, 2)
+			runTasks(100)
+			So(schemas(), ShouldResemble, map[int]int{1: 25, 2: 25})
+
+			job, shards, err := ctl.GetJob(c, job.ID)
+			So(err, ShouldBeNil)
+			So(job.State, ShouldEqual, StateDone)
+			total := int64(0)
+			for _, s := range shards {
+				total += s.Processed
+			}
+			So(total, ShouldEqual, 25)
+		})
+
+		Convey("maps the entities of a query with In filters", func() {
+			q := ds.NewQuery("Record").In("Weight", 1.0, 2.0).Gte("__key__", ds.MakeKey(c, "Record", 11))
+			launch(c, "migrate", q, 2)
+			runTasks(100)
+			So(schemas(), ShouldResemble, map[int]int{1: 10, 2: 40})
+		})
+
+		Convey("doesn't store a job whose tasks can't be added", func() {
+			ctl.Queue = "missing"
+			_, err := ctl.Launch(c, "migrate", ds.NewQuery("Record"), 2)
+			So(err, ShouldNotBeNil)
+
+			n, err := ds.Count(c, ds.NewQuery("mapper.Job"))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 0)
+		})
+
+		Convey("retries the done callback until it succeeds", func() {
+			calls := 0
+			ctl.Register("flaky", func(c context.Context, keys []*ds.Key) error {
+				return nil
+			}, func(c context.Context, job *Job) error {
+				calls++
+				if calls == 1 {
+					return errors.New("flaky done")
+				}
+				return nil
+			})
+			job := launch(c, "flaky", ds.NewQuery("Record"), 1)
+
+			tasks := tqt.GetScheduledTasks()["default"]
+			tqt.ResetTasks()
+			for _, t := range tasks {
+				So(ctl.HandleTask(c, t.Payload), ShouldErrLike, "flaky done")
+
+				job, _, err := ctl.GetJob(c, job.ID)
+				So(err, ShouldBeNil)
+				So(job.State, ShouldEqual, StateDone)
+				So(job.DoneCalled, ShouldBeFalse)
+
+				// The task is retried.
+				So(ctl.HandleTask(c, t.Payload), ShouldBeNil)
+				So(calls, ShouldEqual, 2)
+				job, _, err = ctl.GetJob(c, job.ID)
+				So(err, ShouldBeNil)
+				So(job.DoneCalled, ShouldBeTrue)
+
+				So(ctl.HandleTask(c, t.Payload), ShouldBeNil)
+				So(calls, ShouldEqual, 2)
+			}
+		})
+
+		Convey("can be paused and resumed", func() {
+			job := launch(c, "migrate", ds.NewQuery("Record"), 2)
+			So(runTasks(1), ShouldEqual, 2)
+
+			So(ctl.Pause(c, job.ID), ShouldBeNil)
+			So(runTasks(100), ShouldEqual, 2)
+			So(tqt.GetScheduledTasks()["default"], ShouldBeEmpty)
+			So(schemas(), ShouldResemble, map[int]int{1: 26, 2: 24})
+
+			So(ctl.Resume(c, job.ID), ShouldBeNil)
+			runTasks(100)
+			So(schemas(), ShouldResemble, map[int]int{2: 50})
+			So(done, ShouldHaveLength, 1)
+		})
+
+		Convey("can be aborted", func() {
+			job := launch(c, "migrate", ds.NewQuery("Record"), 2)
+			So(runTasks(1), ShouldEqual, 2)
+
+			So(ctl.Abort(c, job.ID), ShouldBeNil)
+			runTasks(100)
+			So(schemas(), ShouldResemble, map[int]int{1: 26, 2: 24})
+			So(done, ShouldBeEmpty)
+
+			job, _, err := ctl.GetJob(c, job.ID)
+			So(err, ShouldBeNil)
+			So(job.State, ShouldEqual, StateAborted)
+
+			So(ctl.Resume(c, job.ID), ShouldBeNil)
+			So(tqt.GetScheduledTasks()["default"], ShouldBeEmpty)
+		})
+
+		Convey("rejects unregistered mappers", func() {
+			_, err := ctl.Launch(c, "unknown", ds.NewQuery("Record"), 2)
+			So(err, ShouldErrLike, "isn't registered")
+		})
+	})
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package meta
+
+import (
+	ds "github.com/conchoid/gae/service/datastore"
+
+	"golang.org/x/net/context"
+)
+
+// KindsCallback is the callback type used with Kinds. The callback will be
+// invoked with each identified kind.
+//
+// If the callback returns an error, iteration will stop. If the error is
+// datastore.Stop, Kinds will stop iterating and return nil. Otherwise, the
+// error will be forwarded.
+type KindsCallback func(string) error
+
+// Kinds returns a list of all of the kinds in the current namespace of the
+// datastore.
+//
+// This is done by issuing a datastore query for kind "__kind__". The resulting
+// keys have the kinds as string IDs.
+func Kinds(c context.Context, cb KindsCallback) error {
+	return KindsInRange(c, "", "", cb)
+}
+
+// KindsInRange runs Kinds, returning only the kinds which are >= start and
+// < end. An empty start or end leaves that side of the range open.
+func KindsInRange(c context.Context, start, end string, cb KindsCallback) error {
+	q := ds.NewQuery("__kind__").KeysOnly(true)
+	if start != "" {
+		q = q.Gte("__key__", ds.MakeKey(c, "__kind__", start))
+	}
+	if end != "" {
+		q = q.Lt("__key__", ds.MakeKey(c, "__kind__", end))
+	}
+
+	return ds.Run(c, q, func(k *ds.Key) error {
+		return cb(k.StringID())
+	})
+}
+
+// KindsCollector exposes a KindsCallback function that aggregates resulting
+// kinds into the collector slice.
+type KindsCollector []string
+
+// Callback is a KindsCallback which adds each kind to the collector.
+func (c *KindsCollector) Callback(v string) error {
+	*c = append(*c, v)
+	return nil
+}
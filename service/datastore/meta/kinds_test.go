@@ -0,0 +1,79 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package meta
+
+import (
+	"testing"
+
+	"github.com/conchoid/gae/impl/memory"
+	ds "github.com/conchoid/gae/service/datastore"
+	"github.com/conchoid/gae/service/info"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestKinds(t *testing.T) {
+	t.Parallel()
+
+	Convey(`A testing datastore`, t, func() {
+		ctx := memory.Use(context.Background())
+
+		Convey(`A datastore with no entities returns {}.`, func() {
+			var coll KindsCollector
+			So(Kinds(ctx, coll.Callback), ShouldBeNil)
+			So(coll, ShouldResemble, KindsCollector(nil))
+		})
+
+		Convey(`With kinds {Apple, Banana, Cherry, Date}`, func() {
+			for _, kind := range []string{"Date", "Banana", "Apple", "Cherry", "Apple"} {
+				So(ds.Put(ctx, ds.PropertyMap{
+					"$key": ds.MkPropertyNI(ds.NewIncompleteKeys(ctx, 1, kind, nil)[0]),
+				}), ShouldBeNil)
+			}
+			// Entities in other namespaces don't count.
+			So(ds.Put(info.MustNamespace(ctx, "other"), ds.PropertyMap{
+				"$key": ds.MkPropertyNI(ds.MakeKey(info.MustNamespace(ctx, "other"), "Elderberry", 1)),
+			}), ShouldBeNil)
+			ds.GetTestable(ctx).CatchupIndexes()
+
+			Convey(`Can collect all kinds.`, func() {
+				var coll KindsCollector
+				So(Kinds(ctx, coll.Callback), ShouldBeNil)
+				So(coll, ShouldResemble, KindsCollector{"Apple", "Banana", "Cherry", "Date"})
+			})
+
+			Convey(`Can collect the kinds in a range.`, func() {
+				var coll KindsCollector
+				So(KindsInRange(ctx, "B", "Date", coll.Callback), ShouldBeNil)
+				So(coll, ShouldResemble, KindsCollector{"Banana", "Cherry"})
+
+				coll = nil
+				So(KindsInRange(ctx, "Banana", "", coll.Callback), ShouldBeNil)
+				So(coll, ShouldResemble, KindsCollector{"Banana", "Cherry", "Date"})
+			})
+
+			Convey(`Can stop early.`, func() {
+				var coll KindsCollector
+				So(Kinds(ctx, func(kind string) error {
+					coll = append(coll, kind)
+					return ds.Stop
+				}), ShouldBeNil)
+				So(coll, ShouldResemble, KindsCollector{"Apple"})
+			})
+		})
+	})
+}
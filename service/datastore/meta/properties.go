@@ -0,0 +1,77 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package meta
+
+import (
+	ds "github.com/conchoid/gae/service/datastore"
+
+	"golang.org/x/net/context"
+)
+
+// Property is an indexed property of a kind, as returned by the "__property__"
+// metadata query.
+type Property struct {
+	// Name is the name of the property.
+	Name string
+	// Representations are the representations of the values of the property,
+	// e.g. "INT64" or "STRING".
+	Representations []string
+}
+
+// PropertiesCallback is the callback type used with Properties. The callback
+// will be invoked with each identified property.
+//
+// If the callback returns an error, iteration will stop. If the error is
+// datastore.Stop, Properties will stop iterating and return nil. Otherwise,
+// the error will be forwarded.
+type PropertiesCallback func(*Property) error
+
+// propertyEntity is an entity returned by a "__property__" query.
+type propertyEntity struct {
+	Key *ds.Key `gae:"$key"`
+
+	Representation []string `gae:"property_representation"`
+}
+
+// Properties returns a list of all of the indexed properties of kind in the
+// current namespace of the datastore.
+//
+// This is done by issuing a datastore query for kind "__property__", with an
+// ancestor `__kind__/kind` key. The resulting keys have the property names as
+// string IDs.
+func Properties(c context.Context, kind string, cb PropertiesCallback) error {
+	return PropertiesInRange(c, kind, "", "", cb)
+}
+
+// PropertiesInRange runs Properties, returning only the properties whose names
+// are >= start and < end. An empty start or end leaves that side of the range
+// open.
+func PropertiesInRange(c context.Context, kind, start, end string, cb PropertiesCallback) error {
+	kindKey := ds.MakeKey(c, "__kind__", kind)
+	q := ds.NewQuery("__property__").Ancestor(kindKey)
+	if start != "" {
+		q = q.Gte("__key__", ds.NewKey(c, "__property__", start, 0, kindKey))
+	}
+	if end != "" {
+		q = q.Lt("__key__", ds.NewKey(c, "__property__", end, 0, kindKey))
+	}
+
+	return ds.Run(c, q, func(pe *propertyEntity) error {
+		return cb(&Property{
+			Name:            pe.Key.StringID(),
+			Representations: pe.Representation,
+		})
+	})
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package meta
+
+import (
+	"testing"
+	"time"
+
+	"github.com/conchoid/gae/impl/memory"
+	ds "github.com/conchoid/gae/service/datastore"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProperties(t *testing.T) {
+	t.Parallel()
+
+	Convey(`A testing datastore`, t, func() {
+		ctx := memory.Use(context.Background())
+
+		collect := func(kind, start, end string) []Property {
+			var ret []Property
+			So(PropertiesInRange(ctx, kind, start, end, func(p *Property) error {
+				ret = append(ret, *p)
+				return nil
+			}), ShouldBeNil)
+			return ret
+		}
+
+		Convey(`A kind with no entities has no properties.`, func() {
+			So(collect("Fruit", "", ""), ShouldBeNil)
+		})
+
+		Convey(`With some entities`, func() {
+			So(ds.Put(ctx, []ds.PropertyMap{
+				{
+					"$key":   ds.MkPropertyNI(ds.MakeKey(ctx, "Fruit", 1)),
+					"Name":   ds.MkProperty("apple"),
+					"Weight": ds.MkProperty(150),
+					"Notes":  ds.MkPropertyNI("crunchy"),
+				},
+				{
+					"$key":   ds.MkPropertyNI(ds.MakeKey(ctx, "Fruit", 2)),
+					"Name":   ds.MkProperty([]byte("banana")),
+					"Weight": ds.MkProperty(120.5),
+					"Picked": ds.MkProperty(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)),
+					"Tree":   ds.MkProperty(ds.MakeKey(ctx, "Tree", 1)),
+				},
+				{
+					"$key": ds.MkPropertyNI(ds.MakeKey(ctx, "Tree", 1)),
+					"Ripe": ds.MkProperty(true),
+				},
+			}), ShouldBeNil)
+			ds.GetTestable(ctx).CatchupIndexes()
+
+			Convey(`Can collect the indexed properties of a kind.`, func() {
+				So(collect("Fruit", "", ""), ShouldResemble, []Property{
+					{"Name", []string{"STRING"}},
+					{"Picked", []string{"INT64"}},
+					{"Tree", []string{"REFERENCE"}},
+					{"Weight", []string{"DOUBLE", "INT64"}},
+				})
+				So(collect("Tree", "", ""), ShouldResemble, []Property{
+					{"Ripe", []string{"BOOLEAN"}},
+				})
+			})
+
+			Convey(`Can collect the properties in a range.`, func() {
+				So(collect("Fruit", "O", "W"), ShouldResemble, []Property{
+					{"Picked", []string{"INT64"}},
+					{"Tree", []string{"REFERENCE"}},
+				})
+			})
+
+			Convey(`Can use Properties.`, func() {
+				var names []string
+				So(Properties(ctx, "Tree", func(p *Property) error {
+					names = append(names, p.Name)
+					return nil
+				}), ShouldBeNil)
+				So(names, ShouldResemble, []string{"Ripe"})
+			})
+		})
+	})
+}
@@ -57,16 +57,27 @@ func (mat *multiArgType) getKey(kc KeyContext, slot reflect.Value) (*Key, error)
 	return newKeyObjErr(kc, mat.getMGS(slot))
 }
 
-func (mat *multiArgType) getPM(slot reflect.Value) (PropertyMap, error) {
-	return mat.getPLS(slot).Save(true)
+// getPLSWithEncryption returns the PropertyLoadSaver for slot. If it's the
+// default struct PropertyLoadSaver, enc will be used for its encrypted fields.
+func (mat *multiArgType) getPLSWithEncryption(slot reflect.Value, enc EncryptionProvider) PropertyLoadSaver {
+	pls := mat.getPLS(slot)
+	if spls, ok := pls.(*structPLS); ok {
+		spls.enc = enc
+	}
+	return pls
+}
+
+func (mat *multiArgType) getPM(slot reflect.Value, enc EncryptionProvider) (PropertyMap, error) {
+	return mat.getPLSWithEncryption(slot, enc).Save(true)
 }
 
 func (mat *multiArgType) getMetaPM(slot reflect.Value) PropertyMap {
 	return mat.getMGS(slot).GetAllMeta()
 }
 
-func (mat *multiArgType) setPM(slot reflect.Value, pm PropertyMap) error {
-	return mat.getPLS(slot).Load(pm)
+func (mat *multiArgType) setPM(slot reflect.Value, pm PropertyMap, enc EncryptionProvider) error {
+	pm = mat.setVersionMeta(slot, pm)
+	return mat.getPLSWithEncryption(slot, enc).Load(pm)
 }
 
 func (mat *multiArgType) setKey(slot reflect.Value, k *Key) bool {
@@ -128,12 +139,12 @@ func parseArg(et reflect.Type, allowKeys bool) *multiArgType {
 			}
 
 			initCodec(et.Elem())
-			mat.getMGS = func(slot reflect.Value) MetaGetterSetter { return &structPLS{slot.Elem(), codec, nil} }
+			mat.getMGS = func(slot reflect.Value) MetaGetterSetter { return &structPLS{o: slot.Elem(), c: codec} }
 
 		case reflect.Struct:
 			// S
 			initCodec(et)
-			mat.getMGS = func(slot reflect.Value) MetaGetterSetter { return &structPLS{slot, codec, nil} }
+			mat.getMGS = func(slot reflect.Value) MetaGetterSetter { return &structPLS{o: slot, c: codec} }
 
 		default:
 			// Don't know how to get MGS for this type.
@@ -170,12 +181,12 @@ func parseArg(et reflect.Type, allowKeys bool) *multiArgType {
 				return nil
 			}
 			initCodec(et.Elem())
-			mat.getPLS = func(slot reflect.Value) PropertyLoadSaver { return &structPLS{slot.Elem(), codec, nil} }
+			mat.getPLS = func(slot reflect.Value) PropertyLoadSaver { return &structPLS{o: slot.Elem(), c: codec} }
 
 		case reflect.Struct:
 			// S
 			initCodec(et)
-			mat.getPLS = func(slot reflect.Value) PropertyLoadSaver { return &structPLS{slot, codec, nil} }
+			mat.getPLS = func(slot reflect.Value) PropertyLoadSaver { return &structPLS{o: slot, c: codec} }
 
 		default:
 			// Don't know how to get PLS for this type.
@@ -486,7 +497,8 @@ func (mma *metaMultiArg) get(idx metaMultiArgIndex) (*multiArgType, reflect.Valu
 }
 
 // getKeysPMs returns the keys and PropertyMap for the supplied argument items.
-func (mma *metaMultiArg) getKeysPMs(kc KeyContext, meta bool) ([]*Key, []PropertyMap, error) {
+// enc is used to encrypt the encrypted fields of struct items.
+func (mma *metaMultiArg) getKeysPMs(kc KeyContext, enc EncryptionProvider, meta bool) ([]*Key, []PropertyMap, error) {
 	et := newErrorTracker(mma)
 
 	// Determine our flattened keys and property maps.
@@ -518,7 +530,7 @@ func (mma *metaMultiArg) getKeysPMs(kc KeyContext, meta bool) ([]*Key, []Propert
 				pm = mat.getMetaPM(slot)
 			} else {
 				var err error
-				if pm, err = mat.getPM(slot); err != nil {
+				if pm, err = mat.getPM(slot, enc); err != nil {
 					et.trackError(index, err)
 					continue
 				}
@@ -531,6 +543,21 @@ func (mma *metaMultiArg) getKeysPMs(kc KeyContext, meta bool) ([]*Key, []Propert
 	return retKey, retPM, et.error()
 }
 
+// runHooks calls hook for each of the argument items, along with its flattened
+// index. It returns the errors which hook returned, in the same form as
+// getKeysPMs.
+func (mma *metaMultiArg) runHooks(hook func(i int, mat *multiArgType, slot reflect.Value) error) error {
+	et := newErrorTracker(mma)
+	for i := 0; i < mma.count; i++ {
+		index := mma.index(i)
+		mat, slot := mma.get(index)
+		if err := hook(i, mat, slot); err != nil {
+			et.trackError(index, err)
+		}
+	}
+	return et.error()
+}
+
 type errorTracker struct {
 	sync.Mutex
 
@@ -0,0 +1,699 @@
+// Copyright 2015 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.chromium.org/luci/common/data/stringset"
+	"go.chromium.org/luci/common/errors"
+)
+
+// maxSubQueries is the maximum number of sub-queries that a single query may
+// fan out into. This matches the limit that Cloud Datastore imposes on the
+// combined size of IN and != filters.
+const maxSubQueries = 30
+
+// multiCursorPrefix marks the string form of a multiCursor. It never occurs at
+// the start of an implementation's (base64 encoded) cursor.
+const multiCursorPrefix = "~"
+
+// ineqRange is a set of inequality bounds on a single property.
+type ineqRange struct {
+	low, high         Property
+	lowIncl, highIncl bool
+	lowSet, highSet   bool
+}
+
+// neqRanges splits the inequality bounds of q at each of the values excluded by
+// its Neq filters.
+//
+// Some of the returned ranges may be empty; finalizing a sub-query with such a
+// range yields ErrNullQuery.
+func (q *FinalizedQuery) neqRanges() []ineqRange {
+	outer := ineqRange{
+		q.ineqFiltLow, q.ineqFiltHigh,
+		q.ineqFiltLowIncl, q.ineqFiltHighIncl,
+		q.ineqFiltLowSet, q.ineqFiltHighSet,
+	}
+	ret := make([]ineqRange, 0, len(q.neqFilts)+1)
+	cur := outer
+	for i := range q.neqFilts {
+		v := q.neqFilts[i]
+		r := cur
+		if !outer.highSet || v.Compare(&outer.high) <= 0 {
+			r.high, r.highIncl, r.highSet = v, false, true
+		}
+		ret = append(ret, r)
+		if !outer.lowSet || v.Compare(&outer.low) >= 0 {
+			cur.low, cur.lowIncl, cur.lowSet = v, false, true
+		}
+	}
+	return append(ret, cur)
+}
+
+// inIneqBounds returns true iff v satisfies the inequality bounds of q.
+func (q *FinalizedQuery) inIneqBounds(v *Property) bool {
+	if q.ineqFiltLowSet {
+		if c := v.Compare(&q.ineqFiltLow); c < 0 || (c == 0 && !q.ineqFiltLowIncl) {
+			return false
+		}
+	}
+	if q.ineqFiltHighSet {
+		if c := v.Compare(&q.ineqFiltHigh); c > 0 || (c == 0 && !q.ineqFiltHighIncl) {
+			return false
+		}
+	}
+	return true
+}
+
+// errTooManySubQueries is returned by Finalize for queries which would fan out
+// into more than maxSubQueries sub-queries.
+var errTooManySubQueries = fmt.Errorf(
+	"query would fan out into more than %d sub-queries", maxSubQueries)
+
+// combinations returns one plain query for every combination of In filter
+// values and Neq filter ranges of fq, which is the finalized form of q. Some of
+// them may be null queries.
+func (q *Query) combinations(fq *FinalizedQuery) ([]*Query, error) {
+	inProps := make([]string, 0, len(fq.inFilts))
+	for prop := range fq.inFilts {
+		inProps = append(inProps, prop)
+	}
+	sort.Strings(inProps)
+
+	ranges := fq.neqRanges()
+	combos := [][]Property{nil}
+	for _, prop := range inProps {
+		vals := fq.inFilts[prop]
+		if len(combos)*len(vals)*len(ranges) > maxSubQueries {
+			return nil, errTooManySubQueries
+		}
+		next := make([][]Property, 0, len(combos)*len(vals))
+		for _, combo := range combos {
+			for _, v := range vals {
+				next = append(next, append(append([]Property(nil), combo...), v))
+			}
+		}
+		combos = next
+	}
+	if len(combos)*len(ranges) > maxSubQueries {
+		return nil, errTooManySubQueries
+	}
+
+	ret := make([]*Query, 0, len(combos)*len(ranges))
+	for _, combo := range combos {
+		for _, rng := range ranges {
+			ret = append(ret, q.mod(func(sq *Query) {
+				sq.inFilts = nil
+				sq.neqFilts = nil
+
+				sq.eqFilts = make(map[string]PropertySlice, len(fq.eqFilts)+len(combo))
+				for k, v := range fq.eqFilts {
+					sq.eqFilts[k] = append(PropertySlice(nil), v...)
+				}
+				for j, prop := range inProps {
+					sq.eqFilts[prop] = PropertySlice{combo[j]}
+				}
+
+				sq.ineqFiltLow, sq.ineqFiltLowIncl, sq.ineqFiltLowSet = rng.low, rng.lowIncl, rng.lowSet
+				sq.ineqFiltHigh, sq.ineqFiltHighIncl, sq.ineqFiltHighSet = rng.high, rng.highIncl, rng.highSet
+			}))
+		}
+	}
+	return ret, nil
+}
+
+// candidates returns the plain queries which q, finalized as fq, is the union
+// of. Some of them may be null queries.
+func (q *Query) candidates(fq *FinalizedQuery) ([]*Query, error) {
+	if len(q.filterGroups) == 0 {
+		return q.combinations(fq)
+	}
+
+	branches, err := q.filterBranches()
+	if err != nil {
+		return nil, err
+	}
+	ret := []*Query(nil)
+	for _, bq := range branches {
+		bfq, err := bq.finalizeConjunction()
+		switch {
+		case err == ErrNullQuery:
+			continue
+		case err != nil:
+			return nil, err
+		case len(bfq.inFilts) > 0 || len(bfq.neqFilts) > 0:
+			combos, err := bq.combinations(bfq)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, combos...)
+		default:
+			ret = append(ret, bq)
+		}
+		if len(ret) > maxSubQueries {
+			return nil, errTooManySubQueries
+		}
+	}
+	return ret, nil
+}
+
+// fanOut populates fq.subQueries with the sub-queries which q, finalized as
+// fq, is the union of: one for every alternative of its filter groups, and for
+// every combination of In filter values and Neq filter ranges.
+//
+// The sub-queries are plain queries which any RawInterface can run. They
+// return enough data to merge their results in fq's sort order: if fq is
+// keys-only or a projection which doesn't include all of the sorted
+// properties, the sub-queries project the missing properties as well.
+func (q *Query) fanOut(fq *FinalizedQuery) error {
+	cands, err := q.candidates(fq)
+	if err != nil {
+		return err
+	}
+	if len(cands) == 0 {
+		return ErrNullQuery
+	}
+
+	starts, err := splitMultiCursor(fq.start, len(cands))
+	if err != nil {
+		return fmt.Errorf("start cursor is invalid for this query: %s", err)
+	}
+	ends, err := splitMultiCursor(fq.end, len(cands))
+	if err != nil {
+		return fmt.Errorf("end cursor is invalid for this query: %s", err)
+	}
+
+	projected := stringset.NewFromSlice(fq.project...)
+	fq.subQueries = make([]*FinalizedQuery, len(cands))
+	live := 0
+	for i, cand := range cands {
+		if ends != nil && ends[i] == nil {
+			// This sub-query had no results before the end cursor.
+			continue
+		}
+		sub := cand.mod(func(sq *Query) {
+			sq.start, sq.end = nil, nil
+			if starts != nil {
+				sq.start = starts[i]
+			}
+			if ends != nil {
+				sq.end = ends[i]
+			}
+
+			// All sub-queries must return their results in the same order.
+			sq.order = append([]IndexColumn(nil), fq.orders...)
+
+			// Every sub-query may have to supply all of the results up to the
+			// limit of the merged query.
+			sq.limit, sq.offset = nil, nil
+			if fq.limit != nil {
+				limit := *fq.limit
+				if fq.offset != nil {
+					limit += *fq.offset
+				}
+				sq.limit = &limit
+			}
+
+			// Find the sorted properties which this sub-query must return in order
+			// to merge its results. __key__ always comes with the results, and
+			// properties with an equality filter are fixed.
+			need := []string(nil)
+			for _, col := range fq.orders {
+				_, iseq := sq.eqFilts[col.Property]
+				_, isin := sq.inFilts[col.Property]
+				if !iseq && !isin && col.Property != "__key__" {
+					need = append(need, col.Property)
+				}
+			}
+			augment := false
+			switch {
+			case fq.keysOnly:
+				augment = len(need) > 0
+			case len(fq.project) > 0:
+				for _, p := range need {
+					if !projected.Has(p) {
+						augment = true
+						break
+					}
+				}
+			}
+			if augment {
+				if sq.keysOnly {
+					sq.keysOnly = false
+					sq.project = stringset.New(len(need))
+				}
+				for _, p := range need {
+					sq.project.Add(p)
+				}
+				// Deduplication happens while merging.
+				sq.distinct = false
+				// A projection returns a row per value of a multi-valued property, so
+				// a row limit could be used up by duplicates of the same entity. The
+				// merger stops pulling results once the merged query's limit is
+				// reached.
+				sq.limit = nil
+			}
+		})
+		sfq, err := sub.Finalize()
+		switch err {
+		case nil:
+			fq.subQueries[i] = sfq
+			live++
+		case ErrNullQuery:
+		default:
+			return err
+		}
+	}
+	if live == 0 {
+		return ErrNullQuery
+	}
+	return nil
+}
+
+// multiCursor is the Cursor of a query which fans out into sub-queries. It has
+// one entry per sub-query, which is nil if the sub-query had not returned any
+// results at the cursor's position.
+type multiCursor []Cursor
+
+func (c multiCursor) String() string {
+	buf := bytes.Buffer{}
+	tmp := make([]byte, binary.MaxVarintLen64)
+	for _, sub := range c {
+		s := ""
+		if sub != nil {
+			s = sub.String()
+		}
+		buf.Write(tmp[:binary.PutUvarint(tmp, uint64(len(s)))])
+		buf.WriteString(s)
+	}
+	return multiCursorPrefix + base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
+
+// splitMultiCursor returns the components of c, which must be a multiCursor
+// for n sub-queries. A nil c returns nil.
+func splitMultiCursor(c Cursor, n int) (multiCursor, error) {
+	if c == nil {
+		return nil, nil
+	}
+	mc, ok := c.(multiCursor)
+	if !ok {
+		return nil, errors.New("not a multi-query cursor")
+	}
+	if len(mc) != n {
+		return nil, fmt.Errorf("cursor has %d components, expected %d", len(mc), n)
+	}
+	return mc, nil
+}
+
+// isMultiCursor returns true iff s is the string form of a multiCursor.
+func isMultiCursor(s string) bool {
+	return strings.HasPrefix(s, multiCursorPrefix)
+}
+
+// decodeMultiCursor parses the string form of a multiCursor, using decode to
+// parse each of the sub-query cursors.
+func decodeMultiCursor(s string, decode func(string) (Cursor, error)) (Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, multiCursorPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid multi-query cursor: %s", err)
+	}
+	ret := multiCursor{}
+	for len(data) > 0 {
+		l, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < l {
+			return nil, errors.New("invalid multi-query cursor: truncated")
+		}
+		sub := string(data[n : n+int(l)])
+		data = data[n+int(l):]
+
+		var c Cursor
+		if sub != "" {
+			if c, err = decode(sub); err != nil {
+				return nil, err
+			}
+		}
+		ret = append(ret, c)
+	}
+	return ret, nil
+}
+
+// mergeItem is a single result of a sub-query.
+type mergeItem struct {
+	key       *Key
+	data      PropertyMap
+	getCursor CursorCB
+
+	// row is the sort key of this result in the merged query.
+	row []Property
+
+	err error
+}
+
+// subQueryIter runs a single sub-query and hands its results to the merger one
+// at a time.
+type subQueryIter struct {
+	slot int
+	fq   *FinalizedQuery
+
+	results chan *mergeItem
+	resume  chan struct{}
+
+	// head is the next result of this sub-query, or nil if it is exhausted.
+	head *mergeItem
+
+	// cursor is the cursor of this sub-query just after the last consumed
+	// result.
+	cursor    Cursor
+	cursorErr error
+}
+
+// run runs the sub-query. The callback blocks until the merger consumed its
+// result, so that the CursorCB of each result stays valid until it is used.
+func (it *subQueryIter) run(raw RawInterface, stop <-chan struct{}) {
+	defer close(it.results)
+	err := raw.Run(it.fq, func(k *Key, pm PropertyMap, gc CursorCB) error {
+		select {
+		case it.results <- &mergeItem{key: k, data: pm, getCursor: gc}:
+		case <-stop:
+			return Stop
+		}
+		select {
+		case <-it.resume:
+			return nil
+		case <-stop:
+			return Stop
+		}
+	})
+	if err = filterStop(err); err != nil {
+		select {
+		case it.results <- &mergeItem{err: err}:
+		case <-stop:
+		}
+	}
+}
+
+// queryMerger merges the results of the sub-queries of a fanned-out query.
+type queryMerger struct {
+	fq      *FinalizedQuery
+	cursors bool
+
+	iters []*subQueryIter
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newQueryMerger(raw RawInterface, fq *FinalizedQuery, cursors bool) *queryMerger {
+	m := &queryMerger{fq: fq, cursors: cursors, stop: make(chan struct{})}
+	starts, _ := splitMultiCursor(fq.start, len(fq.subQueries))
+	for slot, sub := range fq.subQueries {
+		if sub == nil {
+			continue
+		}
+		it := &subQueryIter{
+			slot:    slot,
+			fq:      sub,
+			results: make(chan *mergeItem),
+			resume:  make(chan struct{}),
+		}
+		if starts != nil {
+			it.cursor = starts[slot]
+		}
+		m.iters = append(m.iters, it)
+
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			it.run(raw, m.stop)
+		}()
+	}
+	return m
+}
+
+func (m *queryMerger) close() {
+	close(m.stop)
+	m.wg.Wait()
+}
+
+// pull waits for the next result of it, and makes it its head.
+func (m *queryMerger) pull(it *subQueryIter) error {
+	itm, ok := <-it.results
+	if !ok {
+		it.head = nil
+		return nil
+	}
+	if itm.err != nil {
+		return itm.err
+	}
+	itm.row = sortRow(m.fq.orders, it.fq, itm.key, itm.data)
+	it.head = itm
+	return nil
+}
+
+// advance consumes the head of it.
+func (m *queryMerger) advance(it *subQueryIter) error {
+	if m.cursors {
+		if it.head.getCursor == nil {
+			it.cursor, it.cursorErr = nil, errors.New("cursors are not supported by this query")
+		} else {
+			it.cursor, it.cursorErr = it.head.getCursor()
+		}
+	}
+	it.resume <- struct{}{}
+	return m.pull(it)
+}
+
+// cursor returns a CursorCB for the current position of the merge.
+func (m *queryMerger) cursor() CursorCB {
+	mc := make(multiCursor, len(m.fq.subQueries))
+	err := error(nil)
+	for _, it := range m.iters {
+		if it.cursorErr != nil {
+			err = it.cursorErr
+		}
+		mc[it.slot] = it.cursor
+	}
+	return func() (Cursor, error) {
+		if err != nil {
+			return nil, err
+		}
+		return mc, nil
+	}
+}
+
+// compareRows compares two sort rows according to orders.
+func compareRows(orders []IndexColumn, a, b []Property) int {
+	for i, col := range orders {
+		c := a[i].Compare(&b[i])
+		if col.Descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// sortRow returns the values of a result of sub by which it sorts in orders.
+func sortRow(orders []IndexColumn, sub *FinalizedQuery, key *Key, pm PropertyMap) []Property {
+	row := make([]Property, len(orders))
+	for i, col := range orders {
+		if col.Property == "__key__" {
+			row[i] = MkProperty(key)
+		} else if vals, iseq := sub.eqFilts[col.Property]; iseq && len(vals) == 1 {
+			row[i] = vals[0]
+		} else {
+			row[i] = sortValue(pm.Slice(col.Property), col.Descending, sub, col.Property)
+		}
+	}
+	return row
+}
+
+// sortValue picks the value of a (possibly multi-valued) property which
+// determines where its entity sorts in the results of sub: the smallest value
+// for ascending orders, the largest one for descending orders. Values outside
+// of sub's inequality bounds aren't considered, since the index scan never
+// sees them.
+func sortValue(vals PropertySlice, desc bool, sub *FinalizedQuery, prop string) Property {
+	ret, found := Property{}, false
+	pick := func(indexedOnly bool) {
+		for _, v := range vals {
+			if indexedOnly && v.IndexSetting() != ShouldIndex {
+				continue
+			}
+			// Projected values don't have a meaningful index setting, and the
+			// index setting takes precedence in Compare.
+			v.indexSetting = ShouldIndex
+			if prop == sub.ineqFiltProp && !sub.inIneqBounds(&v) {
+				continue
+			}
+			if c := v.Compare(&ret); !found || (!desc && c < 0) || (desc && c > 0) {
+				ret, found = v, true
+			}
+		}
+	}
+	pick(true)
+	if !found {
+		pick(false)
+	}
+	if !found {
+		ret.indexSetting = ShouldIndex
+	}
+	return ret
+}
+
+// dedupKey returns the identity of a merged result: results with the same
+// identity are returned only once.
+func (m *queryMerger) dedupKey(itm *mergeItem) string {
+	if len(m.fq.project) == 0 {
+		return itm.key.String()
+	}
+	buf := bytes.Buffer{}
+	if !m.fq.distinct {
+		buf.WriteString(itm.key.String())
+	}
+	for _, p := range m.fq.project {
+		for _, v := range itm.data.Slice(p) {
+			buf.WriteByte(0)
+			buf.WriteString(v.GQL())
+		}
+		buf.WriteByte(1)
+	}
+	return buf.String()
+}
+
+// prune removes the data which sub-queries fetched only for merging.
+func (m *queryMerger) prune(pm PropertyMap) PropertyMap {
+	switch {
+	case m.fq.keysOnly:
+		return nil
+	case len(m.fq.project) > 0 && len(pm) > len(m.fq.project):
+		ret := make(PropertyMap, len(m.fq.project))
+		for _, p := range m.fq.project {
+			if v, ok := pm[p]; ok {
+				ret[p] = v
+			}
+		}
+		return ret
+	}
+	return pm
+}
+
+// runFanOut runs a query which fans out into sub-queries, by running each of
+// them with raw and merging their results.
+//
+// If cursors is false, the CursorCBs passed to cb return an error.
+//
+// Results which sort equal are deduplicated as they are merged. Since an
+// entity may also appear at different positions of the sort order if a sorted
+// property has several values, the keys of all the results are remembered for
+// the whole run. They aren't part of the cursors (see Query.In).
+func runFanOut(raw RawInterface, fq *FinalizedQuery, cursors bool, cb RawRunCB) error {
+	m := newQueryMerger(raw, fq, cursors)
+	defer m.close()
+
+	for _, it := range m.iters {
+		if err := m.pull(it); err != nil {
+			return err
+		}
+	}
+
+	offset, limit := int32(0), int32(-1)
+	if fq.offset != nil {
+		offset = *fq.offset
+	}
+	if fq.limit != nil {
+		limit = *fq.limit
+	}
+
+	seen := stringset.New(0)
+	for limit != 0 {
+		var next *subQueryIter
+		for _, it := range m.iters {
+			if it.head == nil {
+				continue
+			}
+			if next == nil || compareRows(fq.orders, it.head.row, next.head.row) < 0 {
+				next = it
+			}
+		}
+		if next == nil {
+			return nil
+		}
+
+		itm := next.head
+		if err := m.advance(next); err != nil {
+			return err
+		}
+		// Results which sort equal to itm could be duplicates of it; consume
+		// them now so that the cursor of itm is past all of its copies.
+		for _, it := range m.iters {
+			for it.head != nil && compareRows(fq.orders, it.head.row, itm.row) == 0 &&
+				m.dedupKey(it.head) == m.dedupKey(itm) {
+				if err := m.advance(it); err != nil {
+					return err
+				}
+			}
+		}
+
+		if !seen.Add(m.dedupKey(itm)) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if limit > 0 {
+			limit--
+		}
+
+		gc := CursorCB(func() (Cursor, error) {
+			return nil, errors.New("cursors are not supported by this query")
+		})
+		if cursors {
+			gc = m.cursor()
+		}
+		if err := cb(itm.key, m.prune(itm.data), gc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countFanOut counts the results of a query which fans out into sub-queries.
+func countFanOut(raw RawInterface, fq *FinalizedQuery) (int64, error) {
+	if len(fq.project) == 0 && !fq.keysOnly && fq.original != nil {
+		kfq, err := fq.original.KeysOnly(true).Finalize()
+		if err != nil {
+			return 0, err
+		}
+		fq = kfq
+	}
+	count := int64(0)
+	err := runFanOut(raw, fq, false, func(*Key, PropertyMap, CursorCB) error {
+		count++
+		return nil
+	})
+	return count, err
+}
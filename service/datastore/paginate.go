@@ -0,0 +1,362 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+// pageTokenVersion is the version of the page token format.
+const pageTokenVersion = 1
+
+var (
+	// ErrNoPageTokenSecret is returned by Paginate when there is no page token
+	// secret installed in the Context.
+	ErrNoPageTokenSecret = errors.New("datastore: no page token secret installed in the context")
+
+	// ErrInvalidPageToken is returned by Paginate for a token which it didn't
+	// produce, which was produced for a different query, or which was
+	// tampered with.
+	ErrInvalidPageToken = errors.New("datastore: invalid page token")
+)
+
+// SetPageTokenSecret installs the secret which signs the tokens returned by
+// Paginate. Tokens are only accepted by Paginate with the same secret.
+func SetPageTokenSecret(c context.Context, secret []byte) context.Context {
+	return context.WithValue(c, pageTokenSecretKey, secret)
+}
+
+// GetPageTokenSecret returns the page token secret installed in the Context,
+// or nil if there is none.
+func GetPageTokenSecret(c context.Context) []byte {
+	secret, _ := c.Value(pageTokenSecretKey).([]byte)
+	return secret
+}
+
+// Page is a page of query results returned by Paginate.
+type Page struct {
+	// Next is the token of the next page, or empty if this is the last page.
+	Next string
+	// Prev is the token of the previous page, or empty if this is the first
+	// page or the query can't be paged backwards.
+	Prev string
+}
+
+// pageToken is the signed payload of a page token.
+//
+// A token either holds a cursor to start from, or a key to start after (or
+// before, if Reverse is set).
+type pageToken struct {
+	Version     int    `json:"v"`
+	Fingerprint []byte `json:"q"`
+	Cursor      string `json:"c,omitempty"`
+	Key         string `json:"k,omitempty"`
+	Inclusive   bool   `json:"i,omitempty"`
+	Reverse     bool   `json:"r,omitempty"`
+	// Floor is the key of the first result of the first page of a query with an
+	// offset. Paging backwards stops there, rather than going back over the
+	// results skipped by the offset.
+	Floor string `json:"f,omitempty"`
+}
+
+// Paginate runs q, and loads at most pageSize of its results into dst,
+// starting at the page identified by token. An empty token is the first page.
+// The tokens of the pages around it are returned in the Page.
+//
+// dst must be one of the types accepted by GetAll. The limit of q is ignored,
+// and its offset only skips results before the first page.
+//
+// Tokens are opaque strings, which are safe to hand out to clients. They are
+// signed with the secret installed by SetPageTokenSecret, and only valid for
+// the query which produced them (in the same namespace): Paginate returns
+// ErrInvalidPageToken for any other token.
+//
+// Queries which are only ordered by key (which includes unordered queries)
+// can be paged backwards, and have a Prev token for all pages but the first.
+// They're paged by key rather than by cursor, so the pages stay consistent
+// when entities are added or removed. Other queries are paged with cursors,
+// and only forwards.
+func Paginate(c context.Context, q *Query, pageSize int32, token string, dst interface{}) (Page, error) {
+	if pageSize <= 0 {
+		panic(fmt.Errorf("invalid Paginate pageSize: %d", pageSize))
+	}
+	secret := GetPageTokenSecret(c)
+	if secret == nil {
+		return Page{}, ErrNoPageTokenSecret
+	}
+
+	keysOnly := false
+	if _, ok := dst.(*[]*Key); ok {
+		keysOnly = true
+		q = q.KeysOnly(true)
+	}
+	q = q.Limit(-1)
+	fq, err := q.Finalize()
+	if err != nil {
+		return Page{}, err
+	}
+	fp := queryFingerprint(GetKeyContext(c), fq)
+	byKey := orderedByKey(fq)
+	offset, _ := fq.Offset()
+	q = q.Offset(-1)
+
+	tok := &pageToken{}
+	if token != "" {
+		if tok, err = decodePageToken(secret, token); err != nil {
+			return Page{}, err
+		}
+		if !hmac.Equal(tok.Fingerprint, fp) || byKey != (tok.Key != "") {
+			return Page{}, ErrInvalidPageToken
+		}
+	}
+
+	// Build the query of the page.
+	descending := byKey && fq.Orders()[0].Descending
+	if byKey && tok.Key != "" {
+		k, err := NewKeyEncoded(tok.Key)
+		if err != nil {
+			return Page{}, ErrInvalidPageToken
+		}
+		// Paging forwards in descending order, or backwards in ascending order,
+		// continues with lesser keys.
+		switch lesser := descending != tok.Reverse; {
+		case lesser && tok.Inclusive:
+			q = q.Lte("__key__", k)
+		case lesser:
+			q = q.Lt("__key__", k)
+		case tok.Inclusive:
+			q = q.Gte("__key__", k)
+		default:
+			q = q.Gt("__key__", k)
+		}
+		if tok.Reverse {
+			order := "-__key__"
+			if descending {
+				order = "__key__"
+			}
+			q = q.ClearOrder().Order(order)
+
+			if tok.Floor != "" {
+				floor, err := NewKeyEncoded(tok.Floor)
+				if err != nil {
+					return Page{}, ErrInvalidPageToken
+				}
+				if descending {
+					q = q.Lte("__key__", floor)
+				} else {
+					q = q.Gte("__key__", floor)
+				}
+			}
+		}
+	} else if tok.Cursor != "" {
+		cur, err := DecodeCursor(c, tok.Cursor)
+		if err != nil {
+			return Page{}, ErrInvalidPageToken
+		}
+		q = q.Start(cur)
+	} else if offset > 0 {
+		// The offset skips results before the first page only; later pages
+		// start after the previous ones.
+		q = q.Offset(offset)
+	}
+	if fq, err = q.Limit(pageSize + 1).Finalize(); err != nil {
+		return Page{}, err
+	}
+
+	// Fetch one more result than fits in the page, to know if there's more.
+	var keys []*Key
+	var end CursorCB
+	var appendResult func(k *Key, pm PropertyMap) error
+	results := reflect.ValueOf(dst).Elem()
+	first := results.Len()
+	if keysOnly {
+		dstKeys := dst.(*[]*Key)
+		appendResult = func(k *Key, _ PropertyMap) error {
+			*dstKeys = append(*dstKeys, k)
+			return nil
+		}
+	} else {
+		mat := mustParseMultiArg(results.Type())
+		if mat.newElem == nil {
+			panic(fmt.Errorf("invalid Paginate dst (non-concrete element type): %T", dst))
+		}
+		appendResult = func(k *Key, pm PropertyMap) error {
+			itm := mat.newElem()
+			mat.setKey(itm, k)
+			switch err := mat.setPMWithHooks(c, itm, pm); err {
+			case nil:
+				results.Set(reflect.Append(results, itm))
+			case ErrNoSuchEntity:
+				// expired
+			default:
+				return err
+			}
+			return nil
+		}
+	}
+	err = filterStop(Raw(c).Run(fq, func(k *Key, pm PropertyMap, gc CursorCB) error {
+		keys = append(keys, k)
+		if int32(len(keys)) > pageSize {
+			return Stop
+		}
+		// Remember the cursor after the last result of the page.
+		if int32(len(keys)) == pageSize && !byKey {
+			end = gc
+		}
+		return appendResult(k, pm)
+	}))
+	if err != nil {
+		return Page{}, err
+	}
+	more := int32(len(keys)) > pageSize
+	if more {
+		keys = keys[:pageSize]
+	}
+
+	// Make the tokens of the surrounding pages.
+	var page Page
+	floor := tok.Floor
+	if token == "" && offset > 0 && byKey && len(keys) > 0 {
+		floor = keys[0].Encode()
+	}
+	sign := func(t *pageToken) (string, error) {
+		t.Version, t.Fingerprint, t.Floor = pageTokenVersion, fp, floor
+		return encodePageToken(secret, t)
+	}
+	switch {
+	case !byKey:
+		if more {
+			cur, err := end()
+			if err != nil {
+				return Page{}, err
+			}
+			if page.Next, err = sign(&pageToken{Cursor: cur.String()}); err != nil {
+				return Page{}, err
+			}
+		}
+
+	case tok.Reverse:
+		// The results were fetched backwards.
+		reverseSlice(results.Slice(first, results.Len()))
+		if more {
+			last := keys[len(keys)-1]
+			if page.Prev, err = sign(&pageToken{Key: last.Encode(), Reverse: true}); err != nil {
+				return Page{}, err
+			}
+		}
+		next := &pageToken{Key: tok.Key, Inclusive: !tok.Inclusive}
+		if len(keys) > 0 {
+			next = &pageToken{Key: keys[0].Encode()}
+		}
+		if page.Next, err = sign(next); err != nil {
+			return Page{}, err
+		}
+
+	default:
+		var prev *pageToken
+		switch {
+		case token == "":
+		case len(keys) > 0:
+			prev = &pageToken{Key: keys[0].Encode(), Reverse: true}
+		default:
+			prev = &pageToken{Key: tok.Key, Inclusive: !tok.Inclusive, Reverse: true}
+		}
+		if prev != nil {
+			if page.Prev, err = sign(prev); err != nil {
+				return Page{}, err
+			}
+		}
+		if more {
+			if page.Next, err = sign(&pageToken{Key: keys[len(keys)-1].Encode()}); err != nil {
+				return Page{}, err
+			}
+		}
+	}
+	return page, nil
+}
+
+// orderedByKey returns true if fq is only ordered by key, which allows paging
+// by key in both directions.
+func orderedByKey(fq *FinalizedQuery) bool {
+	orders := fq.Orders()
+	return len(orders) == 1 && orders[0].Property == "__key__" && len(fq.SubQueries()) == 0
+}
+
+// queryFingerprint returns a hash which identifies fq in kc.
+func queryFingerprint(kc KeyContext, fq *FinalizedQuery) []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %q %s", kc.AppID, kc.Namespace, fq.GQL())
+	return h.Sum(nil)
+}
+
+// encodePageToken signs and encodes t.
+func encodePageToken(secret []byte, t *pageToken) (string, error) {
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
+
+// decodePageToken decodes token, checking its signature and version.
+func decodePageToken(secret []byte, token string) (*pageToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidPageToken
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	sig, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, ErrInvalidPageToken
+	}
+
+	t := &pageToken{}
+	if err := json.Unmarshal(payload, t); err != nil || t.Version != pageTokenVersion {
+		return nil, ErrInvalidPageToken
+	}
+	return t, nil
+}
+
+// reverseSlice reverses the elements of the slice v in place.
+func reverseSlice(v reflect.Value) {
+	tmp := reflect.New(v.Type().Elem()).Elem()
+	for i, j := 0, v.Len()-1; i < j; i, j = i+1, j-1 {
+		tmp.Set(v.Index(i))
+		v.Index(i).Set(v.Index(j))
+		v.Index(j).Set(tmp)
+	}
+}
@@ -43,6 +43,7 @@ import (
 //   * time.Time
 //   * GeoPoint
 //   * *Key
+//   * PropertyMap (an embedded entity)
 //   * any Type whose underlying type is one of the above types
 //   * Types which implement PropertyConverter on (*Type)
 //   * A struct composed of the above types (except for nested slices)
@@ -65,6 +66,56 @@ import (
 //      field's actual name. Note that by default, all fields (with indexable
 //      types) are indexed.
 //
+//   `gae:"fieldName,entity[,noindex]"` -- indicates that the field, which must
+//      be a struct, a pointer to a struct, or a slice of either, is stored as
+//      an embedded entity (a PTPropertyMap property) instead of being flattened
+//      into dotted property names. A nil pointer is stored as a PTNull.
+//      Embedded entities may themselves contain slices and other embedded
+//      entities. Their indexed properties are queryable by their dotted names
+//      (e.g. "fieldName.Inner"), unless noindex is specified.
+//
+//   `gae:"fieldName,json[,gzip]"` and `gae:"fieldName,gzip"` -- indicate that
+//      the field is stored as an unindexed []byte property holding its value
+//      encoded as JSON (with encoding/json), gzip-compressed, or both. With
+//      json, the field may have any type which encoding/json supports. With
+//      only gzip, it must be a string or a []byte. Each element of a slice
+//      field (other than []byte) is encoded as a separate value. Stored values
+//      which don't decode are reported as an ErrFieldMismatch.
+//
+//   `gae:"fieldName,encrypted[,json][,gzip]"` -- indicates that the field is
+//      stored as an unindexed []byte property, encrypted by the
+//      EncryptionProvider installed in the Context (see SetEncryptionProvider).
+//      It may be combined with json and gzip, which apply before encryption,
+//      and has the same type requirements. The ID of the encrypting key is
+//      stored with the value, so keys may be rotated (see ReEncrypt).
+//
+//      Encrypted fields are only handled by Put, Get and queries, which have
+//      a Context. A PropertyLoadSaver obtained directly from GetPLS has no
+//      EncryptionProvider, so it fails to save or load them.
+//
+//   `gae:"fieldName,ttl"` -- indicates that the field, which must be an
+//      indexed time.Time, holds the time at which the entity expires. A zero
+//      time means that it never expires. A struct may have one such field.
+//      Expired entities may be hidden from reads (see WithHideExpired), and
+//      deleted by a sweeper (see the ttl package).
+//
+//   `gae:"$ttl"` -- is the same as `gae:"_ttl,ttl"`: the field holds the time
+//      at which the entity expires, in the property named TTLProperty.
+//
+//   `gae:"fieldName[,<options>],validate=<rule>[,<rule>...]"` -- indicates
+//      that Put (and Validate) must check the field against the listed rules.
+//      The rules extend to the end of the tag, so validate must be the last
+//      option. The supported rules are:
+//        - required: the field must not be its zero value (or empty).
+//        - min=N, max=N: bounds on the length of a string, slice or map, or
+//          on the value of a number.
+//        - regex=EXPR: a string must match the regular expression EXPR, which
+//          can't contain commas.
+//        - oneof=A|B|C: a string or integer must be one of the listed values.
+//      For slice fields (other than []byte), required, min and max apply to
+//      the slice itself, while regex and oneof apply to each of its elements.
+//      A field which fails a rule is reported as a *ValidationError.
+//
 //   `gae:"$metaKey[,<value>]` -- indicates a field is metadata. Metadata
 //      can be used to control filter behavior, or to store key data when using
 //      the Interface.KeyForObj* methods. The supported field types are:
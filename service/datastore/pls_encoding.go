@@ -0,0 +1,113 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+)
+
+// isEncoded returns true if the field is stored as bytes encoded by
+// encodeField.
+func (st *structTag) isEncoded() bool {
+	return st.isJSON || st.isGzip || st.isEncrypted
+}
+
+// encodeField encodes v, the value of a field tagged with json, gzip and/or
+// encrypted, into the bytes which are stored in the datastore.
+//
+// The encodings are applied in that order, so e.g. a field tagged with json
+// and gzip is stored as gzipped JSON. enc is only used for encrypted fields.
+func (st *structTag) encodeField(v reflect.Value, enc EncryptionProvider) ([]byte, error) {
+	var data []byte
+	switch {
+	case st.isJSON:
+		var err error
+		if data, err = json.Marshal(v.Interface()); err != nil {
+			return nil, err
+		}
+	case v.Kind() == reflect.String:
+		data = []byte(v.String())
+	default:
+		data = v.Bytes()
+	}
+
+	if st.isGzip {
+		buf := bytes.Buffer{}
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+
+	if st.isEncrypted {
+		return encryptValue(enc, data)
+	}
+	return data, nil
+}
+
+// decodeField is the inverse of encodeField. It loads p into v, and returns a
+// non-empty reason if p couldn't be decoded.
+func (st *structTag) decodeField(v reflect.Value, p Property, enc EncryptionProvider) string {
+	var data []byte
+	switch p.Type() {
+	case PTNull:
+		v.Set(reflect.Zero(v.Type()))
+		return ""
+	case PTBytes:
+		data = p.Value().([]byte)
+	default:
+		return typeMismatchReason(p.Value(), v)
+	}
+
+	if st.isEncrypted {
+		var err error
+		if data, err = decryptValue(enc, data); err != nil {
+			return fmt.Sprintf("failed to decrypt value: %s", err)
+		}
+	}
+
+	if st.isGzip {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err == nil {
+			data, err = ioutil.ReadAll(r)
+		}
+		if err != nil {
+			return fmt.Sprintf("failed to decompress gzip value: %s", err)
+		}
+	}
+
+	switch {
+	case st.isJSON:
+		ptr := reflect.New(v.Type())
+		if err := json.Unmarshal(data, ptr.Interface()); err != nil {
+			return fmt.Sprintf("failed to decode JSON value: %s", err)
+		}
+		v.Set(ptr.Elem())
+	case v.Kind() == reflect.String:
+		v.SetString(string(data))
+	default:
+		v.SetBytes(data)
+	}
+	return ""
+}
@@ -35,6 +35,11 @@ type structTag struct {
 	idxSetting     IndexSetting
 	isSlice        bool
 	substructCodec *structCodec
+	entityCodec    *structCodec
+	isJSON         bool
+	isGzip         bool
+	isEncrypted    bool
+	rules          []fieldRule
 	convert        bool
 	metaVal        interface{}
 	isExtra        bool
@@ -55,6 +60,10 @@ type structPLS struct {
 	o   reflect.Value
 	c   *structCodec
 	mgs MetaGetterSetter
+
+	// enc encrypts and decrypts the encrypted fields. It may be nil if there are
+	// none.
+	enc EncryptionProvider
 }
 
 var _ PropertyLoadSaver = (*structPLS)(nil)
@@ -83,7 +92,7 @@ func (p *structPLS) Load(propMap PropertyMap) error {
 		pslice := pdata.Slice()
 		requireSlice := len(pslice) > 1
 		for i, prop := range pslice {
-			if reason := loadInner(p.c, p.o, i, name, prop, requireSlice); reason != "" {
+			if reason := loadInner(p.c, p.o, i, name, prop, requireSlice, p.enc); reason != "" {
 				if useExtra {
 					if extra != nil {
 						if *extra == nil {
@@ -113,8 +122,9 @@ func (p *structPLS) Load(propMap PropertyMap) error {
 	return nil
 }
 
-func loadInner(codec *structCodec, structValue reflect.Value, index int, name string, p Property, requireSlice bool) string {
+func loadInner(codec *structCodec, structValue reflect.Value, index int, name string, p Property, requireSlice bool, enc EncryptionProvider) string {
 	var v reflect.Value
+	var st structTag
 	// Traverse a struct's struct-typed fields.
 	for {
 		fieldIndex, ok := codec.byName[name]
@@ -123,7 +133,7 @@ func loadInner(codec *structCodec, structValue reflect.Value, index int, name st
 		}
 		v = structValue.Field(fieldIndex)
 
-		st := codec.byIndex[fieldIndex]
+		st = codec.byIndex[fieldIndex]
 		if st.substructCodec == nil {
 			break
 		}
@@ -142,6 +152,29 @@ func loadInner(codec *structCodec, structValue reflect.Value, index int, name st
 		codec = st.substructCodec
 	}
 
+	// Embedded entities and encoded fields load each value as a whole.
+	loadValue := (func(reflect.Value) string)(nil)
+	switch {
+	case st.entityCodec != nil:
+		loadValue = func(v reflect.Value) string { return loadEntity(st.entityCodec, v, p, enc) }
+	case st.isEncoded():
+		loadValue = func(v reflect.Value) string { return st.decodeField(v, p, enc) }
+	}
+	if loadValue != nil {
+		if !st.isSlice {
+			if requireSlice {
+				return "multiple-valued property requires a slice field type"
+			}
+			return loadValue(v)
+		}
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if reason := loadValue(elem); reason != "" {
+			return reason
+		}
+		v.Set(reflect.Append(v, elem))
+		return ""
+	}
+
 	doConversion := func(v reflect.Value) (string, bool) {
 		a := v.Addr()
 		if conv, ok := a.Interface().(PropertyConverter); ok {
@@ -222,6 +255,9 @@ func loadInner(codec *structCodec, structValue reflect.Value, index int, name st
 			set = func(x interface{}) {
 				v.SetBytes(reflect.ValueOf(x).Bytes())
 			}
+		case reflect.Map:
+			project = PTPropertyMap
+			set = func(x interface{}) { v.Set(reflect.ValueOf(x)) }
 		default:
 			panic(fmt.Errorf("helper: impossible: %s", typeMismatchReason(p.Value(), v)))
 		}
@@ -241,6 +277,34 @@ func loadInner(codec *structCodec, structValue reflect.Value, index int, name st
 	return ""
 }
 
+// loadEntity loads the embedded entity p into v, which is a struct or a
+// pointer to one, using codec.
+func loadEntity(codec *structCodec, v reflect.Value, p Property, enc EncryptionProvider) string {
+	switch p.Type() {
+	case PTNull:
+		v.Set(reflect.Zero(v.Type()))
+		return ""
+	case PTPropertyMap:
+	default:
+		return typeMismatchReason(p.Value(), v)
+	}
+	if codec.problem != nil {
+		return codec.problem.Error()
+	}
+
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	v.Set(reflect.Zero(v.Type()))
+	if err := (&structPLS{o: v, c: codec, enc: enc}).Load(p.Value().(PropertyMap)); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
 func (p *structPLS) Save(withMeta bool) (PropertyMap, error) {
 	ret := PropertyMap(nil)
 	if withMeta {
@@ -258,6 +322,25 @@ func (p *structPLS) Save(withMeta bool) (PropertyMap, error) {
 	return ret, nil
 }
 
+// saveEntity saves v, which is a struct or a pointer to one, into prop as an
+// embedded entity using codec. A nil pointer is saved as a PTNull.
+func saveEntity(prop *Property, codec *structCodec, v reflect.Value, si IndexSetting, enc EncryptionProvider) error {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return prop.SetValue(nil, si)
+		}
+		v = v.Elem()
+	}
+	if codec.problem != nil {
+		return codec.problem
+	}
+	pm, err := (&structPLS{o: v, c: codec, enc: enc}).Save(false)
+	if err != nil {
+		return err
+	}
+	return prop.SetValue(pm, si)
+}
+
 func (p *structPLS) getDefaultKind() string {
 	if !p.o.IsValid() {
 		return ""
@@ -268,7 +351,7 @@ func (p *structPLS) getDefaultKind() string {
 func (p *structPLS) save(propMap PropertyMap, prefix string, parentST *structTag, is IndexSetting) (idxCount int, err error) {
 	saveProp := func(name string, si IndexSetting, v reflect.Value, st *structTag) (err error) {
 		if st.substructCodec != nil {
-			count, err := (&structPLS{v, st.substructCodec, nil}).save(propMap, name, st, si)
+			count, err := (&structPLS{o: v, c: st.substructCodec, enc: p.enc}).save(propMap, name, st, si)
 			if err == nil {
 				idxCount += count
 				if idxCount > maxIndexedProperties {
@@ -279,9 +362,17 @@ func (p *structPLS) save(propMap PropertyMap, prefix string, parentST *structTag
 		}
 
 		prop := Property{}
-		if st.convert {
+		switch {
+		case st.convert:
 			prop, err = v.Addr().Interface().(PropertyConverter).ToProperty()
-		} else {
+		case st.entityCodec != nil:
+			err = saveEntity(&prop, st.entityCodec, v, si, p.enc)
+		case st.isEncoded():
+			var data []byte
+			if data, err = st.encodeField(v, p.enc); err == nil {
+				err = prop.SetValue(data, NoIndex)
+			}
+		default:
 			err = prop.SetValue(v.Interface(), si)
 		}
 		if err != nil {
@@ -539,8 +630,13 @@ func getStructCodecLocked(t reflect.Type) (c *structCodec) {
 		if i := strings.Index(name, ","); i != -1 {
 			name, opts = name[:i], name[i+1:]
 		}
+		opts, rules := splitValidateOpt(opts)
 		st.canSet = f.PkgPath == "" // blank == exported
-		if opts == "extra" {
+		if name == "$ttl" {
+			// "$ttl" is a ttl field saved in the well-known TTLProperty.
+			name, opts = TTLProperty, opts+",ttl"
+		}
+		if hasOpt(opts, "extra") {
 			if _, ok := c.bySpecial["extra"]; ok {
 				c.problem = me("struct has multiple fields tagged as 'extra'")
 				return
@@ -581,6 +677,10 @@ func getStructCodecLocked(t reflect.Type) (c *structCodec) {
 			}
 			fallthrough
 		case name == "-":
+			if rules != "" {
+				c.problem = me("field %q: validate can't be used on ignored or meta fields", f.Name)
+				return
+			}
 			st.name = "-"
 			continue
 		default:
@@ -593,6 +693,95 @@ func getStructCodecLocked(t reflect.Type) (c *structCodec) {
 			st.name = "-"
 			continue
 		}
+		compiled, err := compileRules(rules, ft)
+		if err != nil {
+			c.problem = me("field %q has invalid validation rules: %s", f.Name, err)
+			return
+		}
+		st.rules = compiled
+
+		if hasOpt(opts, "ttl") {
+			if _, ok := c.bySpecial["ttl"]; ok {
+				c.problem = me("struct has multiple fields tagged as 'ttl'")
+				return
+			}
+			if ft != typeOfTime {
+				c.problem = me("ttl field %q has invalid type %s, expecting time.Time", f.Name, ft)
+				return
+			}
+			if hasOpt(opts, "noindex") {
+				c.problem = me("ttl field %q can't be noindex", f.Name)
+				return
+			}
+			c.bySpecial["ttl"] = i
+		}
+
+		st.isJSON, st.isGzip = hasOpt(opts, "json"), hasOpt(opts, "gzip")
+		st.isEncrypted = hasOpt(opts, "encrypted")
+		if st.isEncoded() {
+			if st.convert || hasOpt(opts, "entity") {
+				c.problem = me("field %q: json, gzip and encrypted can't be used with PropertyConverter or entity fields", f.Name)
+				return
+			}
+			st.isSlice = ft.Kind() == reflect.Slice && ft.Elem().Kind() != reflect.Uint8
+			c.hasSlice = c.hasSlice || st.isSlice
+			if !st.isJSON {
+				et := ft
+				if st.isSlice {
+					et = et.Elem()
+				}
+				if et.Kind() != reflect.String && !(et.Kind() == reflect.Slice && et.Elem().Kind() == reflect.Uint8) {
+					opt := "gzip"
+					if !st.isGzip {
+						opt = "encrypted"
+					}
+					c.problem = me("%s field %q has invalid type %s, expecting a string or []byte", opt, f.Name, ft)
+					return
+				}
+			}
+			if _, ok := c.byName[name]; ok {
+				c.problem = me("struct tag has repeated property name: %q", name)
+				return
+			}
+			c.byName[name] = i
+			st.name = name
+			st.idxSetting = NoIndex
+			continue
+		}
+
+		if hasOpt(opts, "entity") {
+			et := ft
+			if et.Kind() == reflect.Slice {
+				st.isSlice = true
+				c.hasSlice = true
+				et = et.Elem()
+			}
+			if et.Kind() == reflect.Ptr {
+				et = et.Elem()
+			}
+			if st.convert || et.Kind() != reflect.Struct || et == typeOfTime || et == typeOfGeoPoint {
+				c.problem = me("entity field %q has invalid type %s, expecting a struct", f.Name, ft)
+				return
+			}
+			// The codec may still be under construction if the struct is
+			// recursive. That's fine, since embedded entities aren't flattened.
+			sub := getStructCodecLocked(et)
+			if sub.problem != nil && sub.problem != errRecursiveStruct {
+				c.problem = me("field %q has problem: %s", f.Name, sub.problem)
+				return
+			}
+			st.entityCodec = sub
+			if _, ok := c.byName[name]; ok {
+				c.problem = me("struct tag has repeated property name: %q", name)
+				return
+			}
+			c.byName[name] = i
+			st.name = name
+			if hasOpt(opts, "noindex") {
+				st.idxSetting = NoIndex
+			}
+			continue
+		}
 
 		substructType := reflect.Type(nil)
 		if !st.convert {
@@ -665,7 +854,7 @@ func getStructCodecLocked(t reflect.Type) (c *structCodec) {
 			c.byName[name] = i
 		}
 		st.name = name
-		if opts == "noindex" {
+		if hasOpt(opts, "noindex") {
 			st.idxSetting = NoIndex
 		}
 	}
@@ -675,6 +864,17 @@ func getStructCodecLocked(t reflect.Type) (c *structCodec) {
 	return
 }
 
+// hasOpt returns true if opt is one of the comma-separated struct tag options
+// in opts.
+func hasOpt(opts, opt string) bool {
+	for _, o := range strings.Split(opts, ",") {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
 func convertMeta(val string, t reflect.Type) (interface{}, error) {
 	switch t.Kind() {
 	case reflect.String:
@@ -18,6 +18,7 @@ package datastore
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"math"
@@ -337,6 +338,64 @@ type MutuallyRecursive1 struct {
 	R []MutuallyRecursive0
 }
 
+type Embedded struct {
+	A int
+	B Inner1   `gae:",entity"`
+	P *Inner2  `gae:"Ptr,entity,noindex"`
+	S []Inner1 `gae:",entity"`
+}
+
+type EmbeddedSlices struct {
+	S []EmbeddedSlicesInner `gae:",entity"`
+}
+
+type EmbeddedSlicesInner struct {
+	F []float64
+	I []Inner1 `gae:",entity"`
+}
+
+type EmbeddedTree struct {
+	V    string
+	Kids []*EmbeddedTree `gae:",entity"`
+}
+
+type InvalidEmbedded struct {
+	I int `gae:",entity"`
+}
+
+type WithTTL struct {
+	Expires time.Time `gae:",ttl"`
+}
+
+type WithMetaTTL struct {
+	Expires time.Time `gae:"$ttl"`
+}
+
+type InvalidTTL struct {
+	Expires int64 `gae:",ttl"`
+}
+
+type Encoded struct {
+	Config  Inner1            `gae:",json"`
+	Body    string            `gae:",gzip"`
+	Labels  map[string]string `gae:"L,json,gzip"`
+	Blob    []byte            `gae:",gzip"`
+	Entries []*Inner2         `gae:",json"`
+}
+
+type EncodedOuter struct {
+	A   int
+	Sub []EncodedInner
+}
+
+type EncodedInner struct {
+	Config Inner2 `gae:",json"`
+}
+
+type InvalidGzip struct {
+	I int `gae:",gzip"`
+}
+
 type ExoticTypes struct {
 	BS blobstore.Key
 }
@@ -695,6 +754,18 @@ type IDEmbedder struct {
 
 type Simple struct{}
 
+func gzipped(s string) []byte {
+	buf := bytes.Buffer{}
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(s)); err != nil {
+		panic(err)
+	}
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
 type testCase struct {
 	desc       string
 	src        interface{}
@@ -1663,6 +1734,160 @@ var testCases = []testCase{
 		},
 		want: &B2{B: myBlob("rawr")},
 	},
+	{
+		desc: "embedded entities",
+		src: &Embedded{
+			A: 1,
+			B: Inner1{W: 2, X: "two"},
+			P: &Inner2{Y: 3.5},
+			S: []Inner1{{W: 4}, {X: "five"}},
+		},
+		want: PropertyMap{
+			"A":   mp(1),
+			"B":   mp(PropertyMap{"W": mp(2), "X": mp("two")}),
+			"Ptr": mpNI(PropertyMap{"Y": mp(3.5)}),
+			"S": PropertySlice{
+				mp(PropertyMap{"W": mp(4), "X": mp("")}),
+				mp(PropertyMap{"W": mp(0), "X": mp("five")}),
+			},
+		},
+	},
+	{
+		desc: "embedded entities round trip",
+		src: &Embedded{
+			B: Inner1{W: 2, X: "two"},
+			P: &Inner2{Y: 3.5},
+			S: []Inner1{{W: 4}, {X: "five"}},
+		},
+		want: &Embedded{
+			B: Inner1{W: 2, X: "two"},
+			P: &Inner2{Y: 3.5},
+			S: []Inner1{{W: 4}, {X: "five"}},
+		},
+	},
+	{
+		desc: "nil embedded entity",
+		src:  &Embedded{A: 1},
+		want: PropertyMap{
+			"A":   mp(1),
+			"B":   mp(PropertyMap{"W": mp(0), "X": mp("")}),
+			"Ptr": mpNI(nil),
+		},
+	},
+	{
+		desc: "embedded entities may contain slices",
+		src: &EmbeddedSlices{S: []EmbeddedSlicesInner{
+			{F: []float64{1, 2}, I: []Inner1{{W: 3}, {X: "four"}}},
+			{F: []float64{5}},
+		}},
+		want: &EmbeddedSlices{S: []EmbeddedSlicesInner{
+			{F: []float64{1, 2}, I: []Inner1{{W: 3}, {X: "four"}}},
+			{F: []float64{5}},
+		}},
+	},
+	{
+		desc: "embedded entities may be recursive",
+		src: &EmbeddedTree{V: "root", Kids: []*EmbeddedTree{
+			{V: "a"},
+			{V: "b", Kids: []*EmbeddedTree{{V: "c"}}},
+		}},
+		want: &EmbeddedTree{V: "root", Kids: []*EmbeddedTree{
+			{V: "a"},
+			{V: "b", Kids: []*EmbeddedTree{{V: "c"}}},
+		}},
+	},
+	{
+		desc:    "embedded entity type mismatch",
+		src:     &struct{ B string }{B: "not an entity"},
+		want:    &Embedded{},
+		loadErr: "type mismatch",
+	},
+	{
+		desc:   "embedded entity must be a struct",
+		src:    &InvalidEmbedded{I: 1},
+		plsErr: `entity field "I" has invalid type int, expecting a struct`,
+	},
+	{
+		desc: "json fields",
+		src: &Encoded{
+			Config:  Inner1{W: 1, X: "one"},
+			Entries: []*Inner2{{Y: 2}, nil},
+		},
+		want: PropertyMap{
+			"Config":  mpNI([]byte(`{"W":1,"X":"one"}`)),
+			"Body":    mpNI(gzipped("")),
+			"L":       mpNI(gzipped("null")),
+			"Blob":    mpNI(gzipped("")),
+			"Entries": PropertySlice{mpNI([]byte(`{"Y":2}`)), mpNI([]byte("null"))},
+		},
+	},
+	{
+		desc: "json and gzip fields round trip",
+		src: &Encoded{
+			Config:  Inner1{W: 1, X: "one"},
+			Body:    "a long text",
+			Labels:  map[string]string{"k": "v"},
+			Blob:    []byte("a big blob"),
+			Entries: []*Inner2{{Y: 2}, {Y: 3}},
+		},
+		want: &Encoded{
+			Config:  Inner1{W: 1, X: "one"},
+			Body:    "a long text",
+			Labels:  map[string]string{"k": "v"},
+			Blob:    []byte("a big blob"),
+			Entries: []*Inner2{{Y: 2}, {Y: 3}},
+		},
+	},
+	{
+		desc: "json fields in flattened structs",
+		src:  &EncodedOuter{A: 1, Sub: []EncodedInner{{Inner2{1}}, {Inner2{2}}}},
+		want: &EncodedOuter{A: 1, Sub: []EncodedInner{{Inner2{1}}, {Inner2{2}}}},
+	},
+	{
+		desc: "json fields in flattened structs as props",
+		src:  &EncodedOuter{A: 1, Sub: []EncodedInner{{Inner2{1}}, {Inner2{2}}}},
+		want: PropertyMap{
+			"A":          mp(1),
+			"Sub.Config": PropertySlice{mpNI([]byte(`{"Y":1}`)), mpNI([]byte(`{"Y":2}`))},
+		},
+	},
+	{
+		desc:    "bad json",
+		src:     &struct{ Config []byte }{Config: []byte("{not json")},
+		want:    &Encoded{},
+		loadErr: "failed to decode JSON value",
+	},
+	{
+		desc:    "bad gzip",
+		src:     &struct{ Body []byte }{Body: []byte("not gzip")},
+		want:    &Encoded{},
+		loadErr: "failed to decompress gzip value",
+	},
+	{
+		desc:   "gzip needs a string or []byte",
+		src:    &InvalidGzip{I: 1},
+		plsErr: `gzip field "I" has invalid type int, expecting a string or []byte`,
+	},
+	{
+		desc: "ttl field is an indexed time",
+		src:  &WithTTL{Expires: time.Unix(1e9, 0).UTC()},
+		want: PropertyMap{"Expires": mp(time.Unix(1e9, 0).UTC())},
+	},
+	{
+		desc: "$ttl field is saved in TTLProperty",
+		src:  &WithMetaTTL{Expires: time.Unix(1e9, 0).UTC()},
+		want: PropertyMap{TTLProperty: mp(time.Unix(1e9, 0).UTC())},
+	},
+	{
+		desc:   "ttl field must be a time",
+		src:    &InvalidTTL{Expires: 1},
+		plsErr: `ttl field "Expires" has invalid type int64, expecting time.Time`,
+	},
+	{
+		desc: "PropertyMap field",
+		src:  &struct{ M PropertyMap }{M: PropertyMap{"A": mp(1)}},
+		want: &struct{ M PropertyMap }{M: PropertyMap{"A": mp(1)}},
+	},
 }
 
 func TestRoundTrip(t *testing.T) {
@@ -0,0 +1,261 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ValidationError is returned by Put and Validate for a struct field which
+// doesn't satisfy one of the rules in its `validate=` struct tag option.
+type ValidationError struct {
+	// Field is the property name of the field, e.g. "Email" or "Address.Zip".
+	Field string
+	// Rule is the rule which failed, as written in the struct tag.
+	Rule string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("datastore: field %q fails validation rule %q", e.Field, e.Rule)
+}
+
+// Validate checks the fields of obj against their validation rules, without
+// writing anything. obj may be anything which Put accepts. Objects other than
+// structs, such as PropertyMaps, are always valid.
+//
+// The returned error has the same form as Put's: for a slice, it's a
+// MultiError with a *ValidationError for each invalid element.
+func Validate(obj interface{}) error {
+	src := []interface{}{obj}
+	mma, err := makeMetaMultiArg(src, mmaReadWrite)
+	if err != nil {
+		panic(err)
+	}
+	err = mma.runHooks(func(_ int, mat *multiArgType, slot reflect.Value) error {
+		return mat.validate(slot)
+	})
+	return maybeSingleError(err, src)
+}
+
+func (mat *multiArgType) validate(slot reflect.Value) error {
+	if spls, ok := mat.getPLS(slot).(*structPLS); ok {
+		return spls.validate("")
+	}
+	return nil
+}
+
+// validate checks the fields of p, including those of its substructs and
+// embedded entities, and returns the first one which fails a rule.
+func (p *structPLS) validate(prefix string) error {
+	if p.c.problem != nil {
+		return p.c.problem
+	}
+	for i, st := range p.c.byIndex {
+		if st.name == "-" || st.isExtra {
+			continue
+		}
+		name := prefix + st.name
+		v := p.o.Field(i)
+		if err := st.validateField(name, v); err != nil {
+			return err
+		}
+
+		var codec *structCodec
+		switch {
+		case st.substructCodec != nil:
+			codec = st.substructCodec
+		case st.entityCodec != nil:
+			codec, name = st.entityCodec, name+"."
+		default:
+			continue
+		}
+		vals := []reflect.Value{v}
+		if st.isSlice {
+			vals = vals[:0]
+			for j := 0; j < v.Len(); j++ {
+				vals = append(vals, v.Index(j))
+			}
+		}
+		for _, v := range vals {
+			if v.Kind() == reflect.Ptr {
+				if v.IsNil() {
+					continue
+				}
+				v = v.Elem()
+			}
+			if err := (&structPLS{o: v, c: codec}).validate(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fieldRule is a compiled validation rule of a struct field.
+type fieldRule struct {
+	// rule is the rule as written in the struct tag.
+	rule string
+	// elems is true if the rule applies to each element of a slice field,
+	// rather than to the slice itself.
+	elems bool
+	check func(v reflect.Value) bool
+}
+
+func (st *structTag) validateField(name string, v reflect.Value) error {
+	for _, r := range st.rules {
+		ok := true
+		if r.elems && st.isSlice {
+			for j := 0; j < v.Len() && ok; j++ {
+				ok = r.check(v.Index(j))
+			}
+		} else {
+			ok = r.check(v)
+		}
+		if !ok {
+			return &ValidationError{Field: name, Rule: r.rule}
+		}
+	}
+	return nil
+}
+
+// splitValidateOpt splits the validation rules, which extend to the end of the
+// struct tag options, from the other options.
+func splitValidateOpt(opts string) (others, rules string) {
+	const opt = "validate="
+	switch i := strings.Index(","+opts, ","+opt); {
+	case i < 0:
+		return opts, ""
+	case i == 0:
+		return "", opts[len(opt):]
+	default:
+		return opts[:i-1], opts[i+len(opt):]
+	}
+}
+
+// compileRules parses the comma-separated validation rules of a field of type
+// t.
+func compileRules(rules string, t reflect.Type) ([]fieldRule, error) {
+	if rules == "" {
+		return nil, nil
+	}
+	isSlice := t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8
+	et := t
+	if isSlice {
+		et = t.Elem()
+	}
+
+	ret := make([]fieldRule, 0, strings.Count(rules, ",")+1)
+	for _, rule := range strings.Split(rules, ",") {
+		r := fieldRule{rule: rule}
+		name, arg := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			name, arg = rule[:i], rule[i+1:]
+		}
+
+		switch name {
+		case "required":
+			r.check = func(v reflect.Value) bool { return !isZeroValue(v) }
+
+		case "min", "max":
+			bound, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad bound in %q: %s", rule, err)
+			}
+			size := sizeOf(t)
+			if size == nil {
+				return nil, fmt.Errorf("%q can't be applied to type %s", rule, t)
+			}
+			if name == "min" {
+				r.check = func(v reflect.Value) bool { return size(v) >= bound }
+			} else {
+				r.check = func(v reflect.Value) bool { return size(v) <= bound }
+			}
+
+		case "regex":
+			if et.Kind() != reflect.String {
+				return nil, fmt.Errorf("%q can't be applied to type %s", rule, t)
+			}
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, fmt.Errorf("bad regular expression in %q: %s", rule, err)
+			}
+			r.elems = isSlice
+			r.check = func(v reflect.Value) bool { return re.MatchString(v.String()) }
+
+		case "oneof":
+			switch et.Kind() {
+			case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+				reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			default:
+				return nil, fmt.Errorf("%q can't be applied to type %s", rule, t)
+			}
+			allowed := map[string]struct{}{}
+			for _, a := range strings.Split(arg, "|") {
+				allowed[a] = struct{}{}
+			}
+			r.elems = isSlice
+			r.check = func(v reflect.Value) bool {
+				var s string
+				switch v.Kind() {
+				case reflect.String:
+					s = v.String()
+				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+					s = strconv.FormatInt(v.Int(), 10)
+				default:
+					s = strconv.FormatUint(v.Uint(), 10)
+				}
+				_, ok := allowed[s]
+				return ok
+			}
+
+		default:
+			return nil, fmt.Errorf("unknown rule %q", rule)
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+// isZeroValue returns true if v is the zero value of its type, or an empty
+// string, slice or map.
+func isZeroValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// sizeOf returns a function which returns the size checked by the min and max
+// rules for values of type t, or nil if they don't apply to t.
+func sizeOf(t reflect.Type) func(v reflect.Value) float64 {
+	switch t.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return func(v reflect.Value) float64 { return float64(v.Len()) }
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(v reflect.Value) float64 { return float64(v.Int()) }
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return func(v reflect.Value) float64 { return float64(v.Uint()) }
+	case reflect.Float32, reflect.Float64:
+		return func(v reflect.Value) float64 { return v.Float() }
+	}
+	return nil
+}
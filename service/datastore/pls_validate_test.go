@@ -0,0 +1,120 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"testing"
+
+	"github.com/conchoid/gae/service/info"
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+type ValidAddress struct {
+	Zip string `gae:",validate=regex=^[0-9]{5}$"`
+}
+
+type ValidUser struct {
+	ID    int64    `gae:"$id"`
+	Email string   `gae:",noindex,validate=required,max=20,regex=@"`
+	Age   int      `gae:",validate=min=0,max=150"`
+	Role  string   `gae:",validate=oneof=admin|user"`
+	Tags  []string `gae:",validate=max=2,oneof=a|b|c"`
+
+	Home ValidAddress
+	Work *ValidAddress `gae:",entity"`
+}
+
+func validUser() *ValidUser {
+	return &ValidUser{
+		ID: 1, Email: "me@example.com", Age: 30, Role: "user", Tags: []string{"a"},
+		Home: ValidAddress{"12345"},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	Convey("Validate", t, func() {
+		Convey("accepts valid structs", func() {
+			So(Validate(validUser()), ShouldBeNil)
+			So(Validate(PropertyMap{}), ShouldBeNil)
+		})
+
+		Convey("names the failing field and rule", func() {
+			cases := []struct {
+				update func(u *ValidUser)
+				field  string
+				rule   string
+			}{
+				{func(u *ValidUser) { u.Email = "" }, "Email", "required"},
+				{func(u *ValidUser) { u.Email = "someone@a.very.long.domain" }, "Email", "max=20"},
+				{func(u *ValidUser) { u.Email = "nobody" }, "Email", "regex=@"},
+				{func(u *ValidUser) { u.Age = -1 }, "Age", "min=0"},
+				{func(u *ValidUser) { u.Role = "root" }, "Role", "oneof=admin|user"},
+				{func(u *ValidUser) { u.Tags = []string{"a", "b", "c"} }, "Tags", "max=2"},
+				{func(u *ValidUser) { u.Tags = []string{"d"} }, "Tags", "oneof=a|b|c"},
+				{func(u *ValidUser) { u.Home.Zip = "abc" }, "Home.Zip", "regex=^[0-9]{5}$"},
+				{func(u *ValidUser) { u.Work = &ValidAddress{"abc"} }, "Work.Zip", "regex=^[0-9]{5}$"},
+			}
+			for _, tc := range cases {
+				u := validUser()
+				tc.update(u)
+				So(Validate(u), ShouldResemble, &ValidationError{Field: tc.field, Rule: tc.rule})
+			}
+		})
+
+		Convey("returns a MultiError for slices", func() {
+			bad := validUser()
+			bad.Role = ""
+			err := Validate([]*ValidUser{validUser(), bad})
+			So(err, ShouldResemble, errors.MultiError{nil, &ValidationError{Field: "Role", Rule: "oneof=admin|user"}})
+		})
+
+		Convey("rejects invalid rules", func() {
+			type unknownRule struct {
+				Name string `gae:",validate=shiny"`
+			}
+			type badType struct {
+				Count int `gae:",validate=regex=[0-9]"`
+			}
+			type badRegex struct {
+				Name string `gae:",validate=regex=("`
+			}
+			type metaRule struct {
+				ID int64 `gae:"$id,validate=required"`
+			}
+			So(func() { Validate(&unknownRule{}) }, ShouldPanicLike, `unknown rule "shiny"`)
+			So(func() { Validate(&badType{}) }, ShouldPanicLike, `can't be applied to type int`)
+			So(func() { Validate(&badRegex{}) }, ShouldPanicLike, "bad regular expression")
+			So(func() { Validate(&metaRule{}) }, ShouldPanicLike, "validate can't be used")
+		})
+
+		Convey("is checked by Put", func() {
+			c := info.Set(context.Background(), fakeInfo{})
+			fds := fakeDatastore{}
+			c = SetRawFactory(c, fds.factory())
+
+			bad := validUser()
+			bad.Age = 200
+			err := Put(c, []*ValidUser{validUser(), bad})
+			So(err, ShouldResemble, errors.MultiError{nil, &ValidationError{Field: "Age", Rule: "max=150"}})
+		})
+	})
+}
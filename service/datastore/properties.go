@@ -21,6 +21,9 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/conchoid/gae/service/blobstore"
@@ -166,6 +169,15 @@ const (
 	// PTBlobKey represents a blobstore.Key
 	PTBlobKey
 
+	// PTPropertyMap represents an embedded entity, which is held in a
+	// PropertyMap.
+	//
+	// Embedded entities are not indexed as a whole. Instead, if a PTPropertyMap
+	// value is indexed, its indexed sub-properties are indexed under their dotted
+	// names (e.g. "Outer.Inner"), and may be filtered, sorted and projected on
+	// with those names.
+	PTPropertyMap
+
 	// PTUnknown is a placeholder value which should never show up in reality.
 	//
 	// NOTE: THIS MUST BE LAST VALUE FOR THE init() ASSERTION BELOW TO WORK.
@@ -259,6 +271,8 @@ func PropertyTypeOf(v interface{}, checkValid bool) (PropertyType, error) {
 			err = errors.New("invalid GeoPoint value")
 		}
 		return PTGeoPoint, err
+	case PropertyMap:
+		return PTPropertyMap, nil
 	default:
 		return PTUnknown, fmt.Errorf("gae: Property has bad type %T", v)
 	}
@@ -338,7 +352,7 @@ func UpconvertUnderlyingType(o interface{}) interface{} {
 	}
 
 	switch t {
-	case typeOfKey:
+	case typeOfKey, typeOfPropertyMap:
 		if v.IsNil() {
 			return nil
 		}
@@ -407,6 +421,8 @@ func (p *Property) Type() PropertyType { return p.propType }
 //	- float64
 //	- *Key
 //	- GeoPoint
+//	- PropertyMap
+//    (an embedded entity, see PTPropertyMap)
 // This set is smaller than the set of valid struct field types that the
 // datastore can load and save. A Property Value cannot be a slice (apart
 // from []byte); use multiple Properties instead. Also, a Value's type
@@ -462,9 +478,13 @@ func (p *Property) SetValue(value interface{}, is IndexSetting) (err error) {
 //	- []byte
 //	- GeoPoint
 //	- *Key
+//	- PropertyMap
+//
+// PTPropertyMap values are never stored in an index themselves (see
+// PTPropertyMap), but they may still be serialized and compared.
 func (p Property) IndexTypeAndValue() (PropertyType, interface{}) {
 	switch t := p.propType; t {
-	case PTNull, PTInt, PTBool, PTFloat, PTGeoPoint, PTKey:
+	case PTNull, PTInt, PTBool, PTFloat, PTGeoPoint, PTKey, PTPropertyMap:
 		return t, p.Value()
 
 	case PTTime:
@@ -544,6 +564,8 @@ func (p *Property) Project(to PropertyType) (interface{}, error) {
 			return nil, nil
 		case PTBlobKey:
 			return blobstore.Key(""), nil
+		case PTPropertyMap:
+			return PropertyMap(nil), nil
 		}
 	}
 	return nil, fmt.Errorf("unable to project %s to %s", pt, to)
@@ -643,6 +665,9 @@ func (p *Property) Compare(other *Property) int {
 		}
 		return -1
 
+	case PTPropertyMap:
+		return cmpPropertyMap(av.(PropertyMap), bv.(PropertyMap))
+
 	default:
 		panic(fmt.Errorf("uncomparable type: %s", t))
 	}
@@ -671,6 +696,8 @@ func (p *Property) EstimateSize() int64 {
 		return 1 + int64(len(p.Value().([]byte)))
 	case PTKey:
 		return 1 + p.Value().(*Key).EstimateSize()
+	case PTPropertyMap:
+		return 1 + p.Value().(PropertyMap).EstimateSize()
 	}
 	panic(fmt.Errorf("Unknown property type: %s", p.Type().String()))
 }
@@ -681,17 +708,27 @@ func (p *Property) EstimateSize() int64 {
 // The flavor of GQL that this emits is defined here:
 //   https://cloud.google.com/datastore/docs/apis/gql/gql_reference
 //
-// NOTE: GeoPoint values are emitted with speculated future syntax. There is
-// currently no syntax for literal GeoPoint values.
+// NOTE: GeoPoint and embedded entity values are emitted with speculated future
+// syntax. There is currently no syntax for literal GeoPoint or entity values.
 func (p *Property) GQL() string {
 	v := p.Value()
 	switch p.propType {
 	case PTNull:
 		return "NULL"
 
-	case PTInt, PTFloat, PTBool:
+	case PTInt, PTBool:
 		return fmt.Sprint(v)
 
+	case PTFloat:
+		// Always include a "." or an exponent, so that the literal parses back as
+		// a float rather than an int.
+		f := v.(float64)
+		ret := strconv.FormatFloat(f, 'g', -1, 64)
+		if !math.IsInf(f, 0) && !math.IsNaN(f) && !strings.ContainsAny(ret, ".eE") {
+			ret += ".0"
+		}
+		return ret
+
 	case PTString:
 		return gqlQuoteString(v.(string))
 
@@ -714,6 +751,32 @@ func (p *Property) GQL() string {
 		// it.
 		v := v.(GeoPoint)
 		return fmt.Sprintf("GEOPOINT(%v, %v)", v.Lat, v.Lng)
+
+	case PTPropertyMap:
+		// Properties are sorted by name, so that equal entities have the same
+		// GQL.
+		pm := v.(PropertyMap)
+		names := make([]string, 0, len(pm))
+		for name := range pm {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fields := make([]string, len(names))
+		for i, name := range names {
+			val := ""
+			switch pdata := pm[name].(type) {
+			case Property:
+				val = pdata.GQL()
+			case PropertySlice:
+				vals := make([]string, len(pdata))
+				for j := range pdata {
+					vals[j] = pdata[j].GQL()
+				}
+				val = fmt.Sprintf("ARRAY(%s)", strings.Join(vals, ", "))
+			}
+			fields[i] = fmt.Sprintf("%s = %s", gqlQuoteName(name), val)
+		}
+		return fmt.Sprintf("ENTITY(%s)", strings.Join(fields, ", "))
 	}
 	panic(fmt.Errorf("bad type: %s", p.propType))
 }
@@ -966,6 +1029,44 @@ func (pm PropertyMap) EstimateSize() int64 {
 	return ret
 }
 
+// cmpPropertyMap compares the non-meta properties of two embedded entities. The
+// property names are compared in order first, then their values.
+func cmpPropertyMap(a, b PropertyMap) int {
+	names := func(pm PropertyMap) []string {
+		ret := make([]string, 0, len(pm))
+		for k := range pm {
+			if !isMetaKey(k) {
+				ret = append(ret, k)
+			}
+		}
+		sort.Strings(ret)
+		return ret
+	}
+
+	an, bn := names(a), names(b)
+	for i := 0; i < len(an) && i < len(bn); i++ {
+		if an[i] != bn[i] {
+			return strings.Compare(an[i], bn[i])
+		}
+	}
+	if cmp := len(an) - len(bn); cmp != 0 {
+		return cmp
+	}
+
+	for _, k := range an {
+		as, bs := a.Slice(k), b.Slice(k)
+		for i := 0; i < len(as) && i < len(bs); i++ {
+			if cmp := as[i].Compare(&bs[i]); cmp != 0 {
+				return cmp
+			}
+		}
+		if cmp := len(as) - len(bs); cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
+
 func isMetaKey(k string) bool {
 	// empty counts as a metakey since it's not a valid data key, but it's
 	// not really a valid metakey either.
@@ -195,6 +195,26 @@ func TestProperties(t *testing.T) {
 				So(a.Equal(&b), ShouldBeTrue)
 			})
 		})
+
+		Convey("GQL", func() {
+			Convey("float", func() {
+				gql := func(v float64) string {
+					pv := MkProperty(v)
+					return pv.GQL()
+				}
+				So(gql(2), ShouldEqual, "2.0")
+				So(gql(-1.5), ShouldEqual, "-1.5")
+				So(gql(1e21), ShouldEqual, "1e+21")
+			})
+
+			Convey("embedded entity", func() {
+				pv := MkProperty(PropertyMap{
+					"b": PropertySlice{MkProperty(1), MkProperty("two")},
+					"a": MkProperty(PropertyMap{"x": MkProperty(true)}),
+				})
+				So(pv.GQL(), ShouldEqual, "ENTITY(`a` = ENTITY(`x` = true), `b` = ARRAY(1, \"two\"))")
+			})
+		})
 	})
 }
 
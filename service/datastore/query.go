@@ -72,6 +72,7 @@ type queryFields struct {
 	project stringset.Set
 
 	eqFilts map[string]PropertySlice
+	inFilts map[string]PropertySlice
 
 	ineqFiltProp     string
 	ineqFiltLow      Property
@@ -81,6 +82,13 @@ type queryFields struct {
 	ineqFiltHighIncl bool
 	ineqFiltHighSet  bool
 
+	// neqFilts are the values excluded from ineqFiltProp by Neq.
+	neqFilts PropertySlice
+
+	// filterGroups are added by Or and And. All of them must match, in addition
+	// to the other filters.
+	filterGroups []Filter
+
 	start Cursor
 	end   Cursor
 
@@ -120,6 +128,21 @@ func (q *Query) mod(cb func(*Query)) *Query {
 			ret.eqFilts[k] = newV
 		}
 	}
+	if len(q.inFilts) > 0 {
+		ret.inFilts = make(map[string]PropertySlice, len(q.inFilts))
+		for k, v := range q.inFilts {
+			newV := make(PropertySlice, len(v))
+			copy(newV, v)
+			ret.inFilts[k] = newV
+		}
+	}
+	if len(q.neqFilts) > 0 {
+		ret.neqFilts = make(PropertySlice, len(q.neqFilts))
+		copy(ret.neqFilts, q.neqFilts)
+	}
+	if len(q.filterGroups) > 0 {
+		ret.filterGroups = append([]Filter(nil), q.filterGroups...)
+	}
 	cb(&ret)
 	return &ret
 }
@@ -296,24 +319,88 @@ func (q *Query) Eq(field string, values ...interface{}) *Query {
 			s := q.eqFilts[field]
 			for _, value := range values {
 				p := Property{}
-				if q.err = p.SetValue(value, ShouldIndex); q.err != nil {
+				if q.err = p.setFilterValue(value); q.err != nil {
 					return
 				}
-				idx := sort.Search(len(s), func(i int) bool {
-					// s[i] >= p is the same as:
-					return s[i].Equal(&p) || p.Less(&s[i])
-				})
-				if idx == len(s) || !s[idx].Equal(&p) {
-					s = append(s, Property{})
-					copy(s[idx+1:], s[idx:])
-					s[idx] = p
-				}
+				s = addSortedProperty(s, p)
 			}
 			q.eqFilts[field] = s
 		}
 	})
 }
 
+// In adds a membership restriction to the query.
+//
+// Unlike Eq, the values are alternatives: the field must have /at least one/
+// value which is equal to /any/ of the specified values. So a query with
+// `.In("thing", 1, 2)` will return entities where the field "thing" contains
+// a value of 1, a value of 2, or both.
+//
+// Calling In again for the same field narrows the accepted values to the
+// intersection of both calls. An In filter without any values can never match
+// anything, and causes Finalize to return ErrNullQuery.
+//
+// The datastore can't serve membership filters from a single index scan, so
+// Finalize expands a query with In filters into one sub-query per combination
+// of values (see FinalizedQuery.SubQueries). Their results are merged back into
+// a single, deduplicated stream in the query's sort order.
+//
+// If the query is sorted on a property with several values, an entity may
+// match sub-queries at different positions of the sort order, e.g. an entity
+// with the values 1 and 3 for "thing" and `.In("thing", 1, 3).Order("thing")`.
+// A single Run returns it once, at its first position. However cursors don't
+// record which entities were returned, so a query started at a cursor between
+// the positions returns the entity again.
+func (q *Query) In(field string, values ...interface{}) *Query {
+	return q.mod(func(q *Query) {
+		if q.reserved(field) {
+			return
+		}
+		s := PropertySlice{}
+		for _, value := range values {
+			p := Property{}
+			if q.err = p.setFilterValue(value); q.err != nil {
+				return
+			}
+			s = addSortedProperty(s, p)
+		}
+		if q.inFilts == nil {
+			q.inFilts = make(map[string]PropertySlice, 1)
+		}
+		if prev, ok := q.inFilts[field]; ok {
+			both := PropertySlice{}
+			for _, p := range s {
+				if idx := searchProperty(prev, p); idx < len(prev) && prev[idx].Equal(&p) {
+					both = append(both, p)
+				}
+			}
+			s = both
+		}
+		q.inFilts[field] = s
+	})
+}
+
+// searchProperty returns the index in the sorted PropertySlice s at which p is
+// (or would be) located.
+func searchProperty(s PropertySlice, p Property) int {
+	return sort.Search(len(s), func(i int) bool {
+		// s[i] >= p is the same as:
+		return s[i].Equal(&p) || p.Less(&s[i])
+	})
+}
+
+// addSortedProperty inserts p into the sorted PropertySlice s, unless s already
+// contains it.
+func addSortedProperty(s PropertySlice, p Property) PropertySlice {
+	idx := searchProperty(s, p)
+	if idx == len(s) || !s[idx].Equal(&p) {
+		s = append(s, Property{})
+		copy(s[idx+1:], s[idx:])
+		s[idx] = p
+	}
+	return s
+}
+
 func (q *Query) reserved(field string) bool {
 	if field == "__key__" {
 		return false
@@ -331,6 +418,17 @@ func (q *Query) reserved(field string) bool {
 	return false
 }
 
+// setFilterValue sets p to value, which is used to filter on a field.
+func (p *Property) setFilterValue(value interface{}) error {
+	if err := p.SetValue(value, ShouldIndex); err != nil {
+		return err
+	}
+	if p.propType == PTPropertyMap {
+		return fmt.Errorf("cannot filter on an embedded entity, filter on its sub-properties instead")
+	}
+	return nil
+}
+
 func (q *Query) ineqOK(field string, value Property) bool {
 	if q.reserved(field) {
 		return false
@@ -357,7 +455,7 @@ func (q *Query) ineqOK(field string, value Property) bool {
 // where the field "thing" has a single value where `5 < val < 10`.
 func (q *Query) Lt(field string, value interface{}) *Query {
 	p := Property{}
-	err := p.SetValue(value, ShouldIndex)
+	err := p.setFilterValue(value)
 
 	if err == nil && q.ineqFiltHighSet {
 		if q.ineqFiltHigh.Less(&p) {
@@ -390,7 +488,7 @@ func (q *Query) Lt(field string, value interface{}) *Query {
 // where the field "thing" has a single value where `5 < val < 10`.
 func (q *Query) Lte(field string, value interface{}) *Query {
 	p := Property{}
-	err := p.SetValue(value, ShouldIndex)
+	err := p.setFilterValue(value)
 
 	if err == nil && q.ineqFiltHighSet {
 		if q.ineqFiltHigh.Less(&p) {
@@ -423,7 +521,7 @@ func (q *Query) Lte(field string, value interface{}) *Query {
 // where the field "thing" has a single value where `5 < val < 10`.
 func (q *Query) Gt(field string, value interface{}) *Query {
 	p := Property{}
-	err := p.SetValue(value, ShouldIndex)
+	err := p.setFilterValue(value)
 
 	if err == nil && q.ineqFiltLowSet {
 		if p.Less(&q.ineqFiltLow) {
@@ -456,7 +554,7 @@ func (q *Query) Gt(field string, value interface{}) *Query {
 // where the field "thing" has a single value where `5 < val < 10`.
 func (q *Query) Gte(field string, value interface{}) *Query {
 	p := Property{}
-	err := p.SetValue(value, ShouldIndex)
+	err := p.setFilterValue(value)
 
 	if err == nil && q.ineqFiltLowSet {
 		if p.Less(&q.ineqFiltLow) {
@@ -479,6 +577,59 @@ func (q *Query) Gte(field string, value interface{}) *Query {
 	})
 }
 
+// Neq imposes a 'not-equal' restriction on the Query.
+//
+// Neq counts as an inequality filter on field, so it can't be combined with
+// inequality filters on other fields, and the first sort order (if any) must be
+// on field. It may be combined with Lt, Lte, Gt and Gte on the same field, and
+// may be called more than once to exclude several values.
+//
+// Like other inequality filters, Neq interacts with multiply-defined properties
+// by requiring that the field has /at least one/ value which is not excluded.
+//
+// Neq is implemented by expanding the query into one sub-query per range
+// between the excluded values (see In for details).
+func (q *Query) Neq(field string, value interface{}) *Query {
+	p := Property{}
+	err := p.setFilterValue(value)
+
+	return q.mod(func(q *Query) {
+		if q.err = err; err != nil {
+			return
+		}
+		if q.ineqOK(field, p) {
+			q.ineqFiltProp = field
+			q.neqFilts = addSortedProperty(q.neqFilts, p)
+		}
+	})
+}
+
+// Or adds a group of alternative filters to the query: entities must match at
+// least one of filters, as well as all of the other filters of the query.
+//
+// Groups can be nested with OrFilter and AndFilter, e.g.
+//
+//	q.Or(EqFilter("Owner", "bob"), AndFilter(
+//	  EqFilter("Public", true), GtFilter("Score", 10)))
+//
+// Like In, Or causes Finalize to expand the query into one sub-query per
+// alternative (see FinalizedQuery.SubQueries). All inequality filters of the
+// query, including those in groups, must apply to the same field.
+func (q *Query) Or(filters ...Filter) *Query {
+	return q.mod(func(q *Query) {
+		q.filterGroups = append(q.filterGroups, OrFilter(filters...))
+	})
+}
+
+// And adds a group of filters to the query which must all match. This is
+// mostly useful to apply filters which were built with OrFilter and
+// AndFilter.
+func (q *Query) And(filters ...Filter) *Query {
+	return q.mod(func(q *Query) {
+		q.filterGroups = append(q.filterGroups, AndFilter(filters...))
+	})
+}
+
 // ClearFilters clears all equality and inequality filters from the Query. It
 // does not clear the Ancestor filter if one is defined.
 func (q *Query) ClearFilters() *Query {
@@ -489,6 +640,9 @@ func (q *Query) ClearFilters() *Query {
 		} else {
 			q.eqFilts = nil
 		}
+		q.inFilts = nil
+		q.neqFilts = nil
+		q.filterGroups = nil
 		q.ineqFiltLowSet = false
 		q.ineqFiltHighSet = false
 	})
@@ -509,11 +663,131 @@ func (q *Query) Finalize() (*FinalizedQuery, error) {
 }
 
 func (q *Query) finalizeImpl() (*FinalizedQuery, error) {
+	if len(q.filterGroups) > 0 {
+		return q.finalizeFilterGroups()
+	}
+
+	ret, err := q.finalizeConjunction()
+	if err != nil {
+		return nil, err
+	}
+	if len(ret.inFilts) > 0 || len(ret.neqFilts) > 0 {
+		if err := q.fanOut(ret); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// finalizeFilterGroups finalizes a query with filter groups, by expanding it
+// into the conjunctive queries which it is the union of.
+func (q *Query) finalizeFilterGroups() (*FinalizedQuery, error) {
+	branches, err := q.filterBranches()
+	switch {
+	case err != nil:
+		return nil, err
+	case len(branches) == 0:
+		return nil, ErrNullQuery
+	case len(branches) == 1:
+		return branches[0].Finalize()
+	}
+
+	// The merged query is q without its filter groups, except that inequality
+	// filters within the groups determine its sort order.
+	ineqProp := q.ineqFiltProp
+	for _, g := range q.filterGroups {
+		g.ineqFields(func(field string) {
+			if ineqProp == "" {
+				ineqProp = field
+			} else if ineqProp != field {
+				err = ErrMultipleInequalityFilter
+			}
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	base := q.mod(func(q *Query) {
+		q.filterGroups = nil
+		q.ineqFiltProp = ineqProp
+	})
+	ret, err := base.finalizeConjunction()
+	if err != nil {
+		return nil, err
+	}
+	ret.original = q
+	ret.filterGroups = q.filterGroups
+	if err := q.fanOut(ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// filterBranches returns the disjunctive normal form of q: one query per
+// alternative of its filter groups, which has that alternative's filters in
+// place of the groups.
+func (q *Query) filterBranches() ([]*Query, error) {
+	conjs := [][]Filter{nil}
+	for _, g := range q.filterGroups {
+		gd, err := g.dnf()
+		if err != nil {
+			return nil, err
+		}
+		if conjs, err = dnfProduct(conjs, gd); err != nil {
+			return nil, err
+		}
+	}
+
+	ret := make([]*Query, len(conjs))
+	for i, conj := range conjs {
+		bq := q.mod(func(q *Query) {
+			q.filterGroups = nil
+		})
+		for _, f := range conj {
+			bq = f.apply(bq)
+		}
+		ret[i] = bq
+	}
+	return ret, nil
+}
+
+// finalizeConjunction finalizes a query without filter groups, not taking its
+// fan-out into account.
+func (q *Query) finalizeConjunction() (*FinalizedQuery, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+
 	ancestor := (*Key)(nil)
 	if slice, ok := q.eqFilts["__ancestor__"]; ok {
 		ancestor = slice[0].Value().(*Key)
 	}
 
+	// An In filter with a single value is just an equality filter, so fold those
+	// into eqFilts. Only the remaining ones cause the query to fan out.
+	eqFilts, inFilts := q.eqFilts, map[string]PropertySlice(nil)
+	copiedEqFilts := false
+	for prop, vals := range q.inFilts {
+		switch len(vals) {
+		case 0:
+			return nil, ErrNullQuery
+		case 1:
+			if !copiedEqFilts {
+				eqFilts = make(map[string]PropertySlice, len(q.eqFilts)+1)
+				for k, v := range q.eqFilts {
+					eqFilts[k] = v
+				}
+				copiedEqFilts = true
+			}
+			eqFilts[prop] = addSortedProperty(append(PropertySlice(nil), eqFilts[prop]...), vals[0])
+		default:
+			if inFilts == nil {
+				inFilts = make(map[string]PropertySlice, len(q.inFilts))
+			}
+			inFilts[prop] = vals
+		}
+	}
+
 	err := func() error {
 
 		if q.kind == "" { // kindless query checks
@@ -525,7 +799,7 @@ func (q *Query) finalizeImpl() (*FinalizedQuery, error) {
 			if ancestor != nil {
 				allowedEqs = 1
 			}
-			if len(q.eqFilts) > allowedEqs {
+			if len(eqFilts)+len(inFilts) > allowedEqs {
 				return fmt.Errorf("kindless queries may not have any equality filters")
 			}
 			for _, o := range q.order {
@@ -571,10 +845,14 @@ func (q *Query) finalizeImpl() (*FinalizedQuery, error) {
 		err := error(nil)
 		if q.project != nil {
 			q.project.Iter(func(p string) bool {
-				if _, iseq := q.eqFilts[p]; iseq {
+				if _, iseq := eqFilts[p]; iseq {
 					err = fmt.Errorf("cannot project on equality filter field: %s", p)
 					return false
 				}
+				if _, isin := inFilts[p]; isin {
+					err = fmt.Errorf("cannot project on IN filter field: %s", p)
+					return false
+				}
 				return true
 			})
 		}
@@ -595,7 +873,8 @@ func (q *Query) finalizeImpl() (*FinalizedQuery, error) {
 		start:                q.start,
 		end:                  q.end,
 
-		eqFilts: q.eqFilts,
+		eqFilts: eqFilts,
+		inFilts: inFilts,
 
 		ineqFiltProp:     q.ineqFiltProp,
 		ineqFiltLow:      q.ineqFiltLow,
@@ -604,6 +883,7 @@ func (q *Query) finalizeImpl() (*FinalizedQuery, error) {
 		ineqFiltHigh:     q.ineqFiltHigh,
 		ineqFiltHighIncl: q.ineqFiltHighIncl,
 		ineqFiltHighSet:  q.ineqFiltHighSet,
+		neqFilts:         q.neqFilts,
 	}
 	// If a starting cursor is provided, ignore the offset, as it would have been
 	// accounted for in the query that produced the cursor.
@@ -635,7 +915,7 @@ func (q *Query) finalizeImpl() (*FinalizedQuery, error) {
 	//   https://cloud.google.com/appengine/docs/go/datastore/queries#sort_orders_are_ignored_on_properties_with_equality_filters
 	// Deduplicate orders
 	for _, o := range q.order {
-		if _, iseq := q.eqFilts[o.Property]; !iseq {
+		if _, iseq := eqFilts[o.Property]; !iseq {
 			if seenOrders.Add(o.Property) {
 				ret.orders = append(ret.orders, o)
 			}
@@ -717,6 +997,19 @@ func (q *Query) String() string {
 			p("Filter(%q == %s)", prop, v.GQL())
 		}
 	}
+	for prop, vals := range q.inFilts {
+		gql := make([]string, len(vals))
+		for i, v := range vals {
+			gql[i] = v.GQL()
+		}
+		p("Filter(%q IN [%s])", prop, strings.Join(gql, ", "))
+	}
+	for _, v := range q.neqFilts {
+		p("Filter(%q != %s)", q.ineqFiltProp, v.GQL())
+	}
+	for _, g := range q.filterGroups {
+		p("Filter(%s)", g.GQL())
+	}
 	if q.ineqFiltProp != "" {
 		if q.ineqFiltLowSet {
 			op := ">"
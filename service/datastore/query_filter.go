@@ -0,0 +1,257 @@
+// Copyright 2015 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Filter is a condition on the properties of an entity. Filters are combined
+// into trees with OrFilter and AndFilter, and added to a Query with Query.Or
+// and Query.And.
+//
+// Filter values are immutable. The zero Filter is not a valid filter.
+type Filter struct {
+	op       string
+	field    string
+	values   PropertySlice
+	children []Filter
+
+	err error
+}
+
+func mkLeafFilter(op, field string, values ...interface{}) Filter {
+	ret := Filter{op: op, field: field, values: make(PropertySlice, len(values))}
+	for i, v := range values {
+		if ret.err = ret.values[i].setFilterValue(v); ret.err != nil {
+			break
+		}
+	}
+	return ret
+}
+
+// EqFilter is a Filter which requires field to have a value equal to value. See
+// Query.Eq.
+func EqFilter(field string, value interface{}) Filter {
+	return mkLeafFilter("=", field, value)
+}
+
+// InFilter is a Filter which requires field to have a value equal to any of
+// values. See Query.In.
+func InFilter(field string, values ...interface{}) Filter {
+	return mkLeafFilter("IN", field, values...)
+}
+
+// NeqFilter is a Filter which requires field to have a value not equal to
+// value. See Query.Neq.
+func NeqFilter(field string, value interface{}) Filter {
+	return mkLeafFilter("!=", field, value)
+}
+
+// LtFilter is a Filter which requires field to have a value less than value.
+// See Query.Lt.
+func LtFilter(field string, value interface{}) Filter {
+	return mkLeafFilter("<", field, value)
+}
+
+// LteFilter is a Filter which requires field to have a value less than or equal
+// to value. See Query.Lte.
+func LteFilter(field string, value interface{}) Filter {
+	return mkLeafFilter("<=", field, value)
+}
+
+// GtFilter is a Filter which requires field to have a value greater than value.
+// See Query.Gt.
+func GtFilter(field string, value interface{}) Filter {
+	return mkLeafFilter(">", field, value)
+}
+
+// GteFilter is a Filter which requires field to have a value greater than or
+// equal to value. See Query.Gte.
+func GteFilter(field string, value interface{}) Filter {
+	return mkLeafFilter(">=", field, value)
+}
+
+// OrFilter is a Filter which requires at least one of filters to match. An
+// OrFilter without any filters matches nothing.
+func OrFilter(filters ...Filter) Filter {
+	return Filter{op: "OR", children: append([]Filter(nil), filters...)}
+}
+
+// AndFilter is a Filter which requires all of filters to match. An AndFilter
+// without any filters matches everything.
+func AndFilter(filters ...Filter) Filter {
+	return Filter{op: "AND", children: append([]Filter(nil), filters...)}
+}
+
+// Op returns the operator of this Filter. It is one of "=", "IN", "!=", "<",
+// "<=", ">", ">=" for filters on a single field, or "AND" or "OR" for groups of
+// filters.
+func (f Filter) Op() string { return f.op }
+
+// Field returns the field which this Filter applies to. It's empty for groups.
+func (f Filter) Field() string { return f.field }
+
+// Values returns the values which this Filter compares its field to. It's empty
+// for groups.
+func (f Filter) Values() PropertySlice {
+	return append(PropertySlice(nil), f.values...)
+}
+
+// Children returns the filters in this group. It's empty for filters on a
+// single field.
+func (f Filter) Children() []Filter {
+	return append([]Filter(nil), f.children...)
+}
+
+// isGroup returns true iff f is an AND or OR group.
+func (f Filter) isGroup() bool {
+	return f.op == "AND" || f.op == "OR"
+}
+
+// isIneq returns true iff f is an inequality filter on a single field.
+func (f Filter) isIneq() bool {
+	switch f.op {
+	case "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+// ineqFields calls cb for the field of every inequality filter in f.
+func (f Filter) ineqFields(cb func(string)) {
+	if f.isIneq() {
+		cb(f.field)
+	}
+	for _, c := range f.children {
+		c.ineqFields(cb)
+	}
+}
+
+// GQL returns a correctly formatted Cloud Datastore GQL expression which is
+// equivalent to this filter.
+func (f Filter) GQL() string {
+	if f.isGroup() {
+		if len(f.children) == 0 {
+			if f.op == "AND" {
+				return "TRUE"
+			}
+			return "FALSE"
+		}
+		parts := make([]string, len(f.children))
+		for i, c := range f.children {
+			parts[i] = c.GQL()
+		}
+		return "(" + strings.Join(parts, fmt.Sprintf(" %s ", f.op)) + ")"
+	}
+
+	field := gqlQuoteName(f.field)
+	if f.op == "IN" {
+		vals := make([]string, len(f.values))
+		for i, v := range f.values {
+			vals[i] = v.GQL()
+		}
+		return fmt.Sprintf("%s IN ARRAY(%s)", field, strings.Join(vals, ", "))
+	}
+	if f.op == "=" && f.values[0].Type() == PTNull {
+		return fmt.Sprintf("%s IS NULL", field)
+	}
+	return fmt.Sprintf("%s %s %s", field, f.op, f.values[0].GQL())
+}
+
+func (f Filter) String() string {
+	return f.GQL()
+}
+
+// dnf returns the disjunctive normal form of f: a list of conjunctions of leaf
+// filters, any one of which must match. It fails if that list would exceed
+// maxSubQueries entries.
+func (f Filter) dnf() ([][]Filter, error) {
+	switch f.op {
+	case "OR":
+		ret := [][]Filter(nil)
+		for _, c := range f.children {
+			cd, err := c.dnf()
+			if err != nil {
+				return nil, err
+			}
+			if ret = append(ret, cd...); len(ret) > maxSubQueries {
+				return nil, errTooManySubQueries
+			}
+		}
+		return ret, nil
+
+	case "AND":
+		ret := [][]Filter{nil}
+		for _, c := range f.children {
+			cd, err := c.dnf()
+			if err != nil {
+				return nil, err
+			}
+			if ret, err = dnfProduct(ret, cd); err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+
+	case "":
+		return nil, fmt.Errorf("invalid filter: %#v", f)
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return [][]Filter{{f}}, nil
+}
+
+// dnfProduct returns the conjunction of two filters in disjunctive normal form.
+func dnfProduct(a, b [][]Filter) ([][]Filter, error) {
+	if len(a)*len(b) > maxSubQueries {
+		return nil, errTooManySubQueries
+	}
+	ret := make([][]Filter, 0, len(a)*len(b))
+	for _, x := range a {
+		for _, y := range b {
+			conj := make([]Filter, 0, len(x)+len(y))
+			ret = append(ret, append(append(conj, x...), y...))
+		}
+	}
+	return ret, nil
+}
+
+// apply adds the leaf filter f to q.
+func (f Filter) apply(q *Query) *Query {
+	vals := make([]interface{}, len(f.values))
+	for i := range f.values {
+		vals[i] = f.values[i].Value()
+	}
+	switch f.op {
+	case "=":
+		return q.Eq(f.field, vals...)
+	case "IN":
+		return q.In(f.field, vals...)
+	case "!=":
+		return q.Neq(f.field, vals[0])
+	case "<":
+		return q.Lt(f.field, vals[0])
+	case "<=":
+		return q.Lte(f.field, vals[0])
+	case ">":
+		return q.Gt(f.field, vals[0])
+	case ">=":
+		return q.Gte(f.field, vals[0])
+	}
+	panic(fmt.Errorf("impossible filter operator %q", f.op))
+}
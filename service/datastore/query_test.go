@@ -16,6 +16,7 @@ package datastore
 
 import (
 	"math"
+	"strconv"
 	"testing"
 
 	"go.chromium.org/luci/common/sync/parallel"
@@ -337,6 +338,78 @@ var queryTests = []queryTest{
 		"",
 		func(err error) { So(err, ShouldEqual, ErrNullQuery) },
 		nil},
+
+	{"IN filter",
+		nq().In("bob", 3, 1, 2, 1).Order("-bob"),
+		"SELECT * FROM `Foo` WHERE `bob` IN ARRAY(1, 2, 3) ORDER BY `bob` DESC, `__key__`",
+		nil, nil},
+
+	{"IN filter with a single value is an equality filter",
+		nq().In("bob", 1).Order("bob", "wat"),
+		"SELECT * FROM `Foo` WHERE `bob` = 1 ORDER BY `wat`, `__key__`",
+		nil, nq().Eq("bob", 1).Order("wat")},
+
+	{"repeated IN filters intersect",
+		nq().In("bob", 1, 2, 3).In("bob", 3, 4, 2),
+		"SELECT * FROM `Foo` WHERE `bob` IN ARRAY(2, 3) ORDER BY `__key__`",
+		nil, nil},
+
+	{"disjoint IN filters are an empty query",
+		nq().In("bob", 1, 2).In("bob", 3),
+		"",
+		func(err error) { So(err, ShouldEqual, ErrNullQuery) },
+		nil},
+
+	{"IN filter projected field",
+		nq().Project("bob").In("bob", 1, 2),
+		"",
+		errString("cannot project on IN filter field"), nil},
+
+	{"NOT EQUAL filter",
+		nq().Neq("bob", 10).Gte("bob", 2),
+		"SELECT * FROM `Foo` WHERE `bob` != 10 AND `bob` >= 2 ORDER BY `bob`, `__key__`",
+		nil, nil},
+
+	{"NOT EQUAL filter counts as inequality",
+		nq().Neq("bob", 10).Gt("wat", 2),
+		"",
+		errString("inequality filters on multiple properties"), nil},
+
+	{"too many sub-queries",
+		nq().In("a", 1, 2, 3, 4, 5, 6).In("b", 1, 2, 3, 4, 5, 6),
+		"",
+		errString("more than 30 sub-queries"), nil},
+
+	{"OR filter group",
+		nq().Eq("x", 1).Or(EqFilter("a", 1), GtFilter("b", 2)),
+		"SELECT * FROM `Foo` WHERE `x` = 1 AND (`a` = 1 OR `b` > 2) ORDER BY `b`, `__key__`",
+		nil, nil},
+
+	{"nested filter groups",
+		nq().Or(AndFilter(EqFilter("a", 1), EqFilter("b", 2)), InFilter("c", 3, 4)),
+		"SELECT * FROM `Foo` WHERE ((`a` = 1 AND `b` = 2) OR `c` IN ARRAY(3, 4)) ORDER BY `__key__`",
+		nil, nil},
+
+	{"filter groups with a single alternative are plain queries",
+		nq().And(EqFilter("a", 1), LtFilter("b", 2)),
+		"SELECT * FROM `Foo` WHERE `a` = 1 AND `b` < 2 ORDER BY `b`, `__key__`",
+		nil, nq().Eq("a", 1).Lt("b", 2)},
+
+	{"inequalities in filter groups must be on the same property",
+		nq().Or(GtFilter("a", 1), LtFilter("b", 2)),
+		"",
+		errString("inequality filters on multiple properties"), nil},
+
+	{"empty OR filter group",
+		nq().Or(),
+		"",
+		func(err error) { So(err, ShouldEqual, ErrNullQuery) },
+		nil},
+
+	{"bad value in filter group",
+		nq().Or(EqFilter("a", complex(1, 2)), EqFilter("b", 1)),
+		"",
+		errString("bad type complex"), nil},
 }
 
 func TestQueries(t *testing.T) {
@@ -407,3 +480,92 @@ func TestQueryConcurrencySafety(t *testing.T) {
 		So(err, ShouldBeNil)
 	})
 }
+
+func TestQueryFanOut(t *testing.T) {
+	t.Parallel()
+
+	Convey("queries with IN and != filters fan out", t, func() {
+		Convey("one sub-query per combination of IN values", func() {
+			fq, err := nq().In("a", 1, 2).In("b", "x", "y", "z").Finalize()
+			So(err, ShouldBeNil)
+
+			subs := fq.SubQueries()
+			So(subs, ShouldHaveLength, 6)
+			So(subs[0].GQL(), ShouldEqual,
+				"SELECT * FROM `Foo` WHERE `a` = 1 AND `b` = \"x\" ORDER BY `__key__`")
+			So(subs[5].GQL(), ShouldEqual,
+				"SELECT * FROM `Foo` WHERE `a` = 2 AND `b` = \"z\" ORDER BY `__key__`")
+		})
+
+		Convey("!= filters split the inequality range", func() {
+			fq, err := nq().Neq("a", 5).Neq("a", 20).Lt("a", 10).Finalize()
+			So(err, ShouldBeNil)
+
+			subs := fq.SubQueries()
+			So(subs, ShouldHaveLength, 2)
+			So(subs[0].GQL(), ShouldEqual,
+				"SELECT * FROM `Foo` WHERE `a` < 5 ORDER BY `a`, `__key__`")
+			So(subs[1].GQL(), ShouldEqual,
+				"SELECT * FROM `Foo` WHERE `a` > 5 AND `a` < 10 ORDER BY `a`, `__key__`")
+		})
+
+		Convey("sub-queries return the sorted properties", func() {
+			fq, err := nq().In("a", 1, 2).Order("b").KeysOnly(true).Limit(5).Offset(2).Finalize()
+			So(err, ShouldBeNil)
+
+			So(fq.SubQueries()[0].GQL(), ShouldEqual,
+				"SELECT `b` FROM `Foo` WHERE `a` = 1 ORDER BY `b`, `__key__` LIMIT 7")
+		})
+
+		Convey("OR groups fan out into their alternatives", func() {
+			fq, err := nq().Or(EqFilter("a", 1), InFilter("b", 2, 3)).Finalize()
+			So(err, ShouldBeNil)
+
+			subs := fq.SubQueries()
+			So(subs, ShouldHaveLength, 3)
+			So(subs[0].GQL(), ShouldEqual,
+				"SELECT * FROM `Foo` WHERE `a` = 1 ORDER BY `__key__`")
+			So(subs[1].GQL(), ShouldEqual,
+				"SELECT * FROM `Foo` WHERE `b` = 2 ORDER BY `__key__`")
+			So(subs[2].GQL(), ShouldEqual,
+				"SELECT * FROM `Foo` WHERE `b` = 3 ORDER BY `__key__`")
+		})
+
+		Convey("plain queries don't fan out", func() {
+			fq, err := nq().Eq("a", 1).Finalize()
+			So(err, ShouldBeNil)
+			So(fq.SubQueries(), ShouldBeNil)
+		})
+
+		Convey("cursors", func() {
+			q := nq().In("a", 1, 2, 3)
+			curs := multiCursor{fakeCursor(10), nil, fakeCursor(20)}
+
+			Convey("round-trip through their string form", func() {
+				dec, err := decodeMultiCursor(curs.String(), func(s string) (Cursor, error) {
+					v, err := strconv.Atoi(s)
+					return fakeCursor(v), err
+				})
+				So(err, ShouldBeNil)
+				So(dec, ShouldResemble, curs)
+			})
+
+			Convey("are distributed to the sub-queries", func() {
+				fq, err := q.Start(curs).Finalize()
+				So(err, ShouldBeNil)
+				for i, sub := range fq.subQueries {
+					start, _ := sub.Bounds()
+					So(start, ShouldEqual, curs[i])
+				}
+			})
+
+			Convey("must match the sub-queries", func() {
+				_, err := q.Start(fakeCursor(10)).Finalize()
+				So(err, ShouldErrLike, "start cursor is invalid")
+
+				_, err = q.End(curs[:2]).Finalize()
+				So(err, ShouldErrLike, "end cursor is invalid")
+			})
+		})
+	})
+}
@@ -105,6 +105,20 @@ type Constraints struct {
 	// MaxDeleteSize is the maximum number of entities that can be referenced in a
 	// single DeleteMulti call. If <= 0, no constraint is applied.
 	MaxDeleteSize int
+
+	// MaxKeyDepth is the maximum number of elements in the path of a key. If
+	// <= 0, no constraint is applied.
+	MaxKeyDepth int
+	// MaxIndexedPropertySize is the maximum size, in bytes, of an indexed
+	// string or []byte property value. If <= 0, no constraint is applied.
+	MaxIndexedPropertySize int
+	// MaxEntitySize is the maximum size, in bytes, of an entity, as estimated
+	// by PropertyMap.EstimateSize. If <= 0, no constraint is applied.
+	MaxEntitySize int
+	// MaxIndexEntries is the maximum number of index entries, builtin and
+	// composite, that a single entity can have. If <= 0, no constraint is
+	// applied.
+	MaxIndexEntries int
 }
 
 type nullMetaGetterType struct{}
@@ -176,12 +190,38 @@ type RawInterface interface {
 	// NOTE: Implementations and filters are guaranteed that:
 	//   - query is not nil
 	//   - cb is not nil
+	//   - query does not fan out (see FinalizedQuery.SubQueries)
 	Run(q *FinalizedQuery, cb RawRunCB) error
 
 	// Count executes the given query and returns the number of entries which
 	// match it.
+	//
+	// NOTE: Implementations and filters are guaranteed that:
+	//   - query is not nil
+	//   - query does not fan out (see FinalizedQuery.SubQueries)
 	Count(q *FinalizedQuery) (int64, error)
 
+	// Aggregate computes aggs over the results of the given query, and returns
+	// their results in the same order. Implementations which can't compute
+	// aggregations in the backend may use AggregateQuery.
+	//
+	// NOTE: Implementations and filters are guaranteed that:
+	//   - query is not nil
+	//   - query does not fan out (see FinalizedQuery.SubQueries)
+	//   - query is not a projection query
+	//   - aggs is not empty, and contains only valid Aggregations
+	Aggregate(q *FinalizedQuery, aggs []*Aggregation) (PropertySlice, error)
+
+	// SampleKeys returns up to n keys of the entities which match the kind and
+	// the ancestor of the given query, picked across their key range, in no
+	// particular order. The other filters and the orders of the query are
+	// ignored. It's used to split queries (see SplitQuery).
+	//
+	// NOTE: Implementations and filters are guaranteed that:
+	//   - query is not nil, and has a kind
+	//   - n > 0
+	SampleKeys(q *FinalizedQuery, n int32) ([]*Key, error)
+
 	// GetMulti retrieves items from the datastore.
 	//
 	// If there was a server error, it will be returned directly. Otherwise,
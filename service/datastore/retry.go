@@ -0,0 +1,115 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"time"
+
+	"go.chromium.org/luci/common/clock"
+	"go.chromium.org/luci/common/data/rand/mathrand"
+
+	"golang.org/x/net/context"
+)
+
+// RetryPolicy controls the delays between the attempts of a transaction which
+// fails with ErrConcurrentTransaction.
+type RetryPolicy interface {
+	// Next returns the delay before the next attempt, given the number of
+	// failed attempts so far and the time elapsed since the first one started.
+	// It returns false to give up retrying.
+	Next(c context.Context, failed int, elapsed time.Duration) (time.Duration, bool)
+}
+
+// ExponentialBackoff is a RetryPolicy which multiplies the delay before each
+// attempt, with jitter: each delay is picked at random between half of its
+// nominal value and its nominal value, so that contending transactions spread
+// their attempts.
+type ExponentialBackoff struct {
+	// Delay is the nominal delay before the first retry. If omitted, it
+	// defaults to 100ms.
+	Delay time.Duration
+	// Multiplier multiplies the nominal delay after each retry. If omitted, it
+	// defaults to 2.
+	Multiplier float64
+	// MaxDelay caps the nominal delay, if it's set.
+	MaxDelay time.Duration
+	// MaxElapsed is the time after which the transaction isn't retried
+	// anymore, if it's set.
+	MaxElapsed time.Duration
+}
+
+// Next implements RetryPolicy.
+func (e *ExponentialBackoff) Next(c context.Context, failed int, elapsed time.Duration) (time.Duration, bool) {
+	delay, mult := e.Delay, e.Multiplier
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
+	}
+	if mult <= 0 {
+		mult = 2
+	}
+	for i := 1; i < failed && (e.MaxDelay <= 0 || delay < e.MaxDelay); i++ {
+		delay = time.Duration(float64(delay) * mult)
+	}
+	if e.MaxDelay > 0 && delay > e.MaxDelay {
+		delay = e.MaxDelay
+	}
+	if half := int64(delay / 2); half > 0 {
+		delay -= time.Duration(mathrand.Int63n(c, half+1))
+	}
+	if e.MaxElapsed > 0 && elapsed+delay > e.MaxElapsed {
+		return 0, false
+	}
+	return delay, true
+}
+
+// RetryTransaction calls attempt until it doesn't return
+// ErrConcurrentTransaction, or until opts don't allow more attempts, and
+// returns the last error. attempt is given the number of failed attempts so
+// far.
+//
+// Attempts are bounded by opts.Attempts (3 by default), and delayed as
+// directed by opts.RetryPolicy. Waiting for an attempt stops early if c is
+// done, in which case the error of c is returned.
+//
+// This is meant for RawInterface implementations of RunInTransaction.
+func RetryTransaction(c context.Context, opts *TransactionOptions, attempt func(failed int) error) error {
+	attempts, policy := 3, RetryPolicy(nil)
+	if opts != nil {
+		if opts.Attempts > 0 {
+			attempts = opts.Attempts
+		}
+		policy = opts.RetryPolicy
+	}
+
+	start := clock.Now(c)
+	for failed := 0; ; failed++ {
+		err := attempt(failed)
+		if err != ErrConcurrentTransaction || failed+1 >= attempts {
+			return err
+		}
+		if policy == nil {
+			continue
+		}
+		delay, ok := policy.Next(c, failed+1, clock.Now(c).Sub(start))
+		if !ok {
+			return err
+		}
+		if delay > 0 {
+			if tr := clock.Sleep(c, delay); tr.Incomplete() {
+				return tr.Err
+			}
+		}
+	}
+}
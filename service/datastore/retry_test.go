@@ -0,0 +1,113 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go.chromium.org/luci/common/clock"
+	"go.chromium.org/luci/common/clock/testclock"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	t.Parallel()
+
+	Convey("ExponentialBackoff", t, func() {
+		c := context.Background()
+
+		next := func(e *ExponentialBackoff, failed int, elapsed time.Duration) time.Duration {
+			delay, ok := e.Next(c, failed, elapsed)
+			So(ok, ShouldBeTrue)
+			return delay
+		}
+
+		Convey("has defaults", func() {
+			e := &ExponentialBackoff{}
+			for i := 0; i < 10; i++ {
+				So(next(e, 1, 0), ShouldBeBetweenOrEqual, 50*time.Millisecond, 100*time.Millisecond)
+				So(next(e, 3, 0), ShouldBeBetweenOrEqual, 200*time.Millisecond, 400*time.Millisecond)
+			}
+		})
+
+		Convey("respects MaxDelay", func() {
+			e := &ExponentialBackoff{Delay: time.Second, Multiplier: 10, MaxDelay: 5 * time.Second}
+			So(next(e, 2, 0), ShouldBeBetweenOrEqual, 2500*time.Millisecond, 5*time.Second)
+			So(next(e, 100, 0), ShouldBeBetweenOrEqual, 2500*time.Millisecond, 5*time.Second)
+		})
+
+		Convey("gives up after MaxElapsed", func() {
+			e := &ExponentialBackoff{Delay: time.Second, MaxElapsed: 10 * time.Second}
+			next(e, 1, 5*time.Second)
+			_, ok := e.Next(c, 1, 10*time.Second)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestRetryTransaction(t *testing.T) {
+	t.Parallel()
+
+	Convey("RetryTransaction", t, func() {
+		c, tc := testclock.UseTime(context.Background(), testclock.TestRecentTimeUTC)
+		tc.SetTimerCallback(func(d time.Duration, t clock.Timer) { tc.Add(d) })
+
+		failing := func(calls *int) func(int) error {
+			return func(failed int) error {
+				So(failed, ShouldEqual, *calls)
+				*calls++
+				return ErrConcurrentTransaction
+			}
+		}
+
+		Convey("retries immediately 3 times by default", func() {
+			calls := 0
+			So(RetryTransaction(c, nil, failing(&calls)), ShouldEqual, ErrConcurrentTransaction)
+			So(calls, ShouldEqual, 3)
+			So(clock.Now(c), ShouldResemble, testclock.TestRecentTimeUTC)
+		})
+
+		Convey("doesn't retry other errors", func() {
+			calls := 0
+			So(RetryTransaction(c, nil, func(int) error {
+				calls++
+				return fmt.Errorf("omg")
+			}), ShouldErrLike, "omg")
+			So(calls, ShouldEqual, 1)
+		})
+
+		Convey("waits as directed by the RetryPolicy", func() {
+			calls := 0
+			opts := &TransactionOptions{
+				Attempts: 10,
+				RetryPolicy: &ExponentialBackoff{
+					Delay:      time.Second,
+					MaxElapsed: 15 * time.Second,
+				},
+			}
+			So(RetryTransaction(c, opts, failing(&calls)), ShouldEqual, ErrConcurrentTransaction)
+			// Delays of at most 1+2+4+8 seconds fit in 15 seconds, but not an
+			// additional delay of at least 8 seconds after at least 7.5 seconds.
+			So(calls, ShouldEqual, 5)
+			So(clock.Now(c).Sub(testclock.TestRecentTimeUTC), ShouldBeBetweenOrEqual, 7500*time.Millisecond, 15*time.Second)
+		})
+	})
+}
@@ -279,6 +279,8 @@ func writeIndexValue(buf WriteBuffer, context KeyContext, v interface{}) (err er
 		err = WriteGeoPoint(buf, t)
 	case *ds.Key:
 		err = WriteKey(buf, context, t)
+	case ds.PropertyMap:
+		err = WritePropertyMap(buf, context, t)
 
 	default:
 		err = fmt.Errorf("unsupported type: %T", t)
@@ -324,6 +326,8 @@ func ReadProperty(buf ReadBuffer, context KeyContext, kc ds.KeyContext) (p ds.Pr
 			break
 		}
 		val = blobstore.Key(s)
+	case ds.PTPropertyMap:
+		val, err = ReadPropertyMap(buf, context, kc)
 	default:
 		err = fmt.Errorf("read: unknown type! %v", b)
 	}
@@ -514,12 +518,14 @@ func (s SerializedPslice) Less(i, j int) bool { return bytes.Compare(s[i], s[j])
 
 // PropertySlice serializes a single row of a DSProperty map.
 //
-// It does not differentiate between single- and multi- properties.
+// It does not differentiate between single- and multi- properties. Embedded
+// entities (PTPropertyMap values) are skipped, since they're never indexed
+// themselves.
 func PropertySlice(vals ds.PropertySlice) SerializedPslice {
 	dups := stringset.New(0)
 	ret := make(SerializedPslice, 0, len(vals))
 	for _, v := range vals {
-		if v.IndexSetting() == ds.NoIndex {
+		if v.IndexSetting() == ds.NoIndex || v.Type() == ds.PTPropertyMap {
 			continue
 		}
 
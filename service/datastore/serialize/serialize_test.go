@@ -107,6 +107,18 @@ func TestPropertyMapSerialization(t *testing.T) {
 				},
 			},
 		},
+		{
+			"embedded",
+			ds.PropertyMap{
+				"E": ds.PropertySlice{
+					mp(ds.PropertyMap{
+						"A": mp(1),
+						"B": ds.PropertySlice{mpNI("x"), mp(ds.PropertyMap{"C": mp(true)})},
+					}),
+					mpNI(ds.PropertyMap{}),
+				},
+			},
+		},
 		{
 			"empty vals",
 			ds.PropertyMap{
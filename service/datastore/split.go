@@ -0,0 +1,111 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/net/context"
+)
+
+// splitOversampling is the number of sampled keys per shard. Choosing the
+// split points among more keys than strictly needed evens out the shards.
+const splitOversampling = 32
+
+// SplitQuery splits q into at most shards queries, each restricted to a range
+// of keys with Gte and Lt filters on "__key__", which together return the
+// same results as q. The ranges are picked from a sample of the keys of the
+// kind of q (under its ancestor, if it has one), so that the queries return
+// roughly as many results, and may be run in parallel.
+//
+// q must have a kind, and must not have orders or inequality filters other
+// than on "__key__". Fewer queries are returned if there aren't enough
+// entities to split q into shards, and q itself is returned if shards <= 1.
+func SplitQuery(c context.Context, q *Query, shards int) ([]*Query, error) {
+	splits, err := SplitKeys(c, q, shards)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*Query, 0, len(splits)+1)
+	for i := 0; i <= len(splits); i++ {
+		sub := q
+		if i > 0 {
+			sub = sub.Gte("__key__", splits[i-1])
+		}
+		if i < len(splits) {
+			sub = sub.Lt("__key__", splits[i])
+		}
+		ret = append(ret, sub)
+	}
+	return ret, nil
+}
+
+// SplitKeys returns the sorted keys at which SplitQuery splits q: the i-th
+// query of SplitQuery is q with a Gte filter on the (i-1)-th key, if any, and
+// an Lt filter on the i-th key, if any.
+//
+// Unlike the queries, the keys can be stored, e.g. to split q the same way
+// later on.
+func SplitKeys(c context.Context, q *Query, shards int) ([]*Key, error) {
+	fq, err := q.Finalize()
+	if err != nil {
+		return nil, err
+	}
+	if fq.Kind() == "" {
+		return nil, fmt.Errorf("datastore: SplitQuery requires a kind")
+	}
+	if p := fq.IneqFilterProp(); p != "" && p != "__key__" {
+		return nil, fmt.Errorf("datastore: SplitQuery can't split a query with an inequality filter on %q", p)
+	}
+	for _, sf := range fq.SubQueries() {
+		if p := sf.IneqFilterProp(); p != "" && p != "__key__" {
+			return nil, fmt.Errorf("datastore: SplitQuery can't split a query with an inequality filter on %q", p)
+		}
+	}
+	if orders := fq.Orders(); len(orders) != 1 || orders[0].Property != "__key__" {
+		return nil, fmt.Errorf("datastore: SplitQuery can only split queries ordered by key")
+	}
+	if shards <= 1 {
+		return nil, nil
+	}
+
+	sq, err := NewQuery(fq.Kind()).Ancestor(fq.Ancestor()).KeysOnly(true).Finalize()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := Raw(c).SampleKeys(sq, int32(shards*splitOversampling))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(keySlice(keys))
+
+	// Pick shards-1 evenly spaced split points among the sampled keys.
+	var splits []*Key
+	for i := 1; i < shards && len(keys) > 0; i++ {
+		k := keys[i*len(keys)/shards]
+		if len(splits) == 0 || splits[len(splits)-1].Less(k) {
+			splits = append(splits, k)
+		}
+	}
+	return splits, nil
+}
+
+type keySlice []*Key
+
+func (s keySlice) Len() int           { return len(s) }
+func (s keySlice) Less(i, j int) bool { return s[i].Less(s[j]) }
+func (s keySlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
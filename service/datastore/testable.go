@@ -14,11 +14,33 @@
 
 package datastore
 
+import "time"
+
 // TestingSnapshot is an opaque implementation-defined snapshot type.
 type TestingSnapshot interface {
 	ImATestingSnapshot()
 }
 
+// IndexUsage describes how a compound index was used by the queries run
+// against a testing datastore.
+type IndexUsage struct {
+	// Index is the compound index, in the form it has in an index YAML file.
+	Index *IndexDefinition
+
+	// Hits is the number of queries which Index serviced (alone, or merged with
+	// other indexes).
+	Hits int
+
+	// Oversized is the number of queries which Index serviced alone, but which
+	// don't filter on all of its equality columns. A smaller index would have
+	// serviced them just as well.
+	Oversized int
+
+	// Queries are the distinct queries which Index serviced, as GQL, in the
+	// order they were first run.
+	Queries []string
+}
+
 // Testable is the testable interface for fake datastore implementations.
 type Testable interface {
 	// AddIndex adds the provided index.
@@ -47,6 +69,15 @@ type Testable interface {
 	// operation.
 	CatchupIndexes()
 
+	// SetEntityGroupWriteRate simulates the contention of entity groups which
+	// are written to too often. Once set, a write to an entity group which was
+	// already written to `writes` times during the last `period` (as measured
+	// by the clock of the Context) fails with ErrConcurrentTransaction. A write
+	// is a committed transaction, or a non-transactional Put or Delete.
+	//
+	// By default (and if writes is 0) the write rate isn't limited.
+	SetEntityGroupWriteRate(writes int, period time.Duration)
+
 	// SetTransactionRetryCount set how many times RunInTransaction will retry
 	// transaction body pretending transaction conflicts happens. 0 (default)
 	// means commit succeeds on the first attempt (no retries).
@@ -68,6 +99,30 @@ type Testable interface {
 	// By default this is false.
 	AutoIndex(bool)
 
+	// RecordMissingIndexes adds every missing index encountered by a query to
+	// the provided IndexSet, whether or not AutoIndex then creates it. The same
+	// IndexSet may be shared by many datastores (e.g. all the tests of a
+	// package), and written with WriteIndexYAML to produce the index YAML file
+	// needed by the queries they ran. Calling this with nil stops recording.
+	//
+	// By default missing indexes are not recorded.
+	RecordMissingIndexes(*IndexSet)
+
+	// IndexUsage returns the usage of every compound index of this datastore,
+	// sorted by index. Indexes which no query used have 0 Hits, so tests may
+	// check that all the indexes of an index YAML file are needed.
+	IndexUsage() []IndexUsage
+
+	// RefreshStats replaces the statistics entities of each namespace with
+	// statistics of its current entities, like the production datastore
+	// periodically does. These are the __Stat_Total__, __Stat_Kind__ and
+	// __Stat_PropertyType_Kind__ entities, which can be queried like any other
+	// entities.
+	//
+	// Entity sizes are estimated with PropertyMap.EstimateSize, and index sizes
+	// are the sizes of the index rows of this implementation.
+	RefreshStats()
+
 	// DisableSpecialEntities turns off maintenance of special __entity_group__
 	// type entities. By default this mainenance is enabled, but it can be
 	// disabled by calling this with true.
@@ -87,6 +142,10 @@ type Testable interface {
 	// SetConstraints sets this instance's constraints. If the supplied
 	// constraints are invalid, an error will be returned.
 	//
+	// Besides the batch sizes, the constraints limit the keys and entities
+	// which can be put, with the same errors as the production datastore. By
+	// default, they match the production constraints.
+	//
 	// If c is nil, default constraints will be set.
 	SetConstraints(c *Constraints) error
 }
@@ -28,6 +28,35 @@ import (
 //	  this Transaction so far.
 type Transaction interface{}
 
+// DefaultTransactionSizeBudget is the number of bytes which may be written in
+// a transaction.
+//
+// Because our estimation algorithm isn't entirely correct, we take 5% off
+// the limit for encoding and estimate inaccuracies.
+//
+// 10MB taken on 2015/09/24:
+// https://cloud.google.com/appengine/docs/go/datastore/#Go_Quotas_and_limits
+const DefaultTransactionSizeBudget = int64((10 * 1000 * 1000) * 0.95)
+
+// SizeBudgeter is implemented by Transactions which track the number of bytes
+// written in them, such as those of the filter/txnBuf transaction buffer.
+type SizeBudgeter interface {
+	// SizeBudget returns the number of bytes which may still be written in the
+	// transaction before it fails with ErrTransactionTooLarge.
+	SizeBudget() int64
+}
+
+// TransactionSizeBudget returns the number of bytes which may still be
+// written in the current transaction. ok is false if there is no current
+// transaction, or if it doesn't track its size (see SizeBudgeter).
+func TransactionSizeBudget(c context.Context) (remaining int64, ok bool) {
+	sb, ok := CurrentTransaction(c).(SizeBudgeter)
+	if !ok {
+		return 0, false
+	}
+	return sb.SizeBudget(), true
+}
+
 // WithoutTransaction returns a Context that isn't bound to a transaction.
 // This may be called even when outside of a transaction, in which case the
 // input Context is a valid return value.
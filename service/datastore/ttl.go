@@ -0,0 +1,73 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"reflect"
+	"time"
+
+	"go.chromium.org/luci/common/clock"
+
+	"golang.org/x/net/context"
+)
+
+// TTLProperty is the name of the property which holds the expiry of entities
+// loaded into structs with a field tagged with `gae:"$ttl"`.
+const TTLProperty = "_ttl"
+
+// WithHideExpired enables or disables hiding expired entities. It's disabled
+// by default.
+//
+// An entity is expired if it's loaded into a struct whose field tagged with
+// `gae:",ttl"` or `gae:"$ttl"` holds a time which isn't in the future
+// (according to the clock in the Context). Zero times never expire. When
+// hiding is enabled, Get returns ErrNoSuchEntity for expired entities, while
+// GetAll, Run and Iterator skip them. Skipped entities still count towards the
+// limit of the query.
+//
+// Entities are only known to be expired once loaded into a struct, so keys-only
+// reads (e.g. GetAll into a *[]*Key, or a Run callback taking a *Key) and Count
+// still include expired entities.
+//
+// Expired entities are only hidden, not deleted; see the ttl package to sweep
+// them.
+func WithHideExpired(c context.Context, hide bool) context.Context {
+	return context.WithValue(c, hideExpiredKey, hide)
+}
+
+func hideExpired(c context.Context) bool {
+	hide, _ := c.Value(hideExpiredKey).(bool)
+	return hide
+}
+
+// expiry returns the time held by the ttl field of p. ok is false if p has no
+// ttl field.
+func (p *structPLS) expiry() (exp time.Time, ok bool) {
+	i, ok := p.c.bySpecial["ttl"]
+	if !ok {
+		return
+	}
+	return p.o.Field(i).Interface().(time.Time), true
+}
+
+// isExpired returns true if slot holds a struct whose ttl field has passed.
+func (mat *multiArgType) isExpired(c context.Context, slot reflect.Value) bool {
+	spls, ok := mat.getPLS(slot).(*structPLS)
+	if !ok {
+		return false
+	}
+	exp, ok := spls.expiry()
+	return ok && !exp.IsZero() && !clock.Now(c).Before(exp)
+}
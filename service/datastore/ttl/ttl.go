@@ -0,0 +1,153 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ttl deletes expired entities.
+//
+// Entities expire at the time held by their field tagged with `gae:",ttl"` or
+// `gae:"$ttl"` (see package datastore). A Sweeper pages through the expired entities of a
+// kind, oldest first, using the index of that field, and deletes them in
+// batches. Each call to Sweep deletes a bounded number of batches, and returns
+// a cursor to continue from, so a sweep may be spread over several requests,
+// such as a chain of push tasks (see Sweeper.Task).
+package ttl
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	ds "github.com/conchoid/gae/service/datastore"
+	tq "github.com/conchoid/gae/service/taskqueue"
+
+	"go.chromium.org/luci/common/clock"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultBatchSize is the default number of entities deleted at a time.
+	DefaultBatchSize = 500
+
+	// DefaultMaxBatches is the default number of batches deleted by a call to
+	// Sweep.
+	DefaultMaxBatches = 20
+)
+
+// Sweeper deletes the expired entities of a kind.
+type Sweeper struct {
+	// Kind is the kind of the entities to delete.
+	Kind string
+	// Property is the name of the ttl property of the entities. If it's empty,
+	// datastore.TTLProperty (the property of `gae:"$ttl"` fields) is used.
+	Property string
+
+	// BatchSize is the number of entities deleted at a time. If it's 0,
+	// DefaultBatchSize is used.
+	BatchSize int32
+	// MaxBatches is the maximum number of batches deleted by a call to Sweep.
+	// If it's 0, DefaultMaxBatches is used.
+	MaxBatches int
+
+	// Queue is the name of the push queue which runs the sweep's tasks. If it's
+	// empty, the default queue is used.
+	Queue string
+	// Path is the URL of the handler of the sweep's tasks, which must call
+	// HandleTask.
+	Path string
+}
+
+// Sweep deletes entities which expired before now, starting at cursor, which
+// is either empty or a cursor returned by a previous call to Sweep. It returns
+// the number of deleted entities, and if there may be more, the cursor to
+// continue from. next is empty once there are none left.
+func (s *Sweeper) Sweep(c context.Context, cursor string) (next string, deleted int, err error) {
+	batchSize := s.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	maxBatches := s.MaxBatches
+	if maxBatches <= 0 {
+		maxBatches = DefaultMaxBatches
+	}
+	prop := s.Property
+	if prop == "" {
+		prop = ds.TTLProperty
+	}
+	// Zero times never expire.
+	q := ds.NewQuery(s.Kind).Gt(prop, time.Time{}).Lt(prop, clock.Now(c)).
+		Order(prop).KeysOnly(true).Limit(batchSize)
+
+	if cursor != "" {
+		cur, err := ds.DecodeCursor(c, cursor)
+		if err != nil {
+			return "", 0, err
+		}
+		q = q.Start(cur)
+	}
+
+	for i := 0; i < maxBatches; i++ {
+		var keys []*ds.Key
+		var end ds.CursorCB
+		err = ds.Run(c, q, func(k *ds.Key, cb ds.CursorCB) {
+			keys = append(keys, k)
+			end = cb
+		})
+		if err != nil {
+			return "", deleted, err
+		}
+		if len(keys) == 0 {
+			return "", deleted, nil
+		}
+		if err = ds.Delete(c, keys); err != nil {
+			return "", deleted, err
+		}
+		deleted += len(keys)
+
+		if int32(len(keys)) < batchSize {
+			return "", deleted, nil
+		}
+		cur, err := end()
+		if err != nil {
+			return "", deleted, err
+		}
+		q, next = q.Start(cur), cur.String()
+	}
+	return next, deleted, nil
+}
+
+// Task returns the push task which runs the sweep from cursor. Add it with
+// an empty cursor, e.g. from a cron job, to start a sweep.
+func (s *Sweeper) Task(cursor string) *tq.Task {
+	return &tq.Task{
+		Path:    s.Path,
+		Method:  "POST",
+		Payload: []byte(url.Values{"cursor": {cursor}}.Encode()),
+		Header:  http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+	}
+}
+
+// HandleTask runs a call to Sweep for a task returned by Task, whose payload
+// is body. If there may be more expired entities, it adds the task which
+// continues the sweep.
+func (s *Sweeper) HandleTask(c context.Context, body []byte) error {
+	vals, err := url.ParseQuery(string(body))
+	if err != nil {
+		return err
+	}
+	next, _, err := s.Sweep(c, vals.Get("cursor"))
+	if err != nil || next == "" {
+		return err
+	}
+	return tq.Add(c, s.Queue, s.Task(next))
+}
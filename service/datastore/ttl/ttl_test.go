@@ -0,0 +1,144 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ttl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/conchoid/gae/impl/memory"
+	ds "github.com/conchoid/gae/service/datastore"
+	tq "github.com/conchoid/gae/service/taskqueue"
+
+	"go.chromium.org/luci/common/clock/testclock"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type Session struct {
+	ID      int64     `gae:"$id"`
+	Expires time.Time `gae:",ttl"`
+}
+
+type Token struct {
+	ID      int64     `gae:"$id"`
+	Expires time.Time `gae:"$ttl"`
+}
+
+func TestTTL(t *testing.T) {
+	t.Parallel()
+
+	Convey("TTL", t, func() {
+		c, tc := testclock.UseTime(context.Background(), testclock.TestRecentTimeUTC)
+		c = memory.Use(c)
+		ds.GetTestable(c).Consistent(true)
+
+		// Sessions 1 to 5 expire after as many hours, and session 6 never does.
+		var sessions []*Session
+		for i := 1; i <= 6; i++ {
+			s := &Session{ID: int64(i)}
+			if i < 6 {
+				s.Expires = tc.Now().Add(time.Duration(i) * time.Hour)
+			}
+			sessions = append(sessions, s)
+		}
+		So(ds.Put(c, sessions), ShouldBeNil)
+		tc.Add(3*time.Hour + time.Minute)
+
+		ids := func(c context.Context) (ret []int64) {
+			var all []*Session
+			So(ds.GetAll(c, ds.NewQuery("Session"), &all), ShouldBeNil)
+			for _, s := range all {
+				ret = append(ret, s.ID)
+			}
+			return
+		}
+
+		Convey("expired entities can be hidden", func() {
+			So(ds.Get(c, &Session{ID: 1}), ShouldBeNil)
+			So(ids(c), ShouldResemble, []int64{1, 2, 3, 4, 5, 6})
+
+			c = ds.WithHideExpired(c, true)
+			So(ds.Get(c, &Session{ID: 1}), ShouldEqual, ds.ErrNoSuchEntity)
+			So(ds.Get(c, &Session{ID: 6}), ShouldBeNil)
+			So(ids(c), ShouldResemble, []int64{4, 5, 6})
+
+			it := ds.NewIterator(c, ds.NewQuery("Session"))
+			defer it.Close()
+			s := &Session{}
+			So(it.Next(s), ShouldBeNil)
+			So(s.ID, ShouldEqual, 4)
+		})
+
+		Convey("Sweep deletes expired entities in batches", func() {
+			sw := &Sweeper{Kind: "Session", Property: "Expires", BatchSize: 2, MaxBatches: 1}
+
+			next, n, err := sw.Sweep(c, "")
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+			So(next, ShouldNotEqual, "")
+			So(ids(c), ShouldResemble, []int64{3, 4, 5, 6})
+
+			next, n, err = sw.Sweep(c, next)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			So(next, ShouldEqual, "")
+			So(ids(c), ShouldResemble, []int64{4, 5, 6})
+		})
+
+		Convey("Sweep uses TTLProperty for $ttl fields", func() {
+			tokens := []*Token{
+				{ID: 1, Expires: tc.Now().Add(-time.Hour)},
+				{ID: 2, Expires: tc.Now().Add(time.Hour)},
+			}
+			So(ds.Put(c, tokens), ShouldBeNil)
+
+			So(ds.Get(ds.WithHideExpired(c, true), &Token{ID: 1}), ShouldEqual, ds.ErrNoSuchEntity)
+
+			sw := &Sweeper{Kind: "Token"}
+			next, n, err := sw.Sweep(c, "")
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			So(next, ShouldEqual, "")
+			So(ds.Get(c, &Token{ID: 1}), ShouldEqual, ds.ErrNoSuchEntity)
+			So(ds.Get(c, &Token{ID: 2}), ShouldBeNil)
+		})
+
+		Convey("Sweep can run as a chain of tasks", func() {
+			sw := &Sweeper{Kind: "Session", Property: "Expires", BatchSize: 1, MaxBatches: 1, Path: "/sweep"}
+			tqt := tq.GetTestable(c)
+
+			So(tq.Add(c, "", sw.Task("")), ShouldBeNil)
+			runs := 0
+			for {
+				tasks := tqt.GetScheduledTasks()["default"]
+				if len(tasks) == 0 {
+					break
+				}
+				So(tasks, ShouldHaveLength, 1)
+				tqt.ResetTasks()
+				for _, t := range tasks {
+					So(t.Path, ShouldEqual, "/sweep")
+					So(sw.HandleTask(c, t.Payload), ShouldBeNil)
+				}
+				runs++
+			}
+			So(runs, ShouldEqual, 4)
+			So(ids(c), ShouldResemble, []int64{4, 5, 6})
+		})
+	})
+}
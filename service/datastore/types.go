@@ -45,6 +45,13 @@ type TransactionOptions struct {
 	// Attempts controls the number of retries to perform when commits fail
 	// due to a conflicting transaction. If omitted, it defaults to 3.
 	Attempts int
+	// ReadOnly is whether the transaction only reads entities. Put, Delete and
+	// transactional task adds fail with ErrReadOnlyTransaction in a read-only
+	// transaction, which in exchange never contends with other transactions.
+	ReadOnly bool
+	// RetryPolicy controls the delays between the attempts of the transaction.
+	// If omitted, the transaction is retried immediately.
+	RetryPolicy RetryPolicy
 }
 
 // Toggle is a tri-state boolean (Auto/True/False), which allows structs
@@ -0,0 +1,147 @@
+// Copyright 2016 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+
+	"golang.org/x/net/context"
+)
+
+// VersionProperty is the name of the unindexed property which stores the
+// version of entities written from objects with a `$version` meta field.
+const VersionProperty = "_version"
+
+// ErrVersionConflict is returned by Put for an object with a `$version` meta
+// field, when the version of the stored entity isn't the one which was read
+// into the object. This means that the entity was written in the meantime, so
+// the object must be read again before it may be written.
+type ErrVersionConflict struct {
+	Key *Key
+	// Expected is the version of the object passed to Put.
+	Expected int64
+	// Stored is the version of the stored entity, or 0 if there is none.
+	Stored int64
+}
+
+func (e *ErrVersionConflict) Error() string {
+	return fmt.Sprintf("datastore: version conflict for %s: expected version %d, stored version is %d",
+		e.Key, e.Expected, e.Stored)
+}
+
+// EntityVersion returns the version of the stored entity pm, or 0 if it has
+// none.
+func EntityVersion(pm PropertyMap) int64 {
+	if p, ok := pm[VersionProperty].(Property); ok {
+		if v, ok := p.Value().(int64); ok {
+			return v
+		}
+	}
+	return 0
+}
+
+// versionMeta returns the `$version` meta of pm, which was saved from an object
+// passed to Put. ok is false if the object has no version.
+func versionMeta(pm PropertyMap) (version int64, ok bool, err error) {
+	v, ok := pm.GetMeta("version")
+	if !ok {
+		return 0, false, nil
+	}
+	if version, ok = v.(int64); !ok {
+		return 0, false, fmt.Errorf("datastore: $version has type %T, expecting an integer", v)
+	}
+	return version, true, nil
+}
+
+// setVersionMeta strips the version property from pm, which is about to be
+// loaded into slot, and sets it as the `$version` meta of slot instead. It
+// returns pm unchanged if it has no version.
+func (mat *multiArgType) setVersionMeta(slot reflect.Value, pm PropertyMap) PropertyMap {
+	if _, ok := pm[VersionProperty]; !ok || mat.getMGS == nil {
+		return pm
+	}
+	mat.getMGS(slot).SetMeta("version", EntityVersion(pm))
+
+	stripped := make(PropertyMap, len(pm)-1)
+	for k, v := range pm {
+		if k != VersionProperty {
+			stripped[k] = v
+		}
+	}
+	return stripped
+}
+
+// putVersioned writes pm, which was saved from an object with the version
+// expected, if the stored entity has the same version. The version of the
+// written entity is expected+1.
+//
+// The check is done in a transaction; the current one if there is one, or a
+// new one otherwise. An incomplete key can't conflict, so it's written
+// directly.
+func putVersioned(c context.Context, key *Key, pm PropertyMap, expected int64) (newKey *Key, err error) {
+	toPut := make(PropertyMap, len(pm))
+	for k, v := range pm {
+		if k != "$version" {
+			toPut[k] = v
+		}
+	}
+	toPut[VersionProperty] = MkPropertyNI(expected + 1)
+
+	put := func(c context.Context) error {
+		var putErr error
+		err := Raw(c).PutMulti([]*Key{key}, []PropertyMap{toPut}, func(_ int, k *Key, err error) error {
+			newKey, putErr = k, err
+			return nil
+		})
+		if err == nil {
+			err = putErr
+		}
+		return err
+	}
+	if key.IsIncomplete() {
+		err = put(c)
+		return
+	}
+
+	checkAndPut := func(c context.Context) error {
+		stored := int64(0)
+		var getErr error
+		err := Raw(c).GetMulti([]*Key{key}, nil, func(_ int, pm PropertyMap, err error) error {
+			if err == nil {
+				stored = EntityVersion(pm)
+			} else if err != ErrNoSuchEntity {
+				getErr = err
+			}
+			return nil
+		})
+		if err == nil {
+			err = getErr
+		}
+		if err != nil {
+			return err
+		}
+		if stored != expected {
+			return &ErrVersionConflict{Key: key, Expected: expected, Stored: stored}
+		}
+		return put(c)
+	}
+	if CurrentTransaction(c) != nil {
+		err = checkAndPut(c)
+	} else {
+		err = RunInTransaction(c, checkAndPut, nil)
+	}
+	return
+}